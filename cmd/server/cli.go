@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/knadh/koanf"
+	"github.com/knadh/koanf/parsers/toml"
+	"github.com/knadh/koanf/providers/file"
+	"github.com/mr-karan/arbok/internal/api"
+	"github.com/mr-karan/arbok/internal/auth"
+	flag "github.com/spf13/pflag"
+)
+
+const tunnelUsage = `usage: arbok tunnel <command> [flags]
+
+Manage the tunnels of a running server.
+
+commands:
+  list          list all tunnels
+  delete <id>   delete a tunnel
+
+The server URL and API key come from --server/--api-key, then the
+ARBOK_URL/ARBOK_API_KEY environment variables, then the config file
+(listen address, first admin or API key).
+
+flags:
+`
+
+// runTunnelCommand implements `arbok tunnel ...`, a thin client for the
+// management API of a running server. It returns the exit code.
+func runTunnelCommand(args []string, stdout, stderr io.Writer) int {
+	f := flag.NewFlagSet("tunnel", flag.ContinueOnError)
+	f.SetOutput(stderr)
+	cfgPath := f.String("config", "config.toml", "Path to the server config file.")
+	server := f.String("server", "", "Server URL, e.g. https://arbok.example.com")
+	apiKey := f.String("api-key", "", "API key sent as "+auth.HeaderAPIKey)
+	f.Usage = func() {
+		fmt.Fprint(stderr, tunnelUsage+f.FlagUsages())
+	}
+
+	if err := f.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		// pflag stays quiet on parse errors under ContinueOnError.
+		fmt.Fprintf(stderr, "error: %v\n\n", err)
+		f.Usage()
+		return 2
+	}
+
+	cmd, err := parseTunnelArgs(f.Args())
+	if err != nil {
+		fmt.Fprintf(stderr, "error: %v\n\n", err)
+		f.Usage()
+		return 2
+	}
+
+	client, err := newAPIClient(*cfgPath, *server, *apiKey)
+	if err != nil {
+		fmt.Fprintf(stderr, "error: %v\n", err)
+		return 1
+	}
+
+	switch cmd.name {
+	case "list":
+		tunnels, err := client.listTunnels()
+		if err != nil {
+			fmt.Fprintf(stderr, "error: %v\n", err)
+			return 1
+		}
+		writeTunnelTable(stdout, tunnels)
+	case "delete":
+		if err := client.deleteTunnel(cmd.id); err != nil {
+			fmt.Fprintf(stderr, "error: %v\n", err)
+			return 1
+		}
+		fmt.Fprintf(stdout, "deleted tunnel %s\n", cmd.id)
+	}
+	return 0
+}
+
+// tunnelCmd is a parsed `arbok tunnel` invocation
+type tunnelCmd struct {
+	name string
+	id   string
+}
+
+// parseTunnelArgs validates the positional arguments of `arbok tunnel`
+func parseTunnelArgs(args []string) (tunnelCmd, error) {
+	if len(args) == 0 {
+		return tunnelCmd{}, errors.New("missing command")
+	}
+	switch args[0] {
+	case "list", "ls":
+		if len(args) != 1 {
+			return tunnelCmd{}, errors.New("list takes no arguments")
+		}
+		return tunnelCmd{name: "list"}, nil
+	case "delete", "rm":
+		if len(args) != 2 || args[1] == "" {
+			return tunnelCmd{}, errors.New("delete takes exactly one tunnel ID")
+		}
+		return tunnelCmd{name: "delete", id: args[1]}, nil
+	default:
+		return tunnelCmd{}, fmt.Errorf("unknown command %q", args[0])
+	}
+}
+
+// writeTunnelTable prints tunnels as an aligned table
+func writeTunnelTable(w io.Writer, tunnels []api.TunnelResponse) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tSUBDOMAIN\tPORT\tURL\tEXPIRES")
+	for _, t := range tunnels {
+		expires := t.ExpiresAt.UTC().Format(time.RFC3339)
+		if t.Revoked {
+			expires += " (revoked)"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\n", t.ID, t.Subdomain, t.Port, t.URL, expires)
+	}
+	tw.Flush()
+}
+
+// apiClient calls the management API of a running server
+type apiClient struct {
+	baseURL string
+	apiKey  string
+	http    *http.Client
+}
+
+// newAPIClient resolves the server URL and API key from flags, then the
+// environment, then the server config at cfgPath
+func newAPIClient(cfgPath, server, apiKey string) (*apiClient, error) {
+	ko := koanf.New(".")
+	if err := ko.Load(file.Provider(cfgPath), toml.Parser()); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("error loading config: %w", err)
+	}
+
+	if server == "" {
+		server = os.Getenv("ARBOK_URL")
+	}
+	if server == "" {
+		server = serverURLFromConfig(ko)
+	}
+	if apiKey == "" {
+		apiKey = os.Getenv("ARBOK_API_KEY")
+	}
+	if apiKey == "" {
+		// Listing everything needs an admin key when keys are set
+		if keys := append(ko.Strings("auth.admin_keys"), ko.Strings("auth.api_keys")...); len(keys) > 0 {
+			apiKey, _ = auth.ParseKey(keys[0])
+		}
+	}
+
+	u, err := url.Parse(server)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("invalid server URL %q", server)
+	}
+	return &apiClient{
+		baseURL: strings.TrimSuffix(server, "/"),
+		apiKey:  apiKey,
+		http:    &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+// serverURLFromConfig derives the management URL from the listen
+// addresses, preferring the admin listener when one is configured
+func serverURLFromConfig(ko *koanf.Koanf) string {
+	addr := ko.String("http.listen_addr")
+	scheme := "http"
+	if ko.String("http.tls_cert_file") != "" {
+		scheme = "https"
+	}
+	if admin := ko.String("http.admin_listen_addr"); admin != "" {
+		addr, scheme = admin, "http"
+	}
+	if addr == "" {
+		addr = ":8080"
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return scheme + "://" + addr
+	}
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "localhost"
+	}
+	return scheme + "://" + net.JoinHostPort(host, port)
+}
+
+// listTunnels fetches all tunnels
+func (c *apiClient) listTunnels() ([]api.TunnelResponse, error) {
+	var body struct {
+		Tunnels []api.TunnelResponse `json:"tunnels"`
+	}
+	if err := c.do(http.MethodGet, "/api/tunnels", http.StatusOK, &body); err != nil {
+		return nil, err
+	}
+	return body.Tunnels, nil
+}
+
+// deleteTunnel deletes a tunnel by ID
+func (c *apiClient) deleteTunnel(id string) error {
+	return c.do(http.MethodDelete, "/api/tunnel/"+url.PathEscape(id), http.StatusNoContent, nil)
+}
+
+// do sends a request and decodes the response into out, turning any
+// status other than want into an error carrying the API's message
+func (c *apiClient) do(method, path string, want int, out any) error {
+	req, err := http.NewRequest(method, c.baseURL+path, nil)
+	if err != nil {
+		return err
+	}
+	if c.apiKey != "" {
+		req.Header.Set(auth.HeaderAPIKey, c.apiKey)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != want {
+		var apiErr api.ErrorResponse
+		if json.NewDecoder(resp.Body).Decode(&apiErr) == nil && apiErr.Error != "" {
+			if apiErr.Code != "" {
+				return fmt.Errorf("%s (%s, HTTP %d)", apiErr.Error, apiErr.Code, resp.StatusCode)
+			}
+			return fmt.Errorf("%s (HTTP %d)", apiErr.Error, resp.StatusCode)
+		}
+		return fmt.Errorf("unexpected response: %s", resp.Status)
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("invalid response: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/knadh/koanf"
+	"github.com/knadh/koanf/parsers/toml"
+	"github.com/knadh/koanf/providers/rawbytes"
+	"github.com/mr-karan/arbok/internal/api"
+	"github.com/mr-karan/arbok/internal/auth"
+)
+
+func TestParseTunnelArgs(t *testing.T) {
+	tests := []struct {
+		args    []string
+		want    tunnelCmd
+		wantErr bool
+	}{
+		{args: []string{"list"}, want: tunnelCmd{name: "list"}},
+		{args: []string{"ls"}, want: tunnelCmd{name: "list"}},
+		{args: []string{"delete", "abc"}, want: tunnelCmd{name: "delete", id: "abc"}},
+		{args: []string{"rm", "abc"}, want: tunnelCmd{name: "delete", id: "abc"}},
+		{args: nil, wantErr: true},
+		{args: []string{"list", "extra"}, wantErr: true},
+		{args: []string{"delete"}, wantErr: true},
+		{args: []string{"delete", ""}, wantErr: true},
+		{args: []string{"delete", "a", "b"}, wantErr: true},
+		{args: []string{"create"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseTunnelArgs(tt.args)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseTunnelArgs(%q) error = %v, want error %v", tt.args, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseTunnelArgs(%q) = %+v, want %+v", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestWriteTunnelTable(t *testing.T) {
+	expires := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	var out bytes.Buffer
+	writeTunnelTable(&out, []api.TunnelResponse{
+		{ID: "t1", Subdomain: "app", Port: 3000, URL: "https://app.example.com", ExpiresAt: expires},
+		{ID: "t22", Subdomain: "longer-name", Port: 8080, URL: "https://longer-name.example.com", ExpiresAt: expires, Revoked: true},
+	})
+
+	want := `ID   SUBDOMAIN    PORT  URL                              EXPIRES
+t1   app          3000  https://app.example.com          2026-01-02T03:04:05Z
+t22  longer-name  8080  https://longer-name.example.com  2026-01-02T03:04:05Z (revoked)
+`
+	if out.String() != want {
+		t.Errorf("table =\n%s\nwant\n%s", out.String(), want)
+	}
+}
+
+// stubAPI serves the management API endpoints the CLI calls, recording
+// the API key and path of each request
+type stubAPI struct {
+	*httptest.Server
+	keys  []string
+	paths []string
+}
+
+func newStubAPI(t *testing.T) *stubAPI {
+	t.Helper()
+	s := &stubAPI{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.keys = append(s.keys, r.Header.Get(auth.HeaderAPIKey))
+		s.paths = append(s.paths, r.Method+" "+r.URL.EscapedPath())
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/api/tunnels":
+			json.NewEncoder(w).Encode(map[string]any{"tunnels": []api.TunnelResponse{
+				{ID: "t1", Subdomain: "app", Port: 3000, URL: "https://app.example.com"},
+			}})
+		case r.Method == http.MethodDelete && r.URL.Path == "/api/tunnel/t1":
+			w.WriteHeader(http.StatusNoContent)
+		case r.Method == http.MethodDelete:
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(api.ErrorResponse{Error: "Tunnel not found", Code: "TUNNEL_NOT_FOUND"})
+		default:
+			w.WriteHeader(http.StatusTeapot)
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestTunnelCommand(t *testing.T) {
+	t.Setenv("ARBOK_URL", "")
+	t.Setenv("ARBOK_API_KEY", "")
+	missingConfig := filepath.Join(t.TempDir(), "config.toml")
+
+	run := func(args ...string) (int, string, string) {
+		var stdout, stderr bytes.Buffer
+		code := runTunnelCommand(append([]string{"--config", missingConfig}, args...), &stdout, &stderr)
+		return code, stdout.String(), stderr.String()
+	}
+
+	t.Run("list", func(t *testing.T) {
+		s := newStubAPI(t)
+		code, out, errOut := run("--server", s.URL+"/", "--api-key", "admin-key", "list")
+		if code != 0 {
+			t.Fatalf("exit code %d, stderr %q", code, errOut)
+		}
+		if !strings.HasPrefix(out, "ID ") || !strings.Contains(out, "https://app.example.com") {
+			t.Errorf("output %q, want a table with the tunnel", out)
+		}
+		if len(s.keys) != 1 || s.keys[0] != "admin-key" || s.paths[0] != "GET /api/tunnels" {
+			t.Errorf("requests %q with keys %q, want GET /api/tunnels with the API key", s.paths, s.keys)
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		s := newStubAPI(t)
+		code, out, errOut := run("--server", s.URL, "delete", "t1")
+		if code != 0 {
+			t.Fatalf("exit code %d, stderr %q", code, errOut)
+		}
+		if out != "deleted tunnel t1\n" {
+			t.Errorf("output %q", out)
+		}
+		if len(s.keys) != 1 || s.keys[0] != "" {
+			t.Errorf("sent API key %q without one configured", s.keys)
+		}
+	})
+
+	t.Run("API error", func(t *testing.T) {
+		s := newStubAPI(t)
+		code, _, errOut := run("--server", s.URL, "delete", "missing")
+		if code != 1 {
+			t.Errorf("exit code %d, want 1", code)
+		}
+		if !strings.Contains(errOut, "Tunnel not found") || !strings.Contains(errOut, "TUNNEL_NOT_FOUND") {
+			t.Errorf("stderr %q, want the API's message and code", errOut)
+		}
+	})
+
+	t.Run("environment", func(t *testing.T) {
+		s := newStubAPI(t)
+		t.Setenv("ARBOK_URL", s.URL)
+		t.Setenv("ARBOK_API_KEY", "env-key")
+		if code, _, errOut := run("list"); code != 0 {
+			t.Fatalf("exit code %d, stderr %q", code, errOut)
+		}
+		if len(s.keys) != 1 || s.keys[0] != "env-key" {
+			t.Errorf("sent keys %q, want the environment's", s.keys)
+		}
+	})
+
+	t.Run("usage errors", func(t *testing.T) {
+		for _, args := range [][]string{{}, {"bogus"}, {"delete"}, {"--no-such-flag", "list"}} {
+			code, out, errOut := run(args...)
+			if code != 2 || out != "" || !strings.Contains(errOut, "usage: arbok tunnel") {
+				t.Errorf("%q: exit code %d, stdout %q, stderr %q; want 2 with usage", args, code, out, errOut)
+			}
+		}
+	})
+
+	t.Run("invalid server URL", func(t *testing.T) {
+		if code, _, errOut := run("--server", "localhost:8080", "list"); code != 1 || !strings.Contains(errOut, "invalid server URL") {
+			t.Errorf("exit code %d, stderr %q; want 1 with invalid server URL", code, errOut)
+		}
+	})
+}
+
+func TestServerURLFromConfig(t *testing.T) {
+	tests := []struct {
+		config string
+		want   string
+	}{
+		{"", "http://localhost:8080"},
+		{"[http]\nlisten_addr = \":9000\"", "http://localhost:9000"},
+		{"[http]\nlisten_addr = \"10.0.0.1:443\"\ntls_cert_file = \"cert.pem\"", "https://10.0.0.1:443"},
+		{"[http]\nlisten_addr = \":443\"\ntls_cert_file = \"cert.pem\"\nadmin_listen_addr = \"127.0.0.1:9090\"", "http://127.0.0.1:9090"},
+	}
+	for _, tt := range tests {
+		ko := koanf.New(".")
+		if err := ko.Load(rawbytes.Provider([]byte(tt.config)), toml.Parser()); err != nil {
+			t.Fatal(err)
+		}
+		if got := serverURLFromConfig(ko); got != tt.want {
+			t.Errorf("serverURLFromConfig(%q) = %q, want %q", tt.config, got, tt.want)
+		}
+	}
+}
@@ -8,6 +8,7 @@ import (
 
 	"github.com/knadh/koanf"
 	"github.com/knadh/koanf/parsers/toml"
+	"github.com/knadh/koanf/providers/confmap"
 	"github.com/knadh/koanf/providers/env"
 	"github.com/knadh/koanf/providers/file"
 	flag "github.com/spf13/pflag"
@@ -36,8 +37,13 @@ func initLogger(ko *koanf.Koanf) *slog.Logger {
 		AddSource: true, // Enable caller information
 	}
 
-	// Create text handler for console output
-	handler := slog.NewTextHandler(os.Stdout, opts)
+	// Create text handler for console output. With the event log on,
+	// stdout carries only events, so logs move to stderr.
+	out := os.Stdout
+	if ko.Bool("app.event_log") {
+		out = os.Stderr
+	}
+	handler := slog.NewTextHandler(out, opts)
 	logger := slog.New(handler)
 
 	// Set as default logger
@@ -61,6 +67,7 @@ func initConfig(cfgDefault string, envPrefix string) *koanf.Koanf {
 
 	// Register `--config` flag.
 	cfgPath := f.String("config", cfgDefault, "Path to a config file to load.")
+	checkConfig := f.Bool("check-config", false, "Check that the domain and WireGuard endpoint are reachable, then exit.")
 
 	// Parse and Load Flags.
 	err := f.Parse(os.Args[1:])
@@ -84,18 +91,46 @@ func initConfig(cfgDefault string, envPrefix string) *koanf.Koanf {
 	}
 
 	fmt.Printf("attempting to read config from env vars\n")
-	// Load environment variables if the key is given
-	// and merge into the loaded config.
-	if envPrefix != "" {
-		err = ko.Load(env.Provider(envPrefix, ".", func(s string) string {
-			return strings.Replace(strings.ToLower(
-				strings.TrimPrefix(s, envPrefix)), "__", ".", -1)
-		}), nil)
-		if err != nil {
-			fmt.Printf("error loading env config: %v\n", err)
-			os.Exit(1)
-		}
+	if err := loadEnv(ko, envPrefix); err != nil {
+		fmt.Printf("error loading env config: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Remember the path so the config can be reloaded
+	flags := map[string]interface{}{"config_path": *cfgPath}
+	if *checkConfig {
+		flags["check_config"] = true
+	}
+	if err := ko.Load(confmap.Provider(flags, "."), nil); err != nil {
+		fmt.Printf("error loading flags: %v\n", err)
+		os.Exit(1)
 	}
 
 	return ko
 }
+
+// loadEnv merges environment variables starting with envPrefix into ko,
+// if a prefix is given
+func loadEnv(ko *koanf.Koanf, envPrefix string) error {
+	if envPrefix == "" {
+		return nil
+	}
+	return ko.Load(env.Provider(envPrefix, ".", func(s string) string {
+		return strings.Replace(strings.ToLower(
+			strings.TrimPrefix(s, envPrefix)), "__", ".", -1)
+	}), nil)
+}
+
+// reloadConfig loads the config file at path and the environment afresh.
+// Unlike initConfig it reports errors instead of exiting, so a bad edit
+// leaves the running config in place.
+func reloadConfig(path, envPrefix string) (*koanf.Koanf, error) {
+	ko := koanf.New(".")
+	if err := ko.Load(file.Provider(path), toml.Parser()); err != nil {
+		return nil, fmt.Errorf("error loading config: %w", err)
+	}
+	if err := loadEnv(ko, envPrefix); err != nil {
+		return nil, fmt.Errorf("error loading env config: %w", err)
+	}
+	return ko, nil
+}
@@ -4,15 +4,19 @@ import (
 	"context"
 	"fmt"
 	"log/slog"
+	"net"
 	"os"
 	"os/signal"
-	"sync"
+	"slices"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/knadh/koanf"
 	"github.com/mr-karan/arbok/internal/api"
+	"github.com/mr-karan/arbok/internal/apikey"
 	"github.com/mr-karan/arbok/internal/auth"
+	"github.com/mr-karan/arbok/internal/metrics"
 	"github.com/mr-karan/arbok/internal/registry"
 	"github.com/mr-karan/arbok/internal/tunnel"
 )
@@ -23,6 +27,11 @@ var (
 )
 
 func main() {
+	// `arbok tunnel ...` manages a running server instead of starting one
+	if len(os.Args) > 1 && os.Args[1] == "tunnel" {
+		os.Exit(runTunnelCommand(os.Args[2:], os.Stdout, os.Stderr))
+	}
+
 	// Create main context that cancels on SIGINT/SIGTERM
 	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer cancel()
@@ -40,6 +49,17 @@ func main() {
 		os.Exit(1)
 	}
 
+	// --check-config runs the self-check and exits
+	if ko.Bool("check_config") {
+		if warnings := newSelfChecker(logger).run(ctx, cfg.App.Domain, cfg.Server.Endpoint, cfg.Server.ListenPort); warnings > 0 {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	// Every component records to the same metrics, served at /metrics
+	m := metrics.New(cfg.Metrics.Prefix)
+
 	// Initialize WireGuard tunnel
 	tun, err := tunnel.New(tunnel.PeerOpts{
 		Logger:     logger,
@@ -47,87 +67,223 @@ func main() {
 		CIDR:       cfg.Server.CIDR,
 		ListenPort: cfg.Server.ListenPort,
 		PrivateKey: cfg.Server.PrivateKey,
+		Stack: tunnel.StackOptions{
+			MaxConns:             cfg.Server.MaxConns,
+			TCPSendBufferSize:    cfg.Server.TCPSendBufferSize,
+			TCPReceiveBufferSize: cfg.Server.TCPReceiveBufferSize,
+		},
+		Metrics: m,
 	})
 	if err != nil {
 		logger.Error("failed to initialize tunnel", slog.Any("error", err))
 		os.Exit(1)
 	}
 
+	// Persist tunnels across restarts when a state file is configured
+	var store registry.Store
+	if cfg.Store.Path != "" {
+		store = registry.NewFileStore(cfg.Store.Path, cfg.Store.PersistPrivateKeys)
+	}
+
 	// Initialize registry
 	reg, err := registry.NewRegistry(ctx, registry.Config{
-		CIDR:            cfg.Server.CIDR,
-		DefaultTTL:      cfg.Tunnel.DefaultTTL,
-		CleanupInterval: cfg.Tunnel.CleanupInterval,
+		CIDR:               cfg.Server.CIDR,
+		DefaultTTL:         cfg.Tunnel.DefaultTTL,
+		CleanupInterval:    cfg.Tunnel.CleanupInterval,
+		MinCleanupInterval: cfg.Tunnel.MinCleanupInterval,
+		PoolStartOffset:    cfg.Tunnel.PoolStartOffset,
+		PoolRangeStart:     cfg.Tunnel.PoolRangeStart,
+		PoolRangeEnd:       cfg.Tunnel.PoolRangeEnd,
+		RevokedRetention:   cfg.Tunnel.RevokedRetention,
+		MaxTTL:             cfg.Tunnel.MaxTTL,
+		KeyMaxTTLs:         keyMaxTTLs(cfg.Auth.Keys),
+		NameScheme:         cfg.Tunnel.NameScheme,
+		DNSResolvers:       cfg.Tunnel.DNSResolvers,
+		Reservations:       keyReservations(cfg.Auth.Keys),
+		Domains:            cfg.HTTP.Domains,
+		Store:              store,
+		SaveDebounce:       cfg.Store.Debounce,
+		Metrics:            m,
 	}, logger)
 	if err != nil {
 		logger.Error("failed to initialize registry", slog.Any("error", err))
 		os.Exit(1)
 	}
 
+	// Mirror lifecycle events to stdout as NDJSON for log pipelines. The
+	// writer ends once the registry closes, after the last event.
+	eventLogDone := make(chan struct{})
+	if cfg.App.EventLog {
+		sub := reg.Events().SubscribeBuffered(registry.EventLogBuffer)
+		go func() {
+			defer close(eventLogDone)
+			if err := registry.WriteEvents(sub, os.Stdout, logger); err != nil {
+				logger.Error("event log stopped", slog.Any("error", err))
+			}
+		}()
+	} else {
+		close(eventLogDone)
+	}
+
+	// Re-add WireGuard peers for tunnels restored from the store
+	for _, t := range reg.ListTunnels() {
+		if t.Revoked {
+			continue
+		}
+		if err := tun.AddPeer(t.PublicKey, t.AllowedIP, t.PeerAllowedIPs()...); err != nil {
+			logger.Error("failed to restore peer", "error", err, "tunnel_id", t.ID)
+		}
+	}
+
 	// Initialize authenticator
-	authenticator := auth.New(cfg.Auth.APIKeys, logger)
+	authenticator := auth.New(cfg.Auth.APIKeys, cfg.Auth.AdminKeys, m, logger)
+	authenticator.AllowQueryKey(cfg.Auth.AllowQueryKey)
 
 	// Initialize API server
-	// Use endpoint from config, or fallback to domain:port
-	endpoint := cfg.Server.Endpoint
-	if endpoint == "" {
-		endpoint = fmt.Sprintf("%s:%d", cfg.App.Domain, cfg.Server.ListenPort)
-	}
-	
 	apiServer := api.NewAPIServer(api.Config{
-		ListenAddr:       cfg.HTTP.ListenAddr,
-		Domain:           cfg.App.Domain,
-		WireGuardPort:    cfg.Server.ListenPort,
-		WireGuardEndpoint: endpoint,
-		AllowedOrigins:   cfg.HTTP.AllowedOrigins,
+		ListenAddr:               cfg.HTTP.ListenAddr,
+		AdminListenAddr:          cfg.HTTP.AdminListenAddr,
+		MetricsListenAddr:        cfg.Metrics.ListenAddr,
+		Metrics:                  m,
+		ServeUI:                  cfg.HTTP.ServeUI,
+		TrustedProxies:           cfg.HTTP.TrustedProxies,
+		ProxyProtocol:            cfg.HTTP.ProxyProtocol,
+		ProxyProtocolStrict:      cfg.HTTP.ProxyProtocolStrict,
+		SlowRequestThreshold:     cfg.HTTP.SlowRequestThreshold,
+		MaxHeaderCount:           cfg.HTTP.MaxHeaderCount,
+		MaxHeaderBytes:           cfg.HTTP.MaxHeaderBytes,
+		RootBehavior:             cfg.HTTP.RootBehavior,
+		TLSCertFile:              cfg.HTTP.TLSCertFile,
+		TLSKeyFile:               cfg.HTTP.TLSKeyFile,
+		HTTP2:                    cfg.HTTP.HTTP2,
+		Domain:                   cfg.App.Domain,
+		Domains:                  cfg.HTTP.Domains,
+		WireGuardPort:            cfg.Server.ListenPort,
+		WireGuardEndpoint:        cfg.Server.Endpoint,
+		AllowedOrigins:           cfg.HTTP.AllowedOrigins,
+		InterceptorRejectStatus:  cfg.Proxy.InterceptorRejectStatus,
+		ExpiryWarningThreshold:   cfg.Proxy.ExpiryWarningThreshold,
+		StripResponseHeaders:     cfg.Proxy.StripResponseHeaders,
+		CreateRPS:                cfg.Auth.CreateRPS,
+		MaxConcurrentProvisions:  cfg.Tunnel.MaxConcurrentProvisions,
+		CreateBurst:              cfg.Auth.CreateBurst,
+		ShareSecret:              cfg.Auth.ShareSecret,
+		TunnelMaxRPS:             cfg.Proxy.TunnelMaxRPS,
+		GlobalRateLimitBPS:       cfg.Proxy.GlobalRateLimitBPS,
+		KeepWarm:                 cfg.Proxy.KeepWarm,
+		KeepWarmConns:            cfg.Proxy.KeepWarmConns,
+		KeepWarmWindow:           cfg.Proxy.KeepWarmWindow,
+		FairScheduling:           cfg.Proxy.FairScheduling,
+		MaxInFlight:              cfg.Proxy.MaxInFlight,
+		FairQueueTimeout:         cfg.Proxy.FairQueueTimeout,
+		MaxIdleConnsPerTunnel:    cfg.Proxy.MaxIdleConnsPerTunnel,
+		IdleConnTimeout:          cfg.Proxy.IdleConnTimeout,
+		RelayBufferBytes:         cfg.Proxy.RelayBufferBytes,
+		WebSocketRelay:           cfg.Proxy.WebSocketRelay,
+		WebSocketMaxFrameBytes:   cfg.Proxy.WebSocketMaxFrameBytes,
+		WebSocketMaxMessageBytes: cfg.Proxy.WebSocketMaxMessageBytes,
+		DialTimeout:              cfg.Proxy.DialTimeout,
+		ResponseHeaderTimeout:    cfg.Proxy.ResponseHeaderTimeout,
+		MaxRequestTimeout:        cfg.Proxy.MaxRequestTimeout,
+		ExpectContinueTimeout:    cfg.Proxy.ExpectContinueTimeout,
+		StripExpect:              cfg.Proxy.StripExpect,
+		MaxBufferedBodyBytes:     cfg.Proxy.MaxBufferedBodyBytes,
+		InjectHTML:               cfg.Proxy.InjectHTML,
+		BlockedContentTypes:      cfg.Proxy.BlockedContentTypes,
+		InspectRequests:          cfg.Inspect.MaxRequests,
+		InspectBodyBytes:         cfg.Inspect.MaxBodyBytes,
 	}, logger, tun, reg, authenticator)
+	apiServer.AddInterceptor(api.RequestIDInterceptor{})
 
-	// Start services
-	var wg sync.WaitGroup
-
-	// Start WireGuard tunnel
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		if err := tun.Up(ctx); err != nil {
-			logger.Error("tunnel error", slog.Any("error", err))
-		}
-	}()
-
-	// Start HTTP API server
-	wg.Add(1)
+	// Bind the HTTP listeners before serving any of them, so a bad
+	// address stops startup. The WireGuard tunnel is already up.
+	if err := apiServer.Listen(); err != nil {
+		logger.Error("api server error", "error", err)
+		os.Exit(1)
+	}
+	if cfg.App.SelfCheck {
+		// Every listener is bound by now, so the probes can reach them. In
+		// the background, as startup shouldn't wait on DNS.
+		go newSelfChecker(logger).run(ctx, cfg.App.Domain, cfg.Server.Endpoint, cfg.Server.ListenPort)
+	}
+	apiDone := make(chan struct{})
 	go func() {
-		defer wg.Done()
+		defer close(apiDone)
 		if err := apiServer.Start(ctx); err != nil {
 			logger.Error("api server error", "error", err)
 		}
 	}()
 
+	// SIGHUP reloads the settings that can change at runtime
+	go watchReload(ctx, ko.String("config_path"), reg, logger)
+
 	// Wait for shutdown signal
 	<-ctx.Done()
 	logger.Info("shutting down")
 
+	// Warn event subscribers first. Their streams end with this event, so
+	// they don't hold up the HTTP servers draining.
+	reg.Events().Publish(registry.Event{
+		Type:    registry.EventServerShuttingDown,
+		Message: "The server is shutting down, tunnels may drop",
+	})
+
 	// Graceful shutdown
 	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer shutdownCancel()
 
+	// Let the HTTP servers drain first: in-flight requests still dial
+	// through the tunnel and look up the registry
+	select {
+	case <-apiDone:
+	case <-shutdownCtx.Done():
+		logger.Warn("shutdown timeout exceeded")
+	}
+
 	// Close registry (cleans up tunnels)
 	if err := reg.Close(); err != nil {
 		logger.Error("registry shutdown error", "error", err)
 	}
+	<-eventLogDone
 
-	// Wait for goroutines to finish
-	done := make(chan struct{})
-	go func() {
-		wg.Wait()
-		close(done)
-	}()
+	// Close the tunnel last. Anything still proxying gets a 503.
+	if err := tun.Close(); err != nil {
+		logger.Error("tunnel shutdown error", "error", err)
+	}
+	logger.Info("shutdown complete")
+}
 
-	select {
-	case <-done:
-		logger.Info("shutdown complete")
-	case <-shutdownCtx.Done():
-		logger.Warn("shutdown timeout exceeded")
+// watchReload re-reads the config file on SIGHUP and applies the tunnel
+// TTL and cleanup intervals to the registry. Other settings need a
+// restart.
+func watchReload(ctx context.Context, path string, reg *registry.Registry, logger *slog.Logger) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+		}
+
+		logger.Info("reloading config", slog.String("path", path))
+		ko, err := reloadConfig(path, "ARBOK_SERVER")
+		if err != nil {
+			logger.Error("config reload failed, keeping current config", slog.Any("error", err))
+			continue
+		}
+		cfg, err := parseConfig(ko)
+		if err != nil {
+			logger.Error("config reload failed, keeping current config", slog.Any("error", err))
+			continue
+		}
+		reg.UpdateConfig(registry.Config{
+			DefaultTTL:         cfg.Tunnel.DefaultTTL,
+			CleanupInterval:    cfg.Tunnel.CleanupInterval,
+			MinCleanupInterval: cfg.Tunnel.MinCleanupInterval,
+		})
 	}
 }
 
@@ -136,15 +292,35 @@ type Config struct {
 	App struct {
 		Verbose bool   `toml:"verbose"`
 		Domain  string `toml:"domain"`
+		// SelfCheck probes DNS and the WireGuard endpoint at startup
+		SelfCheck bool `toml:"self_check"`
+		// EventLog writes tunnel lifecycle events to stdout as NDJSON
+		EventLog bool `toml:"event_log"`
 	} `toml:"app"`
 
 	Auth struct {
-		APIKeys []string `toml:"api_keys"`
+		APIKeys     []string    `toml:"api_keys"`
+		AdminKeys   []string    `toml:"admin_keys"`
+		Keys        []KeyConfig `toml:"keys"`
+		CreateRPS   float64     `toml:"create_rps"`
+		CreateBurst int         `toml:"create_burst"`
+		ShareSecret string      `toml:"share_secret"`
+		// AllowQueryKey accepts API keys in the api_key query parameter
+		AllowQueryKey bool `toml:"allow_query_key"`
 	} `toml:"auth"`
 
 	Tunnel struct {
-		DefaultTTL      time.Duration `toml:"default_ttl"`
-		CleanupInterval time.Duration `toml:"cleanup_interval"`
+		DefaultTTL              time.Duration `toml:"default_ttl"`
+		MaxTTL                  time.Duration `toml:"max_ttl"`
+		CleanupInterval         time.Duration `toml:"cleanup_interval"`
+		MinCleanupInterval      time.Duration `toml:"min_cleanup_interval"`
+		PoolStartOffset         int           `toml:"pool_start_offset"`
+		PoolRangeStart          string        `toml:"pool_range_start"`
+		PoolRangeEnd            string        `toml:"pool_range_end"`
+		MaxConcurrentProvisions int           `toml:"max_concurrent_provisions"`
+		RevokedRetention        time.Duration `toml:"revoked_retention"`
+		NameScheme              string        `toml:"name_scheme"`
+		DNSResolvers            []string      `toml:"dns_resolvers"`
 	} `toml:"tunnel"`
 
 	Server struct {
@@ -152,12 +328,137 @@ type Config struct {
 		ListenPort int    `toml:"listen_port"`
 		PrivateKey string `toml:"private_key"`
 		Endpoint   string `toml:"endpoint"`
+		MaxConns   int    `toml:"max_conns"`
+
+		TCPSendBufferSize    int `toml:"tcp_send_buffer_size"`
+		TCPReceiveBufferSize int `toml:"tcp_receive_buffer_size"`
 	} `toml:"server"`
 
 	HTTP struct {
-		ListenAddr     string   `toml:"listen_addr"`
-		AllowedOrigins []string `toml:"allowed_origins"`
+		ListenAddr           string        `toml:"listen_addr"`
+		AdminListenAddr      string        `toml:"admin_listen_addr"`
+		ServeUI              bool          `toml:"serve_ui"`
+		TrustedProxies       []*net.IPNet  `toml:"-"`
+		TLSCertFile          string        `toml:"tls_cert_file"`
+		TLSKeyFile           string        `toml:"tls_key_file"`
+		HTTP2                bool          `toml:"http2"`
+		AllowedOrigins       []string      `toml:"allowed_origins"`
+		Domains              []string      `toml:"domains"`
+		ProxyProtocol        bool          `toml:"proxy_protocol"`
+		ProxyProtocolStrict  bool          `toml:"proxy_protocol_strict"`
+		SlowRequestThreshold time.Duration `toml:"slow_request_threshold"`
+		MaxHeaderCount       int           `toml:"max_header_count"`
+		MaxHeaderBytes       int           `toml:"max_header_bytes"`
+		RootBehavior         string        `toml:"root_behavior"`
 	} `toml:"http"`
+
+	Store struct {
+		Path               string        `toml:"path"`
+		Debounce           time.Duration `toml:"debounce"`
+		PersistPrivateKeys bool          `toml:"persist_private_keys"`
+	} `toml:"store"`
+
+	Metrics struct {
+		ListenAddr string `toml:"listen_addr"`
+		Prefix     string `toml:"prefix"`
+	} `toml:"metrics"`
+
+	Proxy struct {
+		InterceptorRejectStatus  int           `toml:"interceptor_reject_status"`
+		ExpiryWarningThreshold   time.Duration `toml:"expiry_warning_threshold"`
+		StripResponseHeaders     []string      `toml:"strip_response_headers"`
+		MaxIdleConnsPerTunnel    int           `toml:"max_idle_conns_per_tunnel"`
+		IdleConnTimeout          time.Duration `toml:"idle_conn_timeout"`
+		RelayBufferBytes         int           `toml:"relay_buffer_bytes"`
+		WebSocketRelay           string        `toml:"websocket_relay"`
+		WebSocketMaxFrameBytes   int64         `toml:"websocket_max_frame_bytes"`
+		WebSocketMaxMessageBytes int64         `toml:"websocket_max_message_bytes"`
+		DialTimeout              time.Duration `toml:"dial_timeout"`
+		ResponseHeaderTimeout    time.Duration `toml:"response_header_timeout"`
+		MaxRequestTimeout        time.Duration `toml:"max_request_timeout"`
+		ExpectContinueTimeout    time.Duration `toml:"expect_continue_timeout"`
+		StripExpect              bool          `toml:"strip_expect"`
+		MaxBufferedBodyBytes     int64         `toml:"max_buffered_body_bytes"`
+		InjectHTML               string        `toml:"inject_html"`
+		BlockedContentTypes      []string      `toml:"blocked_content_types"`
+		TunnelMaxRPS             float64       `toml:"tunnel_max_rps"`
+		GlobalRateLimitBPS       int64         `toml:"global_rate_limit_bps"`
+		KeepWarm                 bool          `toml:"keep_warm"`
+		KeepWarmConns            int           `toml:"keep_warm_conns"`
+		KeepWarmWindow           time.Duration `toml:"keep_warm_window"`
+		FairScheduling           bool          `toml:"fair_scheduling"`
+		MaxInFlight              int           `toml:"max_in_flight"`
+		FairQueueTimeout         time.Duration `toml:"fair_queue_timeout"`
+	} `toml:"proxy"`
+
+	Inspect struct {
+		Enabled       bool  `toml:"enabled"`
+		MaxRequests   int   `toml:"max_requests"`
+		CaptureBodies bool  `toml:"capture_bodies"`
+		MaxBodyBytes  int64 `toml:"max_body_bytes"`
+	} `toml:"inspect"`
+}
+
+// KeyConfig holds the settings of one API key, from an [[auth.keys]]
+// table. Keys may contain dots, so they are values rather than table
+// names.
+type KeyConfig struct {
+	Key string `toml:"key"`
+	// Reservation is the subdomain reserved for the key, optionally
+	// qualified with one of http.domains
+	Reservation string `toml:"reservation"`
+	// MaxTTL overrides tunnel.max_ttl for the key's tunnels
+	MaxTTL time.Duration `toml:"max_ttl"`
+}
+
+// parseKeyConfigs reads the [[auth.keys]] tables
+func parseKeyConfigs(ko *koanf.Koanf) ([]KeyConfig, error) {
+	var keys []KeyConfig
+	seen := make(map[string]bool)
+	for i, k := range ko.Slices("auth.keys") {
+		kc := KeyConfig{
+			Key:         k.String("key"),
+			Reservation: k.String("reservation"),
+		}
+		if kc.Key == "" {
+			return nil, fmt.Errorf("invalid auth.keys entry %d: key is required", i+1)
+		}
+		if v := k.String("max_ttl"); v != "" {
+			ttl, err := time.ParseDuration(v)
+			if err != nil || ttl <= 0 {
+				return nil, fmt.Errorf("invalid auth.keys max_ttl %q for key %s: must be a positive duration", v, apikey.ID(kc.Key))
+			}
+			kc.MaxTTL = ttl
+		}
+		if seen[kc.Key] {
+			return nil, fmt.Errorf("invalid auth.keys entry %d: key %s is listed twice", i+1, apikey.ID(kc.Key))
+		}
+		seen[kc.Key] = true
+		keys = append(keys, kc)
+	}
+	return keys, nil
+}
+
+// keyReservations returns the configured reservations by owner ID
+func keyReservations(keys []KeyConfig) map[string]string {
+	out := make(map[string]string)
+	for _, k := range keys {
+		if k.Reservation != "" {
+			out[apikey.ID(k.Key)] = k.Reservation
+		}
+	}
+	return out
+}
+
+// keyMaxTTLs returns the configured per-key max TTLs by owner ID
+func keyMaxTTLs(keys []KeyConfig) map[string]time.Duration {
+	out := make(map[string]time.Duration)
+	for _, k := range keys {
+		if k.MaxTTL > 0 {
+			out[apikey.ID(k.Key)] = k.MaxTTL
+		}
+	}
+	return out
 }
 
 // parseConfig parses and validates the configuration
@@ -167,31 +468,209 @@ func parseConfig(ko *koanf.Koanf) (*Config, error) {
 	// Set defaults
 	cfg.App.Verbose = ko.Bool("app.verbose")
 	cfg.App.Domain = ko.String("app.domain")
-	
+	cfg.App.SelfCheck = ko.Bool("app.self_check")
+	cfg.App.EventLog = ko.Bool("app.event_log")
+
 	cfg.Auth.APIKeys = ko.Strings("auth.api_keys")
-	
+	cfg.Auth.AdminKeys = ko.Strings("auth.admin_keys")
+	keys, err := parseKeyConfigs(ko)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Auth.Keys = keys
+	cfg.Auth.AllowQueryKey = ko.Bool("auth.allow_query_key")
+	cfg.Auth.CreateRPS = ko.Float64("auth.create_rps")
+	cfg.Auth.CreateBurst = ko.Int("auth.create_burst")
+	if cfg.Auth.CreateBurst == 0 {
+		cfg.Auth.CreateBurst = 5
+	}
+	cfg.Auth.ShareSecret = ko.String("auth.share_secret")
+
 	cfg.Tunnel.DefaultTTL = ko.Duration("tunnel.default_ttl")
 	if cfg.Tunnel.DefaultTTL == 0 {
 		cfg.Tunnel.DefaultTTL = 24 * time.Hour
 	}
-	
+	cfg.Tunnel.MaxTTL = ko.Duration("tunnel.max_ttl")
+
 	cfg.Tunnel.CleanupInterval = ko.Duration("tunnel.cleanup_interval")
 	if cfg.Tunnel.CleanupInterval == 0 {
 		cfg.Tunnel.CleanupInterval = 5 * time.Minute
 	}
 	
+	cfg.Tunnel.MinCleanupInterval = ko.Duration("tunnel.min_cleanup_interval")
+	if cfg.Tunnel.MinCleanupInterval == 0 {
+		cfg.Tunnel.MinCleanupInterval = 10 * time.Second
+	}
+
+	cfg.Tunnel.PoolStartOffset = ko.Int("tunnel.pool_start_offset")
+	cfg.Tunnel.PoolRangeStart = ko.String("tunnel.pool_range_start")
+	cfg.Tunnel.PoolRangeEnd = ko.String("tunnel.pool_range_end")
+	cfg.Tunnel.MaxConcurrentProvisions = ko.Int("tunnel.max_concurrent_provisions")
+	cfg.Tunnel.RevokedRetention = ko.Duration("tunnel.revoked_retention")
+	cfg.Tunnel.NameScheme = ko.String("tunnel.name_scheme")
+	switch cfg.Tunnel.NameScheme {
+	case "":
+		cfg.Tunnel.NameScheme = registry.NameSchemeFriendly
+	case registry.NameSchemeFriendly, registry.NameSchemeRandom:
+	default:
+		return nil, fmt.Errorf("invalid tunnel.name_scheme %q: must be %q or %q",
+			cfg.Tunnel.NameScheme, registry.NameSchemeFriendly, registry.NameSchemeRandom)
+	}
+	cfg.Tunnel.DNSResolvers = ko.Strings("tunnel.dns_resolvers")
+
 	cfg.Server.CIDR = ko.String("server.cidr")
 	cfg.Server.ListenPort = ko.Int("server.listen_port")
 	cfg.Server.PrivateKey = ko.String("server.private_key")
 	cfg.Server.Endpoint = ko.String("server.endpoint")
-	
+	cfg.Server.MaxConns = ko.Int("server.max_conns")
+	if cfg.Server.MaxConns < 0 {
+		return nil, fmt.Errorf("invalid server.max_conns %d: must not be negative", cfg.Server.MaxConns)
+	}
+	cfg.Server.TCPSendBufferSize = ko.Int("server.tcp_send_buffer_size")
+	cfg.Server.TCPReceiveBufferSize = ko.Int("server.tcp_receive_buffer_size")
+	for _, buf := range []struct {
+		key  string
+		size int
+	}{
+		{"tcp_send_buffer_size", cfg.Server.TCPSendBufferSize},
+		{"tcp_receive_buffer_size", cfg.Server.TCPReceiveBufferSize},
+	} {
+		if buf.size != 0 && buf.size < tunnel.MinTCPBufferSize {
+			return nil, fmt.Errorf("invalid server.%s %d: must be 0 or at least %d bytes", buf.key, buf.size, tunnel.MinTCPBufferSize)
+		}
+	}
+
 	cfg.HTTP.ListenAddr = ko.String("http.listen_addr")
+	cfg.HTTP.AdminListenAddr = ko.String("http.admin_listen_addr")
+	for _, cidr := range ko.Strings("http.trusted_proxies") {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid http.trusted_proxies entry %q: %w", cidr, err)
+		}
+		cfg.HTTP.TrustedProxies = append(cfg.HTTP.TrustedProxies, network)
+	}
+	cfg.HTTP.TLSCertFile = ko.String("http.tls_cert_file")
+	cfg.HTTP.TLSKeyFile = ko.String("http.tls_key_file")
+	if (cfg.HTTP.TLSCertFile == "") != (cfg.HTTP.TLSKeyFile == "") {
+		return nil, fmt.Errorf("http.tls_cert_file and http.tls_key_file must be set together")
+	}
+	cfg.HTTP.ServeUI = true
+	if ko.Exists("http.serve_ui") {
+		cfg.HTTP.ServeUI = ko.Bool("http.serve_ui")
+	}
+	cfg.HTTP.HTTP2 = true
+	if ko.Exists("http.http2") {
+		cfg.HTTP.HTTP2 = ko.Bool("http.http2")
+	}
 	cfg.HTTP.AllowedOrigins = ko.Strings("http.allowed_origins")
+	cfg.HTTP.Domains = ko.Strings("http.domains")
+	cfg.HTTP.ProxyProtocol = ko.Bool("http.proxy_protocol")
+	cfg.HTTP.ProxyProtocolStrict = ko.Bool("http.proxy_protocol_strict")
+	cfg.HTTP.SlowRequestThreshold = ko.Duration("http.slow_request_threshold")
+	cfg.HTTP.MaxHeaderCount = ko.Int("http.max_header_count")
+	cfg.HTTP.MaxHeaderBytes = ko.Int("http.max_header_bytes")
+	cfg.HTTP.RootBehavior = ko.String("http.root_behavior")
+	if err := api.ValidateRootBehavior(cfg.HTTP.RootBehavior); err != nil {
+		return nil, fmt.Errorf("invalid http.root_behavior %q: %w", cfg.HTTP.RootBehavior, err)
+	}
+
+	cfg.Store.Path = ko.String("store.path")
+	cfg.Store.Debounce = ko.Duration("store.debounce")
+	cfg.Store.PersistPrivateKeys = ko.Bool("store.persist_private_keys")
+
+	cfg.Metrics.ListenAddr = ko.String("metrics.listen_addr")
+	cfg.Metrics.Prefix = ko.String("metrics.prefix")
+	if cfg.Metrics.Prefix == "" {
+		cfg.Metrics.Prefix = metrics.DefaultPrefix
+	}
+	if !metrics.ValidPrefix(cfg.Metrics.Prefix) {
+		return nil, fmt.Errorf("invalid metrics.prefix %q: must be letters, digits, _ or : and not start with a digit", cfg.Metrics.Prefix)
+	}
+
+	cfg.Proxy.InterceptorRejectStatus = ko.Int("proxy.interceptor_reject_status")
+	if cfg.Proxy.InterceptorRejectStatus == 0 {
+		cfg.Proxy.InterceptorRejectStatus = 403
+	}
+	if cfg.Proxy.InterceptorRejectStatus < 200 || cfg.Proxy.InterceptorRejectStatus > 599 {
+		return nil, fmt.Errorf("invalid proxy.interceptor_reject_status %d: must be an HTTP status between 200 and 599", cfg.Proxy.InterceptorRejectStatus)
+	}
+
+	cfg.Proxy.ExpiryWarningThreshold = ko.Duration("proxy.expiry_warning_threshold")
+	if cfg.Proxy.ExpiryWarningThreshold == 0 {
+		cfg.Proxy.ExpiryWarningThreshold = 10 * time.Minute
+	}
+
+	// An explicitly empty list disables stripping
+	cfg.Proxy.StripResponseHeaders = []string{"Server", "X-Powered-By"}
+	if ko.Exists("proxy.strip_response_headers") {
+		cfg.Proxy.StripResponseHeaders = ko.Strings("proxy.strip_response_headers")
+	}
+
+	cfg.Proxy.MaxIdleConnsPerTunnel = ko.Int("proxy.max_idle_conns_per_tunnel")
+	cfg.Proxy.IdleConnTimeout = ko.Duration("proxy.idle_conn_timeout")
+	cfg.Proxy.RelayBufferBytes = ko.Int("proxy.relay_buffer_bytes")
+	cfg.Proxy.WebSocketRelay = ko.String("proxy.websocket_relay")
+	switch cfg.Proxy.WebSocketRelay {
+	case "":
+		cfg.Proxy.WebSocketRelay = api.WebSocketRelayRaw
+	case api.WebSocketRelayRaw, api.WebSocketRelayFrames:
+	default:
+		return nil, fmt.Errorf("invalid proxy.websocket_relay %q: must be %q or %q",
+			cfg.Proxy.WebSocketRelay, api.WebSocketRelayRaw, api.WebSocketRelayFrames)
+	}
+	cfg.Proxy.WebSocketMaxFrameBytes = ko.Int64("proxy.websocket_max_frame_bytes")
+	cfg.Proxy.WebSocketMaxMessageBytes = ko.Int64("proxy.websocket_max_message_bytes")
+	cfg.Proxy.DialTimeout = ko.Duration("proxy.dial_timeout")
+	cfg.Proxy.ResponseHeaderTimeout = ko.Duration("proxy.response_header_timeout")
+	cfg.Proxy.MaxRequestTimeout = ko.Duration("proxy.max_request_timeout")
+	cfg.Proxy.ExpectContinueTimeout = ko.Duration("proxy.expect_continue_timeout")
+	cfg.Proxy.StripExpect = ko.Bool("proxy.strip_expect")
+	cfg.Proxy.MaxBufferedBodyBytes = ko.Int64("proxy.max_buffered_body_bytes")
+	cfg.Proxy.InjectHTML = ko.String("proxy.inject_html")
+	cfg.Proxy.BlockedContentTypes = ko.Strings("proxy.blocked_content_types")
+	cfg.Proxy.TunnelMaxRPS = ko.Float64("proxy.tunnel_max_rps")
+	cfg.Proxy.GlobalRateLimitBPS = ko.Int64("proxy.global_rate_limit_bps")
+	cfg.Proxy.KeepWarm = ko.Bool("proxy.keep_warm")
+	cfg.Proxy.KeepWarmConns = ko.Int("proxy.keep_warm_conns")
+	cfg.Proxy.KeepWarmWindow = ko.Duration("proxy.keep_warm_window")
+	cfg.Proxy.FairScheduling = ko.Bool("proxy.fair_scheduling")
+	cfg.Proxy.MaxInFlight = ko.Int("proxy.max_in_flight")
+	cfg.Proxy.FairQueueTimeout = ko.Duration("proxy.fair_queue_timeout")
+
+	// The inspector records traffic, so it is off unless enabled
+	cfg.Inspect.Enabled = ko.Bool("inspect.enabled")
+	cfg.Inspect.MaxRequests = api.DefaultInspectRequests
+	if ko.Exists("inspect.max_requests") {
+		cfg.Inspect.MaxRequests = ko.Int("inspect.max_requests")
+	}
+	if !cfg.Inspect.Enabled {
+		cfg.Inspect.MaxRequests = 0
+	}
+	cfg.Inspect.CaptureBodies = ko.Bool("inspect.capture_bodies")
+	cfg.Inspect.MaxBodyBytes = ko.Int64("inspect.max_body_bytes")
+	switch {
+	case !cfg.Inspect.CaptureBodies:
+		cfg.Inspect.MaxBodyBytes = 0
+	case cfg.Inspect.MaxBodyBytes <= 0:
+		cfg.Inspect.MaxBodyBytes = api.DefaultInspectBodyBytes
+	}
 
 	// Validation
 	if cfg.App.Domain == "" {
 		return nil, fmt.Errorf("app.domain is required")
 	}
+
+	// app.domain is always served and is the default for tunnels
+	// created from hosts outside every configured domain
+	cfg.App.Domain = strings.ToLower(cfg.App.Domain)
+	domains := []string{cfg.App.Domain}
+	for _, d := range cfg.HTTP.Domains {
+		d = strings.ToLower(strings.TrimSpace(d))
+		if d != "" && !slices.Contains(domains, d) {
+			domains = append(domains, d)
+		}
+	}
+	cfg.HTTP.Domains = domains
 	if cfg.Server.CIDR == "" {
 		return nil, fmt.Errorf("server.cidr is required")
 	}
@@ -199,5 +678,10 @@ func parseConfig(ko *koanf.Koanf) (*Config, error) {
 		return nil, fmt.Errorf("server.private_key is required")
 	}
 
+	// Use endpoint from config, or fallback to domain:port
+	if cfg.Server.Endpoint == "" {
+		cfg.Server.Endpoint = fmt.Sprintf("%s:%d", cfg.App.Domain, cfg.Server.ListenPort)
+	}
+
 	return &cfg, nil
 }
\ No newline at end of file
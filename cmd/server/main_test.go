@@ -0,0 +1,306 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/knadh/koanf"
+	"github.com/knadh/koanf/parsers/toml"
+	"github.com/knadh/koanf/providers/file"
+	"github.com/mr-karan/arbok/internal/api"
+	"github.com/mr-karan/arbok/internal/apikey"
+	"github.com/mr-karan/arbok/internal/metrics"
+	"github.com/mr-karan/arbok/internal/registry"
+)
+
+// baseConfig is the minimal valid config tests append sections to
+const baseConfig = `
+[app]
+domain = "example.com"
+
+[server]
+cidr = "10.100.0.0/24"
+private_key = "yBQWnFQEq9q9al4ratmo6ylyZ52ngNsk4U11u4JtH0U="
+`
+
+// parseTestConfig parses baseConfig followed by extra
+func parseTestConfig(t *testing.T, extra string) (*Config, error) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.toml")
+	if err := os.WriteFile(path, []byte(baseConfig+extra), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	ko := koanf.New(".")
+	if err := ko.Load(file.Provider(path), toml.Parser()); err != nil {
+		t.Fatalf("loading config: %v", err)
+	}
+	return parseConfig(ko)
+}
+
+func TestInterceptorRejectStatus(t *testing.T) {
+	cfg, err := parseTestConfig(t, "")
+	if err != nil {
+		t.Fatalf("parseConfig: %v", err)
+	}
+	if cfg.Proxy.InterceptorRejectStatus != 403 {
+		t.Errorf("interceptor_reject_status = %d, want 403 by default", cfg.Proxy.InterceptorRejectStatus)
+	}
+
+	for _, status := range []string{"42", "101", "1000"} {
+		_, err := parseTestConfig(t, "[proxy]\ninterceptor_reject_status = "+status+"\n")
+		if err == nil || !strings.Contains(err.Error(), "proxy.interceptor_reject_status") {
+			t.Errorf("status %s: parseConfig error = %v, want one naming proxy.interceptor_reject_status", status, err)
+		}
+	}
+}
+func TestKeyReservationsWithDottedKeys(t *testing.T) {
+	cfg, err := parseTestConfig(t, `
+[auth]
+api_keys = ["team.prod.key", "plain"]
+
+[[auth.keys]]
+key = "team.prod.key"
+reservation = "myapp"
+
+[[auth.keys]]
+key = "plain"
+reservation = "other.team2.example.com"
+`)
+	if err != nil {
+		t.Fatalf("parseConfig: %v", err)
+	}
+
+	got := keyReservations(cfg.Auth.Keys)
+	want := map[string]string{
+		apikey.ID("team.prod.key"): "myapp",
+		apikey.ID("plain"):         "other.team2.example.com",
+	}
+	if len(got) != len(want) {
+		t.Fatalf("reservations = %v, want %v", got, want)
+	}
+	for id, name := range want {
+		if got[id] != name {
+			t.Errorf("reservation of %s = %q, want %q", id, got[id], name)
+		}
+	}
+}
+
+func TestKeyMaxTTLs(t *testing.T) {
+	cfg, err := parseTestConfig(t, `
+[tunnel]
+max_ttl = "24h"
+
+[[auth.keys]]
+key = "premium.key"
+max_ttl = "168h"
+
+[[auth.keys]]
+key = "basic"
+reservation = "myapp"
+`)
+	if err != nil {
+		t.Fatalf("parseConfig: %v", err)
+	}
+
+	if cfg.Tunnel.MaxTTL != 24*time.Hour {
+		t.Errorf("max_ttl = %s, want 24h for keys without their own", cfg.Tunnel.MaxTTL)
+	}
+	got := keyMaxTTLs(cfg.Auth.Keys)
+	if len(got) != 1 || got[apikey.ID("premium.key")] != 168*time.Hour {
+		t.Errorf("max TTLs = %v, want only premium.key at 168h", got)
+	}
+}
+
+func TestKeyConfigErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		extra string
+		want  string
+	}{
+		{
+			name:  "bad max_ttl",
+			extra: "[[auth.keys]]\nkey = \"k1\"\nmax_ttl = \"-1h\"\n",
+			want:  "must be a positive duration",
+		},
+		{
+			name:  "missing key",
+			extra: "[[auth.keys]]\nreservation = \"myapp\"\n",
+			want:  "key is required",
+		},
+		{
+			name:  "duplicate key",
+			extra: "[[auth.keys]]\nkey = \"k1\"\n\n[[auth.keys]]\nkey = \"k1\"\n",
+			want:  "listed twice",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseTestConfig(t, tt.extra)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("parseConfig error = %v, want one containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestStripResponseHeadersDefault(t *testing.T) {
+	tests := []struct {
+		name  string
+		extra string
+		want  []string
+	}{
+		{"default", "", []string{"Server", "X-Powered-By"}},
+		{"configured", "[proxy]\nstrip_response_headers = [\"Via\"]\n", []string{"Via"}},
+		{"disabled", "[proxy]\nstrip_response_headers = []\n", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := parseTestConfig(t, tt.extra)
+			if err != nil {
+				t.Fatalf("parseConfig: %v", err)
+			}
+			if got := cfg.Proxy.StripResponseHeaders; strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("strip_response_headers = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInspectorIsOptIn(t *testing.T) {
+	tests := []struct {
+		name  string
+		extra string
+		want  int
+	}{
+		{"off by default", "", 0},
+		{"max_requests alone doesn't enable it", "[inspect]\nmax_requests = 20\n", 0},
+		{"enabled", "[inspect]\nenabled = true\n", api.DefaultInspectRequests},
+		{"enabled with max_requests", "[inspect]\nenabled = true\nmax_requests = 20\n", 20},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := parseTestConfig(t, tt.extra)
+			if err != nil {
+				t.Fatalf("parseConfig: %v", err)
+			}
+			if cfg.Inspect.MaxRequests != tt.want {
+				t.Errorf("inspector keeps %d requests, want %d", cfg.Inspect.MaxRequests, tt.want)
+			}
+		})
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.toml")
+	if _, err := reloadConfig(path, "ARBOK_TEST"); err == nil {
+		t.Error("reloading a missing file succeeded")
+	}
+
+	if err := os.WriteFile(path, []byte(baseConfig+"[tunnel\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reloadConfig(path, "ARBOK_TEST"); err == nil {
+		t.Error("reloading invalid TOML succeeded")
+	}
+
+	// The environment overrides the file, as at startup
+	if err := os.WriteFile(path, []byte(baseConfig+"[tunnel]\ndefault_ttl = \"1h\"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("ARBOK_TEST_TUNNEL__CLEANUP_INTERVAL", "30s")
+	ko, err := reloadConfig(path, "ARBOK_TEST_")
+	if err != nil {
+		t.Fatalf("reloadConfig: %v", err)
+	}
+	cfg, err := parseConfig(ko)
+	if err != nil {
+		t.Fatalf("parseConfig: %v", err)
+	}
+	if cfg.Tunnel.DefaultTTL != time.Hour || cfg.Tunnel.CleanupInterval != 30*time.Second {
+		t.Errorf("reloaded TTL %v and cleanup interval %v, want 1h and 30s", cfg.Tunnel.DefaultTTL, cfg.Tunnel.CleanupInterval)
+	}
+}
+
+func TestNameScheme(t *testing.T) {
+	tests := []struct {
+		name  string
+		extra string
+		want  string
+	}{
+		{"friendly by default", "", registry.NameSchemeFriendly},
+		{"random", "[tunnel]\nname_scheme = \"random\"\n", registry.NameSchemeRandom},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := parseTestConfig(t, tt.extra)
+			if err != nil {
+				t.Fatalf("parseConfig: %v", err)
+			}
+			if cfg.Tunnel.NameScheme != tt.want {
+				t.Errorf("name_scheme = %q, want %q", cfg.Tunnel.NameScheme, tt.want)
+			}
+		})
+	}
+
+	if _, err := parseTestConfig(t, "[tunnel]\nname_scheme = \"hashed\"\n"); err == nil || !strings.Contains(err.Error(), "tunnel.name_scheme") {
+		t.Errorf("parseConfig error = %v, want one naming tunnel.name_scheme", err)
+	}
+}
+
+func TestMaxConns(t *testing.T) {
+	// baseConfig ends in [server], so bare keys land there
+	cfg, err := parseTestConfig(t, "max_conns = 512\n")
+	if err != nil {
+		t.Fatalf("parseConfig: %v", err)
+	}
+	if cfg.Server.MaxConns != 512 {
+		t.Errorf("max_conns = %d, want 512", cfg.Server.MaxConns)
+	}
+
+	if _, err := parseTestConfig(t, "max_conns = -1\n"); err == nil || !strings.Contains(err.Error(), "server.max_conns") {
+		t.Errorf("parseConfig error = %v, want one naming server.max_conns", err)
+	}
+}
+
+func TestMetricsPrefix(t *testing.T) {
+	tests := []struct {
+		name  string
+		extra string
+		want  string
+	}{
+		{"default", "", metrics.DefaultPrefix},
+		{"configured", "[metrics]\nprefix = \"edge_arbok\"\n", "edge_arbok"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := parseTestConfig(t, tt.extra)
+			if err != nil {
+				t.Fatalf("parseConfig: %v", err)
+			}
+			if cfg.Metrics.Prefix != tt.want {
+				t.Errorf("prefix = %q, want %q", cfg.Metrics.Prefix, tt.want)
+			}
+		})
+	}
+
+	if _, err := parseTestConfig(t, "[metrics]\nprefix = \"9lives\"\n"); err == nil || !strings.Contains(err.Error(), "metrics.prefix") {
+		t.Errorf("parseConfig error = %v, want one naming metrics.prefix", err)
+	}
+}
+
+func TestTCPBufferSizes(t *testing.T) {
+	cfg, err := parseTestConfig(t, "tcp_send_buffer_size = 262144\ntcp_receive_buffer_size = 8388608\n")
+	if err != nil {
+		t.Fatalf("parseConfig: %v", err)
+	}
+	if cfg.Server.TCPSendBufferSize != 256<<10 || cfg.Server.TCPReceiveBufferSize != 8<<20 {
+		t.Errorf("buffer sizes = %d/%d, want 256 KiB and 8 MiB", cfg.Server.TCPSendBufferSize, cfg.Server.TCPReceiveBufferSize)
+	}
+
+	if _, err := parseTestConfig(t, "tcp_receive_buffer_size = 100\n"); err == nil || !strings.Contains(err.Error(), "server.tcp_receive_buffer_size") {
+		t.Errorf("parseConfig error = %v, want one naming server.tcp_receive_buffer_size", err)
+	}
+}
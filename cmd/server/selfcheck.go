@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// selfCheckTimeout bounds each probe of the startup self-check
+const selfCheckTimeout = 3 * time.Second
+
+// selfChecker probes the public configuration clients will be handed.
+// Lookups and dials are injectable so the checks can run against stubs.
+type selfChecker struct {
+	logger     *slog.Logger
+	lookupHost func(ctx context.Context, host string) ([]string, error)
+	dial       func(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+func newSelfChecker(logger *slog.Logger) *selfChecker {
+	var d net.Dialer
+	return &selfChecker{
+		logger:     logger,
+		lookupHost: net.DefaultResolver.LookupHost,
+		dial:       d.DialContext,
+	}
+}
+
+// run checks that domain (and its tunnel wildcard) resolves and that the
+// WireGuard endpoint resolves and doesn't refuse UDP. It's best-effort:
+// problems are logged as warnings and counted, never fatal.
+func (c *selfChecker) run(ctx context.Context, domain, endpoint string, listenPort int) int {
+	warnings := 0
+	warn := func(msg string, attrs ...any) {
+		warnings++
+		c.logger.Warn("self-check: "+msg, attrs...)
+	}
+
+	if _, err := c.lookup(ctx, domain); err != nil {
+		warn("domain does not resolve", "domain", domain, "error", err)
+	} else if _, err := c.lookup(ctx, "arbok-self-check."+domain); err != nil {
+		warn("tunnel subdomains do not resolve, is there a wildcard DNS record?",
+			"record", "*."+domain, "error", err)
+	}
+
+	host, portStr, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		warn("endpoint is not host:port", "endpoint", endpoint, "error", err)
+		return warnings
+	}
+	if port, err := strconv.Atoi(portStr); err == nil && port != listenPort {
+		warn("endpoint port differs from server.listen_port, make sure it is forwarded",
+			"endpoint", endpoint, "listen_port", listenPort)
+	}
+
+	addrs, err := c.lookup(ctx, host)
+	if err != nil {
+		warn("endpoint host does not resolve", "endpoint", endpoint, "error", err)
+		return warnings
+	}
+	for _, addr := range addrs {
+		if ip := net.ParseIP(addr); ip != nil && ip.IsLoopback() && host != "localhost" {
+			warn("endpoint resolves to a loopback address, remote clients can't reach it",
+				"endpoint", endpoint, "addr", addr)
+			break
+		}
+	}
+
+	if err := c.probeUDP(ctx, endpoint); err != nil {
+		warn("endpoint refused UDP, clients won't be able to connect", "endpoint", endpoint, "error", err)
+	}
+
+	if warnings == 0 {
+		c.logger.Info("self-check passed", "domain", domain, "endpoint", endpoint)
+	}
+	return warnings
+}
+
+func (c *selfChecker) lookup(ctx context.Context, host string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, selfCheckTimeout)
+	defer cancel()
+	return c.lookupHost(ctx, host)
+}
+
+// probeUDP sends a datagram to the endpoint. WireGuard silently drops it,
+// so silence is success; only an ICMP port unreachable (surfacing as a
+// refused connection) is reported.
+func (c *selfChecker) probeUDP(ctx context.Context, endpoint string) error {
+	ctx, cancel := context.WithTimeout(ctx, selfCheckTimeout)
+	defer cancel()
+
+	conn, err := c.dial(ctx, "udp", endpoint)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte{0}); err != nil {
+		return err
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); errors.Is(err, syscall.ECONNREFUSED) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"net"
+	"strings"
+	"testing"
+)
+
+// stubSelfChecker returns a self-checker resolving only the hosts in
+// records and dialing UDP at target instead of the endpoint, logging to
+// logs
+func stubSelfChecker(t *testing.T, records map[string]string, target string, logs *bytes.Buffer) *selfChecker {
+	t.Helper()
+	return &selfChecker{
+		logger: slog.New(slog.NewTextHandler(logs, nil)),
+		lookupHost: func(ctx context.Context, host string) ([]string, error) {
+			if addr, ok := records[host]; ok {
+				return []string{addr}, nil
+			}
+			return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+		},
+		dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, target)
+		},
+	}
+}
+
+// openUDP returns the address of a UDP socket that answers every
+// datagram, so probes don't wait out their read deadline
+func openUDP(t *testing.T) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 64)
+		for {
+			_, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteTo([]byte{0}, addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+// closedUDP returns the address of a UDP port nothing listens on
+func closedUDP(t *testing.T) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := conn.LocalAddr().String()
+	conn.Close()
+	return addr
+}
+
+func TestSelfCheck(t *testing.T) {
+	healthy := map[string]string{
+		"tunnel.example.com":                  "192.0.2.10",
+		"arbok-self-check.tunnel.example.com": "192.0.2.10",
+		"vpn.example.com":                     "192.0.2.20",
+	}
+	without := func(host string) map[string]string {
+		records := make(map[string]string)
+		for h, addr := range healthy {
+			if h != host {
+				records[h] = addr
+			}
+		}
+		return records
+	}
+
+	tests := []struct {
+		name     string
+		records  map[string]string
+		endpoint string
+		target   string
+		want     string
+	}{
+		{"healthy", healthy, "vpn.example.com:51820", openUDP(t), "self-check passed"},
+		{"unresolvable domain", without("tunnel.example.com"), "vpn.example.com:51820", openUDP(t), "domain does not resolve"},
+		{"no wildcard record", without("arbok-self-check.tunnel.example.com"), "vpn.example.com:51820", openUDP(t), "tunnel subdomains do not resolve"},
+		{"unresolvable endpoint", without("vpn.example.com"), "vpn.example.com:51820", openUDP(t), "endpoint host does not resolve"},
+		{"endpoint without port", healthy, "vpn.example.com", openUDP(t), "endpoint is not host:port"},
+		{"other port", healthy, "vpn.example.com:443", openUDP(t), "endpoint port differs"},
+		{"refused UDP", healthy, "vpn.example.com:51820", closedUDP(t), "endpoint refused UDP"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs bytes.Buffer
+			c := stubSelfChecker(t, tt.records, tt.target, &logs)
+			warnings := c.run(context.Background(), "tunnel.example.com", tt.endpoint, 51820)
+
+			if !strings.Contains(logs.String(), tt.want) {
+				t.Errorf("logs lack %q:\n%s", tt.want, logs.String())
+			}
+			if passed := tt.want == "self-check passed"; passed != (warnings == 0) {
+				t.Errorf("%d warnings:\n%s", warnings, logs.String())
+			}
+			if warnings > 0 && !strings.Contains(logs.String(), "level=WARN") {
+				t.Errorf("problems not logged as warnings:\n%s", logs.String())
+			}
+		})
+	}
+}
+
+func TestSelfCheckFlagsLoopbackEndpoint(t *testing.T) {
+	var logs bytes.Buffer
+	c := stubSelfChecker(t, map[string]string{
+		"tunnel.example.com":                  "192.0.2.10",
+		"arbok-self-check.tunnel.example.com": "192.0.2.10",
+		"vpn.example.com":                     "127.0.0.1",
+	}, openUDP(t), &logs)
+
+	if c.run(context.Background(), "tunnel.example.com", "vpn.example.com:51820", 51820) != 1 {
+		t.Errorf("want one warning:\n%s", logs.String())
+	}
+	if !strings.Contains(logs.String(), "loopback") {
+		t.Errorf("loopback endpoint not reported:\n%s", logs.String())
+	}
+}
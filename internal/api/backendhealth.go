@@ -0,0 +1,53 @@
+package api
+
+import (
+	"sync"
+
+	"github.com/mr-karan/arbok/internal/registry"
+	"github.com/mr-karan/arbok/internal/tunnel"
+)
+
+// backendHealth tracks whether each tunnel's backend answered its last
+// proxied request and publishes an EventTunnelHealth when that changes
+type backendHealth struct {
+	mu        sync.Mutex
+	unhealthy map[string]bool
+	events    *registry.Hub
+}
+
+func newBackendHealth(events *registry.Hub) *backendHealth {
+	return &backendHealth{
+		unhealthy: make(map[string]bool),
+		events:    events,
+	}
+}
+
+// report records the outcome of a round trip to t's backend, err being
+// nil when it answered. Backends start out healthy.
+func (h *backendHealth) report(t *tunnel.Info, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.unhealthy[t.ID] == (err != nil) {
+		return
+	}
+	change := registry.HealthChange{Healthy: err == nil}
+	if err == nil {
+		delete(h.unhealthy, t.ID)
+	} else {
+		h.unhealthy[t.ID] = true
+		change.Error = err.Error()
+	}
+	// Published under the lock so changes arrive in order
+	event := registry.TunnelEvent(registry.EventTunnelHealth, t)
+	event.Data = change
+	h.events.Publish(event)
+}
+
+// evict drops a removed tunnel's state
+func (h *backendHealth) evict(t *tunnel.Info) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(h.unhealthy, t.ID)
+}
@@ -0,0 +1,71 @@
+package api
+
+import (
+	"context"
+	"io"
+
+	"golang.org/x/time/rate"
+)
+
+// bandwidthChunk is the most a throttled read takes from the limiter at
+// once. Small chunks interleave concurrent transfers, so they share a
+// saturated limit fairly.
+const bandwidthChunk = 16 << 10
+
+// bandwidthLimiter caps the combined throughput of every proxied body and
+// relayed stream, in both directions, with one token bucket of bytes
+type bandwidthLimiter struct {
+	lim *rate.Limiter
+}
+
+// newBandwidthLimiter returns a limiter for bitsPerSecond, or nil when it
+// is zero (no limit)
+func newBandwidthLimiter(bitsPerSecond int64) *bandwidthLimiter {
+	if bitsPerSecond <= 0 {
+		return nil
+	}
+	bytesPerSecond := max(bitsPerSecond/8, 1)
+	// Allow bursts of a tenth of a second, but never less than a chunk
+	burst := max(bytesPerSecond/10, bandwidthChunk)
+	return &bandwidthLimiter{lim: rate.NewLimiter(rate.Limit(bytesPerSecond), int(burst))}
+}
+
+// reader throttles reads from r. A nil limiter returns r unchanged.
+func (b *bandwidthLimiter) reader(ctx context.Context, r io.Reader) io.Reader {
+	if b == nil {
+		return r
+	}
+	return &throttledReader{r: r, lim: b.lim, ctx: ctx}
+}
+
+// readCloser throttles reads from rc, keeping its Close
+func (b *bandwidthLimiter) readCloser(ctx context.Context, rc io.ReadCloser) io.ReadCloser {
+	if b == nil {
+		return rc
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{b.reader(ctx, rc), rc}
+}
+
+// throttledReader waits for the limiter after each read, for the bytes
+// it returned
+type throttledReader struct {
+	r   io.Reader
+	lim *rate.Limiter
+	ctx context.Context
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > bandwidthChunk {
+		p = p[:bandwidthChunk]
+	}
+	n, err := t.r.Read(p)
+	if n > 0 {
+		if werr := t.lim.WaitN(t.ctx, n); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,71 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBandwidthLimitShared(t *testing.T) {
+	const (
+		bytesPerSecond = 256 << 10
+		size           = 128 << 10
+	)
+	b := newBandwidthLimiter(bytesPerSecond * 8)
+	burst := int64(b.lim.Burst())
+
+	start := time.Now()
+	elapsed := make([]time.Duration, 2)
+	var wg sync.WaitGroup
+	for i := range elapsed {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := b.reader(context.Background(), bytes.NewReader(make([]byte, size)))
+			if n, err := io.Copy(io.Discard, r); err != nil || n != size {
+				t.Errorf("copy = %d, %v", n, err)
+			}
+			elapsed[i] = time.Since(start)
+		}()
+	}
+	wg.Wait()
+
+	// Together the transfers stay within the limit, and they share it
+	// rather than one going first: both end close to when the budget
+	// for both runs out
+	want := time.Duration(float64(2*size-burst) / bytesPerSecond * float64(time.Second))
+	for i, d := range elapsed {
+		if d < want*6/10 {
+			t.Errorf("transfer %d took %s, want about %s", i, d, want)
+		}
+	}
+	if total := max(elapsed[0], elapsed[1]); total < want*9/10 {
+		t.Errorf("transfers took %s, limit allows no less than %s", total, want)
+	}
+}
+
+func TestBandwidthLimitDisabled(t *testing.T) {
+	b := newBandwidthLimiter(0)
+	if b != nil {
+		t.Fatal("limiter created for a zero limit")
+	}
+	r := bytes.NewReader(nil)
+	if b.reader(context.Background(), r) != io.Reader(r) {
+		t.Error("nil limiter wrapped the reader")
+	}
+}
+
+func TestBandwidthLimitCanceled(t *testing.T) {
+	b := newBandwidthLimiter(8 * 1024)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := io.Copy(io.Discard, b.reader(ctx, bytes.NewReader(make([]byte, 1<<20))))
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("copy = %v, want %v", err, context.Canceled)
+	}
+}
@@ -0,0 +1,72 @@
+package api
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"net/http"
+)
+
+// DefaultMaxBufferedBodyBytes bounds how much of a proxied body features
+// that need to see it (rewriting, inspection) may hold in memory
+const DefaultMaxBufferedBodyBytes = 1 << 20
+
+// Proxied bodies are streamed by default. Only features that have to see
+// a whole body buffer it, through PeekBody, and only up to a limit:
+// anything larger is streamed through untouched so uploads can't balloon
+// memory.
+
+// PeekBody reads up to limit bytes of body. complete reports whether that
+// was the whole body; when it wasn't, the body is too large to buffer and
+// callers must pass it on unmodified. The returned replay yields the
+// peeked bytes followed by the rest of body and must replace it.
+func PeekBody(body io.ReadCloser, limit int64) (peeked []byte, replay io.ReadCloser, complete bool, err error) {
+	if body == nil || body == http.NoBody {
+		return nil, body, true, nil
+	}
+	if limit < 0 {
+		limit = 0
+	}
+
+	// One byte past the limit tells a body of exactly limit bytes apart
+	// from a larger one
+	peeked, err = io.ReadAll(io.LimitReader(body, limit+1))
+	if err != nil {
+		return nil, body, false, err
+	}
+	if int64(len(peeked)) <= limit {
+		body.Close()
+		return peeked, io.NopCloser(bytes.NewReader(peeked)), true, nil
+	}
+	return peeked, &replayBody{Reader: io.MultiReader(bytes.NewReader(peeked), body), Closer: body}, false, nil
+}
+
+// replayBody streams peeked bytes ahead of the rest of the original body
+type replayBody struct {
+	io.Reader
+	io.Closer
+}
+
+// IsStreamingResponse reports whether resp's body should be streamed to
+// the client as it arrives rather than buffered for rewriting:
+// server-sent events, bodies of unknown length (chunked), and bodies
+// larger than limit. Peeking at such a body would hold back every event
+// or chunk until the limit or the end of the stream.
+func IsStreamingResponse(resp *http.Response, limit int64) bool {
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType == "text/event-stream" {
+		return true
+	}
+	return resp.ContentLength < 0 || resp.ContentLength > limit
+}
+
+// PeekResponseBody peeks at up to limit bytes of resp's body, leaving
+// resp.Body readable from the start
+func PeekResponseBody(resp *http.Response, limit int64) ([]byte, bool, error) {
+	peeked, replay, complete, err := PeekBody(resp.Body, limit)
+	if err != nil {
+		return nil, false, err
+	}
+	resp.Body = replay
+	return peeked, complete, nil
+}
@@ -0,0 +1,142 @@
+package api
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// countingReader counts the bytes read from an endless stream of 'x'
+type countingReader struct{ n int64 }
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 'x'
+	}
+	r.n += int64(len(p))
+	return len(p), nil
+}
+
+func TestPeekBody(t *testing.T) {
+	small := io.NopCloser(strings.NewReader("hello"))
+	peeked, replay, complete, err := PeekBody(small, 16)
+	if err != nil || !complete || string(peeked) != "hello" {
+		t.Fatalf("small body = %q, %v, %v", peeked, complete, err)
+	}
+	if all, _ := io.ReadAll(replay); string(all) != "hello" {
+		t.Errorf("small body replays %q", all)
+	}
+
+	// Exactly at the limit still fits
+	if _, _, complete, _ := PeekBody(io.NopCloser(strings.NewReader("0123456789abcdef")), 16); !complete {
+		t.Error("body of exactly the limit not complete")
+	}
+
+	large := strings.Repeat("0123456789", 10)
+	peeked, replay, complete, err = PeekBody(io.NopCloser(strings.NewReader(large)), 16)
+	if err != nil || complete || len(peeked) != 17 {
+		t.Fatalf("large body peeked %d bytes, complete %v, %v; want 17 and incomplete", len(peeked), complete, err)
+	}
+	if all, _ := io.ReadAll(replay); string(all) != large {
+		t.Errorf("large body replays %d bytes, want the %d sent", len(all), len(large))
+	}
+}
+
+func TestPeekBodyReadsOnlyToLimit(t *testing.T) {
+	src := &countingReader{}
+	_, _, complete, err := PeekBody(io.NopCloser(src), 1<<10)
+	if err != nil || complete {
+		t.Fatalf("endless body: complete %v, %v", complete, err)
+	}
+	// Readers may be handed bigger buffers than asked for, but nowhere
+	// near the whole body
+	if src.n > 64<<10 {
+		t.Errorf("read %d bytes to peek at 1KiB", src.n)
+	}
+}
+
+func TestIsStreamingResponse(t *testing.T) {
+	tests := []struct {
+		name          string
+		contentType   string
+		contentLength int64
+		want          bool
+	}{
+		{"small page", "text/html", 100, false},
+		{"large page", "text/html", 10 << 20, true},
+		{"chunked", "text/html", -1, true},
+		{"events", "text/event-stream; charset=utf-8", 10, true},
+	}
+	for _, tt := range tests {
+		resp := &http.Response{Header: http.Header{"Content-Type": {tt.contentType}}, ContentLength: tt.contentLength}
+		if got := IsStreamingResponse(resp, 1<<20); got != tt.want {
+			t.Errorf("%s: IsStreamingResponse = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestProxyStreamsRequestBody(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  Config
+	}{
+		{"plain", Config{MaxBufferedBodyBytes: 1 << 10}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testProxyStreamsRequestBody(t, tt.cfg)
+		})
+	}
+}
+
+// testProxyStreamsRequestBody uploads a body the backend must start
+// reading before the client finishes sending it
+func testProxyStreamsRequestBody(t *testing.T, cfg Config) {
+	ts := newTestServer(t, cfg, testKeys{})
+	firstChunk := make(chan struct{})
+	created := ts.backend(t, "", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(r.Body, buf); err != nil {
+			return
+		}
+		close(firstChunk)
+		n, _ := io.Copy(io.Discard, r.Body)
+		fmt.Fprint(w, n)
+	}))
+
+	// The client only sends the rest once the backend has the start, so a
+	// proxy holding the body back until it's complete never finishes
+	pr, pw := io.Pipe()
+	r := httptest.NewRequest(http.MethodPost, "/", pr)
+	r.Host = created.Subdomain + "." + ts.cfg.Domain
+	r.ContentLength = -1
+	w := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		ts.proxyHandler().ServeHTTP(w, r)
+		close(done)
+	}()
+
+	pw.Write([]byte("head"))
+	select {
+	case <-firstChunk:
+	case <-time.After(5 * time.Second):
+		pw.CloseWithError(io.ErrUnexpectedEOF)
+		t.Fatal("backend got nothing before the upload finished")
+	}
+	chunk := bytes.Repeat([]byte("x"), 64<<10)
+	for range 128 {
+		pw.Write(chunk)
+	}
+	pw.Close()
+	<-done
+
+	if want := fmt.Sprint(128 * len(chunk)); w.Code != http.StatusOK || w.Body.String() != want {
+		t.Errorf("upload = %d, backend read %s bytes after the first chunk; want 200 and %s", w.Code, w.Body, want)
+	}
+}
@@ -0,0 +1,40 @@
+package api
+
+import "sync"
+
+// DefaultRelayBufferBytes matches io.Copy's default buffer size
+const DefaultRelayBufferBytes = 32 << 10
+
+// bufferPool shares fixed-size copy buffers between relays and the
+// reverse proxy to cut allocations under load. It satisfies
+// httputil.BufferPool.
+type bufferPool struct {
+	size int
+	pool sync.Pool
+}
+
+func newBufferPool(size int) *bufferPool {
+	if size <= 0 {
+		size = DefaultRelayBufferBytes
+	}
+	p := &bufferPool{size: size}
+	p.pool.New = func() any {
+		buf := make([]byte, size)
+		return &buf
+	}
+	return p
+}
+
+// Get returns a buffer of the pool's size
+func (p *bufferPool) Get() []byte {
+	return *p.pool.Get().(*[]byte)
+}
+
+// Put returns a buffer to the pool. Buffers of another size are dropped.
+func (p *bufferPool) Put(buf []byte) {
+	if cap(buf) != p.size {
+		return
+	}
+	buf = buf[:p.size]
+	p.pool.Put(&buf)
+}
@@ -0,0 +1,102 @@
+package api
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net/http"
+	"testing"
+)
+
+func TestBufferPool(t *testing.T) {
+	p := newBufferPool(1024)
+	buf := p.Get()
+	if len(buf) != 1024 {
+		t.Fatalf("buffer of %d bytes, want 1024", len(buf))
+	}
+
+	// A buffer of another size must never come back out
+	p.Put(make([]byte, 10))
+	p.Put(buf[:10])
+	for range 10 {
+		if got := p.Get(); len(got) != 1024 {
+			t.Fatalf("buffer of %d bytes after Puts, want 1024", len(got))
+		}
+	}
+
+	if got := len(newBufferPool(0).Get()); got != DefaultRelayBufferBytes {
+		t.Errorf("default buffer of %d bytes, want %d", got, DefaultRelayBufferBytes)
+	}
+}
+
+// payload returns n random bytes
+func payload(t testing.TB, n int) []byte {
+	t.Helper()
+	data := make([]byte, n)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestConnectRelaysLargePayload(t *testing.T) {
+	// Small buffers make the relay go round many times
+	ts := newTestServer(t, Config{RelayBufferBytes: 1024}, testKeys{})
+	conn, br := ts.dialConnect(t, ts.echoBackend(t))
+
+	data := payload(t, 2<<20)
+	go conn.Write(data)
+	got := make([]byte, len(data))
+	if _, err := io.ReadFull(br, got); err != nil {
+		t.Fatalf("reading echo: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("echoed payload differs from what was sent")
+	}
+}
+
+func TestProxyRelaysLargeBody(t *testing.T) {
+	ts := newTestServer(t, Config{RelayBufferBytes: 1024}, testKeys{})
+	data := payload(t, 2<<20)
+	created := ts.backend(t, "", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body)
+	}))
+
+	w := ts.proxy(t, created, http.MethodPost, "/", string(data))
+	if w.Code != http.StatusOK {
+		t.Fatalf("proxied request = %d", w.Code)
+	}
+	if !bytes.Equal(w.Body.Bytes(), data) {
+		t.Errorf("response of %d bytes differs from the %d byte request", w.Body.Len(), len(data))
+	}
+}
+
+// onlyReader and onlyWriter hide io.ReaderFrom and io.WriterTo so copies
+// go through the buffer
+type onlyReader struct{ io.Reader }
+type onlyWriter struct{ io.Writer }
+
+// BenchmarkRelayCopy compares allocating a buffer per relay, as io.Copy
+// does, with taking one from the pool
+func BenchmarkRelayCopy(b *testing.B) {
+	data := payload(b, 256<<10)
+
+	b.Run("unpooled", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(data)))
+		for range b.N {
+			io.Copy(onlyWriter{io.Discard}, onlyReader{bytes.NewReader(data)})
+		}
+	})
+
+	b.Run("pooled", func(b *testing.B) {
+		p := newBufferPool(DefaultRelayBufferBytes)
+		b.ReportAllocs()
+		b.SetBytes(int64(len(data)))
+		for range b.N {
+			buf := p.Get()
+			io.CopyBuffer(onlyWriter{io.Discard}, onlyReader{bytes.NewReader(data)}, buf)
+			p.Put(buf)
+		}
+	})
+}
@@ -0,0 +1,95 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// checkTimeout bounds a whole reachability check, dial included
+const checkTimeout = 5 * time.Second
+
+// CheckResponse is the result of a backend reachability check. Status is
+// the backend's response status; any answer, even an error page, counts
+// as reachable.
+type CheckResponse struct {
+	Reachable bool   `json:"reachable"`
+	Status    int    `json:"status,omitempty"`
+	LatencyMS int64  `json:"latency_ms"`
+	Error     string `json:"error,omitempty"`
+}
+
+// handleCheckTunnel sends a single GET / to the tunnel's backend through
+// the WireGuard network, so users can tell "tunnel up but nothing
+// listening" apart from problems on the public side
+func (s *Server) handleCheckTunnel(w http.ResponseWriter, r *http.Request) {
+	t := s.registry.GetTunnel(mux.Vars(r)["id"])
+	if t == nil || !s.canAccessTunnel(r, t) {
+		respondError(w, http.StatusNotFound, CodeTunnelNotFound, "Tunnel not found")
+		return
+	}
+	// A revoked tunnel's peer is gone; there is nothing to check
+	if !checkRevoked(w, t) {
+		return
+	}
+	if t.Port == 0 {
+		writeJSON(w, http.StatusOK, CheckResponse{Error: "no backend port set"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), checkTimeout)
+	defer cancel()
+	start := time.Now()
+
+	if t.BackendIsHostname() {
+		var err error
+		if t, err = s.resolveBackend(ctx, t); err != nil && t.ResolvedBackendIP == "" {
+			writeJSON(w, http.StatusOK, CheckResponse{
+				LatencyMS: time.Since(start).Milliseconds(),
+				Error:     "resolving backend: " + err.Error(),
+			})
+			return
+		}
+	}
+
+	// A fresh connection every time; a pooled or warm one would prove
+	// nothing about the backend now
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext:       s.tun.DialContext,
+			DisableKeepAlives: true,
+			TLSClientConfig:   backendTLSConfig(t),
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	scheme := "http"
+	if t.BackendTLS() {
+		scheme = "https"
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s://%s/", scheme, backendTarget(t)), nil)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, CodeInternal, "Failed to build check request")
+		return
+	}
+
+	resp, err := client.Do(req)
+	latency := time.Since(start).Milliseconds()
+	if err != nil {
+		writeJSON(w, http.StatusOK, CheckResponse{LatencyMS: latency, Error: err.Error()})
+		return
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+
+	writeJSON(w, http.StatusOK, CheckResponse{
+		Reachable: true,
+		Status:    resp.StatusCode,
+		LatencyMS: latency,
+	})
+}
@@ -0,0 +1,102 @@
+package api
+
+import (
+	"net"
+	"net/http"
+	"testing"
+)
+
+// check runs a reachability check of tunnel id
+func (ts *testServer) check(t *testing.T, id string) CheckResponse {
+	t.Helper()
+	w := ts.do(http.MethodGet, "", "/api/tunnel/"+id+"/check", "", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("check: %d %s", w.Code, w.Body)
+	}
+	var resp CheckResponse
+	decode(t, w, &resp)
+	return resp
+}
+
+func TestCheckReachableBackend(t *testing.T) {
+	ts := newTestServer(t, Config{}, testKeys{})
+	created := ts.createTunnel(t, "3000?include_config=true", "", "")
+	tnet := ts.connectPeer(t, created.ID, created.PrivateKey)
+
+	ln, err := tnet.ListenTCP(&net.TCPAddr{Port: 3000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})}
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Close() })
+
+	got := ts.check(t, created.ID)
+	if !got.Reachable || got.Status != http.StatusTeapot || got.Error != "" {
+		t.Errorf("check = %+v, want reachable with status %d", got, http.StatusTeapot)
+	}
+}
+
+func TestCheckBackendNotListening(t *testing.T) {
+	ts := newTestServer(t, Config{}, testKeys{})
+	created := ts.createTunnel(t, "3000?include_config=true", "", "")
+	ts.connectPeer(t, created.ID, created.PrivateKey)
+
+	got := ts.check(t, created.ID)
+	if got.Reachable || got.Status != 0 || got.Error == "" {
+		t.Errorf("check = %+v, want unreachable with an error", got)
+	}
+}
+
+func TestCheckRevokedTunnel(t *testing.T) {
+	ts := newTestServer(t, Config{}, testKeys{})
+	created := ts.createTunnel(t, "3000", "", "")
+	if _, _, err := ts.reg.RevokeTunnel(created.ID); err != nil {
+		t.Fatalf("RevokeTunnel: %v", err)
+	}
+
+	w := ts.do(http.MethodGet, "", "/api/tunnel/"+created.ID+"/check", "", "")
+	var resp ErrorResponse
+	decode(t, w, &resp)
+	if w.Code != http.StatusForbidden || resp.Code != CodeTunnelRevoked {
+		t.Errorf("check of a revoked tunnel = %d %s, want 403 %s", w.Code, resp.Code, CodeTunnelRevoked)
+	}
+}
+
+func TestCheckReportsRedirects(t *testing.T) {
+	ts := newTestServer(t, Config{}, testKeys{})
+	created := ts.backend(t, "", http.RedirectHandler("/login", http.StatusFound))
+
+	// The redirect is the backend's answer; following it could leave the
+	// tunnel
+	got := ts.check(t, created.ID)
+	if !got.Reachable || got.Status != http.StatusFound {
+		t.Errorf("check = %+v, want reachable with status %d", got, http.StatusFound)
+	}
+}
+
+func TestCheckWithoutPort(t *testing.T) {
+	ts := newTestServer(t, Config{}, testKeys{})
+	created := ts.createTunnel(t, "0", "", "")
+
+	got := ts.check(t, created.ID)
+	if got.Reachable || got.Error != "no backend port set" {
+		t.Errorf("check = %+v, want the missing port reported", got)
+	}
+}
+
+func TestCheckOtherKeysTunnel(t *testing.T) {
+	ts := newTestServer(t, Config{}, testKeys{api: []string{"key-a", "key-b"}})
+	created := ts.createTunnel(t, "3000", "key-a", "")
+
+	for _, id := range []string{created.ID, "missing"} {
+		w := ts.do(http.MethodGet, "", "/api/tunnel/"+id+"/check", "key-b", "")
+		var resp ErrorResponse
+		decode(t, w, &resp)
+		if w.Code != http.StatusNotFound || resp.Code != CodeTunnelNotFound {
+			t.Errorf("check of %s = %d %s, want 404 %s", id, w.Code, resp.Code, CodeTunnelNotFound)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/mr-karan/arbok/internal/tunnel"
+)
+
+// errContentBlocked is returned from ModifyResponse for responses with a
+// blocked content type; the proxy's error handler turns it into a 451
+var errContentBlocked = errors.New("content type is blocked")
+
+// checkContentType fails responses whose media type is in
+// BlockedContentTypes and flags their tunnel for review
+func (s *Server) checkContentType(t *tunnel.Info, resp *http.Response) error {
+	if len(s.cfg.BlockedContentTypes) == 0 {
+		return nil
+	}
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil {
+		return nil
+	}
+	if !contentTypeBlocked(s.cfg.BlockedContentTypes, mediaType) {
+		return nil
+	}
+
+	reason := fmt.Sprintf("served blocked content type %s", mediaType)
+	if _, err := s.registry.FlagTunnel(t.ID, reason); err != nil {
+		s.logger.Error("failed to flag tunnel", "error", err, "tunnel", t.ID)
+	}
+	return errContentBlocked
+}
+
+// contentTypeBlocked reports whether mediaType matches one of blocked,
+// either exactly or as "type/*"
+func contentTypeBlocked(blocked []string, mediaType string) bool {
+	major, _, _ := strings.Cut(mediaType, "/")
+	for _, b := range blocked {
+		if strings.EqualFold(b, mediaType) || strings.EqualFold(b, major+"/*") {
+			return true
+		}
+	}
+	return false
+}
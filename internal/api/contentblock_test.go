@@ -0,0 +1,48 @@
+package api
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestBlockedContentTypes(t *testing.T) {
+	ts := newTestServer(t, Config{BlockedContentTypes: []string{"application/x-msdownload", "audio/*"}}, testKeys{})
+	tun := ts.backend(t, "", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", r.URL.Query().Get("type"))
+		io.WriteString(w, "payload")
+	}))
+
+	for _, contentType := range []string{"text/html", "application/json", "application/octet-stream"} {
+		w := ts.proxy(t, tun, http.MethodGet, "/?type="+url.QueryEscape(contentType), "")
+		if w.Code != http.StatusOK || w.Body.String() != "payload" {
+			t.Errorf("%s = %d %q, want it passed through", contentType, w.Code, w.Body)
+		}
+	}
+	if ts.reg.GetTunnel(tun.ID).Flagged {
+		t.Fatal("tunnel flagged for allowed content")
+	}
+
+	for _, contentType := range []string{"application/x-msdownload", "Audio/MPEG; codecs=mp3"} {
+		w := ts.proxy(t, tun, http.MethodGet, "/?type="+url.QueryEscape(contentType), "")
+		var resp ErrorResponse
+		decode(t, w, &resp)
+		if w.Code != http.StatusUnavailableForLegalReasons || resp.Code != CodeContentBlocked {
+			t.Errorf("%s = %d %s, want 451 %s", contentType, w.Code, resp.Code, CodeContentBlocked)
+		}
+	}
+	if got := ts.reg.GetTunnel(tun.ID); !got.Flagged || got.FlagReason == "" {
+		t.Errorf("tunnel flagged = %v %q, want it flagged with a reason", got.Flagged, got.FlagReason)
+	}
+}
+
+func TestContentTypesAllowedByDefault(t *testing.T) {
+	ts := newTestServer(t, Config{}, testKeys{})
+	tun := ts.backend(t, "", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-msdownload")
+	}))
+	if w := ts.proxy(t, tun, http.MethodGet, "/", ""); w.Code != http.StatusOK {
+		t.Errorf("response = %d, want 200 with no blocklist", w.Code)
+	}
+}
@@ -0,0 +1,38 @@
+package api
+
+import (
+	"net/http"
+)
+
+// DiscoveryPath serves the server's public WireGuard parameters
+const DiscoveryPath = "/.well-known/arbok"
+
+// DiscoveryResponse is what clients need to build their own WireGuard
+// config. It holds no secrets.
+type DiscoveryResponse struct {
+	PublicKey  string `json:"public_key"`
+	Endpoint   string `json:"endpoint"`
+	ListenPort int    `json:"listen_port"`
+	CIDR       string `json:"cidr"`
+	Domain     string `json:"domain"`
+}
+
+// handleDiscovery returns the server's public key and WireGuard endpoint,
+// unauthenticated, so tooling doesn't have to scrape generated configs.
+// On a tunnel's hostname the path belongs to the tunnel's backend.
+func (s *Server) handleDiscovery(w http.ResponseWriter, r *http.Request) {
+	if subdomain, domain := s.splitHost(r.Host); subdomain != "" {
+		if t := s.registry.GetTunnelBySubdomain(subdomain, domain); t != nil {
+			s.handleTunnelProxy(w, r)
+			return
+		}
+	}
+
+	writeJSON(w, http.StatusOK, DiscoveryResponse{
+		PublicKey:  s.tun.GetPublicKey(),
+		Endpoint:   s.cfg.WireGuardEndpoint,
+		ListenPort: s.cfg.WireGuardPort,
+		CIDR:       s.tun.CIDR(),
+		Domain:     s.requestDomain(r),
+	})
+}
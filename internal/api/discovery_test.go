@@ -0,0 +1,45 @@
+package api
+
+import (
+	"io"
+	"net/http"
+	"testing"
+)
+
+func TestDiscovery(t *testing.T) {
+	ts := newTestServer(t, Config{
+		Domains:           []string{"example.com", "example.org"},
+		WireGuardEndpoint: "wg.example.com:51820",
+		WireGuardPort:     51820,
+	}, testKeys{api: []string{"key"}})
+
+	// Served without an API key, for whichever domain was asked
+	w := ts.do(http.MethodGet, "example.org", DiscoveryPath, "", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET %s = %d %s", DiscoveryPath, w.Code, w.Body)
+	}
+	var resp DiscoveryResponse
+	decode(t, w, &resp)
+	want := DiscoveryResponse{
+		PublicKey:  ts.tun.GetPublicKey(),
+		Endpoint:   "wg.example.com:51820",
+		ListenPort: 51820,
+		CIDR:       ts.tun.CIDR(),
+		Domain:     "example.org",
+	}
+	if resp != want {
+		t.Errorf("discovery = %+v, want %+v", resp, want)
+	}
+}
+
+func TestDiscoveryPathOnTunnelHost(t *testing.T) {
+	ts := newTestServer(t, Config{}, testKeys{})
+	created := ts.backend(t, "", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "backend "+r.URL.Path)
+	}))
+
+	w := ts.do(http.MethodGet, created.Subdomain+"."+ts.cfg.Domain, DiscoveryPath, "", "")
+	if w.Code != http.StatusOK || w.Body.String() != "backend "+DiscoveryPath {
+		t.Errorf("GET %s on the tunnel = %d %q, want the backend's", DiscoveryPath, w.Code, w.Body)
+	}
+}
@@ -0,0 +1,113 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/mr-karan/arbok/internal/apierror"
+)
+
+// ErrorCode identifies an API error. Codes are part of the API: clients
+// match on them, so they never change once released.
+type ErrorCode = apierror.Code
+
+// Request errors
+const (
+	CodeInvalidPort          ErrorCode = "INVALID_PORT"
+	CodeInvalidBody          ErrorCode = "INVALID_BODY"
+	CodeValidationFailed     ErrorCode = "VALIDATION_FAILED"
+	CodeInvalidHost          ErrorCode = "INVALID_HOST"
+	CodeInvalidSubdomain     ErrorCode = "INVALID_SUBDOMAIN"
+	CodeUnknownDomain        ErrorCode = "UNKNOWN_DOMAIN"
+	CodeInvalidLabelSelector ErrorCode = "INVALID_LABEL_SELECTOR"
+	CodeInvalidClientCA      ErrorCode = "INVALID_CLIENT_CA"
+	CodeInvalidPublicKey     ErrorCode = "INVALID_PUBLIC_KEY"
+	CodeInvalidBackendHost   ErrorCode = "INVALID_BACKEND_HOST"
+	CodeInvalidClientCIDR    ErrorCode = "INVALID_CLIENT_CIDR"
+	CodeInvalidDNSResolver   ErrorCode = "INVALID_DNS_RESOLVER"
+	CodeTLSNotEnabled        ErrorCode = "TLS_NOT_ENABLED"
+	CodeAPIKeyRequired       ErrorCode = apierror.CodeAPIKeyRequired
+	CodeInvalidAPIKey        ErrorCode = apierror.CodeInvalidAPIKey
+	CodeAdminRequired        ErrorCode = "ADMIN_REQUIRED"
+	CodeInvalidShareToken    ErrorCode = "INVALID_SHARE_TOKEN"
+	CodeSubdomainReserved    ErrorCode = "SUBDOMAIN_RESERVED"
+	CodeRateLimited          ErrorCode = "RATE_LIMITED"
+	CodeHeadersTooLarge      ErrorCode = "HEADERS_TOO_LARGE"
+)
+
+// Lookup errors
+const (
+	CodeTunnelNotFound    ErrorCode = "TUNNEL_NOT_FOUND"
+	CodeTunnelExpired     ErrorCode = "TUNNEL_EXPIRED"
+	CodeRequestNotFound   ErrorCode = "REQUEST_NOT_FOUND"
+	CodeInspectorDisabled ErrorCode = "INSPECTOR_DISABLED"
+	CodeBodyNotCaptured   ErrorCode = "BODY_NOT_CAPTURED"
+)
+
+// Proxy errors, returned to clients of tunnels
+const (
+	CodeTunnelRevoked      ErrorCode = "TUNNEL_REVOKED"
+	CodeClientNotAllowed   ErrorCode = "CLIENT_NOT_ALLOWED"
+	CodeTunnelRateLimited  ErrorCode = "TUNNEL_RATE_LIMITED"
+	CodeMethodNotAllowed   ErrorCode = "METHOD_NOT_ALLOWED"
+	CodeClientCertRequired ErrorCode = "CLIENT_CERT_REQUIRED"
+	CodeRequestRejected    ErrorCode = "REQUEST_REJECTED"
+	CodeLoopDetected       ErrorCode = "LOOP_DETECTED"
+	CodeBackendUnresolved  ErrorCode = "BACKEND_UNRESOLVED"
+	CodeBackendUnavailable ErrorCode = "BACKEND_UNAVAILABLE"
+	CodeBackendTimeout     ErrorCode = "BACKEND_TIMEOUT"
+	CodeBackendError       ErrorCode = "BACKEND_ERROR"
+	CodeServerBusy         ErrorCode = "SERVER_BUSY"
+	CodeContentBlocked     ErrorCode = "CONTENT_BLOCKED"
+	CodeBackendPortUnset   ErrorCode = "BACKEND_PORT_UNSET"
+)
+
+// Server errors
+const (
+	CodePeerAddFailed      ErrorCode = "PEER_ADD_FAILED"
+	CodeTunnelCreateFailed ErrorCode = "TUNNEL_CREATE_FAILED"
+	CodeDeleteFailed       ErrorCode = "DELETE_FAILED"
+	CodeRevokeFailed       ErrorCode = "REVOKE_FAILED"
+	CodeReservationFailed  ErrorCode = "RESERVATION_FAILED"
+	CodeReconcileFailed    ErrorCode = "RECONCILE_FAILED"
+	CodeWireGuardUnhealthy ErrorCode = "WIREGUARD_UNHEALTHY"
+	CodeInternal           ErrorCode = apierror.CodeInternal
+)
+
+// ErrorResponse represents an API error response
+type ErrorResponse = apierror.Response
+
+// respondError writes an error response
+func respondError(w http.ResponseWriter, status int, code ErrorCode, message string) {
+	apierror.Write(w, status, code, message)
+}
+
+// respondErrorDetails writes an error response with details, such as the
+// validation error, for the client to act on
+func respondErrorDetails(w http.ResponseWriter, status int, code ErrorCode, message string, details any) {
+	apierror.WriteDetails(w, status, code, message, details)
+}
+
+// respondValidationError writes a 400 listing the fields err, a
+// ValidationError, names. Other errors are reported as a string.
+func respondValidationError(w http.ResponseWriter, err error) {
+	var details any = err.Error()
+	var verr ValidationError
+	if errors.As(err, &verr) {
+		details = []FieldError(verr)
+	}
+	respondErrorDetails(w, http.StatusBadRequest, CodeValidationFailed, "Invalid request", details)
+}
+
+// respondPlainError writes an error for curl-friendly endpoints, whose
+// responses are text/plain: the message as the body and the code in
+// X-Arbok-Error-Code. Clients that accept JSON get an ErrorResponse.
+func respondPlainError(w http.ResponseWriter, r *http.Request, status int, code ErrorCode, message string) {
+	if strings.Contains(r.Header.Get("Accept"), "application/json") {
+		respondError(w, status, code, message)
+		return
+	}
+	w.Header().Set("X-Arbok-Error-Code", string(code))
+	http.Error(w, message, status)
+}
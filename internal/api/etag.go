@@ -0,0 +1,39 @@
+package api
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"strings"
+
+	"github.com/mr-karan/arbok/internal/apikey"
+	"github.com/mr-karan/arbok/internal/auth"
+)
+
+// listETag returns a weak ETag for a tunnel list read at the given
+// registry version. The request's path, query and API key are mixed in, as
+// they pick which tunnels are listed. It is weak because countdown fields
+// such as ttl_seconds keep moving without a version change; clients should
+// count down from expires_at instead.
+func listETag(r *http.Request, version uint64) string {
+	h := fnv.New64a()
+	key, _ := auth.GetAPIKey(r.Context())
+	fmt.Fprintf(h, "%d\x00%s\x00%s\x00%s", version, r.URL.Path, r.URL.RawQuery, apikey.ID(key))
+	return fmt.Sprintf(`W/"%016x"`, h.Sum64())
+}
+
+// etagMatches reports whether an If-None-Match header lists etag, using
+// the weak comparison RFC 9110 prescribes for If-None-Match
+func etagMatches(header, etag string) bool {
+	if header == "" {
+		return false
+	}
+	want := strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == want {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,76 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// getList fetches a tunnel list with If-None-Match set to etag
+func (ts *testServer) getList(target, key, etag string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, target, nil)
+	r.Host = ts.cfg.Domain
+	r.Header.Set("X-API-Key", key)
+	if etag != "" {
+		r.Header.Set("If-None-Match", etag)
+	}
+	w := httptest.NewRecorder()
+	ts.router.ServeHTTP(w, r)
+	return w
+}
+
+func TestListETag(t *testing.T) {
+	ts := newTestServer(t, Config{}, testKeys{api: []string{"key-a", "key-b"}, admin: []string{"admin"}})
+	created := ts.createTunnel(t, "3000", "key-a", "")
+
+	w := ts.getList("/api/tunnels", "admin", "")
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || etag == "" {
+		t.Fatalf("list = %d with ETag %q", w.Code, etag)
+	}
+	if w := ts.getList("/api/tunnels", "admin", etag); w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Errorf("unchanged list = %d %q, want an empty 304", w.Code, w.Body)
+	}
+
+	// Other queries and other keys' lists don't share the ETag
+	for _, tc := range []struct{ target, key string }{
+		{"/api/tunnels?label=env:prod", "admin"},
+		{"/api/my/tunnels", "key-a"},
+		{"/api/my/tunnels", "key-b"},
+	} {
+		if w := ts.getList(tc.target, tc.key, etag); w.Code != http.StatusOK {
+			t.Errorf("%s as %s with another list's ETag = %d, want 200", tc.target, tc.key, w.Code)
+		}
+	}
+
+	// Every change gives the list a new ETag
+	for _, change := range []func(){
+		func() { ts.createTunnel(t, "3001", "key-b", "") },
+		func() { ts.do(http.MethodPut, "", "/api/tunnel/"+created.ID, "key-a", `{"description":"demo"}`) },
+		func() { ts.do(http.MethodDelete, "", "/api/tunnel/"+created.ID, "key-a", "") },
+	} {
+		change()
+		w := ts.getList("/api/tunnels", "admin", etag)
+		if w.Code != http.StatusOK || w.Header().Get("ETag") == etag {
+			t.Fatalf("changed list = %d with ETag %q, want 200 and a new ETag", w.Code, w.Header().Get("ETag"))
+		}
+		etag = w.Header().Get("ETag")
+	}
+}
+
+func TestETagMatches(t *testing.T) {
+	const etag = `W/"abc"`
+	for header, want := range map[string]bool{
+		"":                  false,
+		`W/"abc"`:           true,
+		`"abc"`:             true,
+		`"xyz", W/"abc"`:    true,
+		"*":                 true,
+		`"abcd"`:            false,
+		`W/"xyz",  "other"`: false,
+	} {
+		if got := etagMatches(header, etag); got != want {
+			t.Errorf("etagMatches(%q) = %v, want %v", header, got, want)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package api
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/mr-karan/arbok/internal/registry"
+	"github.com/mr-karan/arbok/internal/tunnel"
+)
+
+// eventsKeepAlive is how often an idle event stream gets a comment line,
+// so proxies in between don't time it out
+const eventsKeepAlive = 15 * time.Second
+
+// eventStream writes server-sent events to a client
+type eventStream struct {
+	w  http.ResponseWriter
+	rc *http.ResponseController
+}
+
+// startEventStream sends the headers of a server-sent event stream
+func startEventStream(w http.ResponseWriter) (*eventStream, error) {
+	rc := http.NewResponseController(w)
+	// Streams outlive the server's write timeout
+	rc.SetWriteDeadline(time.Time{})
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	return &eventStream{w: w, rc: rc}, rc.Flush()
+}
+
+// send writes one event. Events that can't be encoded are skipped.
+func (es *eventStream) send(e registry.Event) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return nil
+	}
+	if _, err := fmt.Fprintf(es.w, "event: %s\ndata: %s\n\n", e.Type, data); err != nil {
+		return err
+	}
+	return es.rc.Flush()
+}
+
+// keepAlive writes a comment line
+func (es *eventStream) keepAlive() error {
+	if _, err := fmt.Fprint(es.w, ": keep-alive\n\n"); err != nil {
+		return err
+	}
+	return es.rc.Flush()
+}
+
+// handleEvents streams tunnel lifecycle events as server-sent events.
+// Admins see every tunnel's events, other keys only their own tunnels';
+// server-wide events such as server_shutting_down go to everyone. The
+// stream ends after the shutdown event.
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	admin := s.auth.IsAdmin(r.Context())
+	owner := ownerID(r)
+	visible := func(e registry.Event) bool {
+		if admin || e.TunnelID == "" {
+			return true
+		}
+		return owner != "" && subtle.ConstantTimeCompare([]byte(owner), []byte(e.OwnerID)) == 1
+	}
+
+	sub := s.registry.Events().Subscribe()
+	defer sub.Close()
+
+	stream, err := startEventStream(w)
+	if err != nil {
+		return
+	}
+
+	keepAlive := time.NewTicker(eventsKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			if err := stream.keepAlive(); err != nil {
+				return
+			}
+		case e, ok := <-sub.C:
+			if !ok {
+				return
+			}
+			if !visible(e) {
+				continue
+			}
+			if err := stream.send(e); err != nil || e.Type == registry.EventServerShuttingDown {
+				return
+			}
+		}
+	}
+}
+
+// handleTunnelEvents streams every event of one tunnel as server-sent
+// events: its lifecycle, traffic, backend health, recorded requests and a
+// warning once it is about to expire, plus server-wide events. Owners,
+// admins and share tokens for the tunnel may watch. The stream ends when
+// the tunnel goes away or the server shuts down.
+func (s *Server) handleTunnelEvents(w http.ResponseWriter, r *http.Request) {
+	t := s.registry.GetTunnel(mux.Vars(r)["id"])
+	if t == nil || !s.canAccessTunnel(r, t) {
+		respondError(w, http.StatusNotFound, CodeTunnelNotFound, "Tunnel not found")
+		return
+	}
+
+	sub := s.registry.Events().SubscribeTunnel(t.ID)
+	defer sub.Close()
+
+	stream, err := startEventStream(w)
+	if err != nil {
+		return
+	}
+
+	keepAlive := time.NewTicker(eventsKeepAlive)
+	defer keepAlive.Stop()
+	expiring := time.NewTimer(max(t.TTL()-s.cfg.ExpiryWarningThreshold, 0))
+	defer expiring.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			if err := stream.keepAlive(); err != nil {
+				return
+			}
+		case <-expiring.C:
+			if t.Revoked {
+				continue
+			}
+			if err := stream.send(expiringEvent(t)); err != nil {
+				return
+			}
+		case e, ok := <-sub.C:
+			if !ok {
+				return
+			}
+			if err := stream.send(e); err != nil {
+				return
+			}
+			switch e.Type {
+			case registry.EventTunnelDeleted, registry.EventTunnelExpired, registry.EventServerShuttingDown:
+				return
+			}
+		}
+	}
+}
+
+// expiringEvent warns that t expires soon
+func expiringEvent(t *tunnel.Info) registry.Event {
+	ttl := max(t.TTL(), 0)
+	event := registry.TunnelEvent(registry.EventTunnelExpiring, t)
+	event.Message = fmt.Sprintf("tunnel expires in %s", ttl.Round(time.Second))
+	event.Data = map[string]any{
+		"expires_at":  t.ExpiresAt.UTC(),
+		"ttl_seconds": int64(ttl.Seconds()),
+	}
+	return event
+}
@@ -0,0 +1,178 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mr-karan/arbok/internal/registry"
+)
+
+// eventClient reads a server-sent event stream
+type eventClient struct {
+	br *bufio.Reader
+}
+
+// openEvents opens the event stream at path with key. The server is
+// subscribed by the time it returns.
+func (ts *testServer) openEvents(t *testing.T, srv *httptest.Server, path, key string) *eventClient {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(cancel)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = ts.cfg.Domain
+	req.Header.Set("X-API-Key", key)
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("GET %s = %d %s", path, resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	return &eventClient{br: bufio.NewReader(resp.Body)}
+}
+
+// next returns the next event, skipping keep-alives. It returns io.EOF
+// once the server ended the stream.
+func (c *eventClient) next() (registry.Event, error) {
+	var e registry.Event
+	var name string
+	for {
+		line, err := c.br.ReadString('\n')
+		if err != nil {
+			return e, err
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case strings.HasPrefix(line, "event: "):
+			name = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &e); err != nil {
+				return e, err
+			}
+		case line == "" && name != "":
+			if name != e.Type {
+				return e, errors.New("event name " + name + " doesn't match data " + e.Type)
+			}
+			return e, nil
+		}
+	}
+}
+
+// mustNext is next failing the test on errors
+func (c *eventClient) mustNext(t *testing.T) registry.Event {
+	t.Helper()
+	e, err := c.next()
+	if err != nil {
+		t.Fatalf("reading event: %v", err)
+	}
+	return e
+}
+
+// expectEnd checks that the server ended the stream
+func (c *eventClient) expectEnd(t *testing.T) {
+	t.Helper()
+	if e, err := c.next(); err != io.EOF {
+		t.Errorf("stream continued with %+v, %v, want it ended", e, err)
+	}
+}
+
+func TestEventsScopedToOwnerAndEndOnShutdown(t *testing.T) {
+	ts := newTestServer(t, Config{}, testKeys{api: []string{"key-a", "key-b"}, admin: []string{"admin"}})
+	srv := httptest.NewServer(ts.router)
+	defer srv.Close()
+
+	mine := ts.openEvents(t, srv, "/api/events", "key-a")
+	all := ts.openEvents(t, srv, "/api/events", "admin")
+
+	other := ts.createTunnel(t, "3000", "key-b", "")
+	created := ts.createTunnel(t, "3000", "key-a", "")
+
+	if e := mine.mustNext(t); e.Type != registry.EventTunnelCreated || e.TunnelID != created.ID {
+		t.Errorf("key-a got %s of %s, want only its own %s", e.Type, e.TunnelID, created.ID)
+	}
+	for _, id := range []string{other.ID, created.ID} {
+		if e := all.mustNext(t); e.Type != registry.EventTunnelCreated || e.TunnelID != id {
+			t.Errorf("admin got %s of %s, want %s of %s", e.Type, e.TunnelID, registry.EventTunnelCreated, id)
+		}
+	}
+
+	// Everyone is warned of the shutdown, then the stream ends
+	ts.reg.Events().Publish(registry.Event{Type: registry.EventServerShuttingDown, Message: "bye"})
+	for _, c := range []*eventClient{mine, all} {
+		if e := c.mustNext(t); e.Type != registry.EventServerShuttingDown || e.Message != "bye" {
+			t.Errorf("got %s %q, want %s", e.Type, e.Message, registry.EventServerShuttingDown)
+		}
+		c.expectEnd(t)
+	}
+}
+
+func TestTunnelEventsEndOnDelete(t *testing.T) {
+	ts := newTestServer(t, Config{}, testKeys{api: []string{"key-a", "key-b"}})
+	srv := httptest.NewServer(ts.router)
+	defer srv.Close()
+	created := ts.createTunnel(t, "3000", "key-a", "")
+	other := ts.createTunnel(t, "3001", "key-a", "")
+
+	if w := ts.do(http.MethodGet, "", "/api/tunnel/"+created.ID+"/events", "key-b", ""); w.Code != http.StatusNotFound {
+		t.Errorf("another key's tunnel events = %d, want 404", w.Code)
+	}
+
+	events := ts.openEvents(t, srv, "/api/tunnel/"+created.ID+"/events", "key-a")
+	if err := ts.reg.DeleteTunnel(other.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := ts.reg.DeleteTunnel(created.ID); err != nil {
+		t.Fatal(err)
+	}
+	if e := events.mustNext(t); e.Type != registry.EventTunnelDeleted || e.TunnelID != created.ID {
+		t.Errorf("got %s of %s, want only the tunnel's own deletion", e.Type, e.TunnelID)
+	}
+	events.expectEnd(t)
+}
+
+func TestTunnelEventsReportRequests(t *testing.T) {
+	ts := newTestServer(t, Config{InspectRequests: 10, DialTimeout: 50 * time.Millisecond}, testKeys{})
+	srv := httptest.NewServer(ts.router)
+	// Closed after the streams, which end when their requests are canceled
+	t.Cleanup(srv.Close)
+	up := ts.backend(t, "", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	down := ts.createTunnel(t, "3000", "", "")
+
+	upEvents := ts.openEvents(t, srv, "/api/tunnel/"+up.ID+"/events", "")
+	downEvents := ts.openEvents(t, srv, "/api/tunnel/"+down.ID+"/events", "")
+	ts.proxy(t, up, http.MethodGet, "/hello", "")
+	ts.proxy(t, down, http.MethodGet, "/", "")
+
+	e := upEvents.mustNext(t)
+	captured, _ := e.Data.(map[string]any)
+	if e.Type != registry.EventRequestCaptured || e.TunnelID != up.ID || captured["uri"] != "/hello" || captured["status"] != float64(http.StatusOK) {
+		t.Errorf("got %s of %s with %+v, want %s of /hello", e.Type, e.TunnelID, e.Data, registry.EventRequestCaptured)
+	}
+
+	// The unreachable backend's stream reports its health turning bad
+	var health *registry.Event
+	for range 3 {
+		if e := downEvents.mustNext(t); e.Type == registry.EventTunnelHealth {
+			health = &e
+			break
+		}
+	}
+	if health == nil || health.TunnelID != down.ID {
+		t.Fatalf("no %s event for the unreachable backend", registry.EventTunnelHealth)
+	}
+	if data, _ := health.Data.(map[string]any); data["healthy"] != false {
+		t.Errorf("health event data = %v, want unhealthy", health.Data)
+	}
+}
@@ -0,0 +1,70 @@
+package api
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/mr-karan/arbok/internal/tunnel"
+)
+
+// handleExport streams a ZIP archive with the WireGuard config of every
+// active tunnel, one <subdomain>.conf per tunnel, for disaster recovery.
+// Tunnels created with a client public key export with the private key
+// placeholder, as the server never had their key.
+func (s *Server) handleExport(w http.ResponseWriter, r *http.Request) {
+	var tunnels []*tunnel.Info
+	for _, t := range s.registry.ListTunnels() {
+		if !t.Revoked && !t.IsExpired() {
+			tunnels = append(tunnels, t)
+		}
+	}
+	sort.Slice(tunnels, func(i, j int) bool {
+		return tunnels[i].Hostname() < tunnels[j].Hostname()
+	})
+
+	filename := fmt.Sprintf("arbok-tunnels-%s.zip", time.Now().UTC().Format("20060102T150405Z"))
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+	w.WriteHeader(http.StatusOK)
+
+	if err := s.writeExport(w, tunnels); err != nil {
+		// Headers are gone, so all we can do is cut the archive short
+		s.logger.Error("failed to export tunnels", "error", err)
+	}
+}
+
+// writeExport writes tunnels' configs to w as a ZIP archive, one entry at
+// a time so nothing but the current config is held in memory
+func (s *Server) writeExport(w io.Writer, tunnels []*tunnel.Info) error {
+	zw := zip.NewWriter(w)
+
+	// Subdomains are only unique per domain; fall back to the hostname
+	// when the same one is served under several
+	seen := make(map[string]int, len(tunnels))
+	for _, t := range tunnels {
+		seen[t.Subdomain]++
+	}
+
+	for _, t := range tunnels {
+		name := t.Subdomain + ".conf"
+		if seen[t.Subdomain] > 1 {
+			name = t.Hostname() + ".conf"
+		}
+		entry, err := zw.CreateHeader(&zip.FileHeader{
+			Name:     name,
+			Method:   zip.Deflate,
+			Modified: t.CreatedAt,
+		})
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(entry, s.generateWireGuardConfig(t)); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
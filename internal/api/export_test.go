@@ -0,0 +1,87 @@
+package api
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/mr-karan/arbok/internal/registry"
+)
+
+func TestExportZipsActiveConfigs(t *testing.T) {
+	ts := newTestServer(t, Config{Domains: []string{"example.com", "example.org"}, Domain: "example.com"}, testKeys{})
+	// Each tunnel gets its name from a reservation of its own owner
+	create := func(subdomain string, opts registry.CreateOptions) string {
+		t.Helper()
+		opts.OwnerID = subdomain + "@" + opts.Domain
+		if err := ts.reg.Reserve(opts.OwnerID, subdomain, opts.Domain); err != nil {
+			t.Fatalf("Reserve: %v", err)
+		}
+		info, err := ts.reg.CreateTunnel(3000, opts)
+		if err != nil {
+			t.Fatalf("CreateTunnel: %v", err)
+		}
+		return info.ID
+	}
+	create("app", registry.CreateOptions{})
+	create("app", registry.CreateOptions{Domain: "example.org"})
+	create("solo", registry.CreateOptions{})
+	_, pub, err := registry.NewWireGuardKeyGenerator(nil).Generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	create("client-key", registry.CreateOptions{ClientPublicKey: pub})
+	if _, _, err := ts.reg.RevokeTunnel(create("revoked", registry.CreateOptions{})); err != nil {
+		t.Fatal(err)
+	}
+
+	w := ts.do(http.MethodGet, "", "/api/admin/export", "", "")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/zip" {
+		t.Fatalf("export = %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	if cd := w.Header().Get("Content-Disposition"); !strings.HasPrefix(cd, `attachment; filename="arbok-tunnels-`) {
+		t.Errorf("Content-Disposition = %q", cd)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if err != nil {
+		t.Fatalf("reading archive: %v", err)
+	}
+	configs := make(map[string]string)
+	var names []string
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(rc)
+		rc.Close()
+		names = append(names, f.Name)
+		configs[f.Name] = string(data)
+	}
+
+	want := "app.example.com.conf,app.example.org.conf,client-key.conf,solo.conf"
+	if strings.Join(names, ",") != want {
+		t.Errorf("archive entries = %v, want %s", names, want)
+	}
+	if !strings.Contains(configs["solo.conf"], "PublicKey = "+ts.tun.GetPublicKey()) ||
+		strings.Contains(configs["solo.conf"], privateKeyPlaceholder) {
+		t.Errorf("solo.conf lacks the server key or holds a placeholder:\n%s", configs["solo.conf"])
+	}
+	if !strings.Contains(configs["client-key.conf"], "PrivateKey = "+privateKeyPlaceholder) {
+		t.Errorf("client-key.conf lacks the private key placeholder:\n%s", configs["client-key.conf"])
+	}
+}
+
+func TestExportNeedsAdminKey(t *testing.T) {
+	ts := newTestServer(t, Config{}, testKeys{api: []string{"user"}, admin: []string{"admin"}})
+	if w := ts.do(http.MethodGet, "", "/api/admin/export", "user", ""); w.Code != http.StatusForbidden {
+		t.Errorf("export with a user key = %d, want 403", w.Code)
+	}
+	if w := ts.do(http.MethodGet, "", "/api/admin/export", "admin", ""); w.Code != http.StatusOK {
+		t.Errorf("export with an admin key = %d, want 200", w.Code)
+	}
+}
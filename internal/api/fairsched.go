@@ -0,0 +1,148 @@
+package api
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mr-karan/arbok/internal/tunnel"
+)
+
+// Defaults for fair scheduling
+const (
+	DefaultMaxInFlight      = 256
+	DefaultFairQueueTimeout = 30 * time.Second
+)
+
+// fairScheduler bounds the requests proxied at once across all tunnels.
+// While every slot is busy, waiting requests queue per tunnel and freed
+// slots go to the tunnels in turn, so a tunnel flooding the server only
+// slows itself down instead of everyone else.
+type fairScheduler struct {
+	mu   sync.Mutex
+	free int
+	// queues holds each tunnel's waiters in arrival order; ring is the
+	// round-robin order of tunnels with waiters, next the one served next
+	queues map[string][]chan struct{}
+	ring   []string
+	next   int
+}
+
+func newFairScheduler(slots int) *fairScheduler {
+	return &fairScheduler{free: slots, queues: make(map[string][]chan struct{})}
+}
+
+// acquire takes a slot for a request to tunnel key, waiting for its turn
+// until ctx is done
+func (f *fairScheduler) acquire(ctx context.Context, key string) error {
+	f.mu.Lock()
+	if f.free > 0 && len(f.ring) == 0 {
+		f.free--
+		f.mu.Unlock()
+		return nil
+	}
+	ch := make(chan struct{})
+	if len(f.queues[key]) == 0 {
+		f.ring = append(f.ring, key)
+	}
+	f.queues[key] = append(f.queues[key], ch)
+	f.mu.Unlock()
+
+	select {
+	case <-ch:
+		return nil
+	case <-ctx.Done():
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	select {
+	case <-ch:
+		// Granted as we gave up; pass the slot on
+		f.releaseLocked()
+	default:
+		f.removeLocked(key, ch)
+	}
+	return ctx.Err()
+}
+
+// release frees a slot, handing it to the next tunnel in turn. A nil
+// scheduler does nothing.
+func (f *fairScheduler) release() {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.releaseLocked()
+}
+
+func (f *fairScheduler) releaseLocked() {
+	if len(f.ring) == 0 {
+		f.free++
+		return
+	}
+	if f.next >= len(f.ring) {
+		f.next = 0
+	}
+	key := f.ring[f.next]
+	queue := f.queues[key]
+	close(queue[0])
+	if len(queue) == 1 {
+		delete(f.queues, key)
+		f.ring = append(f.ring[:f.next], f.ring[f.next+1:]...)
+		return
+	}
+	f.queues[key] = queue[1:]
+	f.next++
+}
+
+// removeLocked drops a waiter that gave up
+func (f *fairScheduler) removeLocked(key string, ch chan struct{}) {
+	queue := f.queues[key]
+	for i, c := range queue {
+		if c != ch {
+			continue
+		}
+		queue = append(queue[:i], queue[i+1:]...)
+		break
+	}
+	if len(queue) > 0 {
+		f.queues[key] = queue
+		return
+	}
+	delete(f.queues, key)
+	for i, k := range f.ring {
+		if k != key {
+			continue
+		}
+		f.ring = append(f.ring[:i], f.ring[i+1:]...)
+		if i < f.next {
+			f.next--
+		}
+		break
+	}
+}
+
+// admit waits for the request's turn under fair scheduling. Requests that
+// wait longer than the queue timeout get a 503 with Retry-After. It
+// reports whether to continue; the caller then releases the slot.
+func (s *Server) admit(w http.ResponseWriter, r *http.Request, t *tunnel.Info) bool {
+	if s.scheduler == nil {
+		return true
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), s.cfg.FairQueueTimeout)
+	defer cancel()
+	if err := s.scheduler.acquire(ctx, t.ID); err != nil {
+		s.metrics.FairQueueTimeouts.Inc()
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(s.cfg.FairQueueTimeout.Seconds()))))
+		respondError(w, http.StatusServiceUnavailable, CodeServerBusy, "Server is busy, retry later")
+		return false
+	}
+	return true
+}
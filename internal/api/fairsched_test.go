@@ -0,0 +1,215 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// waitQueued waits until key has n waiters queued
+func waitQueued(t *testing.T, f *fairScheduler, key string, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		f.mu.Lock()
+		queued := len(f.queues[key])
+		f.mu.Unlock()
+		if queued == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d requests queued for %s, want %d", queued, key, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestFairSchedulerSharesSlotsBetweenTunnels(t *testing.T) {
+	f := newFairScheduler(1)
+	if err := f.acquire(context.Background(), "busy"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A flood from one tunnel queues ahead of a few requests from another
+	const busy, quiet = 40, 5
+	var mu sync.Mutex
+	var order []string
+	var wg sync.WaitGroup
+	enqueue := func(key string, n int) {
+		for range n {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := f.acquire(context.Background(), key); err != nil {
+					t.Error(err)
+					return
+				}
+				mu.Lock()
+				order = append(order, key)
+				mu.Unlock()
+				f.release()
+			}()
+		}
+		waitQueued(t, f, key, n)
+	}
+	enqueue("busy", busy)
+	enqueue("quiet", quiet)
+
+	f.release()
+	wg.Wait()
+
+	// Slots alternate between the tunnels, so the quiet one is done
+	// within twice its own number of requests
+	served := 0
+	for _, key := range order[:2*quiet] {
+		if key == "quiet" {
+			served++
+		}
+	}
+	if served != quiet {
+		t.Errorf("quiet tunnel got %d of the first %d slots, want %d: %v", served, 2*quiet, quiet, order)
+	}
+}
+
+func TestConnectWaitsForFairShare(t *testing.T) {
+	ts := newTestServer(t, Config{
+		FairScheduling:   true,
+		MaxInFlight:      1,
+		FairQueueTimeout: 10 * time.Millisecond,
+	}, testKeys{})
+	created := ts.createTunnel(t, "3000", "", "")
+	host := created.Subdomain + "." + ts.cfg.Domain
+
+	// Another request holds the only slot
+	if err := ts.scheduler.acquire(context.Background(), "other"); err != nil {
+		t.Fatal(err)
+	}
+	defer ts.scheduler.release()
+
+	w := ts.connect(host)
+	var errResp ErrorResponse
+	decode(t, w, &errResp)
+	if w.Code != http.StatusServiceUnavailable || errResp.Code != CodeServerBusy {
+		t.Errorf("CONNECT on a saturated server = %d %s, want 503 %s", w.Code, errResp.Code, CodeServerBusy)
+	}
+}
+
+func TestWebSocketWaitsForFairShare(t *testing.T) {
+	ts := newTestServer(t, Config{
+		FairScheduling:   true,
+		MaxInFlight:      1,
+		FairQueueTimeout: 10 * time.Millisecond,
+	}, testKeys{})
+	created := ts.createTunnel(t, "3000", "", "")
+
+	// Another request holds the only slot
+	if err := ts.scheduler.acquire(context.Background(), "other"); err != nil {
+		t.Fatal(err)
+	}
+	defer ts.scheduler.release()
+
+	r := httptest.NewRequest(http.MethodGet, "/socket", nil)
+	r.Host = created.Subdomain + "." + ts.cfg.Domain
+	r.Header.Set("Upgrade", "websocket")
+	r.Header.Set("Connection", "Upgrade")
+	w := httptest.NewRecorder()
+	ts.proxyHandler().ServeHTTP(w, r)
+	var errResp ErrorResponse
+	decode(t, w, &errResp)
+	if w.Code != http.StatusServiceUnavailable || errResp.Code != CodeServerBusy {
+		t.Errorf("upgrade on a saturated server = %d %s, want 503 %s", w.Code, errResp.Code, CodeServerBusy)
+	}
+}
+
+func TestWebSocketReleasesFairShareOnceUpgraded(t *testing.T) {
+	ts := newTestServer(t, Config{
+		FairScheduling:   true,
+		MaxInFlight:      1,
+		FairQueueTimeout: 100 * time.Millisecond,
+	}, testKeys{})
+	created := ts.backend(t, "", upgradeEchoBackend())
+	srv := httptest.NewServer(ts.proxyHandler())
+	t.Cleanup(srv.Close)
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	r := httptest.NewRequest(http.MethodGet, "/socket", nil)
+	r.Host = created.Subdomain + "." + ts.cfg.Domain
+	upgradeHeaders(r.Header)
+	r.Write(conn)
+	if resp, err := http.ReadResponse(bufio.NewReader(conn), r); err != nil || resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("upgrade = %v, %v", resp, err)
+	}
+
+	// The open socket leaves the only slot to other requests
+	if w := ts.proxy(t, created, http.MethodGet, "/", ""); w.Code != http.StatusOK {
+		t.Errorf("request beside an open WebSocket = %d %s, want 200", w.Code, w.Body)
+	}
+}
+
+func TestFairSchedulerWaiterGivesUp(t *testing.T) {
+	f := newFairScheduler(1)
+	if err := f.acquire(context.Background(), "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() { errc <- f.acquire(ctx, "b") }()
+	waitQueued(t, f, "b", 1)
+	cancel()
+	if err := <-errc; err != context.Canceled {
+		t.Fatalf("acquire = %v, want %v", err, context.Canceled)
+	}
+
+	// The waiter left no trace, and the slot comes back when released
+	f.mu.Lock()
+	queued, ring := len(f.queues), len(f.ring)
+	f.mu.Unlock()
+	if queued != 0 || ring != 0 {
+		t.Errorf("%d queues and %d tunnels in the ring after giving up, want none", queued, ring)
+	}
+	f.release()
+	if err := f.acquire(context.Background(), "c"); err != nil {
+		t.Errorf("acquire after release = %v", err)
+	}
+}
+
+func TestProxyWaitsForFairShare(t *testing.T) {
+	ts := newTestServer(t, Config{
+		FairScheduling:   true,
+		MaxInFlight:      1,
+		FairQueueTimeout: 100 * time.Millisecond,
+	}, testKeys{})
+	tun := ts.backend(t, "", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	if err := ts.scheduler.acquire(context.Background(), "other"); err != nil {
+		t.Fatal(err)
+	}
+
+	w := ts.proxy(t, tun, http.MethodGet, "/", "")
+	var errResp ErrorResponse
+	decode(t, w, &errResp)
+	if w.Code != http.StatusServiceUnavailable || errResp.Code != CodeServerBusy {
+		t.Fatalf("request on a saturated server = %d %s, want 503 %s", w.Code, errResp.Code, CodeServerBusy)
+	}
+	if got := w.Header().Get("Retry-After"); got != "1" {
+		t.Errorf("Retry-After = %q, want the queue timeout rounded up", got)
+	}
+
+	// Once the slot is free the request goes through, and gives it back
+	ts.scheduler.release()
+	for range 2 {
+		if w := ts.proxy(t, tun, http.MethodGet, "/", ""); w.Code != http.StatusOK {
+			t.Fatalf("request = %d %s, want 200", w.Code, w.Body)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/mr-karan/arbok/internal/tunnel"
+)
+
+// isTrustedProxy reports whether the request's direct peer is one of the
+// configured trusted proxies
+func (s *Server) isTrustedProxy(r *http.Request) bool {
+	if len(s.cfg.TrustedProxies) == 0 {
+		return false
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, network := range s.cfg.TrustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// headerForwardedSNI carries the TLS server name the client asked for, so
+// multi-tenant backends can route on it
+const headerForwardedSNI = "X-Forwarded-SNI"
+
+// forwardedSNI returns the TLS server name the client sent: from the
+// connection with native TLS, or from a trusted proxy that terminated
+// TLS. It's empty for plain HTTP and clients that sent no SNI.
+func (s *Server) forwardedSNI(r *http.Request) string {
+	if r.TLS != nil {
+		return r.TLS.ServerName
+	}
+	if s.isTrustedProxy(r) {
+		return r.Header.Get(headerForwardedSNI)
+	}
+	return ""
+}
+
+// Headers describing the client certificate presented over native TLS,
+// for backends that identify clients by it
+const (
+	headerClientCertSubject     = "X-Client-Cert-Subject"
+	headerClientCertFingerprint = "X-Client-Cert-Fingerprint"
+)
+
+// setClientCertHeaders strips any client-sent client certificate headers.
+// For tunnels with require_client_cert, where checkClientCert has verified
+// the chain by now, it then sets the subject (RFC 2253) and hex SHA-256
+// fingerprint of the client's certificate. Unverified certificates are
+// never passed on.
+func setClientCertHeaders(h http.Header, r *http.Request, t *tunnel.Info) {
+	h.Del(headerClientCertSubject)
+	h.Del(headerClientCertFingerprint)
+	if !t.RequireClientCert || r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return
+	}
+	cert := r.TLS.PeerCertificates[0]
+	sum := sha256.Sum256(cert.Raw)
+	h.Set(headerClientCertSubject, cert.Subject.String())
+	h.Set(headerClientCertFingerprint, hex.EncodeToString(sum[:]))
+}
+
+// forwardedProto returns the scheme the client used to reach arbok. A
+// trusted proxy's X-Forwarded-Proto wins; otherwise it's https only when
+// the connection itself is TLS.
+func (s *Server) forwardedProto(r *http.Request) string {
+	if s.isTrustedProxy(r) {
+		switch proto := strings.ToLower(r.Header.Get("X-Forwarded-Proto")); proto {
+		case "http", "https":
+			return proto
+		}
+	}
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// clientIP returns the address of the client that made the request. Behind
+// a trusted proxy it's the last X-Forwarded-For entry, the one the proxy
+// itself appended.
+func (s *Server) clientIP(r *http.Request) string {
+	if s.isTrustedProxy(r) {
+		if xff := r.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+			parts := strings.Split(xff[len(xff)-1], ",")
+			if ip := strings.TrimSpace(parts[len(parts)-1]); ip != "" {
+				return ip
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
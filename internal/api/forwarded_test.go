@@ -0,0 +1,165 @@
+package api
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+// mustCIDR parses a CIDR or fails the test
+func mustCIDR(t *testing.T, cidr string) *net.IPNet {
+	t.Helper()
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return network
+}
+
+func TestForwardedProto(t *testing.T) {
+	s := &Server{cfg: Config{TrustedProxies: []*net.IPNet{mustCIDR(t, "10.0.0.0/8")}}}
+
+	tests := []struct {
+		name   string
+		remote string
+		tls    bool
+		header string
+		want   string
+	}{
+		{"plain HTTP", "192.0.2.1:1234", false, "", "http"},
+		{"native TLS", "192.0.2.1:1234", true, "", "https"},
+		{"untrusted header ignored", "192.0.2.1:1234", false, "https", "http"},
+		{"trusted proxy terminated TLS", "10.0.0.5:1234", false, "https", "https"},
+		{"trusted proxy over HTTP", "10.0.0.5:1234", true, "http", "http"},
+		{"trusted proxy with a bogus value", "10.0.0.5:1234", false, "gopher", "http"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.remote
+			if tt.tls {
+				r.TLS = &tls.ConnectionState{}
+			}
+			if tt.header != "" {
+				r.Header.Set("X-Forwarded-Proto", tt.header)
+			}
+			if got := s.forwardedProto(r); got != tt.want {
+				t.Errorf("forwardedProto = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBackendSeesForwardedProto(t *testing.T) {
+	ts := newTestServer(t, Config{}, testKeys{})
+	var proto atomic.Value
+	created := ts.backend(t, "", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proto.Store(r.Header.Get("X-Forwarded-Proto"))
+	}))
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Host = created.Subdomain + "." + ts.cfg.Domain
+	r.Header.Set("X-Forwarded-Proto", "https")
+	ts.proxyHandler().ServeHTTP(httptest.NewRecorder(), r)
+	if got := proto.Load(); got != "http" {
+		t.Errorf("backend saw X-Forwarded-Proto %q over plain HTTP, want http", got)
+	}
+}
+
+func TestBackendSeesForwardedHostAndSNI(t *testing.T) {
+	ts := newTestServer(t, Config{TrustedProxies: []*net.IPNet{mustCIDR(t, "10.0.0.0/8")}}, testKeys{})
+	var host, sni atomic.Value
+	created := ts.backend(t, "", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host.Store(r.Header.Get("X-Forwarded-Host"))
+		sni.Store(r.Header.Get(headerForwardedSNI))
+	}))
+	tunnelHost := created.Subdomain + "." + ts.cfg.Domain
+
+	tests := []struct {
+		name    string
+		remote  string
+		tls     *tls.ConnectionState
+		header  string
+		wantSNI string
+	}{
+		{"native TLS", "192.0.2.1:1234", &tls.ConnectionState{ServerName: tunnelHost}, "", tunnelHost},
+		{"native TLS overrides the header", "10.0.0.5:1234", &tls.ConnectionState{ServerName: tunnelHost}, "spoofed.example", tunnelHost},
+		{"trusted proxy terminated TLS", "10.0.0.5:1234", nil, tunnelHost, tunnelHost},
+		{"untrusted header dropped", "192.0.2.1:1234", nil, "spoofed.example", ""},
+		{"plain HTTP", "192.0.2.1:1234", nil, "", ""},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Host = tunnelHost
+		r.RemoteAddr = tt.remote
+		r.TLS = tt.tls
+		if tt.header != "" {
+			r.Header.Set(headerForwardedSNI, tt.header)
+		}
+		w := httptest.NewRecorder()
+		ts.proxyHandler().ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: proxied request = %d %s", tt.name, w.Code, w.Body)
+		}
+		if got := host.Load(); got != tunnelHost {
+			t.Errorf("%s: backend saw X-Forwarded-Host %q, want %q", tt.name, got, tunnelHost)
+		}
+		if got := sni.Load(); got != tt.wantSNI {
+			t.Errorf("%s: backend saw %s %q, want %q", tt.name, headerForwardedSNI, got, tt.wantSNI)
+		}
+	}
+}
+
+func TestBackendSeesClientCert(t *testing.T) {
+	// Only the handler's view of TLS matters here, so the files aren't read
+	ts := newTestServer(t, Config{TLSCertFile: "server.crt", TLSKeyFile: "server.key"}, testKeys{})
+	var subject, fingerprint atomic.Value
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		subject.Store(r.Header.Get(headerClientCertSubject))
+		fingerprint.Store(r.Header.Get(headerClientCertFingerprint))
+	})
+	ca := newTestCA(t)
+	body, _ := json.Marshal(map[string]any{"require_client_cert": true, "client_ca_pem": ca.pem})
+	verified := ts.backend(t, string(body), handler)
+	unverified := ts.backend(t, "", handler)
+	cert := ca.issue(t, x509.ExtKeyUsageClientAuth)
+	sum := sha256.Sum256(cert.Leaf.Raw)
+
+	tests := []struct {
+		name        string
+		tunnel      TunnelResponse
+		tls         *tls.ConnectionState
+		subject     string
+		fingerprint string
+	}{
+		{"verified client cert", verified, &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert.Leaf}}, "CN=test leaf", hex.EncodeToString(sum[:])},
+		{"unverified client cert", unverified, &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert.Leaf}}, "", ""},
+		{"TLS without a client cert", unverified, &tls.ConnectionState{}, "", ""},
+		{"plain HTTP", unverified, nil, "", ""},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Host = tt.tunnel.Subdomain + "." + ts.cfg.Domain
+		r.TLS = tt.tls
+		r.Header.Set(headerClientCertSubject, "CN=admin")
+		r.Header.Set(headerClientCertFingerprint, "spoofed")
+		w := httptest.NewRecorder()
+		ts.proxyHandler().ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: proxied request = %d %s", tt.name, w.Code, w.Body)
+		}
+		if got := subject.Load(); got != tt.subject {
+			t.Errorf("%s: backend saw subject %q, want %q", tt.name, got, tt.subject)
+		}
+		if got := fingerprint.Load(); got != tt.fingerprint {
+			t.Errorf("%s: backend saw fingerprint %q, want %q", tt.name, got, tt.fingerprint)
+		}
+	}
+}
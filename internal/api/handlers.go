@@ -2,6 +2,7 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"strconv"
@@ -9,16 +10,12 @@ import (
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/mr-karan/arbok/internal/apikey"
+	"github.com/mr-karan/arbok/internal/auth"
+	"github.com/mr-karan/arbok/internal/registry"
 	"github.com/mr-karan/arbok/internal/tunnel"
 )
 
-// ErrorResponse represents an API error response
-type ErrorResponse struct {
-	Error   string `json:"error"`
-	Code    string `json:"code,omitempty"`
-	Details string `json:"details,omitempty"`
-}
-
 // TunnelResponse represents a tunnel in API responses
 type TunnelResponse struct {
 	ID        string    `json:"id"`
@@ -27,7 +24,115 @@ type TunnelResponse struct {
 	Port      uint16    `json:"port"`
 	CreatedAt time.Time `json:"created_at"`
 	ExpiresAt time.Time `json:"expires_at"`
-	TTL       string    `json:"ttl"`
+	// CreatedAtUnix and ExpiresAtUnix are the same times in Unix seconds
+	CreatedAtUnix int64  `json:"created_at_unix"`
+	ExpiresAtUnix int64  `json:"expires_at_unix"`
+	TTL           string `json:"ttl"`
+	// TTLSeconds and TTLHuman ("23h 59m", truncated to the minute) are
+	// easier to consume than TTL
+	TTLSeconds int64  `json:"ttl_seconds"`
+	TTLHuman   string `json:"ttl_human"`
+
+	BackendHost               string                          `json:"backend_host,omitempty"`
+	DNSResolver               string                          `json:"dns_resolver,omitempty"`
+	ResolvedBackendIP         string                          `json:"resolved_backend_ip,omitempty"`
+	RequireClientCert         bool                            `json:"require_client_cert,omitempty"`
+	Labels                    map[string]string               `json:"labels,omitempty"`
+	MaxRPS                    float64                         `json:"max_rps,omitempty"`
+	AllowedClientCIDRs        []string                        `json:"allowed_client_cidrs,omitempty"`
+	Static                    bool                            `json:"static,omitempty"`
+	BackendScheme             string                          `json:"backend_scheme,omitempty"`
+	BackendInsecureSkipVerify bool                            `json:"backend_insecure_skip_verify,omitempty"`
+	ErrorOverrides            map[string]tunnel.ErrorOverride `json:"error_overrides,omitempty"`
+	Description               string                          `json:"description,omitempty"`
+	Routes                    []tunnel.Route                  `json:"routes,omitempty"`
+	RequestTimeout            string                          `json:"request_timeout,omitempty"`
+
+	Revoked   bool       `json:"revoked,omitempty"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+
+	Flagged    bool       `json:"flagged,omitempty"`
+	FlaggedAt  *time.Time `json:"flagged_at,omitempty"`
+	FlagReason string     `json:"flag_reason,omitempty"`
+
+	// Config and PrivateKey are only set on creation when explicitly
+	// requested with ?include_config=true
+	Config     string `json:"config,omitempty"`
+	PrivateKey string `json:"private_key,omitempty"`
+}
+
+// tunnelResponse builds the API representation of a tunnel
+func (s *Server) tunnelResponse(t *tunnel.Info) TunnelResponse {
+	ttl := t.TTL()
+	resp := TunnelResponse{
+		ID:            t.ID,
+		Subdomain:     t.Subdomain,
+		URL:           "https://" + t.Hostname(),
+		Port:          t.Port,
+		CreatedAt:     t.CreatedAt,
+		ExpiresAt:     t.ExpiresAt,
+		CreatedAtUnix: t.CreatedAt.Unix(),
+		ExpiresAtUnix: t.ExpiresAt.Unix(),
+		TTL:           ttl.String(),
+		TTLSeconds:    max(int64(ttl.Seconds()), 0),
+		TTLHuman:      humanizeDuration(ttl),
+
+		BackendHost:               t.BackendHost,
+		DNSResolver:               t.DNSResolver,
+		ResolvedBackendIP:         t.ResolvedBackendIP,
+		RequireClientCert:         t.RequireClientCert,
+		Labels:                    t.Labels,
+		MaxRPS:                    t.MaxRPS,
+		AllowedClientCIDRs:        t.AllowedClientCIDRs,
+		Static:                    t.Static,
+		BackendScheme:             t.BackendScheme,
+		BackendInsecureSkipVerify: t.BackendInsecureSkipVerify,
+		ErrorOverrides:            t.ErrorOverrides,
+		Description:               t.Description,
+		Routes:                    t.Routes,
+
+		Revoked:    t.Revoked,
+		Flagged:    t.Flagged,
+		FlagReason: t.FlagReason,
+	}
+	if t.Revoked {
+		revokedAt := t.RevokedAt
+		resp.RevokedAt = &revokedAt
+	}
+	if t.Flagged {
+		flaggedAt := t.FlaggedAt
+		resp.FlaggedAt = &flaggedAt
+	}
+	if t.RequestTimeout > 0 {
+		resp.RequestTimeout = t.RequestTimeout.String()
+	}
+	return resp
+}
+
+// humanizeDuration formats d as days, hours and minutes, e.g. "1d 2h 5m",
+// truncated to the minute so it never overstates the time left. Zero
+// components are left out.
+func humanizeDuration(d time.Duration) string {
+	d = d.Truncate(time.Minute)
+	if d <= 0 {
+		return "0m"
+	}
+
+	days := d / (24 * time.Hour)
+	hours := d % (24 * time.Hour) / time.Hour
+	minutes := d % time.Hour / time.Minute
+
+	var parts []string
+	if days > 0 {
+		parts = append(parts, fmt.Sprintf("%dd", days))
+	}
+	if hours > 0 {
+		parts = append(parts, fmt.Sprintf("%dh", hours))
+	}
+	if minutes > 0 {
+		parts = append(parts, fmt.Sprintf("%dm", minutes))
+	}
+	return strings.Join(parts, " ")
 }
 
 // writeJSON writes a JSON response
@@ -40,14 +145,6 @@ func writeJSON(w http.ResponseWriter, status int, data interface{}) {
 	}
 }
 
-// writeError writes an error response
-func writeError(w http.ResponseWriter, status int, code, message string) {
-	writeJSON(w, status, ErrorResponse{
-		Error: message,
-		Code:  code,
-	})
-}
-
 // handleHealth handles health check requests
 func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, http.StatusOK, map[string]interface{}{
@@ -56,43 +153,283 @@ func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-// handleCreateTunnel handles tunnel creation requests
+// handleReady reports whether the server can serve tunnels: the WireGuard
+// device is up and the cleanup loop is keeping up
+func (s *Server) handleReady(w http.ResponseWriter, r *http.Request) {
+	lastCleanup, stale := s.registry.LastCleanup()
+	checks := map[string]string{"tunnel": "ok", "cleanup": "ok", "wireguard": "ok"}
+	ready := true
+	if s.tun.GetNetstack() == nil {
+		checks["tunnel"] = "closed"
+		ready = false
+	}
+	if !s.tun.Healthy() {
+		checks["wireguard"] = "unhealthy"
+		ready = false
+	}
+	if stale {
+		checks["cleanup"] = "stale"
+		ready = false
+	}
+
+	status, code := "ready", http.StatusOK
+	if !ready {
+		status, code = "not ready", http.StatusServiceUnavailable
+	}
+	writeJSON(w, code, map[string]interface{}{
+		"status":       status,
+		"checks":       checks,
+		"last_cleanup": lastCleanup.UTC(),
+	})
+}
+
+// CreateTunnelRequest is the optional JSON body of a tunnel creation request
+type CreateTunnelRequest struct {
+	// BackendHost forwards to this IP on the client's network instead of
+	// the client's tunnel IP. The client must route it onward.
+	BackendHost string `json:"backend_host,omitempty"`
+
+	// DNSResolver lets BackendHost be a hostname, resolved by "peer" (the
+	// DNS server on the client's tunnel IP) or one of the server's
+	// configured internal resolvers
+	DNSResolver string `json:"dns_resolver,omitempty"`
+
+	// ClientCAPEM and RequireClientCert enable mutual TLS: only clients
+	// with a certificate signed by one of the CAs reach the backend.
+	// Requires native TLS.
+	ClientCAPEM       string `json:"client_ca_pem,omitempty"`
+	RequireClientCert bool   `json:"require_client_cert,omitempty"`
+
+	// ClientPublicKey lets the client keep its private key to itself. The
+	// returned config then has a placeholder for the client to fill in.
+	ClientPublicKey string `json:"client_public_key,omitempty"`
+
+	// Reclaim recreates a tunnel that expired or was deleted in the last
+	// few minutes with the same IP and subdomain, as far as they're still
+	// free. It needs the same ClientPublicKey and API key as before.
+	Reclaim bool `json:"reclaim,omitempty"`
+
+	// StripResponseHeaders adds to the server's list of backend response
+	// headers hidden from clients
+	StripResponseHeaders []string `json:"strip_response_headers,omitempty"`
+
+	// AllowedMethods limits the HTTP methods proxied to the backend, e.g.
+	// ["GET"] for a read-only service. Empty allows all.
+	AllowedMethods []string `json:"allowed_methods,omitempty"`
+
+	// Labels tag the tunnel, e.g. {"env": "staging"}, so tunnel lists can
+	// be filtered with ?label=env:staging
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// MaxRPS caps the requests per second proxied to the tunnel across
+	// all clients, to protect a fragile backend. Zero uses the server's
+	// default.
+	MaxRPS float64 `json:"max_rps,omitempty"`
+
+	// AllowedClientCIDRs only lets clients from these networks, e.g.
+	// ["203.0.113.0/24"], reach the tunnel. Empty allows everyone.
+	AllowedClientCIDRs []string `json:"allowed_client_cidrs,omitempty"`
+
+	// Static is for backends serving files: HEAD is answered from GET
+	// when the backend rejects it, and byte ranges are cut from full
+	// responses when the backend ignores Range
+	Static bool `json:"static,omitempty"`
+
+	// BackendScheme is "https" when the local service serves TLS. Set
+	// BackendInsecureSkipVerify for self-signed development certificates.
+	BackendScheme             string `json:"backend_scheme,omitempty"`
+	BackendInsecureSkipVerify bool   `json:"backend_insecure_skip_verify,omitempty"`
+
+	// ErrorOverrides replaces proxy error responses by condition
+	// ("backend_error", "backend_timeout", "backend_unavailable"), e.g.
+	// {"backend_error": {"status": 200, "body": "{\"status\":\"down\"}"}}
+	ErrorOverrides map[string]tunnel.ErrorOverride `json:"error_overrides,omitempty"`
+
+	// Description is a human-readable note such as "PR #123 preview"
+	Description string `json:"description,omitempty"`
+
+	// Routes send requests under a path prefix to another local port,
+	// e.g. [{"prefix": "/api", "port": 8081}]; the rest go to the port
+	// in the URL. The longest matching prefix wins.
+	Routes []tunnel.Route `json:"routes,omitempty"`
+
+	// TTL is the tunnel's lifetime, e.g. "30m" or "48h", up to the API
+	// key's max TTL. Empty uses the server's default.
+	TTL string `json:"ttl,omitempty"`
+
+	// RequestTimeout bounds each request to the tunnel, e.g. "5m" for
+	// long polling or "5s" to fail fast, up to the server's max. Empty
+	// uses the server's proxy timeouts.
+	RequestTimeout string `json:"request_timeout,omitempty"`
+}
+
+// UpdateTunnelRequest is the body of a tunnel update. Omitted fields are
+// left unchanged.
+type UpdateTunnelRequest struct {
+	// Description replaces the tunnel's description; "" clears it
+	Description *string `json:"description,omitempty"`
+	// Port sets the backend port, e.g. of a tunnel created with port 0
+	Port *uint16 `json:"port,omitempty"`
+}
+
+// handleCreateTunnel handles tunnel creation requests. Port 0 creates a
+// tunnel without a backend port, to be set later with PUT.
 func (s *Server) handleCreateTunnel(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	port, err := strconv.ParseUint(vars["port"], 10, 16)
-	if err != nil || port == 0 || port > 65535 {
-		writeError(w, http.StatusBadRequest, "INVALID_PORT", "Invalid port number")
+	if err != nil {
+		respondError(w, http.StatusBadRequest, CodeInvalidPort, "Invalid port number, use 1-65535 or 0 to set it later")
 		return
 	}
 	
-	// Create tunnel
-	t, err := s.registry.CreateTunnel(uint16(port))
-	if err != nil {
-		s.logger.Error("failed to create tunnel", "error", err, "port", port)
-		writeError(w, http.StatusInternalServerError, "TUNNEL_CREATE_FAILED", "Failed to create tunnel")
+	if !s.allowCreate(w, r) {
+		respondError(w, http.StatusTooManyRequests, CodeRateLimited, "Too many tunnel creations, retry later")
 		return
 	}
-	
-	// Add peer to WireGuard
-	if err := s.tun.AddPeer(t.PublicKey, t.AllowedIP); err != nil {
-		s.logger.Error("failed to add peer", "error", err, "tunnel_id", t.ID)
-		_ = s.registry.DeleteTunnel(t.ID)
-		writeError(w, http.StatusInternalServerError, "PEER_ADD_FAILED", "Failed to configure tunnel")
+
+	var req CreateTunnelRequest
+	if err := decodeStrictJSON(r, &req); err != nil {
+		respondErrorDetails(w, http.StatusBadRequest, CodeInvalidBody, "Invalid request body", strings.TrimPrefix(err.Error(), "json: "))
+		return
+	}
+	if err := req.Validate(s.cfg.MaxRequestTimeout); err != nil {
+		respondValidationError(w, err)
+		return
+	}
+	// Validate checked the durations parse
+	ttl, _ := time.ParseDuration(req.TTL)
+	requestTimeout, _ := time.ParseDuration(req.RequestTimeout)
+
+	if req.RequireClientCert && !s.tlsEnabled() {
+		respondError(w, http.StatusBadRequest, CodeTLSNotEnabled, "Client certificates require native TLS on the server")
+		return
+	}
+
+	// Only valid requests take a provisioning slot
+	if !s.beginProvision(w) {
+		respondError(w, http.StatusServiceUnavailable, CodeServerBusy, "Too many tunnel creations in progress, retry later")
+		return
+	}
+	defer s.endProvision()
+
+	// Create tunnel, owned by the requesting key if any. With
+	// ?reuse_existing=true the key's live tunnel for this port is returned
+	// instead, if it has one.
+	create := func(port uint16, opts registry.CreateOptions, peers registry.Peers) (*tunnel.Info, bool, error) {
+		t, err := s.registry.CreateTunnelWithPeer(port, opts, peers)
+		return t, err == nil, err
+	}
+	if reuse, _ := strconv.ParseBool(r.URL.Query().Get("reuse_existing")); reuse {
+		create = s.registry.ReuseOrCreateTunnel
+	}
+	t, created, err := create(uint16(port), registry.CreateOptions{
+		OwnerID:                   ownerID(r),
+		Domain:                    s.requestDomain(r),
+		BackendHost:               req.BackendHost,
+		DNSResolver:               req.DNSResolver,
+		ClientCAPEM:               req.ClientCAPEM,
+		RequireClientCert:         req.RequireClientCert,
+		ClientPublicKey:           req.ClientPublicKey,
+		Reclaim:                   req.Reclaim,
+		StripResponseHeaders:      req.StripResponseHeaders,
+		AllowedMethods:            req.AllowedMethods,
+		Labels:                    req.Labels,
+		MaxRPS:                    req.MaxRPS,
+		AllowedClientCIDRs:        req.AllowedClientCIDRs,
+		Static:                    req.Static,
+		BackendScheme:             req.BackendScheme,
+		BackendInsecureSkipVerify: req.BackendInsecureSkipVerify,
+		ErrorOverrides:            req.ErrorOverrides,
+		Description:               req.Description,
+		Routes:                    req.Routes,
+		TTL:                       ttl,
+		RequestTimeout:            requestTimeout,
+	}, s.peers())
+	if err != nil {
+		switch {
+		case errors.Is(err, registry.ErrInvalidClientCA):
+			respondErrorDetails(w, http.StatusBadRequest, CodeInvalidClientCA, "Invalid client CA bundle", err.Error())
+		case errors.Is(err, registry.ErrInvalidPublicKey):
+			respondErrorDetails(w, http.StatusBadRequest, CodeInvalidPublicKey, "Invalid client public key", err.Error())
+		case errors.Is(err, registry.ErrInvalidBackendHost):
+			respondErrorDetails(w, http.StatusBadRequest, CodeInvalidBackendHost, "Invalid backend host", err.Error())
+		case errors.Is(err, registry.ErrInvalidClientCIDR):
+			respondErrorDetails(w, http.StatusBadRequest, CodeInvalidClientCIDR, "Invalid client CIDR", err.Error())
+		case errors.Is(err, registry.ErrInvalidDNSResolver):
+			respondErrorDetails(w, http.StatusBadRequest, CodeInvalidDNSResolver, "Invalid DNS resolver", err.Error())
+		case errors.Is(err, tunnel.ErrDeviceUnhealthy):
+			respondError(w, http.StatusServiceUnavailable, CodeWireGuardUnhealthy, "WireGuard is failing, retry later")
+		case errors.Is(err, registry.ErrPeerAdd):
+			s.logger.Error("failed to add peer", "error", err, "port", port)
+			respondError(w, http.StatusInternalServerError, CodePeerAddFailed, "Failed to configure tunnel")
+		default:
+			s.logger.Error("failed to create tunnel", "error", err, "port", port)
+			respondError(w, http.StatusInternalServerError, CodeTunnelCreateFailed, "Failed to create tunnel")
+		}
 		return
 	}
 	
 	// Return tunnel info
-	resp := TunnelResponse{
-		ID:        t.ID,
-		Subdomain: t.Subdomain,
-		URL:       fmt.Sprintf("https://%s.%s", t.Subdomain, s.cfg.Domain),
-		Port:      t.Port,
-		CreatedAt: t.CreatedAt,
-		ExpiresAt: t.ExpiresAt,
-		TTL:       t.TTL().String(),
+	resp := s.tunnelResponse(t)
+	status := http.StatusCreated
+	if !created {
+		status = http.StatusOK
+	}
+
+	// The creator is entitled to the client config, but it carries the
+	// private key so only include it on request. Configs for client
+	// supplied keys hold no secret and are always returned.
+	includeConfig, _ := strconv.ParseBool(r.URL.Query().Get("include_config"))
+	if includeConfig || t.PrivateKey == "" {
+		resp.Config = s.generateWireGuardConfig(t)
+		resp.PrivateKey = t.PrivateKey
 	}
 	
-	writeJSON(w, http.StatusCreated, resp)
+	writeJSON(w, status, resp)
+}
+
+// ReservationRequest is the body of a subdomain reservation request
+type ReservationRequest struct {
+	Subdomain string `json:"subdomain"`
+	// Domain the subdomain is reserved under; defaults to the domain
+	// the request was addressed to
+	Domain string `json:"domain,omitempty"`
+}
+
+// handleCreateReservation reserves a subdomain for the requesting API key
+func (s *Server) handleCreateReservation(w http.ResponseWriter, r *http.Request) {
+	apiKey, ok := auth.GetAPIKey(r.Context())
+	if !ok || apiKey == "" {
+		respondError(w, http.StatusBadRequest, CodeAPIKeyRequired, "Reservations require an API key")
+		return
+	}
+
+	var req ReservationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, CodeInvalidBody, "Invalid request body")
+		return
+	}
+
+	if req.Domain == "" {
+		req.Domain = s.requestDomain(r)
+	}
+
+	if err := s.registry.Reserve(apikey.ID(apiKey), req.Subdomain, req.Domain); err != nil {
+		switch {
+		case errors.Is(err, registry.ErrInvalidSubdomain):
+			respondError(w, http.StatusBadRequest, CodeInvalidSubdomain, "Invalid subdomain")
+		case errors.Is(err, registry.ErrUnknownDomain):
+			respondError(w, http.StatusBadRequest, CodeUnknownDomain, "Domain is not served by this server")
+		case errors.Is(err, registry.ErrSubdomainReserved):
+			respondError(w, http.StatusConflict, CodeSubdomainReserved, "Subdomain is reserved by another key")
+		default:
+			s.logger.Error("failed to reserve subdomain", "error", err)
+			respondError(w, http.StatusInternalServerError, CodeReservationFailed, "Failed to reserve subdomain")
+		}
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, req)
 }
 
 // handleGetTunnel handles tunnel info requests
@@ -102,21 +439,46 @@ func (s *Server) handleGetTunnel(w http.ResponseWriter, r *http.Request) {
 	
 	t := s.registry.GetTunnel(tunnelID)
 	if t == nil {
-		writeError(w, http.StatusNotFound, "TUNNEL_NOT_FOUND", "Tunnel not found")
+		respondError(w, http.StatusNotFound, CodeTunnelNotFound, "Tunnel not found")
 		return
 	}
 	
-	resp := TunnelResponse{
-		ID:        t.ID,
-		Subdomain: t.Subdomain,
-		URL:       fmt.Sprintf("https://%s.%s", t.Subdomain, s.cfg.Domain),
-		Port:      t.Port,
-		CreatedAt: t.CreatedAt,
-		ExpiresAt: t.ExpiresAt,
-		TTL:       t.TTL().String(),
+	writeJSON(w, http.StatusOK, s.tunnelResponse(t))
+}
+
+// handleUpdateTunnel changes a tunnel's mutable settings. Only its owner
+// or an admin may update it.
+func (s *Server) handleUpdateTunnel(w http.ResponseWriter, r *http.Request) {
+	t := s.registry.GetTunnel(mux.Vars(r)["id"])
+	if t == nil || !s.canAccessTunnel(r, t) {
+		respondError(w, http.StatusNotFound, CodeTunnelNotFound, "Tunnel not found")
+		return
 	}
-	
-	writeJSON(w, http.StatusOK, resp)
+	if t.Revoked && !s.auth.IsAdmin(r.Context()) {
+		respondError(w, http.StatusForbidden, CodeTunnelRevoked, "Revoked tunnels can only be updated by an admin")
+		return
+	}
+
+	var req UpdateTunnelRequest
+	if err := decodeStrictJSON(r, &req); err != nil {
+		respondErrorDetails(w, http.StatusBadRequest, CodeInvalidBody, "Invalid request body", strings.TrimPrefix(err.Error(), "json: "))
+		return
+	}
+	if err := req.Validate(); err != nil {
+		respondValidationError(w, err)
+		return
+	}
+
+	t, err := s.registry.UpdateTunnel(t.ID, registry.UpdateOptions{
+		Description: req.Description,
+		Port:        req.Port,
+	})
+	if err != nil {
+		respondError(w, http.StatusNotFound, CodeTunnelNotFound, "Tunnel not found")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, s.tunnelResponse(t))
 }
 
 // handleDeleteTunnel handles tunnel deletion requests
@@ -125,11 +487,17 @@ func (s *Server) handleDeleteTunnel(w http.ResponseWriter, r *http.Request) {
 	tunnelID := vars["id"]
 	
 	t := s.registry.GetTunnel(tunnelID)
-	if t == nil {
-		writeError(w, http.StatusNotFound, "TUNNEL_NOT_FOUND", "Tunnel not found")
+	if t == nil || !s.canAccessTunnel(r, t) {
+		respondError(w, http.StatusNotFound, CodeTunnelNotFound, "Tunnel not found")
 		return
 	}
 	
+	// Revoked tunnels are kept for operators to inspect
+	if t.Revoked && !s.auth.IsAdmin(r.Context()) {
+		respondError(w, http.StatusForbidden, CodeTunnelRevoked, "Revoked tunnels can only be deleted by an admin")
+		return
+	}
+
 	// Remove peer from WireGuard
 	if err := s.tun.RemovePeer(t.PublicKey, t.AllowedIP); err != nil {
 		s.logger.Error("failed to remove peer", "error", err, "tunnel_id", t.ID)
@@ -138,58 +506,159 @@ func (s *Server) handleDeleteTunnel(w http.ResponseWriter, r *http.Request) {
 	// Delete from registry
 	if err := s.registry.DeleteTunnel(tunnelID); err != nil {
 		s.logger.Error("failed to delete tunnel", "error", err, "tunnel_id", tunnelID)
-		writeError(w, http.StatusInternalServerError, "DELETE_FAILED", "Failed to delete tunnel")
+		respondError(w, http.StatusInternalServerError, CodeDeleteFailed, "Failed to delete tunnel")
 		return
 	}
 	
 	w.WriteHeader(http.StatusNoContent)
 }
 
-// handleListTunnels handles tunnel listing requests
+// handleRevokeTunnel cuts off a tunnel's connectivity by removing its
+// WireGuard peer while keeping the record. Revoking again is a no-op.
+func (s *Server) handleRevokeTunnel(w http.ResponseWriter, r *http.Request) {
+	tunnelID := mux.Vars(r)["id"]
+
+	t, revoked, err := s.registry.RevokeTunnel(tunnelID)
+	if errors.Is(err, registry.ErrTunnelNotFound) {
+		respondError(w, http.StatusNotFound, CodeTunnelNotFound, "Tunnel not found")
+		return
+	}
+	if err != nil {
+		s.logger.Error("failed to revoke tunnel", "error", err, "tunnel_id", tunnelID)
+		respondError(w, http.StatusInternalServerError, CodeRevokeFailed, "Failed to revoke tunnel")
+		return
+	}
+
+	if revoked {
+		if err := s.tun.RemovePeer(t.PublicKey, t.AllowedIP); err != nil {
+			s.logger.Error("failed to remove peer", "error", err, "tunnel_id", t.ID)
+		}
+		// Drop pooled connections so nothing keeps flowing
+		s.transports.evict(t)
+	}
+
+	writeJSON(w, http.StatusOK, s.tunnelResponse(t))
+}
+
+// ReconcileResponse is the response of the reconcile endpoint
+type ReconcileResponse struct {
+	Peers int `json:"peers"`
+}
+
+// handleReconcile resets WireGuard's peers to those of the registry's
+// tunnels, revoked ones excluded, repairing any drift between the two
+func (s *Server) handleReconcile(w http.ResponseWriter, r *http.Request) {
+	peers, err := s.registry.ReconcilePeers(s.tun.SyncPeers)
+	if err != nil {
+		s.logger.Error("failed to reconcile peers", "error", err)
+		respondError(w, http.StatusInternalServerError, CodeReconcileFailed, "Failed to reconcile WireGuard peers")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, ReconcileResponse{Peers: peers})
+}
+
+// CleanupResponse is the response of the cleanup endpoint
+type CleanupResponse struct {
+	Reaped int `json:"reaped"`
+}
+
+// handleCleanup runs the expiry sweep now instead of at the next cleanup
+// interval and reports how many tunnels it removed
+func (s *Server) handleCleanup(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, CleanupResponse{Reaped: s.registry.Cleanup()})
+}
+
+// handleListTunnels lists every tunnel for admins, and only the
+// requesting key's own tunnels for other keys
 func (s *Server) handleListTunnels(w http.ResponseWriter, r *http.Request) {
-	tunnels := s.registry.ListTunnels()
-	
+	version := s.registry.Version()
+	if s.auth.IsAdmin(r.Context()) {
+		s.writeTunnelList(w, r, version, s.registry.ListTunnels())
+		return
+	}
+	s.writeTunnelList(w, r, version, s.registry.ListTunnelsByOwner(ownerID(r)))
+}
+
+// handleListMyTunnels lists the tunnels owned by the requesting API key
+func (s *Server) handleListMyTunnels(w http.ResponseWriter, r *http.Request) {
+	apiKey, ok := auth.GetAPIKey(r.Context())
+	if !ok || apiKey == "" {
+		respondError(w, http.StatusBadRequest, CodeAPIKeyRequired, "Listing your tunnels requires an API key")
+		return
+	}
+
+	version := s.registry.Version()
+	s.writeTunnelList(w, r, version, s.registry.ListTunnelsByOwner(apikey.ID(apiKey)))
+}
+
+// writeTunnelList writes the tunnels matching the request's label
+// selector (repeated ?label=key:value, all of which must match). The list
+// carries an ETag for the registry version it was read at, and clients
+// sending it back in If-None-Match get 304 until a tunnel changes.
+func (s *Server) writeTunnelList(w http.ResponseWriter, r *http.Request, version uint64, tunnels []*tunnel.Info) {
+	selector, err := parseLabelSelector(r.URL.Query()["label"])
+	if err != nil {
+		respondErrorDetails(w, http.StatusBadRequest, CodeInvalidLabelSelector, "Invalid label selector", err.Error())
+		return
+	}
+
+	etag := listETag(r, version)
+	w.Header().Set("ETag", etag)
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
 	resp := make([]TunnelResponse, 0, len(tunnels))
 	for _, t := range tunnels {
-		resp = append(resp, TunnelResponse{
-			ID:        t.ID,
-			Subdomain: t.Subdomain,
-			URL:       fmt.Sprintf("https://%s.%s", t.Subdomain, s.cfg.Domain),
-			Port:      t.Port,
-			CreatedAt: t.CreatedAt,
-			ExpiresAt: t.ExpiresAt,
-			TTL:       t.TTL().String(),
-		})
+		if t.MatchesLabels(selector) {
+			resp = append(resp, s.tunnelResponse(t))
+		}
 	}
-	
+
 	writeJSON(w, http.StatusOK, map[string]interface{}{
 		"tunnels": resp,
 		"count":   len(resp),
 	})
 }
 
-// handleProvisionSimple handles simple tunnel provisioning (curl-friendly)
+// handleProvisionSimple handles simple tunnel provisioning (curl-friendly).
+// Port 0 leaves the backend port to be set later, as on the JSON API.
 func (s *Server) handleProvisionSimple(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	port, err := strconv.ParseUint(vars["port"], 10, 16)
-	if err != nil || port == 0 || port > 65535 {
-		http.Error(w, "Invalid port number", http.StatusBadRequest)
+	if err != nil {
+		respondPlainError(w, r, http.StatusBadRequest, CodeInvalidPort, "Invalid port number, use 1-65535 or 0 to set it later")
 		return
 	}
 	
+	if !s.allowCreate(w, r) {
+		respondPlainError(w, r, http.StatusTooManyRequests, CodeRateLimited, "Too many tunnel creations, retry later")
+		return
+	}
+	if !s.beginProvision(w) {
+		respondPlainError(w, r, http.StatusServiceUnavailable, CodeServerBusy, "Too many tunnel creations in progress, retry later")
+		return
+	}
+	defer s.endProvision()
+
 	// Create tunnel
-	t, err := s.registry.CreateTunnel(uint16(port))
+	t, err := s.registry.CreateTunnelWithPeer(uint16(port), registry.CreateOptions{
+		Domain: s.requestDomain(r),
+	}, s.peers())
 	if err != nil {
+		if errors.Is(err, tunnel.ErrDeviceUnhealthy) {
+			respondPlainError(w, r, http.StatusServiceUnavailable, CodeWireGuardUnhealthy, "WireGuard is failing, retry later")
+			return
+		}
+		if errors.Is(err, registry.ErrPeerAdd) {
+			s.logger.Error("failed to add peer", "error", err, "port", port)
+			respondPlainError(w, r, http.StatusInternalServerError, CodePeerAddFailed, "Failed to configure tunnel")
+			return
+		}
 		s.logger.Error("failed to create tunnel", "error", err, "port", port)
-		http.Error(w, "Failed to create tunnel", http.StatusInternalServerError)
-		return
-	}
-	
-	// Add peer to WireGuard
-	if err := s.tun.AddPeer(t.PublicKey, t.AllowedIP); err != nil {
-		s.logger.Error("failed to add peer", "error", err, "tunnel_id", t.ID)
-		_ = s.registry.DeleteTunnel(t.ID)
-		http.Error(w, "Failed to configure tunnel", http.StatusInternalServerError)
+		respondPlainError(w, r, http.StatusInternalServerError, CodeTunnelCreateFailed, "Failed to create tunnel")
 		return
 	}
 	
@@ -202,21 +671,21 @@ func (s *Server) handleProvisionSimple(w http.ResponseWriter, r *http.Request) {
 # Expires: %s (in %s)
 #
 # Your local service on port %d is now accessible at:
-# https://%s.%s
-#
+# https://%s
+#%s
 # Usage:
 #   1. Save this config: curl %s/%d > burrow.conf
 #   2. Start tunnel: sudo wg-quick up ./burrow.conf  
 #   3. Stop tunnel: sudo wg-quick down ./burrow.conf
 #
-%s`, 
+%s`,
 		t.CreatedAt.Format(time.RFC3339),
 		t.ExpiresAt.Format(time.RFC3339),
 		t.TTL().Round(time.Minute),
-		t.Port, 
-		t.Subdomain, 
-		s.cfg.Domain,
-		s.cfg.Domain,
+		t.Port,
+		t.Hostname(),
+		portUnsetNote(t),
+		t.Domain,
 		t.Port,
 		config,
 	)
@@ -226,13 +695,58 @@ func (s *Server) handleProvisionSimple(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprint(w, instructions)
 }
 
+// portUnsetNote tells how to set the backend port of a tunnel created
+// with port 0, as comment lines of the instructions
+func portUnsetNote(t *tunnel.Info) string {
+	if t.Port != 0 {
+		return ""
+	}
+	return fmt.Sprintf(`
+# No backend port is set yet; requests get 503 until you set one:
+#   curl -X PUT https://%s/api/tunnel/%s -d '{"port":3000}'
+#`, t.Domain, t.ID)
+}
+
+// addPeer adds a tunnel's peer to WireGuard
+func (s *Server) addPeer(t *tunnel.Info) error {
+	return s.peers().AddPeer(t)
+}
+
+// peers returns the registry's view of the WireGuard device
+func (s *Server) peers() registry.Peers {
+	return tunnelPeers{s.tun}
+}
+
+// tunnelPeers adds and removes tunnels' peers on the WireGuard device
+type tunnelPeers struct {
+	tun *tunnel.Tunnel
+}
+
+// AddPeer adds a tunnel's peer to WireGuard
+func (p tunnelPeers) AddPeer(t *tunnel.Info) error {
+	return p.tun.AddPeer(t.PublicKey, t.AllowedIP, t.PeerAllowedIPs()...)
+}
+
+// RemovePeer removes a tunnel's peer from WireGuard
+func (p tunnelPeers) RemovePeer(t *tunnel.Info) error {
+	return p.tun.RemovePeer(t.PublicKey, t.AllowedIP)
+}
+
+// privateKeyPlaceholder stands in for private keys the server never saw
+const privateKeyPlaceholder = "<replace-me>"
 
 // generateWireGuardConfig generates a WireGuard configuration
 func (s *Server) generateWireGuardConfig(t *tunnel.Info) string {
 	serverEndpoint := s.cfg.WireGuardEndpoint
 	
-	tunnelURL := fmt.Sprintf("https://%s.%s", t.Subdomain, s.cfg.Domain)
+	tunnelURL := "https://" + t.Hostname()
 	
+	// Tunnels created with a client public key have no private key here
+	privateKey := t.PrivateKey
+	if privateKey == "" {
+		privateKey = privateKeyPlaceholder
+	}
+
 	return fmt.Sprintf(`[Interface]
 Address = %s/32
 PrivateKey = %s
@@ -244,10 +758,10 @@ AllowedIPs = 10.100.0.0/24
 Endpoint = %s
 PersistentKeepalive = 25`, 
 		t.AllowedIP,
-		t.PrivateKey,
+		privateKey,
 		t.Port,
 		tunnelURL,
-		s.tun.GetPublicKey(), 
+		s.tun.GetPublicKey(),
 		serverEndpoint,
 	)
 }
@@ -255,37 +769,53 @@ PersistentKeepalive = 25`,
 // handleTunnelProxy proxies traffic to tunnels
 func (s *Server) handleTunnelProxy(w http.ResponseWriter, r *http.Request) {
 	// Extract subdomain
-	host := r.Host
-	if idx := strings.Index(host, ":"); idx != -1 {
-		host = host[:idx]
-	}
-	
-	parts := strings.Split(host, ".")
-	if len(parts) < 2 {
-		s.logger.Debug("tunnel proxy: invalid host", "host", host, "parts", len(parts))
-		writeError(w, http.StatusBadRequest, "INVALID_HOST", "Invalid host header")
+	subdomain, domain := s.splitHost(r.Host)
+	if subdomain == "" {
+		s.logger.Debug("tunnel proxy: invalid host", "host", r.Host)
+		respondError(w, http.StatusBadRequest, CodeInvalidHost, "Invalid host header")
 		return
 	}
 	
-	subdomain := parts[0]
-	s.logger.Debug("tunnel proxy: looking for tunnel", "host", host, "subdomain", subdomain)
-	t := s.registry.GetTunnelBySubdomain(subdomain)
-	if t == nil {
+	s.logger.Debug("tunnel proxy: looking for tunnel", "host", r.Host, "subdomain", subdomain, "domain", domain)
+	t := s.registry.GetTunnelBySubdomain(subdomain, domain)
+	if t == nil || t.IsExpired() {
+		if t != nil {
+			s.writeTunnelExpired(w, t.ExpiresAt)
+			return
+		}
+		if ts, ok := s.registry.RecentlyExpired(subdomain, domain); ok {
+			s.writeTunnelExpired(w, ts.ExpiredAt)
+			return
+		}
 		s.logger.Debug("tunnel proxy: tunnel not found", "subdomain", subdomain)
-		writeError(w, http.StatusNotFound, "TUNNEL_NOT_FOUND", "Tunnel not found")
+		respondError(w, http.StatusNotFound, CodeTunnelNotFound, "Tunnel not found")
 		return
 	}
 	
 	s.logger.Debug("tunnel proxy: found tunnel", "subdomain", subdomain, "tunnel_id", t.ID)
-	
-	// Update traffic stats
+
+	// Count the request and response bodies for the tunnel's traffic stats
+	cw := &countingResponseWriter{ResponseWriter: w}
+	var body *countingBody
+	if r.Body != nil && r.Body != http.NoBody {
+		body = &countingBody{ReadCloser: r.Body}
+		r.Body = body
+	}
 	defer func() {
-		// This is a simplified version - in production you'd track actual bytes
-		s.registry.UpdateTraffic(t.ID, 0, 0)
+		var bytesIn uint64
+		if body != nil {
+			bytesIn = body.n.Load()
+		}
+		s.registry.UpdateTraffic(t.ID, bytesIn, cw.n)
 	}()
 	
 	// Use the proxy handler
-	s.handleTunnelTrafficWithProxy(w, r)
+	s.handleTunnelTrafficWithProxy(cw, r)
+}
+
+// writeTunnelExpired tells the client the tunnel existed but has expired
+func (s *Server) writeTunnelExpired(w http.ResponseWriter, expiredAt time.Time) {
+	respondErrorDetails(w, http.StatusGone, CodeTunnelExpired, "Tunnel expired", fmt.Sprintf("This tunnel expired at %s. Ask its owner to create a new one.", expiredAt.UTC().Format(time.RFC3339)))
 }
 
 // handleWebsite serves the embedded website
@@ -293,7 +823,7 @@ func (s *Server) handleWebsite(w http.ResponseWriter, r *http.Request) {
 	content, err := webFiles.ReadFile("web/index.html")
 	if err != nil {
 		s.logger.Error("failed to read website", "error", err)
-		http.Error(w, "Website unavailable", http.StatusInternalServerError)
+		respondError(w, http.StatusInternalServerError, CodeInternal, "Website unavailable")
 		return
 	}
 	
@@ -309,7 +839,7 @@ func (s *Server) handleClientScript(w http.ResponseWriter, r *http.Request) {
 # Arbok Client - One command tunnel management
 # Usage: curl -O https://server/client && chmod +x client && ./client start 3000
 
-ARBOK_SERVER="${ARBOK_SERVER:-` + s.cfg.Domain + `}"
+ARBOK_SERVER="${ARBOK_SERVER:-` + s.requestDomain(r) + `}"
 # ... (rest of the client script would be embedded here)
 `
 	
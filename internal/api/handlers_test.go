@@ -0,0 +1,654 @@
+package api
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mr-karan/arbok/internal/registry"
+	"github.com/mr-karan/arbok/internal/tunnel"
+)
+
+// decode unmarshals a recorded JSON response into v
+func decode(t *testing.T, w *httptest.ResponseRecorder, v any) {
+	t.Helper()
+	if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+		t.Fatalf("decoding %q: %v", w.Body.String(), err)
+	}
+}
+
+// createTunnel creates a tunnel for port through the API
+func (ts *testServer) createTunnel(t *testing.T, port, key, body string) TunnelResponse {
+	t.Helper()
+	w := ts.do(http.MethodPost, "", "/api/tunnel/"+port, key, body)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create tunnel: %d %s", w.Code, w.Body)
+	}
+	var resp TunnelResponse
+	decode(t, w, &resp)
+	return resp
+}
+
+func TestCreateWithoutPortThenSetPort(t *testing.T) {
+	ts := newTestServer(t, Config{}, testKeys{})
+	created := ts.createTunnel(t, "0", "", "")
+	if created.Port != 0 {
+		t.Fatalf("created with port %d, want 0", created.Port)
+	}
+	host := created.Subdomain + "." + ts.cfg.Domain
+	before := ts.reg.GetTunnel(created.ID)
+
+	// Traffic is refused until a port is set
+	w := ts.do(http.MethodGet, host, "/", "", "")
+	var errResp ErrorResponse
+	decode(t, w, &errResp)
+	if w.Code != http.StatusServiceUnavailable || errResp.Code != CodeBackendPortUnset {
+		t.Fatalf("proxy without port = %d %s, want 503 %s", w.Code, errResp.Code, CodeBackendPortUnset)
+	}
+	if strings.Contains(w.Body.String(), created.ID) {
+		t.Errorf("public error %s reveals the tunnel ID", w.Body)
+	}
+
+	w = ts.do(http.MethodPut, "", "/api/tunnel/"+created.ID, "", `{"port":3000}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("set port: %d %s", w.Code, w.Body)
+	}
+	var updated TunnelResponse
+	decode(t, w, &updated)
+	if updated.Port != 3000 {
+		t.Errorf("updated port = %d, want 3000", updated.Port)
+	}
+	if got := ts.reg.GetTunnel(created.ID); got.Port != 3000 || got.PortFor("/") != 3000 {
+		t.Errorf("registry port = %d, want 3000", got.Port)
+	}
+	if before.Port != 0 {
+		t.Error("setting the port changed the Info readers already held")
+	}
+
+	// Port 0 can't be set back
+	w = ts.do(http.MethodPut, "", "/api/tunnel/"+created.ID, "", `{"port":0}`)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("PUT port 0 = %d, want 400", w.Code)
+	}
+}
+
+func TestDeleteNeedsOwner(t *testing.T) {
+	ts := newTestServer(t, Config{}, testKeys{api: []string{"key-a", "key-b"}, admin: []string{"admin"}})
+	mine := ts.createTunnel(t, "3000", "key-a", "")
+	other := ts.createTunnel(t, "3001", "key-a", "")
+
+	if w := ts.do(http.MethodDelete, "", "/api/tunnel/"+mine.ID, "key-b", ""); w.Code != http.StatusNotFound {
+		t.Errorf("deleting another key's tunnel = %d, want 404", w.Code)
+	}
+	if ts.reg.GetTunnel(mine.ID) == nil {
+		t.Fatal("tunnel deleted by another key")
+	}
+	if w := ts.do(http.MethodDelete, "", "/api/tunnel/"+mine.ID, "key-a", ""); w.Code != http.StatusNoContent {
+		t.Errorf("deleting own tunnel = %d, want 204", w.Code)
+	}
+	if w := ts.do(http.MethodDelete, "", "/api/tunnel/"+other.ID, "admin", ""); w.Code != http.StatusNoContent {
+		t.Errorf("admin deleting a tunnel = %d, want 204", w.Code)
+	}
+}
+
+func TestAdminEndpointsNeedAdminKey(t *testing.T) {
+	tests := []struct {
+		name string
+		keys testKeys
+		key  string
+		want int
+	}{
+		{"open mode", testKeys{}, "", http.StatusOK},
+		{"no admin keys configured", testKeys{api: []string{"k1"}}, "k1", http.StatusForbidden},
+		{"non-admin key", testKeys{api: []string{"k1"}, admin: []string{"admin"}}, "k1", http.StatusForbidden},
+		{"admin key", testKeys{api: []string{"k1"}, admin: []string{"admin"}}, "admin", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestServer(t, Config{}, tt.keys)
+			if w := ts.do(http.MethodGet, "", "/api/admin/export", tt.key, ""); w.Code != tt.want {
+				t.Errorf("GET /api/admin/export = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestExpiredTunnelIsGone(t *testing.T) {
+	ts := newTestServer(t, Config{}, testKeys{})
+	expired, err := ts.reg.CreateTunnel(3000, registry.CreateOptions{})
+	if err != nil {
+		t.Fatalf("CreateTunnel: %v", err)
+	}
+	expired.ExpiresAt = time.Now().Add(-time.Minute)
+
+	check := func(subdomain string, status int, code ErrorCode) {
+		t.Helper()
+		w := ts.proxy(t, TunnelResponse{Subdomain: subdomain}, http.MethodGet, "/hello", "")
+		var resp ErrorResponse
+		decode(t, w, &resp)
+		if w.Code != status || resp.Code != code {
+			t.Errorf("request to %s = %d %s, want %d %s", subdomain, w.Code, resp.Code, status, code)
+		}
+	}
+
+	check(expired.Subdomain, http.StatusGone, "TUNNEL_EXPIRED")
+	check("never", http.StatusNotFound, "TUNNEL_NOT_FOUND")
+}
+
+func TestCreateIncludesConfigOnRequest(t *testing.T) {
+	ts := newTestServer(t, Config{}, testKeys{})
+
+	plain := ts.createTunnel(t, "3000", "", "")
+	if plain.Config != "" || plain.PrivateKey != "" {
+		t.Errorf("config returned without include_config: %+v", plain)
+	}
+
+	withConfig := ts.createTunnel(t, "3000?include_config=true", "", "")
+	if withConfig.PrivateKey == "" {
+		t.Error("include_config=true returned no private key")
+	}
+	for _, want := range []string{
+		"PublicKey = " + ts.tun.GetPublicKey(),
+		"PrivateKey = " + withConfig.PrivateKey,
+		"Address = " + ts.reg.GetTunnel(withConfig.ID).AllowedIP + "/32",
+	} {
+		if !strings.Contains(withConfig.Config, want) {
+			t.Errorf("config lacks %q:\n%s", want, withConfig.Config)
+		}
+	}
+}
+
+func TestCreateWithClientPublicKey(t *testing.T) {
+	ts := newTestServer(t, Config{}, testKeys{})
+	priv, pub, err := registry.NewWireGuardKeyGenerator(nil).Generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := `{"client_public_key":"` + pub + `"}`
+
+	created := ts.createTunnel(t, "3000", "", body)
+	if created.PrivateKey != "" {
+		t.Errorf("returned a private key %q for a client supplied key", created.PrivateKey)
+	}
+	if !strings.Contains(created.Config, "PrivateKey = "+privateKeyPlaceholder) {
+		t.Errorf("config lacks the private key placeholder:\n%s", created.Config)
+	}
+	info := ts.reg.GetTunnel(created.ID)
+	if info.PublicKey != pub || info.PrivateKey != "" {
+		t.Errorf("stored keys = %q, %q; want %q and no private key", info.PublicKey, info.PrivateKey, pub)
+	}
+
+	// The client's own private key completes the handshake
+	ln, err := ts.connectPeer(t, created.ID, priv).ListenTCP(&net.TCPAddr{Port: 3000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "backend")
+	})}
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Close() })
+	if w := ts.proxy(t, created, http.MethodGet, "/", ""); w.Code != http.StatusOK || w.Body.String() != "backend" {
+		t.Errorf("request through the tunnel = %d %q, want the backend", w.Code, w.Body)
+	}
+
+	// A key can't be shared between tunnels
+	w := ts.do(http.MethodPost, "", "/api/tunnel/3001", "", body)
+	var resp ErrorResponse
+	decode(t, w, &resp)
+	if w.Code != http.StatusBadRequest || resp.Code != "INVALID_PUBLIC_KEY" {
+		t.Errorf("create with a key in use = %d %s, want 400 INVALID_PUBLIC_KEY", w.Code, resp.Code)
+	}
+}
+
+func TestCreateRejectsBadClientPublicKey(t *testing.T) {
+	ts := newTestServer(t, Config{}, testKeys{})
+
+	for _, key := range []string{
+		"not base64!",
+		base64.StdEncoding.EncodeToString(make([]byte, 31)),
+		base64.StdEncoding.EncodeToString(make([]byte, 33)),
+	} {
+		w := ts.do(http.MethodPost, "", "/api/tunnel/3000", "", `{"client_public_key":"`+key+`"}`)
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "client_public_key") {
+			t.Errorf("create with key %q = %d %s, want 400 naming client_public_key", key, w.Code, w.Body)
+		}
+	}
+	if n := len(ts.reg.ListTunnels()); n != 0 {
+		t.Errorf("%d tunnels after rejected creates, want 0", n)
+	}
+}
+
+func TestCreateRateLimitedPerKey(t *testing.T) {
+	ts := newTestServer(t, Config{CreateRPS: 0.01, CreateBurst: 2}, testKeys{api: []string{"key-a", "key-b"}})
+
+	for i := 0; i < 2; i++ {
+		ts.createTunnel(t, "3000", "key-a", "")
+	}
+	w := ts.do(http.MethodPost, "", "/api/tunnel/3000", "key-a", "")
+	var resp ErrorResponse
+	decode(t, w, &resp)
+	if w.Code != http.StatusTooManyRequests || resp.Code != "RATE_LIMITED" {
+		t.Fatalf("create past the burst = %d %s, want 429 RATE_LIMITED", w.Code, resp.Code)
+	}
+	if retry := w.Header().Get("Retry-After"); retry == "" || retry == "0" {
+		t.Errorf("Retry-After = %q, want the seconds until the next token", retry)
+	}
+	if n := len(ts.reg.ListTunnels()); n != 2 {
+		t.Errorf("%d tunnels, want 2: a limited create must not allocate", n)
+	}
+
+	// Another key has its own bucket
+	ts.createTunnel(t, "3000", "key-b", "")
+}
+
+// listIDs returns the IDs of the tunnels in a list response
+func listIDs(t *testing.T, w *httptest.ResponseRecorder) map[string]bool {
+	t.Helper()
+	if w.Code != http.StatusOK {
+		t.Fatalf("list = %d %s", w.Code, w.Body)
+	}
+	var resp struct {
+		Tunnels []TunnelResponse `json:"tunnels"`
+	}
+	decode(t, w, &resp)
+	ids := make(map[string]bool)
+	for _, tun := range resp.Tunnels {
+		ids[tun.ID] = true
+	}
+	return ids
+}
+
+func TestListMyTunnels(t *testing.T) {
+	ts := newTestServer(t, Config{}, testKeys{api: []string{"team-a", "team-b"}, admin: []string{"admin"}})
+	owned := map[string][]string{}
+	for _, key := range []string{"team-a", "team-a", "team-b"} {
+		owned[key] = append(owned[key], ts.createTunnel(t, "3000", key, "").ID)
+	}
+
+	for key, want := range owned {
+		for _, target := range []string{"/api/my/tunnels", "/api/tunnels"} {
+			got := listIDs(t, ts.do(http.MethodGet, "", target, key, ""))
+			if len(got) != len(want) {
+				t.Errorf("%s lists %d tunnels at %s, want %d", key, len(got), target, len(want))
+			}
+			for _, id := range want {
+				if !got[id] {
+					t.Errorf("%s doesn't see its tunnel %s at %s", key, id, target)
+				}
+			}
+		}
+	}
+
+	// Admins see everyone's through the full list
+	if got := listIDs(t, ts.do(http.MethodGet, "", "/api/tunnels", "admin", "")); len(got) != 3 {
+		t.Errorf("admin lists %d tunnels, want 3", len(got))
+	}
+	if got := listIDs(t, ts.do(http.MethodGet, "", "/api/my/tunnels", "admin", "")); len(got) != 0 {
+		t.Errorf("admin's own list has %d tunnels, want 0", len(got))
+	}
+
+	// Deleted tunnels leave the owner's list
+	if err := ts.reg.DeleteTunnel(owned["team-a"][0]); err != nil {
+		t.Fatal(err)
+	}
+	if got := listIDs(t, ts.do(http.MethodGet, "", "/api/my/tunnels", "team-a", "")); len(got) != 1 || got[owned["team-a"][0]] {
+		t.Errorf("team-a lists %v after a delete, want only %s", got, owned["team-a"][1])
+	}
+}
+
+func TestRevokeTunnel(t *testing.T) {
+	ts := newTestServer(t, Config{}, testKeys{api: []string{"user"}, admin: []string{"admin"}})
+	created := ts.backendAs(t, "user", "", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	target := "/api/admin/tunnel/" + created.ID + "/revoke"
+
+	if w := ts.do(http.MethodPost, "", target, "user", ""); w.Code != http.StatusForbidden {
+		t.Errorf("revoke with a non-admin key = %d, want 403", w.Code)
+	}
+	if w := ts.proxy(t, created, http.MethodGet, "/", ""); w.Code != http.StatusOK {
+		t.Fatalf("request before revoking = %d %s", w.Code, w.Body)
+	}
+
+	// Revoking is idempotent
+	var first TunnelResponse
+	for i := 0; i < 2; i++ {
+		w := ts.do(http.MethodPost, "", target, "admin", "")
+		var resp TunnelResponse
+		decode(t, w, &resp)
+		if w.Code != http.StatusOK || !resp.Revoked || resp.RevokedAt == nil {
+			t.Fatalf("revoke %d = %d %+v", i, w.Code, resp)
+		}
+		if i == 0 {
+			first = resp
+		} else if !resp.RevokedAt.Equal(*first.RevokedAt) {
+			t.Errorf("second revoke moved revoked_at from %v to %v", first.RevokedAt, resp.RevokedAt)
+		}
+	}
+
+	w := ts.proxy(t, created, http.MethodGet, "/", "")
+	var errResp ErrorResponse
+	decode(t, w, &errResp)
+	if w.Code != http.StatusForbidden || errResp.Code != "TUNNEL_REVOKED" {
+		t.Errorf("request to a revoked tunnel = %d %s, want 403 TUNNEL_REVOKED", w.Code, errResp.Code)
+	}
+
+	// The record stays for admins to look at
+	if ids := listIDs(t, ts.do(http.MethodGet, "", "/api/tunnels", "admin", "")); !ids[created.ID] {
+		t.Error("revoked tunnel missing from the admin list")
+	}
+
+	if w := ts.do(http.MethodPost, "", "/api/admin/tunnel/nope/revoke", "admin", ""); w.Code != http.StatusNotFound {
+		t.Errorf("revoke of an unknown tunnel = %d, want 404", w.Code)
+	}
+}
+
+func TestListFilteredByLabels(t *testing.T) {
+	ts := newTestServer(t, Config{}, testKeys{})
+	staging := ts.createTunnel(t, "3000", "", `{"labels":{"env":"staging","team":"payments"}}`)
+	prod := ts.createTunnel(t, "3000", "", `{"labels":{"env":"prod","team":"payments"}}`)
+	unlabeled := ts.createTunnel(t, "3000", "", "")
+	if staging.Labels["env"] != "staging" {
+		t.Errorf("created labels = %v", staging.Labels)
+	}
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"", []string{staging.ID, prod.ID, unlabeled.ID}},
+		{"?label=env:staging", []string{staging.ID}},
+		{"?label=team:payments", []string{staging.ID, prod.ID}},
+		{"?label=team:payments&label=env:prod", []string{prod.ID}},
+		{"?label=env:dev", nil},
+	}
+	for _, tt := range tests {
+		got := listIDs(t, ts.do(http.MethodGet, "", "/api/tunnels"+tt.query, "", ""))
+		if len(got) != len(tt.want) {
+			t.Errorf("%q lists %v, want %v", tt.query, got, tt.want)
+			continue
+		}
+		for _, id := range tt.want {
+			if !got[id] {
+				t.Errorf("%q lists %v, want %v", tt.query, got, tt.want)
+			}
+		}
+	}
+
+	for _, query := range []string{"?label=env", "?label=:staging", "?label=env:a b"} {
+		w := ts.do(http.MethodGet, "", "/api/tunnels"+strings.ReplaceAll(query, " ", "%20"), "", "")
+		var resp ErrorResponse
+		decode(t, w, &resp)
+		if w.Code != http.StatusBadRequest || resp.Code != "INVALID_LABEL_SELECTOR" {
+			t.Errorf("%q = %d %s, want 400 INVALID_LABEL_SELECTOR", query, w.Code, resp.Code)
+		}
+	}
+}
+
+func TestHumanizeDuration(t *testing.T) {
+	tests := []struct {
+		d    time.Duration
+		want string
+	}{
+		{0, "0m"},
+		{-time.Minute, "0m"},
+		{29 * time.Second, "0m"},
+		{59 * time.Second, "0m"},
+		{90 * time.Minute, "1h 30m"},
+		{2 * time.Hour, "2h"},
+		{23*time.Hour + 59*time.Minute + 59*time.Second + 900*time.Millisecond, "23h 59m"},
+		{23*time.Hour + 58*time.Minute + 10*time.Second, "23h 58m"},
+		{26*time.Hour + 5*time.Minute, "1d 2h 5m"},
+		{7*24*time.Hour + time.Minute, "7d 1m"},
+	}
+	for _, tt := range tests {
+		if got := humanizeDuration(tt.d); got != tt.want {
+			t.Errorf("humanizeDuration(%v) = %q, want %q", tt.d, got, tt.want)
+		}
+	}
+}
+
+func TestTunnelResponseTTL(t *testing.T) {
+	ts := newTestServer(t, Config{}, testKeys{})
+	created := ts.tunnelResponse(&tunnel.Info{ExpiresAt: time.Now().Add(30 * time.Minute)})
+	if created.TTLSeconds < 1790 || created.TTLSeconds > 1800 || created.TTLHuman != "29m" {
+		t.Errorf("ttl_seconds = %d, ttl_human = %q; want about 1800 and 29m", created.TTLSeconds, created.TTLHuman)
+	}
+
+	expired := ts.tunnelResponse(&tunnel.Info{ExpiresAt: time.Now().Add(-time.Minute)})
+	if expired.TTLSeconds != 0 || expired.TTLHuman != "0m" {
+		t.Errorf("expired ttl_seconds = %d, ttl_human = %q; want 0 and 0m", expired.TTLSeconds, expired.TTLHuman)
+	}
+}
+
+func TestCreateReusesExistingTunnel(t *testing.T) {
+	ts := newTestServer(t, Config{}, testKeys{api: []string{"key-a", "key-b"}})
+	first := ts.createTunnel(t, "3000", "key-a", "")
+
+	reuse := func(port, key string) (int, TunnelResponse) {
+		t.Helper()
+		w := ts.do(http.MethodPost, "", "/api/tunnel/"+port+"?reuse_existing=true", key, "")
+		var resp TunnelResponse
+		decode(t, w, &resp)
+		return w.Code, resp
+	}
+
+	if code, got := reuse("3000", "key-a"); code != http.StatusOK || got.ID != first.ID {
+		t.Errorf("reuse = %d %s, want 200 with %s", code, got.ID, first.ID)
+	}
+	if code, got := reuse("3001", "key-a"); code != http.StatusCreated || got.ID == first.ID {
+		t.Errorf("reuse for another port = %d %s, want a new tunnel", code, got.ID)
+	}
+	if code, got := reuse("3000", "key-b"); code != http.StatusCreated || got.ID == first.ID {
+		t.Errorf("reuse by another key = %d %s, want a new tunnel", code, got.ID)
+	}
+
+	// Without the option, or once the tunnel is revoked, a new one is made
+	if again := ts.createTunnel(t, "3000", "key-a", ""); again.ID == first.ID {
+		t.Error("create without reuse_existing returned the existing tunnel")
+	}
+	if _, _, err := ts.reg.RevokeTunnel(first.ID); err != nil {
+		t.Fatal(err)
+	}
+	if code, got := reuse("3000", "key-a"); code == http.StatusOK && got.ID == first.ID {
+		t.Error("reuse returned a revoked tunnel")
+	}
+}
+
+func TestProvisionSimpleErrors(t *testing.T) {
+	ts := newTestServer(t, Config{}, testKeys{})
+
+	// curl gets the message as text and the code in a header
+	w := ts.do(http.MethodGet, "", "/70000", "", "")
+	if w.Code != http.StatusBadRequest || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") {
+		t.Fatalf("provision = %d %s, want a text/plain 400", w.Code, w.Header().Get("Content-Type"))
+	}
+	if code := w.Header().Get("X-Arbok-Error-Code"); code != string(CodeInvalidPort) {
+		t.Errorf("X-Arbok-Error-Code = %q, want %s", code, CodeInvalidPort)
+	}
+
+	// Clients that accept JSON get an ErrorResponse
+	r := httptest.NewRequest(http.MethodGet, "/70000", nil)
+	r.Host = ts.cfg.Domain
+	r.Header.Set("Accept", "application/json")
+	w = httptest.NewRecorder()
+	ts.router.ServeHTTP(w, r)
+	var resp ErrorResponse
+	decode(t, w, &resp)
+	if w.Code != http.StatusBadRequest || resp.Code != CodeInvalidPort || resp.Error == "" {
+		t.Errorf("provision = %d %+v, want 400 %s", w.Code, resp, CodeInvalidPort)
+	}
+}
+
+func TestResponseHasUnixTimes(t *testing.T) {
+	ts := newTestServer(t, Config{}, testKeys{})
+	created := ts.createTunnel(t, "3000", "", "")
+	if created.CreatedAtUnix != created.CreatedAt.Unix() || created.ExpiresAtUnix != created.ExpiresAt.Unix() {
+		t.Errorf("unix times = %d/%d, want %d/%d", created.CreatedAtUnix, created.ExpiresAtUnix,
+			created.CreatedAt.Unix(), created.ExpiresAt.Unix())
+	}
+	if created.CreatedAtUnix == 0 || created.ExpiresAtUnix <= created.CreatedAtUnix {
+		t.Errorf("unix times = %d/%d, want expiry after creation", created.CreatedAtUnix, created.ExpiresAtUnix)
+	}
+}
+
+func TestReconcileKeepsLivePeers(t *testing.T) {
+	ts := newTestServer(t, Config{}, testKeys{api: []string{"user"}, admin: []string{"admin"}})
+	live := ts.backendAs(t, "admin", "", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "up")
+	}))
+	ts.createTunnel(t, "3001", "user", "")
+	if w := ts.proxy(t, live, http.MethodGet, "/", ""); w.Code != http.StatusOK {
+		t.Fatalf("request = %d %s", w.Code, w.Body)
+	}
+
+	if w := ts.do(http.MethodPost, "", "/api/admin/reconcile", "user", ""); w.Code != http.StatusForbidden {
+		t.Errorf("reconcile as a user = %d, want 403", w.Code)
+	}
+	w := ts.do(http.MethodPost, "", "/api/admin/reconcile", "admin", "")
+	var resp ReconcileResponse
+	decode(t, w, &resp)
+	if w.Code != http.StatusOK || resp.Peers != 2 {
+		t.Fatalf("reconcile = %d %+v, want 200 with 2 peers", w.Code, resp)
+	}
+
+	// The connected peer was kept as is, session included
+	if w := ts.proxy(t, live, http.MethodGet, "/", ""); w.Code != http.StatusOK || w.Body.String() != "up" {
+		t.Errorf("request after reconcile = %d %q, want the backend", w.Code, w.Body)
+	}
+}
+
+func TestReady(t *testing.T) {
+	ts := newTestServer(t, Config{}, testKeys{})
+
+	var resp struct {
+		Status string            `json:"status"`
+		Checks map[string]string `json:"checks"`
+	}
+	w := ts.do(http.MethodGet, "", "/ready", "", "")
+	decode(t, w, &resp)
+	if w.Code != http.StatusOK || resp.Status != "ready" {
+		t.Fatalf("ready = %d %+v", w.Code, resp)
+	}
+	for _, check := range []string{"tunnel", "cleanup", "wireguard"} {
+		if resp.Checks[check] != "ok" {
+			t.Errorf("check %s = %q, want ok", check, resp.Checks[check])
+		}
+	}
+
+	ts.tun.Close()
+	w = ts.do(http.MethodGet, "", "/ready", "", "")
+	decode(t, w, &resp)
+	if w.Code != http.StatusServiceUnavailable || resp.Status != "not ready" || resp.Checks["tunnel"] != "closed" {
+		t.Errorf("ready after close = %d %+v, want 503 with the tunnel closed", w.Code, resp)
+	}
+}
+
+func TestTunnelDescription(t *testing.T) {
+	ts := newTestServer(t, Config{}, testKeys{api: []string{"key-a", "key-b"}})
+	created := ts.createTunnel(t, "3000", "key-a", `{"description":"PR #123 preview"}`)
+	if created.Description != "PR #123 preview" {
+		t.Fatalf("created with description %q", created.Description)
+	}
+
+	w := ts.do(http.MethodPut, "", "/api/tunnel/"+created.ID, "key-a", `{"description":"demo for client X"}`)
+	var updated TunnelResponse
+	decode(t, w, &updated)
+	if w.Code != http.StatusOK || updated.Description != "demo for client X" {
+		t.Fatalf("update = %d %q", w.Code, updated.Description)
+	}
+	// Omitted fields are left alone
+	if w := ts.do(http.MethodPut, "", "/api/tunnel/"+created.ID, "key-a", `{}`); w.Code != http.StatusOK {
+		t.Fatalf("empty update = %d %s", w.Code, w.Body)
+	}
+
+	w = ts.do(http.MethodGet, "", "/api/my/tunnels", "key-a", "")
+	var list struct {
+		Tunnels []TunnelResponse `json:"tunnels"`
+	}
+	decode(t, w, &list)
+	if len(list.Tunnels) != 1 || list.Tunnels[0].Description != "demo for client X" {
+		t.Errorf("list = %+v, want the updated description", list.Tunnels)
+	}
+
+	long := `{"description":"` + strings.Repeat("a", maxDescriptionLength+1) + `"}`
+	if w := ts.do(http.MethodPut, "", "/api/tunnel/"+created.ID, "key-a", long); w.Code != http.StatusBadRequest {
+		t.Errorf("too long description = %d, want 400", w.Code)
+	}
+	if w := ts.do(http.MethodPut, "", "/api/tunnel/"+created.ID, "key-b", `{"description":"mine"}`); w.Code != http.StatusNotFound {
+		t.Errorf("updating another key's tunnel = %d, want 404", w.Code)
+	}
+	if got := ts.reg.GetTunnel(created.ID).Description; got != "demo for client X" {
+		t.Errorf("description = %q after rejected updates", got)
+	}
+}
+
+func TestCleanupEndpoint(t *testing.T) {
+	ts := newTestServer(t, Config{}, testKeys{api: []string{"user"}, admin: []string{"admin"}})
+	expired, err := ts.reg.CreateTunnel(3000, registry.CreateOptions{TTL: time.Nanosecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	live := ts.createTunnel(t, "3001", "user", "")
+
+	if w := ts.do(http.MethodPost, "", "/api/admin/cleanup", "user", ""); w.Code != http.StatusForbidden {
+		t.Errorf("cleanup as a user = %d, want 403", w.Code)
+	}
+	w := ts.do(http.MethodPost, "", "/api/admin/cleanup", "admin", "")
+	var resp CleanupResponse
+	decode(t, w, &resp)
+	if w.Code != http.StatusOK || resp.Reaped != 1 {
+		t.Fatalf("cleanup = %d %+v, want 200 with 1 reaped", w.Code, resp)
+	}
+	if ts.reg.GetTunnel(expired.ID) != nil || ts.reg.GetTunnel(live.ID) == nil {
+		t.Error("cleanup didn't reap just the expired tunnel")
+	}
+}
+
+func TestPortSetLaterServesTraffic(t *testing.T) {
+	ts := newTestServer(t, Config{}, testKeys{})
+	created := ts.createTunnel(t, "0?include_config=true", "", "")
+	tnet := ts.connectPeer(t, created.ID, created.PrivateKey)
+	ln, err := tnet.ListenTCP(&net.TCPAddr{Port: 8080})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "late backend")
+	})}
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	if w := ts.proxy(t, created, http.MethodGet, "/", ""); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("request without port = %d, want 503", w.Code)
+	}
+	if w := ts.do(http.MethodPut, "", "/api/tunnel/"+created.ID, "", `{"port":70000}`); w.Code != http.StatusBadRequest {
+		t.Errorf("PUT port 70000 = %d, want 400", w.Code)
+	}
+	if w := ts.do(http.MethodPut, "", "/api/tunnel/"+created.ID, "", `{"port":8080}`); w.Code != http.StatusOK {
+		t.Fatalf("set port: %d %s", w.Code, w.Body)
+	}
+	if w := ts.proxy(t, created, http.MethodGet, "/", ""); w.Code != http.StatusOK || w.Body.String() != "late backend" {
+		t.Errorf("request after setting the port = %d %q, want the backend", w.Code, w.Body)
+	}
+}
+
+func TestProvisionSimpleWithoutPort(t *testing.T) {
+	ts := newTestServer(t, Config{}, testKeys{})
+	w := ts.do(http.MethodGet, "", "/0", "", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("provision /0 = %d %s", w.Code, w.Body)
+	}
+	tunnels := ts.reg.ListTunnels()
+	if len(tunnels) != 1 || tunnels[0].Port != 0 {
+		t.Fatalf("tunnels = %v, want one without a port", tunnels)
+	}
+	if want := "/api/tunnel/" + tunnels[0].ID + ` -d '{"port":3000}'`; !strings.Contains(w.Body.String(), want) {
+		t.Errorf("instructions lack how to set the port:\n%s", w.Body)
+	}
+}
@@ -0,0 +1,43 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// Defaults for inbound header limits
+const (
+	DefaultMaxHeaderCount = 100
+	DefaultMaxHeaderBytes = 64 << 10
+)
+
+// headerSizeOverhead is counted per header line on top of its name and
+// value, for the ": " and CRLF
+const headerSizeOverhead = 4
+
+// limitHeaders refuses requests with more than MaxHeaderCount header
+// lines or MaxHeaderBytes of headers with a 431, before routing or
+// proxying. The stdlib's MaxHeaderBytes still bounds parsing, but answers
+// without an error body.
+func (s *Server) limitHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		count, size := 0, 0
+		for name, values := range r.Header {
+			count += len(values)
+			for _, v := range values {
+				size += len(name) + len(v) + headerSizeOverhead
+			}
+		}
+
+		switch {
+		case count > s.cfg.MaxHeaderCount:
+			respondErrorDetails(w, http.StatusRequestHeaderFieldsTooLarge, CodeHeadersTooLarge, "Request header fields too large",
+				fmt.Sprintf("%d headers, at most %d allowed", count, s.cfg.MaxHeaderCount))
+		case size > s.cfg.MaxHeaderBytes:
+			respondErrorDetails(w, http.StatusRequestHeaderFieldsTooLarge, CodeHeadersTooLarge, "Request header fields too large",
+				fmt.Sprintf("%d bytes of headers, at most %d allowed", size, s.cfg.MaxHeaderBytes))
+		default:
+			next.ServeHTTP(w, r)
+		}
+	})
+}
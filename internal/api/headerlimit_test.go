@@ -0,0 +1,54 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHeaderLimits(t *testing.T) {
+	ts := newTestServer(t, Config{MaxHeaderCount: 10, MaxHeaderBytes: 1024}, testKeys{})
+	tun := ts.backend(t, "", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	tunnelHost := tun.Subdomain + "." + ts.cfg.Domain
+
+	many := http.Header{}
+	for i := range 11 {
+		many.Set(fmt.Sprintf("X-Header-%d", i), "v")
+	}
+	repeated := http.Header{"X-Repeated": make([]string, 11)}
+	large := http.Header{"Cookie": {strings.Repeat("a", 1024)}}
+
+	for _, tc := range []struct {
+		name   string
+		host   string
+		path   string
+		header http.Header
+		code   int
+	}{
+		{"API within limits", ts.cfg.Domain, "/health", http.Header{"X-Ok": {"1"}}, http.StatusOK},
+		{"tunnel within limits", tunnelHost, "/", http.Header{"X-Ok": {"1"}}, http.StatusOK},
+		{"API with too many headers", ts.cfg.Domain, "/health", many, http.StatusRequestHeaderFieldsTooLarge},
+		{"tunnel with too many headers", tunnelHost, "/", many, http.StatusRequestHeaderFieldsTooLarge},
+		{"repeated header lines", tunnelHost, "/", repeated, http.StatusRequestHeaderFieldsTooLarge},
+		{"tunnel with large headers", tunnelHost, "/", large, http.StatusRequestHeaderFieldsTooLarge},
+	} {
+		r := httptest.NewRequest(http.MethodGet, tc.path, nil)
+		r.Host = tc.host
+		r.Header = tc.header
+		w := httptest.NewRecorder()
+		ts.router.ServeHTTP(w, r)
+		if w.Code != tc.code {
+			t.Errorf("%s: %d %s, want %d", tc.name, w.Code, w.Body, tc.code)
+			continue
+		}
+		if tc.code != http.StatusOK {
+			var resp ErrorResponse
+			decode(t, w, &resp)
+			if resp.Code != CodeHeadersTooLarge || resp.Details == nil {
+				t.Errorf("%s: error %s %v, want %s with details", tc.name, resp.Code, resp.Details, CodeHeadersTooLarge)
+			}
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package api
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// errBodyTooLarge is returned for bodies that decode past the buffering
+// limit
+var errBodyTooLarge = errors.New("body too large")
+
+// injectHTML inserts the configured snippet right after the <body> tag of
+// HTML responses, e.g. for maintenance banners. gzip and deflate bodies
+// are decoded and re-encoded. Streaming responses (see
+// IsStreamingResponse) and responses in other encodings, without a <body>
+// tag, in a charset the snippet can't be written in, or larger than
+// MaxBufferedBodyBytes are passed on untouched.
+func (s *Server) injectHTML(resp *http.Response) error {
+	snippet := s.cfg.InjectHTML
+	if snippet == "" || resp.StatusCode != http.StatusOK || resp.Request.Method == http.MethodHead {
+		return nil
+	}
+	if IsStreamingResponse(resp, s.cfg.MaxBufferedBodyBytes) {
+		return nil
+	}
+	mediaType, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || mediaType != "text/html" || !snippetFitsCharset(snippet, params["charset"]) {
+		return nil
+	}
+	encoding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding")))
+	if encoding != "" && encoding != "identity" && encoding != "gzip" && encoding != "deflate" {
+		return nil
+	}
+
+	peeked, complete, err := PeekResponseBody(resp, s.cfg.MaxBufferedBodyBytes)
+	if err != nil {
+		return err
+	}
+	if !complete {
+		return nil
+	}
+
+	page, err := decodeBody(peeked, encoding, s.cfg.MaxBufferedBodyBytes)
+	if err != nil {
+		// Not what it claims to be, or too large once decoded
+		return nil
+	}
+	if params["charset"] == "" && (bytes.HasPrefix(page, []byte{0xfe, 0xff}) || bytes.HasPrefix(page, []byte{0xff, 0xfe})) {
+		// UTF-16, by its byte order mark
+		return nil
+	}
+	at := bodyTagEnd(page)
+	if at < 0 {
+		return nil
+	}
+
+	injected := make([]byte, 0, len(page)+len(snippet))
+	injected = append(injected, page[:at]...)
+	injected = append(injected, snippet...)
+	injected = append(injected, page[at:]...)
+	body, err := encodeBody(injected, encoding)
+	if err != nil {
+		return err
+	}
+
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	// The bytes changed, so a strong validator no longer matches them
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		resp.Header.Set("ETag", "W/"+etag)
+	}
+	return nil
+}
+
+// snippetFitsCharset reports whether snippet, which is UTF-8, can be
+// inserted verbatim into a page in charset. Pages without a charset are
+// assumed to be UTF-8; ASCII snippets fit every ASCII-compatible charset.
+func snippetFitsCharset(snippet, charset string) bool {
+	switch strings.ToLower(charset) {
+	case "", "utf-8", "utf8":
+		return true
+	case "utf-16", "utf-16le", "utf-16be", "utf-32", "utf-32le", "utf-32be":
+		return false
+	}
+	for i := 0; i < len(snippet); i++ {
+		if snippet[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
+
+// bodyTagEnd returns the offset just past the page's <body> start tag, or
+// -1 without one. Tag names are matched case-insensitively.
+func bodyTagEnd(page []byte) int {
+	for i := 0; ; {
+		j := bytes.IndexByte(page[i:], '<')
+		if j < 0 {
+			return -1
+		}
+		i += j + 1
+		if len(page)-i < 5 || !strings.EqualFold(string(page[i:i+4]), "body") {
+			continue
+		}
+		switch page[i+4] {
+		case '>', ' ', '\t', '\n', '\r', '\f', '/':
+		default:
+			continue
+		}
+		end := bytes.IndexByte(page[i:], '>')
+		if end < 0 {
+			return -1
+		}
+		return i + end + 1
+	}
+}
+
+// decodeBody undoes a gzip or deflate content encoding, refusing results
+// over limit bytes
+func decodeBody(body []byte, encoding string, limit int64) ([]byte, error) {
+	var r io.ReadCloser
+	var err error
+	switch encoding {
+	case "gzip":
+		r, err = gzip.NewReader(bytes.NewReader(body))
+	case "deflate":
+		r, err = zlib.NewReader(bytes.NewReader(body))
+	default:
+		return body, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	decoded, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(decoded)) > limit {
+		return nil, errBodyTooLarge
+	}
+	return decoded, nil
+}
+
+// encodeBody applies a gzip or deflate content encoding
+func encodeBody(body []byte, encoding string) ([]byte, error) {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch encoding {
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	case "deflate":
+		w = zlib.NewWriter(&buf)
+	default:
+		return body, nil
+	}
+	if _, err := w.Write(body); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,198 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testBanner = `<div id="banner">Maintenance at 2am</div>`
+
+func TestInjectHTMLThroughProxy(t *testing.T) {
+	ts := newTestServer(t, Config{InjectHTML: testBanner}, testKeys{})
+	tun := ts.backend(t, "", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/page":
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Header().Set("ETag", `"v1"`)
+			io.WriteString(w, `<html><BODY class="app"><p>hi</p></BODY></html>`)
+		case "/data":
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, `{"body":"<body>"}`)
+		}
+	}))
+
+	w := ts.proxy(t, tun, http.MethodGet, "/page", "")
+	want := `<html><BODY class="app">` + testBanner + `<p>hi</p></BODY></html>`
+	if w.Code != http.StatusOK || w.Body.String() != want {
+		t.Fatalf("page = %d %q, want %q", w.Code, w.Body, want)
+	}
+	if etag := w.Header().Get("ETag"); etag != `W/"v1"` {
+		t.Errorf("ETag = %q, want it weakened", etag)
+	}
+
+	if w := ts.proxy(t, tun, http.MethodGet, "/data", ""); w.Body.String() != `{"body":"<body>"}` {
+		t.Errorf("JSON = %q, want it untouched", w.Body)
+	}
+}
+
+// injectInto runs injectHTML on a response with header and body and
+// returns the decoded result
+func injectInto(t *testing.T, s *Server, header http.Header, body []byte) string {
+	t.Helper()
+	resp := &http.Response{
+		StatusCode:    http.StatusOK,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       httptest.NewRequest(http.MethodGet, "/", nil),
+	}
+	if err := s.injectHTML(resp); err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.ContentLength != int64(len(got)) {
+		t.Errorf("ContentLength = %d, body is %d bytes", resp.ContentLength, len(got))
+	}
+	got, err = decodeBody(got, header.Get("Content-Encoding"), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(got)
+}
+
+func TestInjectHTML(t *testing.T) {
+	ts := newTestServer(t, Config{InjectHTML: testBanner}, testKeys{})
+	const page = "<html><body>hi</body></html>"
+	injected := "<html><body>" + testBanner + "hi</body></html>"
+
+	for _, encoding := range []string{"", "gzip", "deflate"} {
+		body, err := encodeBody([]byte(page), encoding)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h := http.Header{"Content-Type": {"text/html"}}
+		if encoding != "" {
+			h.Set("Content-Encoding", encoding)
+		}
+		if got := injectInto(t, ts.Server, h, body); got != injected {
+			t.Errorf("%q encoding: page = %q, want %q", encoding, got, injected)
+		}
+	}
+
+	for _, tc := range []struct {
+		name   string
+		header http.Header
+		page   string
+	}{
+		{"no body tag", http.Header{"Content-Type": {"text/html"}}, "<html><bodyish>hi</bodyish></html>"},
+		{"other encoding", http.Header{"Content-Type": {"text/html"}, "Content-Encoding": {"br"}}, page},
+		{"UTF-16 charset", http.Header{"Content-Type": {"text/html; charset=utf-16"}}, page},
+		{"not HTML", http.Header{"Content-Type": {"text/plain"}}, page},
+	} {
+		if got := injectInto(t, ts.Server, tc.header, []byte(tc.page)); got != tc.page {
+			t.Errorf("%s: page = %q, want it untouched", tc.name, got)
+		}
+	}
+
+	// Non-ASCII snippets only go into UTF-8 pages
+	ts.cfg.InjectHTML = "<p>café</p>"
+	latin1 := http.Header{"Content-Type": {"text/html; charset=iso-8859-1"}}
+	if got := injectInto(t, ts.Server, latin1, []byte(page)); got != page {
+		t.Errorf("latin-1 page = %q, want it untouched", got)
+	}
+	if got := injectInto(t, ts.Server, http.Header{"Content-Type": {"text/html"}}, []byte(page)); !strings.Contains(got, "café") {
+		t.Errorf("UTF-8 page = %q, want the snippet", got)
+	}
+}
+
+func TestBodyTagEnd(t *testing.T) {
+	for page, want := range map[string]int{
+		"<body>":                     6,
+		"<html><Body id=x>":          17,
+		"<body\n>":                   7,
+		"<bodyx><body>":              13,
+		"<!-- no body -->":           -1,
+		"<body":                      -1,
+		"<html><head></head></html>": -1,
+	} {
+		if got := bodyTagEnd([]byte(page)); got != want {
+			t.Errorf("bodyTagEnd(%q) = %d, want %d", page, got, want)
+		}
+	}
+}
+
+func TestInjectHTMLPassesStreamsThrough(t *testing.T) {
+	for _, contentType := range []string{"text/event-stream", "text/html"} {
+		t.Run(contentType, func(t *testing.T) {
+			testInjectHTMLPassesStreamThrough(t, contentType)
+		})
+	}
+}
+
+// testInjectHTMLPassesStreamThrough proxies a chunked stream of
+// contentType with injection enabled
+func testInjectHTMLPassesStreamThrough(t *testing.T, contentType string) {
+	ts := newTestServer(t, Config{InjectHTML: testBanner}, testKeys{})
+	next := make(chan struct{})
+	tun := ts.backend(t, "", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		io.WriteString(w, "data: <body>first\n\n")
+		w.(http.Flusher).Flush()
+		<-next
+		io.WriteString(w, "data: second\n\n")
+	}))
+	srv := httptest.NewServer(ts.proxyHandler())
+	defer srv.Close()
+
+	req, err := http.NewRequest(http.MethodGet, srv.URL+"/events", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = tun.Subdomain + "." + ts.cfg.Domain
+
+	// The first event arrives while the backend holds back the second,
+	// so the proxy can't be buffering the stream
+	var resp *http.Response
+	var br *bufio.Reader
+	read := make(chan error, 1)
+	go func() {
+		var err error
+		if resp, err = srv.Client().Do(req); err != nil {
+			read <- err
+			return
+		}
+		br = bufio.NewReader(resp.Body)
+		line, err := br.ReadString('\n')
+		if err == nil && line != "data: <body>first\n" {
+			err = fmt.Errorf("first event = %q, want it untouched", line)
+		}
+		read <- err
+	}()
+	select {
+	case err := <-read:
+		if err != nil {
+			close(next)
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		close(next)
+		t.Fatal("first event held back until the stream ends")
+	}
+	defer resp.Body.Close()
+	close(next)
+
+	rest, err := io.ReadAll(br)
+	if err != nil || string(rest) != "\ndata: second\n\n" {
+		t.Errorf("rest of stream = %q, %v", rest, err)
+	}
+}
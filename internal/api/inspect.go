@@ -0,0 +1,351 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+	"github.com/mr-karan/arbok/internal/apikey"
+	"github.com/mr-karan/arbok/internal/auth"
+	"github.com/mr-karan/arbok/internal/registry"
+	"github.com/mr-karan/arbok/internal/tunnel"
+)
+
+// Defaults for the request inspector
+const (
+	DefaultInspectRequests  = 50
+	DefaultInspectBodyBytes = 32 << 10
+)
+
+// The inspector keeps the last few proxied requests of each tunnel in
+// memory so their owners can see what reached the backend. Credential
+// headers are recorded redacted so the records never hold secrets. Bodies
+// are only recorded when body capture is enabled, and then only their
+// first InspectBodyBytes: they are teed off while streaming, never
+// buffered ahead of the backend.
+
+// InspectedRequest is a proxied request recorded by the inspector
+type InspectedRequest struct {
+	ID         string        `json:"id"`
+	Time       time.Time     `json:"time"`
+	Method     string        `json:"method"`
+	URI        string        `json:"uri"`
+	RemoteAddr string        `json:"remote_addr"`
+	Header     http.Header   `json:"header"`
+	Status     int           `json:"status,omitempty"`
+	RespHeader http.Header   `json:"response_header,omitempty"`
+	Duration   time.Duration `json:"duration_ns"`
+	Error      string        `json:"error,omitempty"`
+	// HasBody reports whether bodies were captured for this request
+	HasBody bool `json:"has_body"`
+
+	reqBody  *bodyCapture
+	respBody *bodyCapture
+}
+
+// CapturedBody is a recorded body. Data is plain text when the captured
+// bytes are valid UTF-8 and base64 otherwise.
+type CapturedBody struct {
+	Encoding  string `json:"encoding"`
+	Data      string `json:"data"`
+	Size      int64  `json:"size"`
+	Truncated bool   `json:"truncated"`
+}
+
+// InspectedBodies is the response of the request body endpoint
+type InspectedBodies struct {
+	Request  CapturedBody `json:"request"`
+	Response CapturedBody `json:"response"`
+}
+
+// bodyCapture tees up to limit bytes of a body as it streams past and
+// counts the rest
+type bodyCapture struct {
+	io.ReadCloser
+
+	mu    sync.Mutex
+	limit int
+	buf   bytes.Buffer
+	size  int64
+}
+
+func (c *bodyCapture) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	if n > 0 {
+		c.mu.Lock()
+		if room := c.limit - c.buf.Len(); room > 0 {
+			c.buf.Write(p[:min(n, room)])
+		}
+		c.size += int64(n)
+		c.mu.Unlock()
+	}
+	return n, err
+}
+
+// captured returns the recorded body
+func (c *bodyCapture) captured() CapturedBody {
+	if c == nil {
+		return CapturedBody{Encoding: "utf8"}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	body := CapturedBody{
+		Encoding:  "utf8",
+		Size:      c.size,
+		Truncated: c.size > int64(c.buf.Len()),
+	}
+	if utf8.Valid(c.buf.Bytes()) {
+		body.Data = c.buf.String()
+	} else {
+		body.Encoding = "base64"
+		body.Data = base64.StdEncoding.EncodeToString(c.buf.Bytes())
+	}
+	return body
+}
+
+// inspector holds the recorded requests of every tunnel
+type inspector struct {
+	mu        sync.Mutex
+	byTunnel  map[string][]*InspectedRequest
+	max       int
+	bodyBytes int
+}
+
+func newInspector(max int, bodyBytes int64) *inspector {
+	return &inspector{
+		byTunnel:  make(map[string][]*InspectedRequest),
+		max:       max,
+		bodyBytes: int(bodyBytes),
+	}
+}
+
+// inspectKey is the context key of the request being recorded
+type inspectKey struct{}
+
+// begin starts recording r, teeing its body when capture is enabled. The
+// returned request carries the record for the proxy's hooks.
+func (in *inspector) begin(r *http.Request) (*InspectedRequest, *http.Request) {
+	var id [8]byte
+	rand.Read(id[:])
+	rec := &InspectedRequest{
+		ID:         hex.EncodeToString(id[:]),
+		Time:       time.Now(),
+		Method:     r.Method,
+		URI:        r.RequestURI,
+		RemoteAddr: r.RemoteAddr,
+		Header:     redactHeader(r.Header),
+		HasBody:    in.bodyBytes > 0,
+	}
+	if rec.HasBody {
+		rec.reqBody = &bodyCapture{ReadCloser: http.NoBody, limit: in.bodyBytes}
+		if r.Body != nil && r.Body != http.NoBody {
+			rec.reqBody.ReadCloser = r.Body
+			r.Body = rec.reqBody
+		}
+	}
+	return rec, r.WithContext(context.WithValue(r.Context(), inspectKey{}, rec))
+}
+
+// response records a backend response, teeing its body when capture is
+// enabled. It is called from the proxy's ModifyResponse.
+func (in *inspector) response(resp *http.Response) {
+	rec, _ := resp.Request.Context().Value(inspectKey{}).(*InspectedRequest)
+	if rec == nil {
+		return
+	}
+	rec.Status = resp.StatusCode
+	rec.RespHeader = redactHeader(resp.Header)
+	if rec.HasBody {
+		rec.respBody = &bodyCapture{ReadCloser: resp.Body, limit: in.bodyBytes}
+		resp.Body = rec.respBody
+	}
+}
+
+// redactedValue replaces the values of credential headers in records
+const redactedValue = "[redacted]"
+
+// credentialHeaders are the headers whose values are never recorded
+var credentialHeaders = []string{
+	"Authorization",
+	"Proxy-Authorization",
+	"Cookie",
+	"Set-Cookie",
+	"X-Api-Key",
+	"X-Auth-Token",
+	"X-Csrf-Token",
+}
+
+// redactHeader returns a copy of h with credential values replaced
+func redactHeader(h http.Header) http.Header {
+	h = h.Clone()
+	for _, name := range credentialHeaders {
+		if values := h[name]; len(values) > 0 {
+			h[name] = slices.Repeat([]string{redactedValue}, len(values))
+		}
+	}
+	return h
+}
+
+// fail records why a request never got a backend response
+func (in *inspector) fail(r *http.Request, err error) {
+	if rec, _ := r.Context().Value(inspectKey{}).(*InspectedRequest); rec != nil {
+		rec.Error = err.Error()
+	}
+}
+
+// finish stores a completed record, dropping the tunnel's oldest once
+// more than max are kept
+func (in *inspector) finish(t *tunnel.Info, rec *InspectedRequest) {
+	rec.Duration = time.Since(rec.Time)
+
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	recs := append(in.byTunnel[t.ID], rec)
+	if len(recs) > in.max {
+		recs = append(recs[:0:0], recs[len(recs)-in.max:]...)
+	}
+	in.byTunnel[t.ID] = recs
+}
+
+// CapturedRequest is the data of a request_captured event, a summary of
+// the record served at /api/tunnel/{id}/requests
+type CapturedRequest struct {
+	ID       string        `json:"id"`
+	Method   string        `json:"method"`
+	URI      string        `json:"uri"`
+	Status   int           `json:"status,omitempty"`
+	Duration time.Duration `json:"duration_ns"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// publishCapture announces a finished record to the tunnel's event
+// subscribers
+func (s *Server) publishCapture(t *tunnel.Info, rec *InspectedRequest) {
+	event := registry.TunnelEvent(registry.EventRequestCaptured, t)
+	event.Data = CapturedRequest{
+		ID:       rec.ID,
+		Method:   rec.Method,
+		URI:      rec.URI,
+		Status:   rec.Status,
+		Duration: rec.Duration,
+		Error:    rec.Error,
+	}
+	s.registry.Events().Publish(event)
+}
+
+// list returns a tunnel's records, newest first
+func (in *inspector) list(id string) []*InspectedRequest {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	recs := in.byTunnel[id]
+	out := make([]*InspectedRequest, 0, len(recs))
+	for i := len(recs) - 1; i >= 0; i-- {
+		out = append(out, recs[i])
+	}
+	return out
+}
+
+// get returns one of a tunnel's records
+func (in *inspector) get(id, reqID string) *InspectedRequest {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	for _, rec := range in.byTunnel[id] {
+		if rec.ID == reqID {
+			return rec
+		}
+	}
+	return nil
+}
+
+// evict drops a removed tunnel's records
+func (in *inspector) evict(t *tunnel.Info) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	delete(in.byTunnel, t.ID)
+}
+
+// canAccessTunnel reports whether the request's key owns t or is an
+// admin, or its share token is for t
+func (s *Server) canAccessTunnel(r *http.Request, t *tunnel.Info) bool {
+	if id := sharedTunnel(r.Context()); id != "" {
+		return id == t.ID
+	}
+	if s.auth.IsAdmin(r.Context()) {
+		return true
+	}
+	owner := ownerID(r)
+	return owner != "" && subtle.ConstantTimeCompare([]byte(owner), []byte(t.OwnerID)) == 1
+}
+
+// ownerID returns the owner ID tunnels created by the request's key are
+// recorded under, or "" without a key. Only the ID is kept with a tunnel
+// so that neither memory dumps nor the state file hold the key itself.
+func ownerID(r *http.Request) string {
+	key, _ := auth.GetAPIKey(r.Context())
+	if key == "" {
+		return ""
+	}
+	return apikey.ID(key)
+}
+
+// inspectedTunnel resolves the {id} of an inspector route, writing an
+// error when the inspector is off or the tunnel isn't the caller's
+func (s *Server) inspectedTunnel(w http.ResponseWriter, r *http.Request) *tunnel.Info {
+	if s.inspector == nil {
+		respondError(w, http.StatusNotFound, CodeInspectorDisabled, "The request inspector is disabled")
+		return nil
+	}
+	t := s.registry.GetTunnel(mux.Vars(r)["id"])
+	if t == nil || !s.canAccessTunnel(r, t) {
+		respondError(w, http.StatusNotFound, CodeTunnelNotFound, "Tunnel not found")
+		return nil
+	}
+	return t
+}
+
+// handleListRequests returns a tunnel's recently proxied requests
+func (s *Server) handleListRequests(w http.ResponseWriter, r *http.Request) {
+	t := s.inspectedTunnel(w, r)
+	if t == nil {
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"requests": s.inspector.list(t.ID),
+	})
+}
+
+// handleGetRequestBody returns the captured bodies of a recorded request
+func (s *Server) handleGetRequestBody(w http.ResponseWriter, r *http.Request) {
+	t := s.inspectedTunnel(w, r)
+	if t == nil {
+		return
+	}
+	rec := s.inspector.get(t.ID, mux.Vars(r)["reqID"])
+	if rec == nil {
+		respondError(w, http.StatusNotFound, CodeRequestNotFound, "Request not found")
+		return
+	}
+	if !rec.HasBody {
+		respondError(w, http.StatusNotFound, CodeBodyNotCaptured, "Bodies were not captured for this request")
+		return
+	}
+	writeJSON(w, http.StatusOK, InspectedBodies{
+		Request:  rec.reqBody.captured(),
+		Response: rec.respBody.captured(),
+	})
+}
@@ -0,0 +1,190 @@
+package api
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mr-karan/arbok/internal/tunnel"
+)
+
+// inspect runs req and resp through the inspector the way the proxy
+// does, streaming both bodies, and returns the record
+func inspect(t *testing.T, in *inspector, tun *tunnel.Info, req *http.Request, resp *http.Response) *InspectedRequest {
+	t.Helper()
+	rec, req := in.begin(req)
+	if _, err := io.ReadAll(req.Body); err != nil {
+		t.Fatal(err)
+	}
+	resp.Request = req
+	in.response(resp)
+	if _, err := io.ReadAll(resp.Body); err != nil {
+		t.Fatal(err)
+	}
+	in.finish(tun, rec)
+	return rec
+}
+
+// backendResponse returns a 200 response with body
+func backendResponse(body string) *http.Response {
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"text/plain"}},
+		Body:       io.NopCloser(strings.NewReader(body)),
+	}
+}
+
+func TestInspectorCapturesBodies(t *testing.T) {
+	ts := newTestServer(t, Config{InspectRequests: 10, InspectBodyBytes: 16}, testKeys{})
+	created := ts.createTunnel(t, "3000", "", "")
+	tun := ts.reg.GetTunnel(created.ID)
+
+	req := httptest.NewRequest(http.MethodPost, "/submit", strings.NewReader("hello"))
+	rec := inspect(t, ts.inspector, tun, req, backendResponse(strings.Repeat("x", 100)))
+
+	w := ts.do(http.MethodGet, "", "/api/tunnel/"+created.ID+"/requests/"+rec.ID+"/body", "", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("get body: %d %s", w.Code, w.Body)
+	}
+	var bodies InspectedBodies
+	decode(t, w, &bodies)
+
+	if got := bodies.Request; got.Data != "hello" || got.Size != 5 || got.Truncated {
+		t.Errorf("request body = %+v, want hello untruncated", got)
+	}
+	if got := bodies.Response; got.Data != strings.Repeat("x", 16) || got.Size != 100 || !got.Truncated {
+		t.Errorf("response body = %+v, want the first 16 of 100 bytes, truncated", got)
+	}
+}
+
+func TestInspectorEncodesBinaryBodies(t *testing.T) {
+	in := newInspector(10, 16)
+	tun := &tunnel.Info{ID: "t1"}
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("\xff\xfe"))
+	rec := inspect(t, in, tun, req, backendResponse(""))
+
+	if got := rec.reqBody.captured(); got.Encoding != "base64" || got.Data != "//4=" {
+		t.Errorf("binary body = %+v, want base64 //4=", got)
+	}
+}
+
+func TestInspectorRedactsCredentials(t *testing.T) {
+	ts := newTestServer(t, Config{InspectRequests: 10}, testKeys{})
+	created := ts.createTunnel(t, "3000", "", "")
+	tun := ts.reg.GetTunnel(created.ID)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	req.Header.Set("Cookie", "session=secret")
+	req.Header.Set("X-API-Key", "secret")
+	req.Header.Set("Accept", "text/html")
+	resp := backendResponse("ok")
+	resp.Header.Add("Set-Cookie", "session=secret")
+	resp.Header.Add("Set-Cookie", "other=secret")
+	inspect(t, ts.inspector, tun, req, resp)
+
+	w := ts.do(http.MethodGet, "", "/api/tunnel/"+created.ID+"/requests", "", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("list requests: %d %s", w.Code, w.Body)
+	}
+	if strings.Contains(w.Body.String(), "secret") {
+		t.Errorf("recorded requests hold credentials: %s", w.Body)
+	}
+	var list struct {
+		Requests []InspectedRequest `json:"requests"`
+	}
+	decode(t, w, &list)
+	got := list.Requests[0]
+	if got.Header.Get("Authorization") != redactedValue || got.Header.Get("Accept") != "text/html" {
+		t.Errorf("request header = %v, want Authorization redacted and Accept kept", got.Header)
+	}
+	if n := len(got.RespHeader.Values("Set-Cookie")); n != 2 {
+		t.Errorf("response has %d Set-Cookie values, want both redacted", n)
+	}
+
+	// The proxied request keeps its credentials
+	if req.Header.Get("Authorization") != "Bearer secret" {
+		t.Error("redaction changed the proxied request")
+	}
+}
+
+// listRequests returns the inspector's records of a tunnel through the API
+func (ts *testServer) listRequests(t *testing.T, id, key string) []InspectedRequest {
+	t.Helper()
+	w := ts.do(http.MethodGet, "", "/api/tunnel/"+id+"/requests", key, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("list requests: %d %s", w.Code, w.Body)
+	}
+	var list struct {
+		Requests []InspectedRequest `json:"requests"`
+	}
+	decode(t, w, &list)
+	return list.Requests
+}
+
+func TestInspectorRecordsProxiedRequests(t *testing.T) {
+	ts := newTestServer(t, Config{InspectRequests: 2}, testKeys{})
+	created := ts.backend(t, "", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}))
+
+	for _, path := range []string{"/one", "/two", "/three"} {
+		if w := ts.proxy(t, created, http.MethodPost, path, "body"); w.Code != http.StatusAccepted {
+			t.Fatalf("proxied request = %d %s", w.Code, w.Body)
+		}
+	}
+
+	recs := ts.listRequests(t, created.ID, "")
+	if len(recs) != 2 || recs[0].URI != "/three" || recs[1].URI != "/two" {
+		t.Fatalf("records = %+v, want /three then /two", recs)
+	}
+	if recs[0].Method != http.MethodPost || recs[0].Status != http.StatusAccepted || recs[0].HasBody {
+		t.Errorf("record = %+v, want POST answered 202 without bodies", recs[0])
+	}
+
+	// Bodies weren't captured
+	w := ts.do(http.MethodGet, "", "/api/tunnel/"+created.ID+"/requests/"+recs[0].ID+"/body", "", "")
+	var resp ErrorResponse
+	decode(t, w, &resp)
+	if w.Code != http.StatusNotFound || resp.Code != "BODY_NOT_CAPTURED" {
+		t.Errorf("get body = %d %s, want 404 BODY_NOT_CAPTURED", w.Code, resp.Code)
+	}
+
+	// Deleting the tunnel drops its records
+	if err := ts.reg.DeleteTunnel(created.ID); err != nil {
+		t.Fatal(err)
+	}
+	if recs := ts.inspector.list(created.ID); len(recs) != 0 {
+		t.Errorf("%d records kept after delete", len(recs))
+	}
+}
+
+func TestInspectorStreamsRequestBody(t *testing.T) {
+	// Recording a body must not hold the upload back from the backend
+	testProxyStreamsRequestBody(t, Config{MaxBufferedBodyBytes: 1 << 10, InspectRequests: 10})
+}
+
+func TestInspectorOnlyForOwners(t *testing.T) {
+	ts := newTestServer(t, Config{InspectRequests: 10}, testKeys{api: []string{"owner", "other"}, admin: []string{"admin"}})
+	created := ts.createTunnel(t, "3000", "owner", "")
+
+	for key, want := range map[string]int{"owner": http.StatusOK, "admin": http.StatusOK, "other": http.StatusNotFound} {
+		if w := ts.do(http.MethodGet, "", "/api/tunnel/"+created.ID+"/requests", key, ""); w.Code != want {
+			t.Errorf("%s lists requests = %d, want %d", key, w.Code, want)
+		}
+	}
+}
+
+func TestInspectorDisabledByDefault(t *testing.T) {
+	ts := newTestServer(t, Config{}, testKeys{})
+	created := ts.createTunnel(t, "3000", "", "")
+
+	w := ts.do(http.MethodGet, "", "/api/tunnel/"+created.ID+"/requests", "", "")
+	var resp ErrorResponse
+	decode(t, w, &resp)
+	if w.Code != http.StatusNotFound || resp.Code != "INSPECTOR_DISABLED" {
+		t.Errorf("list requests = %d %s, want 404 INSPECTOR_DISABLED", w.Code, resp.Code)
+	}
+}
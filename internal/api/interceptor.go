@@ -0,0 +1,99 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/google/uuid"
+)
+
+// ProxyInterceptor runs custom logic around proxied tunnel traffic.
+// Before is called before the request reaches the backend; returning an
+// error short-circuits the request. After is called with the backend
+// response before it is written to the client and may mutate it.
+type ProxyInterceptor interface {
+	Before(r *http.Request) error
+	After(resp *http.Response) error
+}
+
+// InterceptorError lets an interceptor choose the status code returned
+// to the client when it rejects a request.
+type InterceptorError struct {
+	Status int
+	Err    error
+}
+
+func (e *InterceptorError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *InterceptorError) Unwrap() error {
+	return e.Err
+}
+
+// NoopInterceptor is a ProxyInterceptor that does nothing
+type NoopInterceptor struct{}
+
+func (NoopInterceptor) Before(r *http.Request) error    { return nil }
+func (NoopInterceptor) After(resp *http.Response) error { return nil }
+
+// RequestIDInterceptor tags each proxied request with an X-Request-Id
+// header (keeping one supplied by the client) and echoes it back on the
+// response so both sides can correlate logs.
+type RequestIDInterceptor struct{}
+
+const headerRequestID = "X-Request-Id"
+
+func (RequestIDInterceptor) Before(r *http.Request) error {
+	if r.Header.Get(headerRequestID) == "" {
+		r.Header.Set(headerRequestID, uuid.New().String())
+	}
+	return nil
+}
+
+func (RequestIDInterceptor) After(resp *http.Response) error {
+	if resp.Request != nil && resp.Header.Get(headerRequestID) == "" {
+		if id := resp.Request.Header.Get(headerRequestID); id != "" {
+			resp.Header.Set(headerRequestID, id)
+		}
+	}
+	return nil
+}
+
+// AddInterceptor registers an interceptor for proxied tunnel traffic.
+// Interceptors run in registration order.
+func (s *Server) AddInterceptor(i ProxyInterceptor) {
+	s.interceptors = append(s.interceptors, i)
+}
+
+// runBeforeInterceptors runs all Before hooks and writes an error response
+// if one of them rejects the request. It reports whether to continue.
+func (s *Server) runBeforeInterceptors(w http.ResponseWriter, r *http.Request) bool {
+	for _, i := range s.interceptors {
+		if err := i.Before(r); err != nil {
+			status := s.cfg.InterceptorRejectStatus
+			var ie *InterceptorError
+			if errors.As(err, &ie) && ie.Status != 0 {
+				status = ie.Status
+			}
+			// WriteHeader panics on codes outside 100-599
+			if status < 100 || status > 599 {
+				status = http.StatusForbidden
+			}
+			s.logger.Debug("proxy request rejected by interceptor", "error", err, "status", status)
+			respondError(w, status, CodeRequestRejected, err.Error())
+			return false
+		}
+	}
+	return true
+}
+
+// runAfterInterceptors runs all After hooks on a backend response
+func (s *Server) runAfterInterceptors(resp *http.Response) error {
+	for _, i := range s.interceptors {
+		if err := i.After(resp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+)
+
+// funcInterceptor is a ProxyInterceptor running before and after
+type funcInterceptor struct {
+	before func(r *http.Request) error
+	after  func(resp *http.Response) error
+}
+
+func (i funcInterceptor) Before(r *http.Request) error {
+	if i.before == nil {
+		return nil
+	}
+	return i.before(r)
+}
+
+func (i funcInterceptor) After(resp *http.Response) error {
+	if i.after == nil {
+		return nil
+	}
+	return i.after(resp)
+}
+
+func TestInterceptorBeforeRejectionSkipsBackend(t *testing.T) {
+	ts := newTestServer(t, Config{}, testKeys{})
+	var hits atomic.Int32
+	created := ts.backend(t, "", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+	}))
+
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"default status", errors.New("blocked"), http.StatusForbidden},
+		{"chosen status", &InterceptorError{Status: http.StatusTeapot, Err: errors.New("blocked")}, http.StatusTeapot},
+		{"invalid status", &InterceptorError{Status: 1000, Err: errors.New("blocked")}, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts.interceptors = []ProxyInterceptor{funcInterceptor{before: func(*http.Request) error { return tt.err }}}
+			w := ts.proxy(t, created, http.MethodGet, "/hello", "")
+
+			var resp ErrorResponse
+			decode(t, w, &resp)
+			if w.Code != tt.want || resp.Code != "REQUEST_REJECTED" {
+				t.Errorf("rejected request = %d %s, want %d %s", w.Code, resp.Code, tt.want, "REQUEST_REJECTED")
+			}
+		})
+	}
+	if hits.Load() != 0 {
+		t.Errorf("backend called %d times for rejected requests", hits.Load())
+	}
+}
+
+func TestInterceptorAfterMutatesResponse(t *testing.T) {
+	ts := newTestServer(t, Config{}, testKeys{})
+	created := ts.backend(t, "", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Backend", "secret")
+		if r.Header.Get("X-Before") != "ran" {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	ts.AddInterceptor(funcInterceptor{
+		before: func(r *http.Request) error {
+			r.Header.Set("X-Before", "ran")
+			return nil
+		},
+		after: func(resp *http.Response) error {
+			resp.Header.Del("X-Backend")
+			resp.Header.Set("X-After", "ran")
+			return nil
+		},
+	})
+
+	w := ts.proxy(t, created, http.MethodGet, "/hello", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("proxied request = %d %s, want 200 with the Before header set", w.Code, w.Body)
+	}
+	if w.Header().Get("X-After") != "ran" || w.Header().Get("X-Backend") != "" {
+		t.Errorf("response headers = %v, want After's changes", w.Header())
+	}
+}
+
+func TestRequestIDInterceptor(t *testing.T) {
+	ts := newTestServer(t, Config{}, testKeys{})
+	var seen atomic.Value
+	created := ts.backend(t, "", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen.Store(r.Header.Get(headerRequestID))
+	}))
+	ts.AddInterceptor(RequestIDInterceptor{})
+
+	w := ts.proxy(t, created, http.MethodGet, "/hello", "")
+	id := w.Header().Get(headerRequestID)
+	if id == "" || seen.Load() != id {
+		t.Errorf("request ID %q echoed, backend saw %q", id, seen.Load())
+	}
+}
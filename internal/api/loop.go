@@ -0,0 +1,39 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+
+	"github.com/mr-karan/arbok/internal/tunnel"
+)
+
+// headerHop is added to every request proxied to a backend, carrying the
+// ID of the server that forwarded it. A request arriving with our own ID
+// has come back around through a backend pointing at us.
+const headerHop = "X-Arbok-Hop"
+
+// newHopID returns a random ID identifying this server in headerHop
+func newHopID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// checkLoop rejects requests we already forwarded once, which came back
+// around through a backend pointing at us, with 508 Loop Detected. It
+// reports whether to continue.
+func (s *Server) checkLoop(w http.ResponseWriter, r *http.Request, t *tunnel.Info) bool {
+	for _, v := range r.Header.Values(headerHop) {
+		for _, id := range strings.Split(v, ",") {
+			if strings.TrimSpace(id) == s.hopID {
+				s.metrics.ProxyLoopsDetected.Inc()
+				s.logger.Warn("proxy loop detected", "tunnel_id", t.ID)
+				respondError(w, http.StatusLoopDetected, CodeLoopDetected, "This tunnel's backend forwards back to arbok")
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,58 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+// wantLoop checks that a proxied request was refused as a loop
+func wantLoop(t *testing.T, w *httptest.ResponseRecorder) {
+	t.Helper()
+	var resp ErrorResponse
+	decode(t, w, &resp)
+	if w.Code != http.StatusLoopDetected || resp.Code != "LOOP_DETECTED" {
+		t.Errorf("request = %d %s, want 508 LOOP_DETECTED", w.Code, resp.Code)
+	}
+}
+
+func TestProxyLoopByHopHeader(t *testing.T) {
+	ts := newTestServer(t, Config{}, testKeys{})
+	var hops atomic.Value
+	var calls atomic.Int32
+	created := ts.backend(t, "", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		hops.Store(r.Header.Values(headerHop))
+	}))
+
+	send := func(hop string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Host = created.Subdomain + "." + ts.cfg.Domain
+		if hop != "" {
+			r.Header.Set(headerHop, hop)
+		}
+		w := httptest.NewRecorder()
+		ts.proxyHandler().ServeHTTP(w, r)
+		return w
+	}
+
+	// Requests forwarded by another server pass, stamped with our ID
+	if w := send("other-server"); w.Code != http.StatusOK {
+		t.Fatalf("request via another server = %d %s", w.Code, w.Body)
+	}
+	if got, _ := hops.Load().([]string); len(got) != 2 || got[0] != "other-server" || got[1] != ts.hopID {
+		t.Errorf("backend saw %s %q, want the other server's ID then ours", headerHop, got)
+	}
+
+	// Ones we already forwarded never reach the backend again
+	before := calls.Load()
+	before508 := ts.metrics.ProxyLoopsDetected.Get()
+	wantLoop(t, send("other-server, "+ts.hopID))
+	if calls.Load() != before {
+		t.Error("looped request reached the backend")
+	}
+	if ts.metrics.ProxyLoopsDetected.Get() != before508+1 {
+		t.Error("loop not counted")
+	}
+}
@@ -0,0 +1,35 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// DefaultMaxConcurrentProvisions bounds the tunnel creations in progress
+// at once
+const DefaultMaxConcurrentProvisions = 16
+
+// provisionRetryAfter is the Retry-After, in seconds, of shed creations.
+// Peer changes take milliseconds, so slots free up quickly.
+const provisionRetryAfter = 1
+
+// beginProvision takes a provisioning slot. Adding peers serializes on
+// the WireGuard device, so rather than queue a burst of creations behind
+// it, creations beyond MaxConcurrentProvisions are shed: it sets
+// Retry-After and returns false, and the caller writes the 503. Callers
+// that get a slot must release it with endProvision.
+func (s *Server) beginProvision(w http.ResponseWriter) bool {
+	select {
+	case s.provisions <- struct{}{}:
+		return true
+	default:
+		s.metrics.ProvisionsShed.Inc()
+		w.Header().Set("Retry-After", strconv.Itoa(provisionRetryAfter))
+		return false
+	}
+}
+
+// endProvision releases a slot taken by beginProvision
+func (s *Server) endProvision() {
+	<-s.provisions
+}
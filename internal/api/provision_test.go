@@ -0,0 +1,39 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestProvisionsShedBeyondLimit(t *testing.T) {
+	ts := newTestServer(t, Config{MaxConcurrentProvisions: 2}, testKeys{})
+
+	// Slots are released once a creation finishes
+	for range 3 {
+		ts.createTunnel(t, "3000", "", "")
+	}
+
+	// With every slot held by a creation in progress, more are shed
+	for range cap(ts.provisions) {
+		ts.provisions <- struct{}{}
+	}
+	w := ts.do(http.MethodPost, "", "/api/tunnel/3000", "", "")
+	var resp ErrorResponse
+	decode(t, w, &resp)
+	if w.Code != http.StatusServiceUnavailable || resp.Code != CodeServerBusy || w.Header().Get("Retry-After") != "1" {
+		t.Errorf("create = %d %s Retry-After %q, want 503 %s 1", w.Code, resp.Code, w.Header().Get("Retry-After"), CodeServerBusy)
+	}
+	if w := ts.do(http.MethodGet, "", "/3000", "", ""); w.Code != http.StatusServiceUnavailable || w.Header().Get("X-Arbok-Error-Code") != string(CodeServerBusy) {
+		t.Errorf("simple provision = %d %s, want 503 %s", w.Code, w.Header().Get("X-Arbok-Error-Code"), CodeServerBusy)
+	}
+	// Invalid requests are turned away before they'd take a slot
+	if w := ts.do(http.MethodPost, "", "/api/tunnel/3000", "", `{"ttl":"soon"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("invalid create = %d, want 400", w.Code)
+	}
+	if n := len(ts.reg.ListTunnels()); n != 3 {
+		t.Errorf("%d tunnels, want only the 3 admitted", n)
+	}
+
+	ts.endProvision()
+	ts.createTunnel(t, "3000", "", "")
+}
@@ -2,47 +2,73 @@ package api
 
 import (
 	"bufio"
+	"bytes"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
+
+	"github.com/mr-karan/arbok/internal/middleware"
+	"github.com/mr-karan/arbok/internal/tunnel"
 )
 
-// createReverseProxy creates a reverse proxy for a tunnel using netstack
-func (s *Server) createReverseProxy(targetIP string, port uint16) *httputil.ReverseProxy {
+// createReverseProxy creates a reverse proxy to port of a tunnel's
+// backend using netstack
+func (s *Server) createReverseProxy(t *tunnel.Info, port uint16) *httputil.ReverseProxy {
 	target := &url.URL{
 		Scheme: "http",
-		Host:   fmt.Sprintf("%s:%d", targetIP, port),
+		Host:   fmt.Sprintf("%s:%d", t.BackendAddr(), port),
+	}
+	if t.BackendTLS() {
+		target.Scheme = "https"
 	}
 
 	proxy := httputil.NewSingleHostReverseProxy(target)
-	
-	// Get netstack from tunnel for userspace networking
-	tnet := s.tun.GetNetstack()
-	
-	// Customize the transport to use netstack (userspace WireGuard networking)
-	proxy.Transport = &http.Transport{
-		DialContext:           tnet.DialContext, // Use netstack instead of kernel networking
-		ForceAttemptHTTP2:     true,
-		MaxIdleConns:          100,
-		IdleConnTimeout:       90 * time.Second,
-		TLSHandshakeTimeout:   10 * time.Second,
-		ExpectContinueTimeout: 1 * time.Second,
+
+	// Reuse the tunnel's own connection pool
+	proxy.Transport = s.transports.get(t)
+	if t.Static {
+		proxy.Transport = headFallback{proxy.Transport}
 	}
+	proxy.BufferPool = s.buffers
 
 	// Customize error handling
 	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		if errors.Is(err, errContentBlocked) {
+			respondError(w, http.StatusUnavailableForLegalReasons, CodeContentBlocked, "This content is not available through this server")
+			return
+		}
+		// Only failed round trips say anything about the backend
+		var respErr *responseError
+		if !errors.As(err, &respErr) && !errors.Is(err, context.Canceled) {
+			s.health.report(t, err)
+		}
 		s.logger.Error("proxy error", "error", err, "target", target.String())
-		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		if s.inspector != nil {
+			s.inspector.fail(r, err)
+		}
+		writeDialError(w, t, err)
 	}
 
 	// Modify request headers
 	proxy.Director = func(req *http.Request) {
+		// The host the client asked for, before it's rewritten to the
+		// backend's
+		originalHost := req.Host
+
 		req.URL.Scheme = target.Scheme
 		req.URL.Host = target.Host
 		req.Host = target.Host
@@ -54,65 +80,359 @@ func (s *Server) createReverseProxy(targetIP string, port uint16) *httputil.Reve
 			}
 			req.Header.Set("X-Forwarded-For", clientIP)
 		}
-		req.Header.Set("X-Forwarded-Host", req.Host)
-		req.Header.Set("X-Forwarded-Proto", "https")
-		
+		req.Header.Set("X-Forwarded-Host", originalHost)
+		req.Header.Set("X-Forwarded-Proto", s.forwardedProto(req))
+		if sni := s.forwardedSNI(req); sni != "" {
+			req.Header.Set(headerForwardedSNI, sni)
+		} else {
+			req.Header.Del(headerForwardedSNI)
+		}
+		req.Header.Add(headerHop, s.hopID)
+		setClientCertHeaders(req.Header, req, t)
+
 		// Remove hop-by-hop headers
 		for _, h := range hopHeaders {
 			req.Header.Del(h)
 		}
+		if s.cfg.StripExpect {
+			req.Header.Del("Expect")
+		}
+
+		if req.Body != nil && req.Body != http.NoBody {
+			req.Body = s.bandwidth.readCloser(req.Context(), req.Body)
+		}
 	}
 
 	// Modify response headers
-	proxy.ModifyResponse = func(resp *http.Response) error {
+	modifyResponse := func(resp *http.Response) error {
+		if err := s.checkContentType(t, resp); err != nil {
+			return err
+		}
+
 		// Remove hop-by-hop headers from response
 		for _, h := range hopHeaders {
 			resp.Header.Del(h)
 		}
+
+		// Hide backend fingerprints
+		for _, h := range s.cfg.StripResponseHeaders {
+			resp.Header.Del(h)
+		}
+		for _, h := range t.StripResponseHeaders {
+			resp.Header.Del(h)
+		}
+		if err := s.runAfterInterceptors(resp); err != nil {
+			return err
+		}
+		if err := s.injectHTML(resp); err != nil {
+			return err
+		}
+		if t.Static {
+			serveStaticRange(resp)
+		}
+
+		// Record what the client will get
+		if s.inspector != nil {
+			s.inspector.response(resp)
+		}
+		resp.Body = s.bandwidth.readCloser(resp.Request.Context(), resp.Body)
+		return nil
+	}
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		s.health.report(t, nil)
+		if err := modifyResponse(resp); err != nil {
+			return &responseError{err}
+		}
 		return nil
 	}
 
 	return proxy
 }
 
-// extractSubdomain extracts the subdomain from a host header value.
-// It handles port stripping and returns just the subdomain portion.
-func extractSubdomain(host string) string {
+// responseError wraps errors from modifying a backend response, telling
+// the proxy's error handler that the backend did answer
+type responseError struct {
+	err error
+}
+
+func (e *responseError) Error() string { return e.err.Error() }
+func (e *responseError) Unwrap() error { return e.err }
+
+// splitHost splits a host header value into the tunnel subdomain and the
+// configured domain it belongs to. It handles port stripping; the
+// subdomain is the first label. Hosts outside every configured domain
+// return an empty domain, meaning the default one.
+func (s *Server) splitHost(host string) (subdomain, domain string) {
 	// Remove port if present
 	if idx := strings.IndexByte(host, ':'); idx != -1 {
 		host = host[:idx]
 	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	for _, d := range s.domains {
+		if host == d {
+			return "", d
+		}
+		if strings.HasSuffix(host, "."+d) {
+			domain = d
+			break
+		}
+	}
 	
 	// Extract subdomain (first part before first dot)
 	if idx := strings.IndexByte(host, '.'); idx != -1 {
-		return host[:idx]
+		return host[:idx], domain
 	}
-	return host
+	return "", domain
+}
+
+// requestDomain returns the configured domain a request was addressed to,
+// falling back to the default domain
+func (s *Server) requestDomain(r *http.Request) string {
+	if _, domain := s.splitHost(r.Host); domain != "" {
+		return domain
+	}
+	return s.cfg.Domain
 }
 
 // handleTunnelTrafficWithProxy handles incoming traffic and proxies it to the tunnel
 func (s *Server) handleTunnelTrafficWithProxy(w http.ResponseWriter, r *http.Request) {
 	// Extract subdomain from host
-	subdomain := extractSubdomain(r.Host)
+	subdomain, domain := s.splitHost(r.Host)
 	if subdomain == "" {
-		http.Error(w, "Invalid host header", http.StatusBadRequest)
+		respondError(w, http.StatusBadRequest, CodeInvalidHost, "Invalid host header")
 		return
 	}
-	tunnel := s.registry.GetTunnelBySubdomain(subdomain)
+	tunnel := s.registry.GetTunnelBySubdomain(subdomain, domain)
 	if tunnel == nil {
-		http.Error(w, "Tunnel not found", http.StatusNotFound)
+		respondError(w, http.StatusNotFound, CodeTunnelNotFound, "Tunnel not found")
+		return
+	}
+
+	// Path-prefix routes pick the backend port
+	port := tunnel.PortFor(r.URL.Path)
+
+	// Correlate the request log line with the tunnel
+	middleware.AddLogAttrs(r.Context(),
+		slog.String("tunnel_id", tunnel.ID),
+		slog.String("subdomain", tunnel.Subdomain),
+		slog.String("target", fmt.Sprintf("%s:%d", tunnel.BackendAddr(), port)),
+	)
+
+	if !checkRevoked(w, tunnel) {
 		return
 	}
 
+	if !checkPortSet(w, port) {
+		return
+	}
+
+	if !s.checkClientNetwork(w, r, tunnel) {
+		return
+	}
+
+	if !s.allowTunnel(w, tunnel) {
+		return
+	}
+
+	tunnel, ok := s.ensureBackend(w, r, tunnel)
+	if !ok {
+		return
+	}
+
+	if !s.checkLoop(w, r, tunnel) {
+		return
+	}
+
+	if !checkMethod(w, r, tunnel) {
+		return
+	}
+
+	if !s.checkClientCert(w, r, tunnel) {
+		return
+	}
+
+	// Run request interceptors before anything reaches the backend
+	if !s.runBeforeInterceptors(w, r) {
+		return
+	}
+
+	// Wait for a fair share of the server when it's saturated. WebSockets
+	// give their slot back once upgraded, like CONNECT streams once
+	// established, so long-lived streams can't starve requests.
+	if !s.admit(w, r, tunnel) {
+		return
+	}
+	release := sync.OnceFunc(s.scheduler.release)
+	defer release()
+
+	// Backend connections idle in pools between requests, so it's the
+	// requests and WebSocket streams that hold the netstack's slots
+	releaseConn, ok := s.acquireConn(w, r, tunnel)
+	if !ok {
+		return
+	}
+	defer releaseConn()
+
 	// Handle WebSocket upgrade
 	if isWebSocketRequest(r) {
-		s.handleWebSocket(w, r, tunnel.AllowedIP, tunnel.Port)
+		s.handleWebSocket(w, r, tunnel, release)
 		return
 	}
 
+	// Let clients know when the tunnel is about to go away
+	s.setExpiryHeaders(w.Header(), tunnel.TTL())
+
+	// A tunnel's own timeout bounds the whole request, and may outlast
+	// the server's write timeout. It's capped by the current max, which
+	// may have been lowered since the tunnel was created.
+	if timeout := min(tunnel.RequestTimeout, s.cfg.MaxRequestTimeout); timeout > 0 {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		r = r.WithContext(ctx)
+		http.NewResponseController(w).SetWriteDeadline(time.Now().Add(timeout + requestTimeoutGrace))
+	}
+
 	// Create and use reverse proxy
-	proxy := s.createReverseProxy(tunnel.AllowedIP, tunnel.Port)
+	proxy := s.createReverseProxy(tunnel, port)
+	if s.inspector == nil {
+		proxy.ServeHTTP(w, r)
+		return
+	}
+	rec, r := s.inspector.begin(r)
 	proxy.ServeHTTP(w, r)
+	s.inspector.finish(tunnel, rec)
+	s.publishCapture(tunnel, rec)
+}
+
+// writeDialError reports a failed backend round trip: 503 once the tunnel
+// is shutting down, 504 when the dial or response headers timed out, 502
+// otherwise. The tunnel's error override for the condition, if any, is
+// sent instead.
+func writeDialError(w http.ResponseWriter, t *tunnel.Info, err error) {
+	cond := dialErrorCondition(err)
+	if o, ok := t.ErrorOverrides[cond]; ok {
+		writeErrorOverride(w, o)
+		return
+	}
+	switch cond {
+	case tunnel.ErrorBackendUnavailable:
+		respondError(w, http.StatusServiceUnavailable, CodeBackendUnavailable, "Tunnel is shutting down")
+	case tunnel.ErrorBackendTimeout:
+		respondError(w, http.StatusGatewayTimeout, CodeBackendTimeout, "Backend did not respond in time")
+	default:
+		respondError(w, http.StatusBadGateway, CodeBackendError, "Could not reach backend")
+	}
+}
+
+// dialErrorCondition classifies a failed backend round trip as one of the
+// tunnel.Error* conditions
+func dialErrorCondition(err error) string {
+	if errors.Is(err, tunnel.ErrClosed) {
+		return tunnel.ErrorBackendUnavailable
+	}
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return tunnel.ErrorBackendTimeout
+	}
+	return tunnel.ErrorBackend
+}
+
+// writeErrorOverride sends a tunnel's replacement for a proxy error
+func writeErrorOverride(w http.ResponseWriter, o tunnel.ErrorOverride) {
+	contentType := o.ContentType
+	if contentType == "" {
+		contentType = "text/plain; charset=utf-8"
+		if json.Valid([]byte(o.Body)) {
+			contentType = "application/json"
+		}
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(o.Status)
+	io.WriteString(w, o.Body)
+}
+
+// checkRevoked refuses traffic for tunnels revoked by an operator. It
+// reports whether to continue.
+func checkRevoked(w http.ResponseWriter, t *tunnel.Info) bool {
+	if !t.Revoked {
+		return true
+	}
+	respondError(w, http.StatusForbidden, CodeTunnelRevoked, "This tunnel has been revoked")
+	return false
+}
+
+// requestTimeoutGrace is how long past a tunnel's request timeout the
+// response may still be written, e.g. the 504 reporting it
+const requestTimeoutGrace = 5 * time.Second
+
+// checkPortSet refuses traffic with 503 while a tunnel created with port 0
+// has no backend port for the request yet. It reports whether to continue.
+func checkPortSet(w http.ResponseWriter, port uint16) bool {
+	if port != 0 {
+		return true
+	}
+	// Anyone can reach this, so the tunnel ID stays out of the message
+	respondError(w, http.StatusServiceUnavailable, CodeBackendPortUnset, "Backend port not configured")
+	return false
+}
+
+// checkClientNetwork enforces a tunnel's client network allowlist against
+// the real client address, as forwarded by trusted proxies. It reports
+// whether to continue.
+func (s *Server) checkClientNetwork(w http.ResponseWriter, r *http.Request, t *tunnel.Info) bool {
+	if t.ClientAllowed(net.ParseIP(s.clientIP(r))) {
+		return true
+	}
+	respondError(w, http.StatusForbidden, CodeClientNotAllowed, "Your network is not allowed to reach this tunnel")
+	return false
+}
+
+// checkMethod enforces a tunnel's allowed methods, writing a 405 with an
+// Allow header for others. It reports whether to continue.
+func checkMethod(w http.ResponseWriter, r *http.Request, t *tunnel.Info) bool {
+	if t.MethodAllowed(r.Method) {
+		return true
+	}
+	allow := t.AllowedMethods
+	if slices.Contains(allow, http.MethodGet) && !slices.Contains(allow, http.MethodHead) {
+		allow = append(slices.Clip(allow), http.MethodHead)
+	}
+	w.Header().Set("Allow", strings.Join(allow, ", "))
+	respondError(w, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "Method not allowed for this tunnel")
+	return false
+}
+
+// checkClientCert enforces a tunnel's mutual TLS requirement, writing a
+// 403 when the client didn't present a certificate signed by the tunnel's
+// CA bundle. It reports whether to continue.
+func (s *Server) checkClientCert(w http.ResponseWriter, r *http.Request, t *tunnel.Info) bool {
+	if !t.RequireClientCert {
+		return true
+	}
+	var chain []*x509.Certificate
+	if r.TLS != nil {
+		chain = r.TLS.PeerCertificates
+	}
+	if err := t.VerifyClientCert(chain); err != nil {
+		s.logger.Debug("client certificate rejected", "error", err, "tunnel_id", t.ID)
+		respondError(w, http.StatusForbidden, CodeClientCertRequired, "A valid client certificate is required")
+		return false
+	}
+	return true
+}
+
+// setExpiryHeaders adds X-Arbok-Expires-In (seconds) and, once the tunnel
+// is within the warning threshold, X-Arbok-Expiry-Warning
+func (s *Server) setExpiryHeaders(h http.Header, ttl time.Duration) {
+	if ttl < 0 {
+		ttl = 0
+	}
+	h.Set("X-Arbok-Expires-In", strconv.FormatInt(int64(ttl.Seconds()), 10))
+	if ttl <= s.cfg.ExpiryWarningThreshold {
+		h.Set("X-Arbok-Expiry-Warning", fmt.Sprintf("tunnel expires in %s", ttl.Round(time.Second)))
+	}
 }
 
 // isWebSocketRequest checks if the request is a WebSocket upgrade request
@@ -122,17 +442,22 @@ func isWebSocketRequest(r *http.Request) bool {
 }
 
 // handleWebSocket handles WebSocket connections
-func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request, targetIP string, port uint16) {
+func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request, t *tunnel.Info, upgraded func()) {
 	// Dial the backend WebSocket server
-	targetURL := fmt.Sprintf("ws://%s:%d%s", targetIP, port, r.URL.Path)
+	scheme := "ws"
+	if t.BackendTLS() {
+		scheme = "wss"
+	}
+	targetURL := fmt.Sprintf("%s://%s:%d%s", scheme, t.BackendAddr(), t.PortFor(r.URL.Path), r.URL.Path)
 	if r.URL.RawQuery != "" {
 		targetURL += "?" + r.URL.RawQuery
 	}
 
-	targetConn, resp, err := s.websocketDial(targetURL, r.Header)
+	setClientCertHeaders(r.Header, r, t)
+	targetConn, resp, err := s.websocketDial(r.Context(), targetURL, r.Header, backendTLSConfig(t))
 	if err != nil {
 		s.logger.Error("websocket dial error", "error", err, "target", targetURL)
-		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		writeDialError(w, t, err)
 		return
 	}
 	defer targetConn.Close()
@@ -140,39 +465,47 @@ func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request, targetI
 	// Hijack the client connection
 	hijacker, ok := w.(http.Hijacker)
 	if !ok {
-		http.Error(w, "Hijacking not supported", http.StatusInternalServerError)
+		respondError(w, http.StatusInternalServerError, CodeInternal, "Hijacking not supported")
 		return
 	}
 
 	clientConn, _, err := hijacker.Hijack()
 	if err != nil {
 		s.logger.Error("hijack error", "error", err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		respondError(w, http.StatusInternalServerError, CodeInternal, "Internal server error")
 		return
 	}
 	defer clientConn.Close()
+	// The relay outlives the server's read and write timeouts, whatever
+	// deadline the connection was left with
+	clientConn.SetDeadline(time.Time{})
 
 	// Write the WebSocket upgrade response
 	if err := writeWebSocketResponse(clientConn, resp); err != nil {
 		s.logger.Error("write response error", "error", err)
 		return
 	}
+	upgraded()
+
+	s.relayWebSocket(r.Context(), clientConn, targetConn)
+}
 
+// relayConns copies data in both directions until either side finishes
+// or the context is cancelled. Copies use pooled buffers.
+func (s *Server) relayConns(ctx context.Context, clientConn, targetConn net.Conn) {
 	// Use context for proper cancellation
-	ctx, cancel := context.WithCancel(r.Context())
+	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
 	// Proxy data between connections with proper cleanup
 	errc := make(chan error, 2)
 	go func() {
 		defer cancel() // Cancel context when one direction completes
-		_, err := io.Copy(targetConn, clientConn)
-		errc <- err
+		errc <- s.copyBuffered(targetConn, clientConn)
 	}()
 	go func() {
 		defer cancel() // Cancel context when one direction completes
-		_, err := io.Copy(clientConn, targetConn)
-		errc <- err
+		errc <- s.copyBuffered(clientConn, targetConn)
 	}()
 
 	// Wait for either copy to complete or context cancellation
@@ -184,24 +517,221 @@ func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request, targetI
 	}
 }
 
-// websocketDial dials a WebSocket connection using the tunnel's netstack
-func (s *Server) websocketDial(targetURL string, headers http.Header) (net.Conn, *http.Response, error) {
+// copyBuffered copies src to dst with a buffer from the relay pool,
+// returning it once the copy is done
+func (s *Server) copyBuffered(dst io.Writer, src io.Reader) error {
+	buf := s.buffers.Get()
+	defer s.buffers.Put(buf)
+	_, err := io.CopyBuffer(dst, s.bandwidth.reader(context.Background(), src), buf)
+	return err
+}
+
+// handleConnect handles HTTP CONNECT requests by opening a raw TCP stream
+// to the tunnel's backend, letting clients pass TLS through untouched
+func (s *Server) handleConnect(w http.ResponseWriter, r *http.Request) {
+	// For CONNECT the authority is carried in the Host
+	subdomain, domain := s.splitHost(r.Host)
+	if subdomain == "" {
+		respondError(w, http.StatusBadRequest, CodeInvalidHost, "Invalid host header")
+		return
+	}
+	tunnel := s.registry.GetTunnelBySubdomain(subdomain, domain)
+	if tunnel == nil {
+		respondError(w, http.StatusNotFound, CodeTunnelNotFound, "Tunnel not found")
+		return
+	}
+
+	target := fmt.Sprintf("%s:%d", tunnel.BackendAddr(), tunnel.Port)
+	middleware.AddLogAttrs(r.Context(),
+		slog.String("tunnel_id", tunnel.ID),
+		slog.String("subdomain", tunnel.Subdomain),
+		slog.String("target", target),
+	)
+
+	if !checkRevoked(w, tunnel) {
+		return
+	}
+
+	if !checkPortSet(w, tunnel.Port) {
+		return
+	}
+
+	if !s.checkClientNetwork(w, r, tunnel) {
+		return
+	}
+
+	if !s.allowTunnel(w, tunnel) {
+		return
+	}
+
+	tunnel, ok := s.ensureBackend(w, r, tunnel)
+	if !ok {
+		return
+	}
+	// A hostname backend's address is only known once resolved
+	target = fmt.Sprintf("%s:%d", tunnel.BackendAddr(), tunnel.Port)
+
+	if !s.checkLoop(w, r, tunnel) {
+		return
+	}
+
+	if !checkMethod(w, r, tunnel) {
+		return
+	}
+
+	if !s.checkClientCert(w, r, tunnel) {
+		return
+	}
+
+	if !s.runBeforeInterceptors(w, r) {
+		return
+	}
+
+	// The stream holds a slot like any proxied request until it is
+	// established
+	if !s.admit(w, r, tunnel) {
+		return
+	}
+	release := sync.OnceFunc(s.scheduler.release)
+	defer release()
+
+	releaseConn, ok := s.acquireConn(w, r, tunnel)
+	if !ok {
+		return
+	}
+	defer releaseConn()
+
+	targetConn, err := s.dialTunnel(r.Context(), "tcp", target)
+	if err != nil {
+		s.logger.Error("connect dial error", "error", err, "target", target)
+		writeDialError(w, tunnel, err)
+		return
+	}
+	defer targetConn.Close()
+
+	// HTTP/2 has no connection to hijack: the stream itself carries the
+	// relay, upstream in the request body and downstream in the response
+	if r.ProtoMajor == 2 {
+		release()
+		s.relayStream(w, r, targetConn)
+		return
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		respondError(w, http.StatusInternalServerError, CodeInternal, "Hijacking not supported")
+		return
+	}
+
+	clientConn, brw, err := hijacker.Hijack()
+	if err != nil {
+		s.logger.Error("hijack error", "error", err)
+		respondError(w, http.StatusInternalServerError, CodeInternal, "Internal server error")
+		return
+	}
+	defer clientConn.Close()
+	// Relays outlive the server's read and write timeouts, whatever
+	// deadline the connection was left with
+	clientConn.SetDeadline(time.Time{})
+
+	if _, err := io.WriteString(clientConn, "HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+		s.logger.Error("write response error", "error", err)
+		return
+	}
+	release()
+
+	// Forward anything the client sent before the hijack
+	if n := brw.Reader.Buffered(); n > 0 {
+		buffered, _ := brw.Reader.Peek(n)
+		if _, err := targetConn.Write(buffered); err != nil {
+			return
+		}
+	}
+
+	s.relayConns(r.Context(), clientConn, targetConn)
+}
+
+// relayStream relays an HTTP/2 CONNECT stream to targetConn until either
+// side finishes or the client goes away
+func (s *Server) relayStream(w http.ResponseWriter, r *http.Request, targetConn net.Conn) {
+	// Relays outlive the server's request timeouts
+	rc := http.NewResponseController(w)
+	rc.SetReadDeadline(time.Time{})
+	rc.SetWriteDeadline(time.Time{})
+
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		s.logger.Error("write response error", "error", err)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		defer cancel()
+		s.copyBuffered(targetConn, r.Body)
+	}()
+	go func() {
+		defer wg.Done()
+		defer cancel()
+		s.copyBuffered(flushWriter{w: w, rc: rc}, targetConn)
+	}()
+	<-ctx.Done()
+
+	// Unblock both copies and wait for them: w must not be written to
+	// once the handler has returned
+	targetConn.Close()
+	r.Body.Close()
+	wg.Wait()
+}
+
+// flushWriter flushes after every write so relayed bytes aren't held in
+// the response buffer
+type flushWriter struct {
+	w  io.Writer
+	rc *http.ResponseController
+}
+
+func (f flushWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	if err == nil {
+		err = f.rc.Flush()
+	}
+	return n, err
+}
+
+// websocketDial dials a WebSocket connection using the tunnel's netstack,
+// over TLS when tlsConf is set. Canceling ctx abandons the dial and the
+// TLS handshake.
+func (s *Server) websocketDial(ctx context.Context, targetURL string, headers http.Header, tlsConf *tls.Config) (net.Conn, *http.Response, error) {
 	// Parse the URL
 	u, err := url.Parse(targetURL)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	// Get netstack from tunnel for userspace networking
-	tnet := s.tun.GetNetstack()
-	
 	// Dial TCP connection using netstack (userspace WireGuard networking)
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-	conn, err := tnet.DialContext(ctx, "tcp", u.Host)
+	conn, err := s.dialTunnel(ctx, "tcp", u.Host)
 	if err != nil {
 		return nil, nil, err
 	}
+	if tlsConf != nil {
+		// HTTP/1.1 only, upgrades don't exist in HTTP/2
+		tlsConf = tlsConf.Clone()
+		tlsConf.NextProtos = []string{"http/1.1"}
+		tlsConn := tls.Client(conn, tlsConf)
+		ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		defer cancel()
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+		conn = tlsConn
+	}
 
 	// Send WebSocket upgrade request
 	req := &http.Request{
@@ -218,17 +748,19 @@ func (s *Server) websocketDial(targetURL string, headers http.Header) (net.Conn,
 			req.Header[k] = v
 		}
 	}
+	req.Header[headerHop] = append(slices.Clone(headers.Values(headerHop)), s.hopID)
 
 	if err := req.Write(conn); err != nil {
 		conn.Close()
 		return nil, nil, err
 	}
 
-	// Read response
-	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	// Read response, bounding how much of the backend's header block we accept
+	br := bufio.NewReader(&io.LimitedReader{R: conn, N: maxWebSocketHeaderBytes})
+	resp, err := http.ReadResponse(br, req)
 	if err != nil {
 		conn.Close()
-		return nil, nil, err
+		return nil, nil, fmt.Errorf("invalid upgrade response: %w", err)
 	}
 
 	if resp.StatusCode != http.StatusSwitchingProtocols {
@@ -236,13 +768,63 @@ func (s *Server) websocketDial(targetURL string, headers http.Header) (net.Conn,
 		return nil, nil, fmt.Errorf("bad status code: %d", resp.StatusCode)
 	}
 
+	if err := validateUpgradeHeaders(resp.Header); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	// Keep any frames the backend sent along with the upgrade response
+	if n := br.Buffered(); n > 0 {
+		buffered, _ := br.Peek(n)
+		conn = &prefixedConn{Conn: conn, r: io.MultiReader(bytes.NewReader(buffered), conn)}
+	}
+
 	return conn, resp, nil
 }
 
+const (
+	// maxWebSocketHeaderBytes caps the size of a backend's upgrade response head
+	maxWebSocketHeaderBytes = 16 << 10
+	// maxWebSocketHeaders caps the number of header lines relayed to the client
+	maxWebSocketHeaders = 64
+)
+
+// validateUpgradeHeaders rejects upgrade responses with too many headers
+// or values that can't be safely relayed verbatim
+func validateUpgradeHeaders(h http.Header) error {
+	count := 0
+	for k, values := range h {
+		if k == "" || strings.ContainsAny(k, " \t\r\n:") {
+			return fmt.Errorf("invalid header name in upgrade response: %q", k)
+		}
+		for _, v := range values {
+			if strings.ContainsAny(v, "\r\n") {
+				return fmt.Errorf("invalid header value in upgrade response for %s", k)
+			}
+			count++
+		}
+	}
+	if count > maxWebSocketHeaders {
+		return fmt.Errorf("too many headers in upgrade response: %d", count)
+	}
+	return nil
+}
+
+// prefixedConn is a net.Conn whose reads first drain bytes already
+// consumed from the underlying connection
+type prefixedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *prefixedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
 // writeWebSocketResponse writes a WebSocket upgrade response
 func writeWebSocketResponse(conn net.Conn, resp *http.Response) error {
 	// Write status line
-	if _, err := fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\n", resp.StatusCode, resp.Status); err != nil {
+	if _, err := fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\n", resp.StatusCode, http.StatusText(resp.StatusCode)); err != nil {
 		return err
 	}
 
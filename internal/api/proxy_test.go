@@ -0,0 +1,735 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/mr-karan/arbok/internal/auth"
+	"github.com/mr-karan/arbok/internal/tunnel"
+)
+
+// rawBackend is a backend that answers every request with head, written
+// verbatim to the connection
+func rawBackend(head string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.WriteString(conn, head)
+	})
+}
+
+// upgradeEchoBackend is a backend that accepts every WebSocket upgrade and
+// echoes the stream back. Other requests get an empty 200.
+func upgradeEchoBackend() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") == "" {
+			return
+		}
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		io.Copy(conn, conn)
+	})
+}
+
+// upgradeHeaders sets the headers of a WebSocket upgrade request
+func upgradeHeaders(h http.Header) {
+	h.Set("Connection", "Upgrade")
+	h.Set("Upgrade", "websocket")
+	h.Set("Sec-WebSocket-Version", "13")
+	h.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+}
+
+func TestWebSocketRejectsBadUpgradeResponses(t *testing.T) {
+	const switching = "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"
+	var many strings.Builder
+	for i := range maxWebSocketHeaders + 1 {
+		fmt.Fprintf(&many, "X-Header-%d: v\r\n", i)
+	}
+
+	tests := []struct {
+		name string
+		head string
+	}{
+		{"too many headers", switching + many.String() + "\r\n"},
+		{"oversized header block", switching + "X-Big: " + strings.Repeat("a", maxWebSocketHeaderBytes) + "\r\n\r\n"},
+		{"malformed status line", "HTTP/1.1 abc Switching\r\n\r\n"},
+		{"not switching protocols", "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestServer(t, Config{}, testKeys{})
+			created := ts.backend(t, "", rawBackend(tt.head))
+
+			r := httptest.NewRequest(http.MethodGet, "/socket", nil)
+			r.Host = created.Subdomain + "." + ts.cfg.Domain
+			upgradeHeaders(r.Header)
+			w := httptest.NewRecorder()
+			ts.proxyHandler().ServeHTTP(w, r)
+
+			var resp ErrorResponse
+			decode(t, w, &resp)
+			if w.Code != http.StatusBadGateway || resp.Code != "BACKEND_ERROR" {
+				t.Errorf("upgrade = %d %s, want 502 BACKEND_ERROR", w.Code, resp.Code)
+			}
+		})
+	}
+}
+
+// echoBackend creates a tunnel whose backend echoes the first
+// connection back to itself
+func (ts *testServer) echoBackend(t *testing.T) TunnelResponse {
+	t.Helper()
+	created, ln := ts.listen(t, "")
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+	return created
+}
+
+// dialConnect opens a CONNECT stream to the tunnel through a live proxy
+// listener, returning the connection and a reader positioned after the
+// CONNECT response
+func (ts *testServer) dialConnect(t *testing.T, tun TunnelResponse) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	srv := httptest.NewServer(ts.proxyHandler())
+	t.Cleanup(srv.Close)
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	host := tun.Subdomain + "." + ts.cfg.Domain + ":443"
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", host, host)
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		t.Fatalf("reading CONNECT response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT = %d, want 200", resp.StatusCode)
+	}
+	return conn, br
+}
+
+func TestConnectRelaysBytes(t *testing.T) {
+	ts := newTestServer(t, Config{}, testKeys{})
+	conn, br := ts.dialConnect(t, ts.echoBackend(t))
+
+	const msg = "bytes through the tunnel"
+	io.WriteString(conn, msg)
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(br, got); err != nil {
+		t.Fatalf("reading echo: %v", err)
+	}
+	if string(got) != msg {
+		t.Errorf("echo = %q, want %q", got, msg)
+	}
+}
+
+func TestConnectOutlivesServerTimeouts(t *testing.T) {
+	ts := newTestServer(t, Config{}, testKeys{})
+	echo := ts.echoBackend(t)
+	srv := httptest.NewUnstartedServer(ts.proxyHandler())
+	srv.Config.ReadTimeout = 100 * time.Millisecond
+	srv.Config.WriteTimeout = 100 * time.Millisecond
+	srv.Start()
+	t.Cleanup(srv.Close)
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	host := echo.Subdomain + "." + ts.cfg.Domain + ":443"
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", host, host)
+	br := bufio.NewReader(conn)
+	if resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect}); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT = %v, %v", resp, err)
+	}
+
+	// Well past both server timeouts the stream still relays
+	time.Sleep(300 * time.Millisecond)
+	const msg = "still here"
+	io.WriteString(conn, msg)
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(br, got); err != nil || string(got) != msg {
+		t.Errorf("echo after the server timeouts = %q, %v; want %q", got, err, msg)
+	}
+}
+
+func TestWebSocketOutlivesServerTimeouts(t *testing.T) {
+	ts := newTestServer(t, Config{}, testKeys{})
+	created := ts.backend(t, "", upgradeEchoBackend())
+	srv := httptest.NewUnstartedServer(ts.proxyHandler())
+	srv.Config.ReadTimeout = 100 * time.Millisecond
+	srv.Config.WriteTimeout = 100 * time.Millisecond
+	srv.Start()
+	t.Cleanup(srv.Close)
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	r := httptest.NewRequest(http.MethodGet, "/socket", nil)
+	r.Host = created.Subdomain + "." + ts.cfg.Domain
+	upgradeHeaders(r.Header)
+	r.Write(conn)
+	br := bufio.NewReader(conn)
+	if resp, err := http.ReadResponse(br, r); err != nil || resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("upgrade = %v, %v", resp, err)
+	}
+
+	// Well past both server timeouts the stream still relays
+	time.Sleep(300 * time.Millisecond)
+	const msg = "still here"
+	io.WriteString(conn, msg)
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(br, got); err != nil || string(got) != msg {
+		t.Errorf("echo after the server timeouts = %q, %v; want %q", got, err, msg)
+	}
+}
+
+func TestProxyLogLineNamesTunnel(t *testing.T) {
+	ts := newTestServer(t, Config{}, testKeys{})
+	created := ts.backend(t, "", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	// A server over the same tunnel and registry, logging as JSON
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&logs, nil))
+	srv := NewAPIServer(ts.cfg, logger, ts.tun, ts.reg, auth.New(nil, nil, ts.metrics, logger))
+
+	r := httptest.NewRequest(http.MethodGet, "/hello", nil)
+	r.Host = created.Subdomain + "." + ts.cfg.Domain
+	w := httptest.NewRecorder()
+	srv.proxyHandler().ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("proxied request = %d %s", w.Code, w.Body)
+	}
+
+	for _, line := range strings.Split(logs.String(), "\n") {
+		var entry map[string]any
+		if err := json.Unmarshal([]byte(line), &entry); err != nil || entry["msg"] != "http request" {
+			continue
+		}
+		if entry["subdomain"] != created.Subdomain || entry["tunnel_id"] != created.ID ||
+			!strings.HasSuffix(fmt.Sprint(entry["target"]), ":3000") {
+			t.Errorf("request log entry = %s, want the tunnel and target", line)
+		}
+		return
+	}
+	t.Errorf("no request log entry in %s", logs.String())
+}
+
+func TestExpiryWarningHeader(t *testing.T) {
+	ts := newTestServer(t, Config{ExpiryWarningThreshold: 10 * time.Minute}, testKeys{})
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	fresh := ts.backend(t, "", ok)
+
+	w := ts.proxy(t, fresh, http.MethodGet, "/", "")
+	if w.Header().Get("X-Arbok-Expires-In") == "" {
+		t.Error("response has no X-Arbok-Expires-In")
+	}
+	if warning := w.Header().Get("X-Arbok-Expiry-Warning"); warning != "" {
+		t.Errorf("fresh tunnel warned: %q", warning)
+	}
+
+	expiring := ts.backend(t, "", ok)
+	ts.reg.GetTunnel(expiring.ID).ExpiresAt = time.Now().Add(5 * time.Minute)
+	w = ts.proxy(t, expiring, http.MethodGet, "/", "")
+	if warning := w.Header().Get("X-Arbok-Expiry-Warning"); !strings.HasPrefix(warning, "tunnel expires in 4m") &&
+		!strings.HasPrefix(warning, "tunnel expires in 5m") {
+		t.Errorf("expiry warning = %q, want about 5m left", warning)
+	}
+}
+
+func TestProxyDialsBackendHost(t *testing.T) {
+	ts := newTestServer(t, Config{}, testKeys{})
+	var local atomic.Value
+	created := ts.backend(t, `{"backend_host":"192.168.50.10"}`, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		local.Store(r.Context().Value(http.LocalAddrContextKey).(net.Addr).String())
+	}))
+
+	w := ts.proxy(t, created, http.MethodGet, "/", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("proxied request = %d %s", w.Code, w.Body)
+	}
+	if got := local.Load(); got != "192.168.50.10:3000" {
+		t.Errorf("backend reached at %v, want 192.168.50.10:3000", got)
+	}
+	if info := ts.reg.GetTunnel(created.ID); info.AllowedIP == "192.168.50.10" {
+		t.Error("backend host replaced the tunnel's own address")
+	}
+}
+
+func TestStripResponseHeaders(t *testing.T) {
+	ts := newTestServer(t, Config{StripResponseHeaders: []string{"Server", "X-Powered-By"}}, testKeys{})
+	fingerprinted := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", "Apache/2.4.1")
+		w.Header().Set("X-Powered-By", "PHP/5.6")
+		w.Header().Set("X-Backend-Node", "node-7")
+		w.Header().Set("X-Request-Cost", "3")
+	})
+	plain := ts.backend(t, "", fingerprinted)
+	extra := ts.backend(t, `{"strip_response_headers":["X-Backend-Node"]}`, fingerprinted)
+
+	tests := []struct {
+		name     string
+		tun      TunnelResponse
+		stripped []string
+		kept     []string
+	}{
+		{"server list", plain, []string{"Server", "X-Powered-By"}, []string{"X-Backend-Node", "X-Request-Cost"}},
+		{"tunnel additions", extra, []string{"Server", "X-Powered-By", "X-Backend-Node"}, []string{"X-Request-Cost"}},
+	}
+	for _, tt := range tests {
+		w := ts.proxy(t, tt.tun, http.MethodGet, "/", "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: proxied request = %d %s", tt.name, w.Code, w.Body)
+		}
+		for _, h := range tt.stripped {
+			if v := w.Header().Get(h); v != "" {
+				t.Errorf("%s: %s = %q, want it stripped", tt.name, h, v)
+			}
+		}
+		for _, h := range tt.kept {
+			if w.Header().Get(h) == "" {
+				t.Errorf("%s: %s stripped, want it passed through", tt.name, h)
+			}
+		}
+	}
+}
+
+func TestIdenticalSubdomainsAcrossDomains(t *testing.T) {
+	ts := newTestServer(t, Config{Domain: "team1.com", Domains: []string{"team1.com", "team2.com"}},
+		testKeys{api: []string{"team1-key", "team2-key"}})
+
+	// Each team reserves app under its own domain and gets it on create
+	for _, domain := range []string{"team1.com", "team2.com"} {
+		key := strings.TrimSuffix(domain, ".com") + "-key"
+		if w := ts.do(http.MethodPost, domain, "/api/reservations", key, `{"subdomain":"app"}`); w.Code != http.StatusCreated {
+			t.Fatalf("reserve app under %s: %d %s", domain, w.Code, w.Body)
+		}
+		w := ts.do(http.MethodPost, domain, "/api/tunnel/3000?include_config=true", key, "")
+		if w.Code != http.StatusCreated {
+			t.Fatalf("create under %s: %d %s", domain, w.Code, w.Body)
+		}
+		var created TunnelResponse
+		decode(t, w, &created)
+		if want := "https://app." + domain; created.URL != want {
+			t.Errorf("tunnel URL = %q, want %q", created.URL, want)
+		}
+		if !strings.Contains(created.Config, "https://app."+domain) {
+			t.Errorf("config for %s names another host:\n%s", domain, created.Config)
+		}
+
+		ln, err := ts.connectPeer(t, created.ID, created.PrivateKey).ListenTCP(&net.TCPAddr{Port: 3000})
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, domain)
+		})}
+		go srv.Serve(ln)
+		t.Cleanup(func() { srv.Close() })
+	}
+
+	// Each host reaches its own domain's tunnel
+	for _, domain := range []string{"team1.com", "team2.com"} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Host = "app." + domain
+		w := httptest.NewRecorder()
+		ts.proxyHandler().ServeHTTP(w, r)
+		if w.Code != http.StatusOK || w.Body.String() != domain {
+			t.Errorf("GET app.%s = %d %q, want %q", domain, w.Code, w.Body, domain)
+		}
+	}
+}
+
+// connect sends a CONNECT request for host through the server's proxy
+// handler and returns the recorded response
+func (ts *testServer) connect(host string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodConnect, host+":443", nil)
+	w := httptest.NewRecorder()
+	ts.proxyHandler().ServeHTTP(w, r)
+	return w
+}
+
+func TestProxyAfterTunnelClose(t *testing.T) {
+	ts := newTestServer(t, Config{}, testKeys{})
+	created := ts.backend(t, "", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	host := created.Subdomain + "." + ts.cfg.Domain
+	if w := ts.proxy(t, created, http.MethodGet, "/", ""); w.Code != http.StatusOK {
+		t.Fatalf("request before close = %d %s", w.Code, w.Body)
+	}
+
+	ts.tun.Close()
+
+	check := func(kind string, w *httptest.ResponseRecorder) {
+		t.Helper()
+		var resp ErrorResponse
+		decode(t, w, &resp)
+		if w.Code != http.StatusServiceUnavailable || resp.Code != "BACKEND_UNAVAILABLE" {
+			t.Errorf("%s after close = %d %s, want 503 BACKEND_UNAVAILABLE", kind, w.Code, resp.Code)
+		}
+	}
+	check("request", ts.proxy(t, created, http.MethodGet, "/", ""))
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Host = host
+	upgradeHeaders(r.Header)
+	w := httptest.NewRecorder()
+	ts.proxyHandler().ServeHTTP(w, r)
+	check("WebSocket upgrade", w)
+
+	check("CONNECT", ts.connect(host))
+}
+
+func TestAllowedMethods(t *testing.T) {
+	ts := newTestServer(t, Config{}, testKeys{})
+	var hits atomic.Int32
+	counting := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { hits.Add(1) })
+	readOnly := ts.backend(t, `{"allowed_methods":["get"]}`, counting)
+	open := ts.backend(t, "", counting)
+
+	w := ts.proxy(t, readOnly, http.MethodPost, "/", "data")
+	var resp ErrorResponse
+	decode(t, w, &resp)
+	if w.Code != http.StatusMethodNotAllowed || resp.Code != "METHOD_NOT_ALLOWED" {
+		t.Errorf("POST to a GET-only tunnel = %d %s, want 405 METHOD_NOT_ALLOWED", w.Code, resp.Code)
+	}
+	if allow := w.Header().Get("Allow"); allow != "GET, HEAD" {
+		t.Errorf("Allow = %q, want %q", allow, "GET, HEAD")
+	}
+	if hits.Load() != 0 {
+		t.Error("rejected request reached the backend")
+	}
+
+	for _, method := range []string{http.MethodGet, http.MethodHead} {
+		if w := ts.proxy(t, readOnly, method, "/", ""); w.Code != http.StatusOK {
+			t.Errorf("%s to a GET-only tunnel = %d, want 200", method, w.Code)
+		}
+	}
+	if w := ts.proxy(t, open, http.MethodPost, "/", "data"); w.Code != http.StatusOK {
+		t.Errorf("POST to an unrestricted tunnel = %d, want 200", w.Code)
+	}
+
+	if w := ts.do(http.MethodPost, "", "/api/tunnel/3000", "", `{"allowed_methods":["GET","NOT A METHOD"]}`); w.Code != http.StatusBadRequest {
+		t.Errorf("create with an invalid method = %d, want 400", w.Code)
+	}
+}
+
+// guardedWriter is a ResponseWriter that fails the test when written to
+// after its handler returned
+type guardedWriter struct {
+	t        *testing.T
+	header   http.Header
+	mu       sync.Mutex
+	writes   int
+	returned atomic.Bool
+}
+
+func (g *guardedWriter) Header() http.Header { return g.header }
+func (g *guardedWriter) WriteHeader(int)     {}
+func (g *guardedWriter) Flush()              {}
+
+func (g *guardedWriter) Write(p []byte) (int, error) {
+	if g.returned.Load() {
+		g.t.Error("response written after the handler returned")
+	}
+	g.mu.Lock()
+	g.writes++
+	g.mu.Unlock()
+	return len(p), nil
+}
+
+func (g *guardedWriter) count() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.writes
+}
+
+func TestRelayStreamWaitsForCopies(t *testing.T) {
+	s := &Server{logger: discardLogger(), buffers: newBufferPool(0)}
+
+	targetConn, backend := net.Pipe()
+	defer backend.Close()
+	// The backend streams until the relay goes away
+	go func() {
+		for {
+			if _, err := backend.Write([]byte("data")); err != nil {
+				return
+			}
+		}
+	}()
+
+	// The client never sends anything upstream
+	body, bodyWriter := io.Pipe()
+	defer bodyWriter.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	r := httptest.NewRequest(http.MethodConnect, "/", body).WithContext(ctx)
+	w := &guardedWriter{t: t, header: make(http.Header)}
+
+	done := make(chan struct{})
+	go func() {
+		s.relayStream(w, r, targetConn)
+		w.returned.Store(true)
+		close(done)
+	}()
+
+	for w.count() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("relayStream did not return after the client went away")
+	}
+	// Any copy still running would write within this window
+	time.Sleep(50 * time.Millisecond)
+}
+
+func TestConnectAppliesTunnelRateLimit(t *testing.T) {
+	ts := newTestServer(t, Config{}, testKeys{})
+	// Only GET is proxied, so CONNECTs that pass the limit stop at the
+	// method check instead of dialing
+	created := ts.createTunnel(t, "3000", "", `{"max_rps":1,"allowed_methods":["GET"]}`)
+	host := created.Subdomain + "." + ts.cfg.Domain
+
+	if w := ts.connect(host); w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("first CONNECT = %d %s, want 405", w.Code, w.Body)
+	}
+	w := ts.connect(host)
+	var errResp ErrorResponse
+	decode(t, w, &errResp)
+	if w.Code != http.StatusTooManyRequests || errResp.Code != "TUNNEL_RATE_LIMITED" {
+		t.Errorf("second CONNECT = %d %s, want 429 TUNNEL_RATE_LIMITED", w.Code, errResp.Code)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("throttled CONNECT has no Retry-After")
+	}
+}
+
+func TestTunnelRateLimits(t *testing.T) {
+	ts := newTestServer(t, Config{TunnelMaxRPS: 1}, testKeys{})
+	// GET only, so requests that pass the limit stop at the method check
+	defaulted := ts.createTunnel(t, "3000", "", `{"allowed_methods":["GET"]}`)
+	own := ts.createTunnel(t, "3000", "", `{"max_rps":3,"allowed_methods":["GET"]}`)
+
+	// passed sends n POSTs to a tunnel and counts those under its limit
+	passed := func(tun TunnelResponse, n int) int {
+		t.Helper()
+		count := 0
+		for range n {
+			w := ts.proxy(t, tun, http.MethodPost, "/", "")
+			switch w.Code {
+			case http.StatusMethodNotAllowed:
+				count++
+			case http.StatusTooManyRequests:
+				if w.Header().Get("Retry-After") == "" {
+					t.Error("throttled request has no Retry-After")
+				}
+			default:
+				t.Fatalf("request = %d %s", w.Code, w.Body)
+			}
+		}
+		return count
+	}
+
+	if got := passed(defaulted, 5); got != 1 {
+		t.Errorf("%d of 5 requests passed the server-wide 1 rps, want 1", got)
+	}
+	// max_rps overrides the default, and each tunnel has its own bucket
+	if got := passed(own, 5); got != 3 {
+		t.Errorf("%d of 5 requests passed max_rps 3, want 3", got)
+	}
+
+	// Deleting a tunnel drops its limiter
+	if err := ts.reg.DeleteTunnel(defaulted.ID); err != nil {
+		t.Fatal(err)
+	}
+	ts.tunnelLimiters.mu.Lock()
+	_, kept := ts.tunnelLimiters.limiters[defaulted.ID]
+	ts.tunnelLimiters.mu.Unlock()
+	if kept {
+		t.Error("limiter kept after the tunnel was deleted")
+	}
+}
+
+func TestAllowedClientCIDRs(t *testing.T) {
+	ts := newTestServer(t, Config{TrustedProxies: []*net.IPNet{mustCIDR(t, "10.0.0.0/8")}}, testKeys{})
+	// GET only, so allowed clients stop at the method check
+	created := ts.createTunnel(t, "3000", "", `{"allowed_client_cidrs":["203.0.113.5/24","2001:db8::/32"],"allowed_methods":["GET"]}`)
+	if info := ts.reg.GetTunnel(created.ID); len(info.AllowedClientCIDRs) != 2 || info.AllowedClientCIDRs[0] != "203.0.113.0/24" {
+		t.Errorf("stored networks = %v, want them in canonical form", info.AllowedClientCIDRs)
+	}
+
+	tests := []struct {
+		name      string
+		remote    string
+		forwarded string
+		want      int
+	}{
+		{"allowed network", "203.0.113.9:1234", "", http.StatusMethodNotAllowed},
+		{"allowed IPv6 network", "[2001:db8::1]:1234", "", http.StatusMethodNotAllowed},
+		{"other network", "198.51.100.1:1234", "", http.StatusForbidden},
+		{"allowed client behind a trusted proxy", "10.0.0.1:1234", "203.0.113.9", http.StatusMethodNotAllowed},
+		{"other client behind a trusted proxy", "10.0.0.1:1234", "198.51.100.1", http.StatusForbidden},
+		{"spoofed header from an untrusted peer", "198.51.100.1:1234", "203.0.113.9", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		for _, method := range []string{http.MethodPost, http.MethodConnect} {
+			r := httptest.NewRequest(method, "/", nil)
+			r.Host = created.Subdomain + "." + ts.cfg.Domain
+			r.RemoteAddr = tt.remote
+			if tt.forwarded != "" {
+				r.Header.Set("X-Forwarded-For", tt.forwarded)
+			}
+			w := httptest.NewRecorder()
+			ts.proxyHandler().ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Errorf("%s: %s = %d %s, want %d", tt.name, method, w.Code, w.Body, tt.want)
+				continue
+			}
+			if tt.want == http.StatusForbidden {
+				var resp ErrorResponse
+				decode(t, w, &resp)
+				if resp.Code != "CLIENT_NOT_ALLOWED" {
+					t.Errorf("%s: %s code %s, want CLIENT_NOT_ALLOWED", tt.name, method, resp.Code)
+				}
+			}
+		}
+	}
+}
+
+func TestProxyMatchesHostCaseInsensitively(t *testing.T) {
+	ts := newTestServer(t, Config{}, testKeys{})
+	tun := ts.backend(t, "", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+
+	upper := strings.ToUpper(tun.Subdomain)
+	for _, host := range []string{upper + ".Example.com", upper + ".EXAMPLE.COM.", upper + ".example.com:443"} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Host = host
+		w := httptest.NewRecorder()
+		ts.proxyHandler().ServeHTTP(w, r)
+		if w.Code != http.StatusOK || w.Body.String() != "ok" {
+			t.Errorf("Host %s = %d %q, want tunnel %s", host, w.Code, w.Body, tun.Subdomain)
+		}
+	}
+}
+
+// dialWith makes the server dial backends of tunnels proxied from now on
+// with dial instead of through the netstack
+func (ts *testServer) dialWith(dial func(ctx context.Context, network, addr string) (net.Conn, error)) {
+	newTransport := ts.transports.newTransport
+	ts.transports.newTransport = func(t *tunnel.Info) *http.Transport {
+		tr := newTransport(t)
+		tr.DialContext = dial
+		return tr
+	}
+}
+
+func TestErrorOverrides(t *testing.T) {
+	const overrides = `{"error_overrides":{
+		"backend_error":{"status":200,"body":"{\"status\":\"down\"}"},
+		"backend_timeout":{"status":299,"body":"slow","content_type":"text/x-status"}}}`
+
+	t.Run("refused", func(t *testing.T) {
+		ts := newTestServer(t, Config{}, testKeys{})
+		ts.dialWith(func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return nil, &net.OpError{Op: "dial", Net: network, Err: syscall.ECONNREFUSED}
+		})
+		refused := ts.createTunnel(t, "3000", "", overrides)
+		w := ts.proxy(t, refused, http.MethodGet, "/", "")
+		if w.Code != http.StatusOK || w.Body.String() != `{"status":"down"}` || w.Header().Get("Content-Type") != "application/json" {
+			t.Errorf("refused = %d %s %q, want the JSON override", w.Code, w.Header().Get("Content-Type"), w.Body)
+		}
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		ts := newTestServer(t, Config{}, testKeys{})
+		// The dial blocks until it gives up
+		ts.dialWith(func(ctx context.Context, network, addr string) (net.Conn, error) {
+			ctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+			defer cancel()
+			<-ctx.Done()
+			return nil, ctx.Err()
+		})
+		silent := ts.createTunnel(t, "3000", "", overrides)
+		w := ts.proxy(t, silent, http.MethodGet, "/", "")
+		if w.Code != 299 || w.Body.String() != "slow" || w.Header().Get("Content-Type") != "text/x-status" {
+			t.Errorf("timeout = %d %s %q, want the override", w.Code, w.Header().Get("Content-Type"), w.Body)
+		}
+
+		// Conditions without an override keep the default error
+		plain := ts.createTunnel(t, "3001", "", `{"error_overrides":{"backend_error":{"status":200}}}`)
+		w = ts.proxy(t, plain, http.MethodGet, "/", "")
+		var resp ErrorResponse
+		decode(t, w, &resp)
+		if w.Code != http.StatusGatewayTimeout || resp.Code != CodeBackendTimeout {
+			t.Errorf("timeout without an override = %d %s, want 504 %s", w.Code, resp.Code, CodeBackendTimeout)
+		}
+	})
+}
+
+func TestProxyRoutesPathPrefixes(t *testing.T) {
+	ts := newTestServer(t, Config{}, testKeys{})
+	created := ts.createTunnel(t, "3000?include_config=true", "", `{"routes":[{"prefix":"/api","port":8081}]}`)
+	tnet := ts.connectPeer(t, created.ID, created.PrivateKey)
+	for _, port := range []int{3000, 8081} {
+		ln, err := tnet.ListenTCP(&net.TCPAddr{Port: port})
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "%d %s", port, r.URL.Path)
+		})}
+		go srv.Serve(ln)
+		t.Cleanup(func() { srv.Close() })
+	}
+
+	for target, want := range map[string]string{
+		"/":          "3000 /",
+		"/apis":      "3000 /apis",
+		"/api":       "8081 /api",
+		"/api/users": "8081 /api/users",
+	} {
+		if w := ts.proxy(t, created, http.MethodGet, target, ""); w.Code != http.StatusOK || w.Body.String() != want {
+			t.Errorf("GET %s = %d %q, want %q", target, w.Code, w.Body, want)
+		}
+	}
+}
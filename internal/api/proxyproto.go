@@ -0,0 +1,219 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxyProtoHeaderTimeout bounds how long a connection may take to send
+// its PROXY protocol header
+const proxyProtoHeaderTimeout = 5 * time.Second
+
+var (
+	// proxyProtoV1Prefix starts a text (v1) PROXY protocol header
+	proxyProtoV1Prefix = []byte("PROXY ")
+	// proxyProtoV2Sig starts a binary (v2) PROXY protocol header
+	proxyProtoV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+	errNoProxyHeader = errors.New("missing PROXY protocol header")
+)
+
+// proxyProtoListener wraps a listener whose connections may start with a
+// PROXY protocol header (v1 or v2), as sent by L4 load balancers such as
+// HAProxy or AWS NLB. The header is consumed and RemoteAddr reports the
+// real client.
+type proxyProtoListener struct {
+	net.Listener
+	// strict rejects connections that don't send a header
+	strict bool
+	// trusted limits whose headers are honoured; empty trusts everyone
+	trusted []*net.IPNet
+}
+
+func (l *proxyProtoListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyProtoConn{Conn: conn, listener: l, br: bufio.NewReader(conn)}, nil
+}
+
+// trusts reports whether addr may send a PROXY header
+func (l *proxyProtoListener) trusts(addr net.Addr) bool {
+	if len(l.trusted) == 0 {
+		return true
+	}
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, network := range l.trusted {
+		if network.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyProtoConn parses the header lazily, on the first Read or
+// RemoteAddr call, so a slow client can't stall the accept loop
+type proxyProtoConn struct {
+	net.Conn
+	listener *proxyProtoListener
+	br       *bufio.Reader
+
+	once       sync.Once
+	remoteAddr net.Addr
+	err        error
+}
+
+func (c *proxyProtoConn) init() {
+	c.once.Do(func() {
+		c.remoteAddr = c.Conn.RemoteAddr()
+		if !c.listener.trusts(c.remoteAddr) {
+			if c.listener.strict {
+				c.err = fmt.Errorf("PROXY header from untrusted peer %s", c.remoteAddr)
+			}
+			return
+		}
+
+		c.Conn.SetReadDeadline(time.Now().Add(proxyProtoHeaderTimeout))
+		addr, err := readProxyHeader(c.br)
+		c.Conn.SetReadDeadline(time.Time{})
+
+		switch {
+		case errors.Is(err, errNoProxyHeader) && !c.listener.strict:
+		case err != nil:
+			c.err = err
+		case addr != nil:
+			c.remoteAddr = addr
+		}
+	})
+}
+
+func (c *proxyProtoConn) Read(p []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.br.Read(p)
+}
+
+func (c *proxyProtoConn) RemoteAddr() net.Addr {
+	c.init()
+	return c.remoteAddr
+}
+
+// readProxyHeader consumes a v1 or v2 PROXY header from br. It returns a
+// nil address for headers that carry none (UNKNOWN, LOCAL) and
+// errNoProxyHeader, consuming nothing, when the stream doesn't start
+// with a header.
+func readProxyHeader(br *bufio.Reader) (net.Addr, error) {
+	first, err := br.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	switch first[0] {
+	case proxyProtoV1Prefix[0]:
+		if prefix, err := br.Peek(len(proxyProtoV1Prefix)); err == nil && bytes.Equal(prefix, proxyProtoV1Prefix) {
+			return readProxyHeaderV1(br)
+		}
+	case proxyProtoV2Sig[0]:
+		if sig, err := br.Peek(len(proxyProtoV2Sig)); err == nil && bytes.Equal(sig, proxyProtoV2Sig) {
+			return readProxyHeaderV2(br)
+		}
+	}
+	return nil, errNoProxyHeader
+}
+
+// readProxyHeaderV1 parses "PROXY TCP4 src dst sport dport\r\n"
+func readProxyHeaderV1(br *bufio.Reader) (net.Addr, error) {
+	// A v1 header is at most 107 bytes including the CRLF
+	var line []byte
+	for len(line) < 107 {
+		b, err := br.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("reading PROXY v1 header: %w", err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("PROXY v1 header too long or not CRLF terminated")
+	}
+
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed PROXY v1 header %q", line)
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("malformed PROXY v1 source %s:%s", fields[2], fields[4])
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyHeaderV2 parses the binary header: signature, version and
+// command, family and protocol, length, then the addresses
+func readProxyHeaderV2(br *bufio.Reader) (net.Addr, error) {
+	var hdr [16]byte
+	if _, err := io.ReadFull(br, hdr[:]); err != nil {
+		return nil, fmt.Errorf("reading PROXY v2 header: %w", err)
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported PROXY protocol version %d", hdr[12]>>4)
+	}
+	command := hdr[12] & 0x0f
+	family := hdr[13]
+	length := int(binary.BigEndian.Uint16(hdr[14:16]))
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(br, payload); err != nil {
+		return nil, fmt.Errorf("reading PROXY v2 addresses: %w", err)
+	}
+
+	// LOCAL connections (health checks) carry no client address
+	if command == 0 {
+		return nil, nil
+	}
+	if command != 1 {
+		return nil, fmt.Errorf("unsupported PROXY v2 command %d", command)
+	}
+
+	switch family {
+	case 0x11: // TCP over IPv4
+		if length < 12 {
+			return nil, errors.New("short PROXY v2 IPv4 address block")
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(payload[0:4]),
+			Port: int(binary.BigEndian.Uint16(payload[8:10])),
+		}, nil
+	case 0x21: // TCP over IPv6
+		if length < 36 {
+			return nil, errors.New("short PROXY v2 IPv6 address block")
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(payload[0:16]),
+			Port: int(binary.BigEndian.Uint16(payload[32:34])),
+		}, nil
+	default:
+		// UDP, unix sockets and unspecified families keep the peer address
+		return nil, nil
+	}
+}
@@ -0,0 +1,192 @@
+package api
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// proxyHeaderV2 builds a binary PROXY header for command and family with
+// the given source and destination
+func proxyHeaderV2(command, family byte, src, dst *net.TCPAddr) []byte {
+	var addrs []byte
+	if src != nil {
+		ip, dstIP := src.IP.To4(), dst.IP.To4()
+		if family == 0x21 {
+			ip, dstIP = src.IP.To16(), dst.IP.To16()
+		}
+		addrs = append(append(addrs, ip...), dstIP...)
+		addrs = binary.BigEndian.AppendUint16(addrs, uint16(src.Port))
+		addrs = binary.BigEndian.AppendUint16(addrs, uint16(dst.Port))
+	}
+	hdr := append([]byte{}, proxyProtoV2Sig...)
+	hdr = append(hdr, 0x20|command, family)
+	hdr = binary.BigEndian.AppendUint16(hdr, uint16(len(addrs)))
+	return append(hdr, addrs...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	const rest = "GET / HTTP/1.1\r\n"
+	v4 := &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 51234}
+	v6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::7"), Port: 51234}
+	dst4 := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 443}
+	dst6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443}
+
+	tests := []struct {
+		name   string
+		header string
+		want   string
+		err    bool
+	}{
+		{"v1 TCP4", "PROXY TCP4 203.0.113.7 10.0.0.1 51234 443\r\n", "203.0.113.7:51234", false},
+		{"v1 TCP6", "PROXY TCP6 2001:db8::7 2001:db8::1 51234 443\r\n", "[2001:db8::7]:51234", false},
+		{"v1 UNKNOWN", "PROXY UNKNOWN\r\n", "", false},
+		{"v2 IPv4", string(proxyHeaderV2(1, 0x11, v4, dst4)), "203.0.113.7:51234", false},
+		{"v2 IPv6", string(proxyHeaderV2(1, 0x21, v6, dst6)), "[2001:db8::7]:51234", false},
+		{"v2 LOCAL", string(proxyHeaderV2(0, 0x00, nil, nil)), "", false},
+		{"v1 bad address", "PROXY TCP4 nowhere 10.0.0.1 51234 443\r\n", "", true},
+		{"v1 without CRLF", "PROXY TCP4 203.0.113.7 10.0.0.1 51234 443\n", "", true},
+		{"v1 too long", "PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n", "", true},
+	}
+	for _, tt := range tests {
+		br := bufio.NewReader(strings.NewReader(tt.header + rest))
+		addr, err := readProxyHeader(br)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%s: parsed %v, want an error", tt.name, addr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		got := ""
+		if addr != nil {
+			got = addr.String()
+		}
+		if got != tt.want {
+			t.Errorf("%s: address %q, want %q", tt.name, got, tt.want)
+		}
+		if left, _ := io.ReadAll(br); string(left) != rest {
+			t.Errorf("%s: stream continues with %q, want %q", tt.name, left, rest)
+		}
+	}
+
+	// Without a header nothing is consumed
+	br := bufio.NewReader(strings.NewReader(rest))
+	if _, err := readProxyHeader(br); !errors.Is(err, errNoProxyHeader) {
+		t.Errorf("plain request: %v, want %v", err, errNoProxyHeader)
+	}
+	if left, _ := io.ReadAll(br); string(left) != rest {
+		t.Errorf("plain request consumed: %q left", left)
+	}
+}
+
+// serveProxyProto serves the remote address each request sees on a
+// listener accepting PROXY headers and returns its address
+func serveProxyProto(t *testing.T, strict bool) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.RemoteAddr)
+	})}
+	go srv.Serve(&proxyProtoListener{Listener: ln, strict: strict})
+	t.Cleanup(func() { srv.Close() })
+	return ln.Addr().String()
+}
+
+// remoteAddrVia sends header then a request to addr and returns the
+// remote address the handler saw, failing when the handler wasn't reached
+func remoteAddrVia(t *testing.T, addr string, header []byte) (string, error) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	conn.Write(header)
+	fmt.Fprint(conn, "GET / HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("status %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(resp.Body)
+	return string(body), err
+}
+
+func TestProxyProtoListenerSetsRemoteAddr(t *testing.T) {
+	addr := serveProxyProto(t, false)
+	dst := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 443}
+
+	tests := []struct {
+		name   string
+		header []byte
+		want   string
+	}{
+		{"v1", []byte("PROXY TCP4 203.0.113.7 10.0.0.1 51234 443\r\n"), "203.0.113.7:51234"},
+		{"v2", proxyHeaderV2(1, 0x11, &net.TCPAddr{IP: net.ParseIP("198.51.100.9"), Port: 40000}, dst), "198.51.100.9:40000"},
+	}
+	for _, tt := range tests {
+		got, err := remoteAddrVia(t, addr, tt.header)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: RemoteAddr = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	// Lenient mode lets connections without a header through as they are
+	got, err := remoteAddrVia(t, addr, nil)
+	if err != nil || !strings.HasPrefix(got, "127.0.0.1:") {
+		t.Errorf("request without a header saw %q, %v; want the peer address", got, err)
+	}
+}
+
+func TestProxyProtoStrictRejectsMissingHeader(t *testing.T) {
+	addr := serveProxyProto(t, true)
+	if got, err := remoteAddrVia(t, addr, nil); err == nil {
+		t.Errorf("strict listener served a request without a header, seen from %q", got)
+	}
+	if got, err := remoteAddrVia(t, addr, []byte("PROXY TCP4 203.0.113.7 10.0.0.1 51234 443\r\n")); err != nil || got != "203.0.113.7:51234" {
+		t.Errorf("strict listener with a header: %q, %v", got, err)
+	}
+}
+
+func TestProxyProtoIgnoresUntrustedPeers(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, lb, _ := net.ParseCIDR("192.0.2.0/24")
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.RemoteAddr)
+	})}
+	go srv.Serve(&proxyProtoListener{Listener: ln, trusted: []*net.IPNet{lb}})
+	t.Cleanup(func() { srv.Close() })
+
+	// Headers from outside the trusted load balancers aren't parsed, so
+	// clients can't spoof their address; the request is then malformed
+	got, err := remoteAddrVia(t, ln.Addr().String(), []byte("PROXY TCP4 203.0.113.7 10.0.0.1 51234 443\r\n"))
+	if err == nil {
+		t.Errorf("untrusted peer's header was honoured, handler saw %q", got)
+	}
+}
@@ -0,0 +1,100 @@
+package api
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mr-karan/arbok/internal/apikey"
+	"github.com/mr-karan/arbok/internal/auth"
+	"github.com/mr-karan/arbok/internal/metrics"
+	"github.com/mr-karan/arbok/internal/tunnel"
+	"golang.org/x/time/rate"
+)
+
+// allowCreate applies the tunnel creation rate limit. Requests are limited
+// per API key, by its ID so the limiter never holds keys, or per client IP
+// when no key is used. When the limit is hit
+// it sets Retry-After and returns false; the caller writes the 429.
+func (s *Server) allowCreate(w http.ResponseWriter, r *http.Request) bool {
+	if s.createLimiter == nil {
+		return true
+	}
+
+	key := "ip:" + s.clientIP(r)
+	if apiKey, ok := auth.GetAPIKey(r.Context()); ok && apiKey != "" {
+		key = "key:" + apikey.ID(apiKey)
+	}
+
+	ok, wait := s.createLimiter.Allow(key)
+	if !ok {
+		s.metrics.CreateRateLimited.Inc()
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		s.logger.Debug("tunnel creation rate limited", "retry_after", wait.Round(time.Millisecond))
+	}
+	return ok
+}
+
+// tunnelLimiters holds the token bucket of each rate limited tunnel
+type tunnelLimiters struct {
+	mu       sync.Mutex
+	limiters map[string]*rate.Limiter
+	metrics  *metrics.Metrics
+}
+
+func newTunnelLimiters(m *metrics.Metrics) *tunnelLimiters {
+	return &tunnelLimiters{limiters: make(map[string]*rate.Limiter), metrics: m}
+}
+
+// get returns the limiter for a tunnel allowing rps requests per second,
+// with bursts of up to a second's worth
+func (l *tunnelLimiters) get(t *tunnel.Info, rps float64) *rate.Limiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	lim, ok := l.limiters[t.ID]
+	if !ok {
+		lim = rate.NewLimiter(rate.Limit(rps), max(1, int(math.Ceil(rps))))
+		l.limiters[t.ID] = lim
+	}
+	return lim
+}
+
+// evict drops a removed tunnel's limiter and throttling series
+func (l *tunnelLimiters) evict(t *tunnel.Info) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, ok := l.limiters[t.ID]; ok {
+		delete(l.limiters, t.ID)
+		l.metrics.ForgetTunnelThrottled(t.Subdomain, t.Domain)
+	}
+}
+
+// allowTunnel applies a tunnel's request rate limit, its own max_rps or
+// the server-wide default, across all clients. Over the limit it writes a
+// 429 with Retry-After and returns false.
+func (s *Server) allowTunnel(w http.ResponseWriter, t *tunnel.Info) bool {
+	rps := t.MaxRPS
+	if rps <= 0 {
+		rps = s.cfg.TunnelMaxRPS
+	}
+	if rps <= 0 {
+		return true
+	}
+
+	now := time.Now()
+	res := s.tunnelLimiters.get(t, rps).ReserveN(now, 1)
+	wait := res.DelayFrom(now)
+	if wait == 0 {
+		return true
+	}
+	res.CancelAt(now)
+
+	s.metrics.TunnelThrottled(t.Subdomain, t.Domain).Inc()
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	respondError(w, http.StatusTooManyRequests, CodeTunnelRateLimited, "Too many requests to this tunnel, retry later")
+	return false
+}
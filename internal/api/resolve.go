@@ -0,0 +1,153 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mr-karan/arbok/internal/tunnel"
+)
+
+// backendResolveInterval is how long a resolved hostname backend is used
+// before it is looked up again
+const backendResolveInterval = 5 * time.Minute
+
+// backendResolveTimeout bounds a single backend lookup
+const backendResolveTimeout = 5 * time.Second
+
+// backendResolvers tracks when each tunnel's hostname backend was last
+// resolved. Lookups for one tunnel are serialized so a burst of requests
+// triggers a single query.
+type backendResolvers struct {
+	mu      sync.Mutex
+	entries map[string]*backendResolveEntry
+}
+
+type backendResolveEntry struct {
+	mu         sync.Mutex
+	resolvedAt time.Time
+}
+
+func newBackendResolvers() *backendResolvers {
+	return &backendResolvers{entries: make(map[string]*backendResolveEntry)}
+}
+
+// entry returns the resolve state for a tunnel, creating it on first use
+func (b *backendResolvers) entry(t *tunnel.Info) *backendResolveEntry {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	e, ok := b.entries[t.ID]
+	if !ok {
+		e = &backendResolveEntry{}
+		b.entries[t.ID] = e
+	}
+	return e
+}
+
+// evict drops a removed tunnel's resolve state
+func (b *backendResolvers) evict(t *tunnel.Info) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.entries, t.ID)
+}
+
+// resolverFor returns the resolver a tunnel picked for its hostname
+// backend: the peer's own DNS server, reached through the tunnel, or one
+// of the configured internal resolvers, reached from the server's network
+func (s *Server) resolverFor(t *tunnel.Info) *net.Resolver {
+	if t.DNSResolver == tunnel.PeerResolver {
+		return s.tun.Resolver(net.JoinHostPort(t.AllowedIP, "53"))
+	}
+	addr := t.DNSResolver
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}
+}
+
+// ensureBackend resolves a tunnel's hostname backend when it hasn't been
+// resolved recently and routes the address to the peer. A failed lookup
+// keeps the previous address; without one the request gets a 502. It
+// returns the tunnel as updated by the lookup and whether to continue.
+func (s *Server) ensureBackend(w http.ResponseWriter, r *http.Request, t *tunnel.Info) (*tunnel.Info, bool) {
+	if !t.BackendIsHostname() {
+		return t, true
+	}
+
+	e := s.backendResolvers.entry(t)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	// A lookup made while waiting for the entry may have replaced t
+	if current := s.registry.GetTunnel(t.ID); current != nil {
+		t = current
+	}
+	if t.ResolvedBackendIP != "" && time.Since(e.resolvedAt) < backendResolveInterval {
+		return t, true
+	}
+
+	t, err := s.resolveBackend(r.Context(), t)
+	if err == nil {
+		e.resolvedAt = time.Now()
+		return t, true
+	}
+	if t.ResolvedBackendIP != "" {
+		s.logger.Warn("failed to re-resolve backend, keeping previous address",
+			"tunnel_id", t.ID, "backend_host", t.BackendHost,
+			"address", t.ResolvedBackendIP, "error", err)
+		// Don't retry on every request while the resolver is down
+		e.resolvedAt = time.Now().Add(-backendResolveInterval + time.Minute)
+		return t, true
+	}
+
+	s.logger.Warn("failed to resolve backend", "tunnel_id", t.ID,
+		"backend_host", t.BackendHost, "resolver", t.DNSResolver, "error", err)
+	respondErrorDetails(w, http.StatusBadGateway, CodeBackendUnresolved, "Could not resolve backend host", err.Error())
+	return t, false
+}
+
+// resolveBackend looks up a tunnel's hostname backend, records the first
+// usable IPv4 address and, when it changed, routes it to the peer. It
+// returns the tunnel as updated, or t when nothing was recorded.
+func (s *Server) resolveBackend(ctx context.Context, t *tunnel.Info) (*tunnel.Info, error) {
+	ctx, cancel := context.WithTimeout(ctx, backendResolveTimeout)
+	defer cancel()
+
+	addrs, err := s.resolverFor(t).LookupIPAddr(ctx, t.BackendHost)
+	if err != nil {
+		return t, err
+	}
+
+	var lastErr error = errors.New("no IPv4 address")
+	for _, addr := range addrs {
+		ip4 := addr.IP.To4()
+		if ip4 == nil {
+			continue
+		}
+		updated, changed, err := s.registry.SetResolvedBackend(t.ID, ip4.String())
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if changed {
+			if err := s.addPeer(updated); err != nil {
+				return updated, err
+			}
+			// Pooled connections point at the old address
+			s.transports.evict(t)
+			s.logger.Info("resolved backend host", slog.String("tunnel_id", t.ID),
+				slog.String("backend_host", t.BackendHost), slog.String("address", ip4.String()))
+		}
+		return updated, nil
+	}
+	return t, lastErr
+}
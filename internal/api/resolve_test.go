@@ -0,0 +1,157 @@
+package api
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// serveDNS answers A queries on conn from records, keyed by lowercase
+// name without the trailing dot. Other names get NXDOMAIN and other
+// query types an empty answer.
+func serveDNS(conn net.PacketConn, records map[string]net.IP, queries *atomic.Int32) {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		queries.Add(1)
+		if resp := dnsReply(buf[:n], records); resp != nil {
+			conn.WriteTo(resp, addr)
+		}
+	}
+}
+
+// dnsReply builds the response to a single-question DNS query
+func dnsReply(query []byte, records map[string]net.IP) []byte {
+	if len(query) < 12 {
+		return nil
+	}
+	// Walk the question's name to find its type
+	var labels []string
+	i := 12
+	for i < len(query) && query[i] != 0 {
+		end := i + 1 + int(query[i])
+		if end > len(query) {
+			return nil
+		}
+		labels = append(labels, string(query[i+1:end]))
+		i = end
+	}
+	if i+5 > len(query) {
+		return nil
+	}
+	question := query[12 : i+5]
+	qtype := binary.BigEndian.Uint16(query[i+1:])
+
+	resp := append([]byte(nil), query[:2]...)
+	ip, found := records[strings.ToLower(strings.Join(labels, "."))]
+	flags, answers := uint16(0x8180), uint16(0)
+	switch {
+	case !found:
+		flags |= 3 // NXDOMAIN
+	case qtype == 1:
+		answers = 1
+	}
+	resp = binary.BigEndian.AppendUint16(resp, flags)
+	resp = binary.BigEndian.AppendUint16(resp, 1)
+	resp = binary.BigEndian.AppendUint16(resp, answers)
+	resp = append(resp, 0, 0, 0, 0)
+	resp = append(resp, question...)
+	if answers == 1 {
+		// Name pointer to the question, type A, class IN, TTL 60
+		resp = append(resp, 0xc0, 12, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4)
+		resp = append(resp, ip.To4()...)
+	}
+	return resp
+}
+
+// hostnameBackend creates a tunnel whose backend_host is host, resolved by
+// the peer's DNS server, and brings up a peer that answers DNS on its
+// tunnel IP from records and serves handler on backendIP:3000
+func (ts *testServer) hostnameBackend(t *testing.T, host string, backendIP netip.Addr, records map[string]net.IP, handler http.Handler) (TunnelResponse, *atomic.Int32) {
+	t.Helper()
+	created := ts.createTunnel(t, "3000?include_config=true", "", `{"backend_host":"`+host+`","dns_resolver":"peer"}`)
+	tnet := ts.connectPeer(t, created.ID, created.PrivateKey, backendIP)
+
+	info := ts.reg.GetTunnel(created.ID)
+	dns, err := tnet.ListenUDP(&net.UDPAddr{IP: net.ParseIP(info.AllowedIP), Port: 53})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { dns.Close() })
+	queries := new(atomic.Int32)
+	go serveDNS(dns, records, queries)
+
+	ln, err := tnet.ListenTCP(&net.TCPAddr{IP: backendIP.AsSlice(), Port: 3000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: handler}
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Close() })
+	return created, queries
+}
+
+func TestProxyResolvesBackendThroughPeer(t *testing.T) {
+	ts := newTestServer(t, Config{}, testKeys{})
+	backendIP := netip.MustParseAddr("192.168.50.10")
+	created, queries := ts.hostnameBackend(t, "DB.internal.", backendIP,
+		map[string]net.IP{"db.internal": backendIP.AsSlice()},
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, "db")
+		}))
+	if info := ts.reg.GetTunnel(created.ID); info.BackendHost != "db.internal" || info.ResolvedBackendIP != "" {
+		t.Fatalf("created backend %q resolved to %q, want db.internal unresolved", info.BackendHost, info.ResolvedBackendIP)
+	}
+
+	w := ts.proxy(t, created, http.MethodGet, "/", "")
+	if w.Code != http.StatusOK || w.Body.String() != "db" {
+		t.Fatalf("proxied request = %d %q, want the backend", w.Code, w.Body)
+	}
+	info := ts.reg.GetTunnel(created.ID)
+	if info.ResolvedBackendIP != backendIP.String() {
+		t.Errorf("resolved backend = %q, want %s", info.ResolvedBackendIP, backendIP)
+	}
+	if got := ts.tunnelResponse(info).ResolvedBackendIP; got != backendIP.String() {
+		t.Errorf("response resolved_backend_ip = %q", got)
+	}
+
+	// The address is reused until the resolve interval passes
+	asked := queries.Load()
+	if w := ts.proxy(t, created, http.MethodGet, "/", ""); w.Code != http.StatusOK {
+		t.Fatalf("second request = %d %s", w.Code, w.Body)
+	}
+	if queries.Load() != asked {
+		t.Error("backend resolved again within the resolve interval")
+	}
+}
+
+func TestProxyUnresolvableBackend(t *testing.T) {
+	ts := newTestServer(t, Config{}, testKeys{})
+	created, _ := ts.hostnameBackend(t, "missing.internal", netip.MustParseAddr("192.168.50.10"), nil,
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	w := ts.proxy(t, created, http.MethodGet, "/", "")
+	var resp ErrorResponse
+	decode(t, w, &resp)
+	if w.Code != http.StatusBadGateway || resp.Code != "BACKEND_UNRESOLVED" {
+		t.Errorf("request = %d %s, want 502 BACKEND_UNRESOLVED", w.Code, resp.Code)
+	}
+}
+
+func TestCreateRejectsUnknownDNSResolver(t *testing.T) {
+	ts := newTestServer(t, Config{}, testKeys{})
+	w := ts.do(http.MethodPost, "", "/api/tunnel/3000", "", `{"backend_host":"db.internal","dns_resolver":"10.0.0.53:53"}`)
+	var resp ErrorResponse
+	decode(t, w, &resp)
+	if w.Code != http.StatusBadRequest || resp.Code != "INVALID_DNS_RESOLVER" {
+		t.Errorf("create = %d %s, want 400 INVALID_DNS_RESOLVER", w.Code, resp.Code)
+	}
+}
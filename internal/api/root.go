@@ -0,0 +1,57 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Root behaviors: what a request for / that isn't tunnel traffic gets
+const (
+	// RootRedirectUI redirects to the website at /ui (the default)
+	RootRedirectUI = "redirect_ui"
+	// RootRedirectURL, followed by a URL, redirects there, e.g. to the
+	// operator's own docs: "redirect_url:https://docs.example.com"
+	RootRedirectURL = "redirect_url:"
+	// RootOK answers 200 with a short plain text landing
+	RootOK = "ok"
+	// RootNotFound answers 404
+	RootNotFound = "notfound"
+)
+
+// ValidateRootBehavior checks a root behavior setting. Empty means
+// RootRedirectUI.
+func ValidateRootBehavior(behavior string) error {
+	switch behavior {
+	case "", RootRedirectUI, RootOK, RootNotFound:
+		return nil
+	}
+	target, ok := strings.CutPrefix(behavior, RootRedirectURL)
+	if !ok {
+		return fmt.Errorf("must be %q, %q, %q or %q followed by a URL",
+			RootRedirectUI, RootOK, RootNotFound, RootRedirectURL)
+	}
+	u, err := url.Parse(target)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%s needs an absolute http(s) URL", RootRedirectURL)
+	}
+	return nil
+}
+
+// serveRoot answers a request for / that isn't tunnel traffic as
+// configured by RootBehavior
+func (s *Server) serveRoot(w http.ResponseWriter, r *http.Request) {
+	behavior := s.cfg.RootBehavior
+	switch {
+	case behavior == RootOK:
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintf(w, "arbok tunnel server\n\nCreate a tunnel to local port 3000:\n  curl https://%s/3000\n", r.Host)
+	case behavior == RootNotFound:
+		http.NotFound(w, r)
+	case strings.HasPrefix(behavior, RootRedirectURL):
+		http.Redirect(w, r, strings.TrimPrefix(behavior, RootRedirectURL), http.StatusFound)
+	default:
+		http.Redirect(w, r, "/ui", http.StatusFound)
+	}
+}
@@ -0,0 +1,62 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestRootBehavior(t *testing.T) {
+	tests := []struct {
+		behavior string
+		code     int
+		location string
+		body     string
+	}{
+		{"", http.StatusFound, "/ui", ""},
+		{RootRedirectUI, http.StatusFound, "/ui", ""},
+		{RootRedirectURL + "https://docs.example.org/start", http.StatusFound, "https://docs.example.org/start", ""},
+		{RootOK, http.StatusOK, "", "curl https://example.com/3000"},
+		{RootNotFound, http.StatusNotFound, "", ""},
+	}
+	for _, tt := range tests {
+		ts := newTestServer(t, Config{ServeUI: true, RootBehavior: tt.behavior}, testKeys{})
+		w := ts.do(http.MethodGet, "", "/", "", "")
+		if w.Code != tt.code || w.Header().Get("Location") != tt.location {
+			t.Errorf("%q: / = %d to %q, want %d to %q", tt.behavior, w.Code, w.Header().Get("Location"), tt.code, tt.location)
+		}
+		if !strings.Contains(w.Body.String(), tt.body) {
+			t.Errorf("%q: body %q lacks %q", tt.behavior, w.Body, tt.body)
+		}
+	}
+}
+
+func TestRootBehaviorKeepsTunnelTraffic(t *testing.T) {
+	ts := newTestServer(t, Config{ServeUI: true, RootBehavior: RootNotFound}, testKeys{})
+	tun := ts.backend(t, "", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("from the tunnel"))
+	}))
+	w := ts.do(http.MethodGet, tun.Subdomain+"."+ts.cfg.Domain, "/", "", "")
+	if w.Code != http.StatusOK || w.Body.String() != "from the tunnel" {
+		t.Errorf("tunnel / = %d %q, want the backend's response", w.Code, w.Body)
+	}
+}
+
+func TestValidateRootBehavior(t *testing.T) {
+	for behavior, valid := range map[string]bool{
+		"":                              true,
+		RootRedirectUI:                  true,
+		RootOK:                          true,
+		RootNotFound:                    true,
+		"redirect_url:https://docs.io/": true,
+		"redirect_url:http://docs.io":   true,
+		"redirect_url:/docs":            false,
+		"redirect_url:ftp://docs.io":    false,
+		"redirect_url:":                 false,
+		"redirect":                      false,
+	} {
+		if err := ValidateRootBehavior(behavior); (err == nil) != valid {
+			t.Errorf("ValidateRootBehavior(%q) = %v, want valid=%v", behavior, err, valid)
+		}
+	}
+}
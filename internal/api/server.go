@@ -2,11 +2,14 @@ package api
 
 import (
 	"context"
+	"crypto/tls"
 	"embed"
 	"fmt"
 	"io/fs"
 	"log/slog"
+	"net"
 	"net/http"
+	"sort"
 	"strings"
 	"time"
 
@@ -25,121 +28,553 @@ var webFiles embed.FS
 type Server struct {
 	cfg      Config
 	logger   *slog.Logger
+	metrics  *metrics.Metrics
 	tun      *tunnel.Tunnel
 	registry *registry.Registry
 	auth     *auth.Authenticator
 	router   *mux.Router
+	// adminRouter serves management routes when AdminListenAddr is set
+	adminRouter *mux.Router
+
+	interceptors []ProxyInterceptor
+
+	// createLimiter throttles tunnel creation; nil when disabled
+	createLimiter *auth.RateLimiter
+
+	// provisions holds a token per tunnel creation in progress
+	provisions chan struct{}
+
+	// domains are the served domains, longest first so the most specific
+	// one matches a host
+	domains []string
+
+	// transports caches a connection pool per tunnel
+	transports *transportCache
+
+	// backendResolvers paces lookups of hostname backends
+	backendResolvers *backendResolvers
+
+	// inspector records recent proxied requests, nil when disabled
+	inspector *inspector
+
+	// health publishes changes in backend reachability
+	health *backendHealth
+
+	// tunnelLimiters enforce per-tunnel request rate limits
+	tunnelLimiters *tunnelLimiters
+
+	// scheduler shares in-flight requests fairly between tunnels, nil
+	// unless fair scheduling is on
+	scheduler *fairScheduler
+
+	// bandwidth caps the combined throughput of all proxied traffic, nil
+	// without a limit
+	bandwidth *bandwidthLimiter
+
+	// shares mints and verifies share tokens
+	shares *shareSigner
+
+	// warm holds pre-dialed backend connections, nil unless keep-warm
+	// is enabled
+	warm *warmPool
+
+	// buffers are shared by the reverse proxy and raw relays
+	buffers *bufferPool
+
+	// servers and listeners are bound by Listen and served by Start
+	servers   []*http.Server
+	listeners []net.Listener
+
+	// hopID identifies this server in X-Arbok-Hop, to catch tunnels
+	// proxying back to us
+	hopID string
 }
 
 // Config holds server configuration
 type Config struct {
-	ListenAddr        string
+	ListenAddr string
+	// AdminListenAddr, when set, moves /api, /health, /metrics and the UI
+	// to a separate listener so the proxy port serves tunnel traffic only
+	AdminListenAddr string
+	// MetricsListenAddr, when set, serves /metrics only on its own
+	// listener, typically bound to loopback, instead of the routers
+	MetricsListenAddr string
+	// Metrics are served at /metrics and recorded to by the server. nil
+	// uses a set with the default prefix.
+	Metrics *metrics.Metrics
+	// Domain is the default domain; Domains lists every served domain
+	// including it. Tunnels live under the domain they were created from.
 	Domain            string
+	Domains           []string
 	WireGuardPort     int
 	WireGuardEndpoint string
 	AllowedOrigins    []string
+	// TLSCertFile and TLSKeyFile enable native TLS on ListenAddr
+	TLSCertFile string
+	TLSKeyFile  string
+	// HTTP2 offers h2 alongside http/1.1 via ALPN on the TLS listener
+	HTTP2 bool
+	// TrustedProxies are the networks whose forwarding headers are believed
+	TrustedProxies []*net.IPNet
+	// ServeUI registers the website, client script and root redirect
+	ServeUI bool
+
+	// InterceptorRejectStatus is the status returned when a proxy
+	// interceptor rejects a request without choosing its own status.
+	InterceptorRejectStatus int
+
+	// ExpiryWarningThreshold is the remaining TTL below which proxied
+	// responses carry an X-Arbok-Expiry-Warning header
+	ExpiryWarningThreshold time.Duration
+
+	// StripResponseHeaders are removed from every proxied response to
+	// hide backend fingerprints such as Server and X-Powered-By
+	StripResponseHeaders []string
+
+	// CreateRPS and CreateBurst limit tunnel creations per API key (or
+	// client IP without one). Zero CreateRPS disables the limit.
+	CreateRPS   float64
+	CreateBurst int
+
+	// MaxConcurrentProvisions bounds tunnel creations in progress at
+	// once, across all keys; more get a 503 with Retry-After
+	MaxConcurrentProvisions int
+
+	// GlobalRateLimitBPS caps the combined throughput, in bits per second,
+	// of every proxied body and relayed stream. Zero means no limit.
+	GlobalRateLimitBPS int64
+
+	// TunnelMaxRPS caps requests per second to each tunnel that doesn't
+	// set its own max_rps. Zero means no limit.
+	TunnelMaxRPS float64
+
+	// MaxIdleConnsPerTunnel and IdleConnTimeout size each tunnel's own
+	// backend connection pool
+	MaxIdleConnsPerTunnel int
+	IdleConnTimeout       time.Duration
+
+	// DialTimeout bounds dials to backends through the netstack and
+	// ResponseHeaderTimeout how long a backend may take to start
+	// responding. Either expiring returns 504.
+	DialTimeout           time.Duration
+	ResponseHeaderTimeout time.Duration
+
+	// MaxRequestTimeout caps the request_timeout tunnels may set
+	MaxRequestTimeout time.Duration
+
+	// ExpectContinueTimeout is how long a request with Expect:
+	// 100-continue waits for the backend's go-ahead before its body is
+	// sent anyway. StripExpect drops the header instead, for backends
+	// that mishandle it; clients still get their 100 Continue from the
+	// proxy.
+	ExpectContinueTimeout time.Duration
+	StripExpect           bool
+
+	// ProxyProtocol accepts PROXY protocol v1/v2 headers on ListenAddr,
+	// from TrustedProxies when set. ProxyProtocolStrict rejects
+	// connections without one.
+	ProxyProtocol       bool
+	ProxyProtocolStrict bool
+
+	// SlowRequestThreshold, when positive, logs only requests slower than
+	// it or with a non-2xx status at Info and everything else at Debug
+	SlowRequestThreshold time.Duration
+
+	// RootBehavior is what / answers with the UI served: RootRedirectUI
+	// (the default), RootRedirectURL followed by a URL, RootOK or
+	// RootNotFound
+	RootBehavior string
+
+	// MaxHeaderCount and MaxHeaderBytes cap the header lines and total
+	// header size of inbound requests; larger requests get a 431
+	MaxHeaderCount int
+	MaxHeaderBytes int
+
+	// RelayBufferBytes sizes the pooled buffers used to copy proxied and
+	// relayed (WebSocket, CONNECT) streams
+	RelayBufferBytes int
+
+	// WebSocketRelay is WebSocketRelayRaw (the default) or
+	// WebSocketRelayFrames, which enforces the frame and message limits
+	WebSocketRelay           string
+	WebSocketMaxFrameBytes   int64
+	WebSocketMaxMessageBytes int64
+
+	// ShareSecret signs share tokens. Empty uses a random key, so tokens
+	// don't survive restarts.
+	ShareSecret string
+
+	// KeepWarm holds KeepWarmConns pre-dialed connections to the backend
+	// of each tunnel that saw traffic within KeepWarmWindow
+	KeepWarm       bool
+	KeepWarmConns  int
+	KeepWarmWindow time.Duration
+
+	// FairScheduling bounds proxied requests in flight to MaxInFlight and,
+	// when they're all busy, admits waiting requests round-robin across
+	// tunnels. Requests waiting longer than FairQueueTimeout get a 503.
+	// CONNECT streams and WebSockets hold their slot until they close.
+	FairScheduling   bool
+	MaxInFlight      int
+	FairQueueTimeout time.Duration
+
+	// InjectHTML is inserted after the <body> tag of proxied HTML
+	// responses, e.g. a maintenance banner. Empty disables it.
+	InjectHTML string
+
+	// BlockedContentTypes are media types (e.g. "application/x-msdownload",
+	// or "text/*" for a whole type) backends may not serve. Matching
+	// responses get 451 and flag their tunnel for admin review. Empty
+	// disables the check.
+	BlockedContentTypes []string
+
+	// MaxBufferedBodyBytes caps how much of a body features that rewrite
+	// or inspect it may buffer; larger bodies stream through untouched
+	MaxBufferedBodyBytes int64
+
+	// InspectRequests is how many recent requests the inspector keeps per
+	// tunnel; zero disables it. InspectBodyBytes, when positive, captures
+	// up to that many bytes of each request and response body.
+	InspectRequests  int
+	InspectBodyBytes int64
 }
 
 // NewServer creates a new API server
-func NewAPIServer(cfg Config, logger *slog.Logger, tun *tunnel.Tunnel, reg *registry.Registry, auth *auth.Authenticator) *Server {
+func NewAPIServer(cfg Config, logger *slog.Logger, tun *tunnel.Tunnel, reg *registry.Registry, authenticator *auth.Authenticator) *Server {
 	s := &Server{
 		cfg:      cfg,
 		logger:   logger,
 		tun:      tun,
 		registry: reg,
-		auth:     auth,
+		auth:     authenticator,
 		router:   mux.NewRouter(),
 	}
-	
+	s.metrics = cfg.Metrics
+	if s.metrics == nil {
+		s.metrics = metrics.New("")
+	}
+	s.buffers = newBufferPool(cfg.RelayBufferBytes)
+	s.shares = newShareSigner(cfg.ShareSecret)
+	s.bandwidth = newBandwidthLimiter(cfg.GlobalRateLimitBPS)
+	if cfg.FairScheduling {
+		if s.cfg.MaxInFlight <= 0 {
+			s.cfg.MaxInFlight = DefaultMaxInFlight
+		}
+		if s.cfg.FairQueueTimeout <= 0 {
+			s.cfg.FairQueueTimeout = DefaultFairQueueTimeout
+		}
+		s.scheduler = newFairScheduler(s.cfg.MaxInFlight)
+	}
+	s.hopID = newHopID()
+	if s.cfg.WebSocketMaxFrameBytes <= 0 {
+		s.cfg.WebSocketMaxFrameBytes = DefaultWebSocketMaxFrameBytes
+	}
+	if s.cfg.WebSocketMaxMessageBytes <= 0 {
+		s.cfg.WebSocketMaxMessageBytes = DefaultWebSocketMaxMessageBytes
+	}
+	if s.cfg.MaxHeaderCount <= 0 {
+		s.cfg.MaxHeaderCount = DefaultMaxHeaderCount
+	}
+	if s.cfg.MaxHeaderBytes <= 0 {
+		s.cfg.MaxHeaderBytes = DefaultMaxHeaderBytes
+	}
+	if s.cfg.MaxBufferedBodyBytes <= 0 {
+		s.cfg.MaxBufferedBodyBytes = DefaultMaxBufferedBodyBytes
+	}
+	if s.cfg.MaxRequestTimeout <= 0 {
+		s.cfg.MaxRequestTimeout = DefaultMaxRequestTimeout
+	}
+	s.transports = newTransportCache(s.newTunnelTransport)
+	// Close a tunnel's pooled connections once it's gone
+	reg.OnDelete(s.transports.evict)
+	s.backendResolvers = newBackendResolvers()
+	reg.OnDelete(s.backendResolvers.evict)
+	s.tunnelLimiters = newTunnelLimiters(s.metrics)
+	reg.OnDelete(s.tunnelLimiters.evict)
+	s.health = newBackendHealth(reg.Events())
+	reg.OnDelete(s.health.evict)
+	if cfg.KeepWarm {
+		s.warm = newWarmPool()
+		reg.OnDelete(s.warm.evict)
+	}
+	if cfg.InspectRequests > 0 {
+		s.inspector = newInspector(cfg.InspectRequests, cfg.InspectBodyBytes)
+		reg.OnDelete(s.inspector.evict)
+	}
+
+	if cfg.CreateRPS > 0 {
+		s.createLimiter = auth.NewRateLimiter(cfg.CreateRPS, cfg.CreateBurst)
+	}
+	if s.cfg.MaxConcurrentProvisions <= 0 {
+		s.cfg.MaxConcurrentProvisions = DefaultMaxConcurrentProvisions
+	}
+	s.provisions = make(chan struct{}, s.cfg.MaxConcurrentProvisions)
+
+	s.domains = append([]string{}, cfg.Domains...)
+	if len(s.domains) == 0 {
+		s.domains = []string{cfg.Domain}
+	}
+	for i, d := range s.domains {
+		s.domains[i] = strings.ToLower(d)
+	}
+	sort.Slice(s.domains, func(i, j int) bool {
+		return len(s.domains[i]) > len(s.domains[j])
+	})
+
 	s.setupRoutes()
 	return s
 }
 
 func (s *Server) setupRoutes() {
-	// Global middleware for all routes
-	s.router.Use(
+	// Management routes live on the main router unless a separate
+	// admin listener is configured
+	admin := s.router
+	if s.cfg.AdminListenAddr != "" {
+		s.adminRouter = mux.NewRouter()
+		admin = s.adminRouter
+		s.useGlobalMiddleware(s.adminRouter)
+	}
+	s.useGlobalMiddleware(s.router)
+
+	s.setupAdminRoutes(admin)
+
+	// Tunnel provisioning
+	s.router.HandleFunc("/{port:[0-9]+}", s.handleProvisionSimple).Methods("GET")
+
+	// Public WireGuard parameters, served where clients connect
+	s.router.HandleFunc(DiscoveryPath, s.handleDiscovery).Methods("GET")
+
+	// Tunnel traffic proxy
+	s.router.PathPrefix("/").HandlerFunc(s.handleTunnelProxy)
+}
+
+// useGlobalMiddleware installs the middleware shared by every route
+func (s *Server) useGlobalMiddleware(router *mux.Router) {
+	router.Use(
 		middleware.Recovery(s.logger),
-		middleware.Logger(s.logger),
+		middleware.Logger(s.logger, s.metrics, s.cfg.SlowRequestThreshold),
 		middleware.CORS(s.cfg.AllowedOrigins),
+		s.limitHeaders,
 	)
+}
+
+// setupAdminRoutes registers the UI, health, metrics and API routes
+func (s *Server) setupAdminRoutes(router *mux.Router) {
+	split := router != s.router
 	
+	if s.cfg.ServeUI {
+		s.setupUIRoutes(router, split)
+	}
+
+	// Health and metrics endpoints
+	router.HandleFunc("/health", s.handleHealth).Methods("GET")
+	router.HandleFunc("/ready", s.handleReady).Methods("GET")
+	if s.cfg.MetricsListenAddr == "" {
+		router.HandleFunc("/metrics", s.metrics.Handler()).Methods("GET")
+	}
+
+	// Read-only tunnel endpoints, also open to the tunnel's share tokens
+	router.Handle("/api/tunnel/{id}", s.shareReadable(s.handleGetTunnel)).Methods("GET")
+	router.Handle("/api/tunnel/{id}/requests", s.shareReadable(s.handleListRequests)).Methods("GET")
+	router.Handle("/api/tunnel/{id}/traffic", s.shareReadable(s.handleTunnelTraffic)).Methods("GET")
+	router.Handle("/api/tunnel/{id}/events", s.shareReadable(s.handleTunnelEvents)).Methods("GET")
+	router.Handle("/api/tunnel/{id}/requests/{reqID}/body", s.shareReadable(s.handleGetRequestBody)).Methods("GET")
+
+	// Protected API endpoints
+	api := router.PathPrefix("/api").Subrouter()
+	api.Use(s.auth.Middleware)
+	api.HandleFunc("/tunnel/{port:[0-9]+}", s.handleCreateTunnel).Methods("POST")
+	api.HandleFunc("/tunnel/{id}", s.handleUpdateTunnel).Methods("PUT")
+	api.HandleFunc("/tunnel/{id}", s.handleDeleteTunnel).Methods("DELETE")
+	api.HandleFunc("/tunnel/{id}/share", s.handleShareTunnel).Methods("POST")
+	api.HandleFunc("/tunnel/{id}/check", s.handleCheckTunnel).Methods("GET")
+	api.HandleFunc("/tunnels", s.handleListTunnels).Methods("GET")
+	api.HandleFunc("/my/tunnels", s.handleListMyTunnels).Methods("GET")
+	api.HandleFunc("/events", s.handleEvents).Methods("GET")
+	api.HandleFunc("/reservations", s.handleCreateReservation).Methods("POST")
+	api.HandleFunc("/admin/tunnel/{id}/revoke", s.requireAdmin(s.handleRevokeTunnel)).Methods("POST")
+	api.HandleFunc("/admin/export", s.requireAdmin(s.handleExport)).Methods("GET")
+	api.HandleFunc("/admin/reconcile", s.requireAdmin(s.handleReconcile)).Methods("POST")
+	api.HandleFunc("/admin/cleanup", s.requireAdmin(s.handleCleanup)).Methods("POST")
+}
+
+// setupUIRoutes registers the embedded website, client script and the
+// root handler (a redirect to /ui by default)
+func (s *Server) setupUIRoutes(router *mux.Router, split bool) {
 	// Static website at /ui
 	webFS, err := fs.Sub(webFiles, "web")
 	if err != nil {
 		s.logger.Error("failed to create web filesystem", slog.Any("error", err))
 	} else {
-		s.router.PathPrefix("/static/").Handler(http.StripPrefix("/static/", http.FileServer(http.FS(webFS))))
-		s.router.HandleFunc("/ui", s.handleWebsite).Methods("GET")
+		router.PathPrefix("/static/").Handler(http.StripPrefix("/static/", http.FileServer(http.FS(webFS))))
+		router.HandleFunc("/ui", s.handleWebsite).Methods("GET")
+		// Browser tunnel creation, subject to API keys like /api
+		router.Handle("/ui/create", formAPIKey(s.auth.Middleware(http.HandlerFunc(s.handleUICreate)))).Methods("POST")
 		// Redirect root to /ui for convenience
-		s.router.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		router.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 			// Only redirect if this is not a tunnel subdomain
-			host := r.Host
-			if idx := strings.Index(host, ":"); idx != -1 {
-				host = host[:idx]
-			}
-			parts := strings.Split(host, ".")
-			if len(parts) >= 2 {
-				subdomain := parts[0]
-				if t := s.registry.GetTunnelBySubdomain(subdomain); t != nil {
+			if subdomain, domain := s.splitHost(r.Host); !split && subdomain != "" {
+				if t := s.registry.GetTunnelBySubdomain(subdomain, domain); t != nil {
 					// This is a tunnel request, pass to proxy
 					s.handleTunnelProxy(w, r)
 					return
 				}
 			}
-			// Regular root request, redirect to UI
-			http.Redirect(w, r, "/ui", http.StatusFound)
+			// Regular root request, redirect to UI or as configured
+			s.serveRoot(w, r)
 		}).Methods("GET")
 	}
-	
-	// Health and metrics endpoints
-	s.router.HandleFunc("/health", s.handleHealth).Methods("GET")
-	s.router.HandleFunc("/metrics", metrics.Handler()).Methods("GET")
-	
+
 	// Client helper script
-	s.router.HandleFunc("/client", s.handleClientScript).Methods("GET")
-	
-	// Protected API endpoints
-	api := s.router.PathPrefix("/api").Subrouter()
-	api.Use(s.auth.Middleware)
-	api.HandleFunc("/tunnel/{port:[0-9]+}", s.handleCreateTunnel).Methods("POST")
-	api.HandleFunc("/tunnel/{id}", s.handleGetTunnel).Methods("GET")
-	api.HandleFunc("/tunnel/{id}", s.handleDeleteTunnel).Methods("DELETE")
-	api.HandleFunc("/tunnels", s.handleListTunnels).Methods("GET")
-	
-	
-	// Tunnel provisioning
-	s.router.HandleFunc("/{port:[0-9]+}", s.handleProvisionSimple).Methods("GET")
-	
-	// Tunnel traffic proxy
-	s.router.PathPrefix("/").HandlerFunc(s.handleTunnelProxy)
+	router.HandleFunc("/client", s.handleClientScript).Methods("GET")
 }
 
-// Start starts the HTTP server
+// requireAdmin restricts a handler to admin-scoped API keys
+func (s *Server) requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.auth.IsAdmin(r.Context()) {
+			respondError(w, http.StatusForbidden, CodeAdminRequired, "This endpoint requires an admin API key")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// Listen binds the main listener, plus the admin and metrics listeners
+// when configured. Binding them all before serving anything means a bad
+// address fails startup instead of leaving the server up without one of
+// its listeners. Start calls it if it hasn't been called.
+func (s *Server) Listen() error {
+	proxyServer := s.newHTTPServer(s.cfg.ListenAddr, s.proxyHandler())
+	if s.tlsEnabled() {
+		// Client certificates are requested but verified per tunnel, since
+		// each tunnel carries its own CA bundle
+		proxyServer.TLSConfig = &tls.Config{
+			MinVersion: tls.VersionTLS12,
+			ClientAuth: tls.RequestClientCert,
+			NextProtos: []string{"http/1.1"},
+		}
+		// WebSocket upgrades still negotiate http/1.1, and CONNECT
+		// works over either
+		if s.cfg.HTTP2 {
+			proxyServer.TLSConfig.NextProtos = []string{"h2", "http/1.1"}
+		} else {
+			proxyServer.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+		}
+	}
+	servers := []*http.Server{proxyServer}
+	if s.adminRouter != nil {
+		servers = append(servers, s.newHTTPServer(s.cfg.AdminListenAddr, s.adminRouter))
+	}
+	if s.cfg.MetricsListenAddr != "" {
+		metricsMux := http.NewServeMux()
+		metricsMux.HandleFunc("GET /metrics", s.metrics.Handler())
+		servers = append(servers, s.newHTTPServer(s.cfg.MetricsListenAddr, metricsMux))
+	}
+
+	listeners := make([]net.Listener, 0, len(servers))
+	for _, server := range servers {
+		ln, err := net.Listen("tcp", server.Addr)
+		if err != nil {
+			for _, ln := range listeners {
+				ln.Close()
+			}
+			return fmt.Errorf("http server error on %s: %w", server.Addr, err)
+		}
+		// Load balancers in front of the proxy listener may prepend
+		// the real client address
+		if server == proxyServer && s.cfg.ProxyProtocol {
+			ln = &proxyProtoListener{
+				Listener: ln,
+				strict:   s.cfg.ProxyProtocolStrict,
+				trusted:  s.cfg.TrustedProxies,
+			}
+		}
+		listeners = append(listeners, ln)
+	}
+	s.servers, s.listeners = servers, listeners
+	return nil
+}
+
+// Start serves the listeners bound by Listen until ctx is done
 func (s *Server) Start(ctx context.Context) error {
-	server := &http.Server{
-		Addr:         s.cfg.ListenAddr,
-		Handler:      s.router,
-		ReadTimeout:  30 * time.Second,
-		WriteTimeout: 30 * time.Second,
-		IdleTimeout:  120 * time.Second,
+	if s.listeners == nil {
+		if err := s.Listen(); err != nil {
+			return err
+		}
 	}
+	servers := s.servers
 	
+	if s.warm != nil {
+		go s.keepWarm(ctx)
+	}
+
 	// Handle graceful shutdown
 	go func() {
 		<-ctx.Done()
 		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 		defer cancel()
 		
-		s.logger.Info("shutting down http server")
-		if err := server.Shutdown(shutdownCtx); err != nil {
-			s.logger.Error("http server shutdown error", slog.Any("error", err))
+		for _, server := range servers {
+			s.logger.Info("shutting down http server", slog.String("addr", server.Addr))
+			if err := server.Shutdown(shutdownCtx); err != nil {
+				s.logger.Error("http server shutdown error", slog.Any("error", err))
+			}
 		}
 	}()
 	
-	s.logger.Info("starting http server", slog.String("addr", s.cfg.ListenAddr))
-	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-		return fmt.Errorf("http server error: %w", err)
+	errc := make(chan error, len(servers))
+	for i, server := range servers {
+		go func(server *http.Server, ln net.Listener) {
+			s.logger.Info("starting http server", slog.String("addr", server.Addr), slog.Bool("tls", server.TLSConfig != nil))
+			var err error
+			if server.TLSConfig != nil {
+				err = server.ServeTLS(ln, s.cfg.TLSCertFile, s.cfg.TLSKeyFile)
+			} else {
+				err = server.Serve(ln)
+			}
+			if err != nil && err != http.ErrServerClosed {
+				errc <- fmt.Errorf("http server error on %s: %w", server.Addr, err)
+				return
+			}
+			errc <- nil
+		}(server, s.listeners[i])
 	}
 	
-	return nil
-}
\ No newline at end of file
+	var firstErr error
+	for range servers {
+		if err := <-errc; err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// tlsEnabled reports whether the main listener serves native TLS
+func (s *Server) tlsEnabled() bool {
+	return s.cfg.TLSCertFile != "" && s.cfg.TLSKeyFile != ""
+}
+
+// proxyHandler wraps the main router so CONNECT requests, which carry no
+// path for the router to match, go straight to the tunnel relay
+func (s *Server) proxyHandler() http.Handler {
+	connect := middleware.Recovery(s.logger)(middleware.Logger(s.logger, s.metrics, s.cfg.SlowRequestThreshold)(s.limitHeaders(http.HandlerFunc(s.handleConnect))))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodConnect {
+			connect.ServeHTTP(w, r)
+			return
+		}
+		s.router.ServeHTTP(w, r)
+	})
+}
+
+// newHTTPServer creates an http.Server with the default timeouts
+func (s *Server) newHTTPServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:         addr,
+		Handler:      handler,
+		ReadTimeout:  30 * time.Second,
+		WriteTimeout: 30 * time.Second,
+		IdleTimeout:  120 * time.Second,
+	}
+}
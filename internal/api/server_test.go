@@ -0,0 +1,353 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mr-karan/arbok/internal/auth"
+	"github.com/mr-karan/arbok/internal/metrics"
+	"github.com/mr-karan/arbok/internal/registry"
+	"github.com/mr-karan/arbok/internal/tunnel"
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/tun/netstack"
+)
+
+// discardLogger returns a logger that drops everything
+func discardLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+// testServer is an API server over a real userspace WireGuard interface
+// and registry, torn down when the test ends
+type testServer struct {
+	*Server
+	reg *registry.Registry
+	tun *tunnel.Tunnel
+	// wgPort is the UDP port WireGuard listens on
+	wgPort int
+}
+
+// testKeys configures the authenticator of a test server; no API keys
+// disables authentication
+type testKeys struct {
+	api   []string
+	admin []string
+}
+
+// newTestServer creates a test server for cfg, serving example.com unless
+// cfg names a domain. Like the server's config, cfg.Domains lists every
+// served domain, the default included.
+func newTestServer(t testing.TB, cfg Config, keys testKeys) *testServer {
+	t.Helper()
+	logger := discardLogger()
+	if cfg.Domain == "" {
+		cfg.Domain = "example.com"
+	}
+	if len(cfg.Domains) == 0 {
+		cfg.Domains = []string{cfg.Domain}
+	}
+	if cfg.Metrics == nil {
+		cfg.Metrics = metrics.New("")
+	}
+
+	reg, err := registry.NewRegistry(context.Background(), registry.Config{
+		CIDR:            tunnel.DefaultCIDR,
+		DefaultTTL:      time.Hour,
+		CleanupInterval: time.Minute,
+		Domains:         cfg.Domains,
+		Metrics:         cfg.Metrics,
+	}, logger)
+	if err != nil {
+		t.Fatalf("NewRegistry: %v", err)
+	}
+	t.Cleanup(func() { reg.Close() })
+
+	priv, _, err := registry.NewWireGuardKeyGenerator(nil).Generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wgPort := freeUDPPort(t)
+	tun, err := tunnel.New(tunnel.PeerOpts{
+		PrivateKey: priv,
+		ListenPort: wgPort,
+		Logger:     logger,
+		Metrics:    cfg.Metrics,
+	})
+	if err != nil {
+		t.Fatalf("tunnel.New: %v", err)
+	}
+	t.Cleanup(func() { tun.Close() })
+
+	authenticator := auth.New(keys.api, keys.admin, cfg.Metrics, logger)
+	return &testServer{
+		Server: NewAPIServer(cfg, logger, tun, reg, authenticator),
+		reg:    reg,
+		tun:    tun,
+		wgPort: wgPort,
+	}
+}
+
+// freeUDPPort returns a UDP port that was free a moment ago
+func freeUDPPort(t testing.TB) int {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+// freeTCPAddr returns a loopback TCP address that was free a moment ago
+func freeTCPAddr(t testing.TB) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+// do sends a request to host (the server's domain when empty) with key
+// as its API key, if any, and returns the recorded response
+func (ts *testServer) do(method, host, target, key, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, bytes.NewBufferString(body))
+	if host == "" {
+		host = ts.cfg.Domain
+	}
+	r.Host = host
+	if key != "" {
+		r.Header.Set("X-API-Key", key)
+	}
+	w := httptest.NewRecorder()
+	ts.router.ServeHTTP(w, r)
+	return w
+}
+
+// hexKey converts a base64 WireGuard key to the hex the UAPI takes
+func hexKey(t *testing.T, key string) string {
+	t.Helper()
+	raw, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hex.EncodeToString(raw)
+}
+
+// connectPeer brings up the WireGuard client of tunnel id, created with
+// its private key, and returns its network. The client holds the
+// tunnel's backend address too, and any extra addresses, such as one a
+// hostname backend will resolve to.
+func (ts *testServer) connectPeer(t *testing.T, id, privateKey string, extra ...netip.Addr) *netstack.Net {
+	t.Helper()
+	info := ts.reg.GetTunnel(id)
+	addrs := []netip.Addr{netip.MustParseAddr(info.AllowedIP)}
+	for _, ip := range info.PeerAllowedIPs() {
+		addrs = append(addrs, netip.MustParseAddr(ip))
+	}
+	addrs = append(addrs, extra...)
+	tunDev, tnet, err := netstack.CreateNetTUN(addrs, nil, 1420)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dev := device.NewDevice(tunDev, conn.NewDefaultBind(), device.NewLogger(device.LogLevelSilent, ""))
+	t.Cleanup(dev.Close)
+
+	config := fmt.Sprintf("private_key=%s\npublic_key=%s\nendpoint=127.0.0.1:%d\nallowed_ip=%s\npersistent_keepalive_interval=1\n",
+		hexKey(t, privateKey), hexKey(t, ts.tun.GetPublicKey()), ts.wgPort, ts.tun.CIDR())
+	if err := dev.IpcSet(config); err != nil {
+		t.Fatalf("configuring peer: %v", err)
+	}
+	if err := dev.Up(); err != nil {
+		t.Fatal(err)
+	}
+	return tnet
+}
+
+// listen creates a tunnel for port 3000 and listens on that port at a
+// connected WireGuard peer. The listener is closed when the test ends.
+func (ts *testServer) listen(t *testing.T, body string) (TunnelResponse, net.Listener) {
+	t.Helper()
+	return ts.listenAs(t, "", body)
+}
+
+// listenAs is listen with the tunnel created by an API key
+func (ts *testServer) listenAs(t *testing.T, key, body string) (TunnelResponse, net.Listener) {
+	t.Helper()
+	created := ts.createTunnel(t, "3000", key, body)
+	tnet := ts.connectPeer(t, created.ID, ts.reg.GetTunnel(created.ID).PrivateKey)
+
+	ln, err := tnet.ListenTCP(&net.TCPAddr{Port: 3000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	return created, ln
+}
+
+// backend creates a tunnel for port 3000 and serves handler on it from a
+// connected WireGuard peer
+func (ts *testServer) backend(t *testing.T, body string, handler http.Handler) TunnelResponse {
+	t.Helper()
+	return ts.backendAs(t, "", body, handler)
+}
+
+// backendAs is backend with the tunnel created by an API key
+func (ts *testServer) backendAs(t *testing.T, key, body string, handler http.Handler) TunnelResponse {
+	t.Helper()
+	created, ln := ts.listenAs(t, key, body)
+	srv := &http.Server{Handler: handler}
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Close() })
+	return created
+}
+
+// proxy sends a request for target to the tunnel's host through the
+// server's proxy handler and returns the recorded response
+func (ts *testServer) proxy(t *testing.T, tun TunnelResponse, method, target, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest(method, target, bytes.NewBufferString(body))
+	r.Host = tun.Subdomain + "." + ts.cfg.Domain
+	w := httptest.NewRecorder()
+	ts.proxyHandler().ServeHTTP(w, r)
+	return w
+}
+
+func TestAdminRoutesOnlyOnAdminListener(t *testing.T) {
+	ts := newTestServer(t, Config{AdminListenAddr: "127.0.0.1:0", ServeUI: true}, testKeys{})
+	if ts.adminRouter == nil {
+		t.Fatal("no admin router with an admin listener configured")
+	}
+
+	for _, target := range []string{"/api/tunnels", "/health", "/ui"} {
+		r := httptest.NewRequest(http.MethodGet, target, nil)
+		r.Host = ts.cfg.Domain
+		w := httptest.NewRecorder()
+		ts.adminRouter.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Errorf("GET %s on the admin listener = %d, want 200", target, w.Code)
+		}
+
+		if w := ts.do(http.MethodGet, "", target, "", ""); w.Code == http.StatusOK {
+			t.Errorf("GET %s on the proxy listener = 200, want it unrouted", target)
+		}
+	}
+
+	// Tunnel provisioning and discovery stay where clients connect
+	for _, target := range []string{"/3000", DiscoveryPath} {
+		if w := ts.do(http.MethodGet, "", target, "", ""); w.Code != http.StatusOK {
+			t.Errorf("GET %s on the proxy listener = %d, want 200", target, w.Code)
+		}
+	}
+}
+
+func TestServeUIDisabled(t *testing.T) {
+	for _, serveUI := range []bool{true, false} {
+		ts := newTestServer(t, Config{ServeUI: serveUI}, testKeys{})
+		created := ts.backend(t, "", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, "backend")
+		}))
+
+		w := ts.do(http.MethodGet, "", "/ui", "", "")
+		if ui := w.Code == http.StatusOK; ui != serveUI {
+			t.Errorf("serve_ui=%v: GET /ui = %d", serveUI, w.Code)
+		}
+		w = ts.do(http.MethodGet, "", "/", "", "")
+		if redirect := w.Code == http.StatusFound; redirect != serveUI {
+			t.Errorf("serve_ui=%v: GET / = %d", serveUI, w.Code)
+		}
+
+		// Tunnel traffic for / reaches the backend either way
+		w = ts.proxy(t, created, http.MethodGet, "/", "")
+		if w.Code != http.StatusOK || w.Body.String() != "backend" {
+			t.Errorf("serve_ui=%v: GET / on the tunnel = %d %q, want the backend", serveUI, w.Code, w.Body)
+		}
+	}
+}
+
+func TestMetricsOnDedicatedListener(t *testing.T) {
+	metricsAddr := freeTCPAddr(t)
+	ts := newTestServer(t, Config{ListenAddr: freeTCPAddr(t), MetricsListenAddr: metricsAddr}, testKeys{})
+
+	if w := ts.do(http.MethodGet, "", "/metrics", "", ""); w.Code == http.StatusOK {
+		t.Error("GET /metrics on the main listener = 200, want it unrouted")
+	}
+	if w := ts.do(http.MethodGet, "", "/health", "", ""); w.Code != http.StatusOK {
+		t.Errorf("GET /health = %d, want 200", w.Code)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- ts.Start(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("Start: %v", err)
+		}
+	})
+
+	var resp *http.Response
+	var err error
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if resp, err = http.Get("http://" + metricsAddr + "/metrics"); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		t.Fatalf("GET /metrics on the metrics listener: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !bytes.Contains(body, []byte("arbok_")) {
+		t.Errorf("GET /metrics on the metrics listener = %d %q, want the metrics", resp.StatusCode, body)
+	}
+}
+
+func TestStartFailsWhenAListenerCannotBind(t *testing.T) {
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	mainAddr := freeTCPAddr(t)
+	ts := newTestServer(t, Config{ListenAddr: mainAddr, MetricsListenAddr: busy.Addr().String()}, testKeys{})
+
+	done := make(chan error, 1)
+	go func() { done <- ts.Start(context.Background()) }()
+	select {
+	case err := <-done:
+		if err == nil || !strings.Contains(err.Error(), busy.Addr().String()) {
+			t.Errorf("Start = %v, want the metrics listener's bind error", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Start kept serving although the metrics listener failed to bind")
+	}
+
+	// Nothing was served, so the main address is free again
+	ln, err := net.Listen("tcp", mainAddr)
+	if err != nil {
+		t.Fatalf("main listener left bound: %v", err)
+	}
+	ln.Close()
+}
+
+func TestMetricsOnRouterByDefault(t *testing.T) {
+	ts := newTestServer(t, Config{}, testKeys{})
+	if w := ts.do(http.MethodGet, "", "/metrics", "", ""); w.Code != http.StatusOK {
+		t.Errorf("GET /metrics = %d, want 200", w.Code)
+	}
+}
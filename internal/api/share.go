@@ -0,0 +1,145 @@
+package api
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Share tokens give read-only access to one tunnel's details and recorded
+// requests without an API key, e.g. to let a teammate watch the inspector.
+// They are HMAC-signed, carry the tunnel ID and an expiry, and are passed
+// as ?share_token= on the read-only tunnel routes.
+const (
+	// DefaultShareTTL is how long a share token is valid by default
+	DefaultShareTTL = time.Hour
+	// maxShareTTL caps the requested validity
+	maxShareTTL = 7 * 24 * time.Hour
+
+	shareTokenParam = "share_token"
+)
+
+// ShareResponse is the response of the share endpoint
+type ShareResponse struct {
+	Token     string    `json:"token"`
+	TunnelID  string    `json:"tunnel_id"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// shareSigner mints and verifies share tokens
+type shareSigner struct {
+	key []byte
+}
+
+// newShareSigner returns a signer keyed by secret. Without a secret a
+// random key is used, so tokens stop working on restart.
+func newShareSigner(secret string) *shareSigner {
+	key := []byte(secret)
+	if len(key) == 0 {
+		key = make([]byte, 32)
+		rand.Read(key)
+	}
+	return &shareSigner{key: key}
+}
+
+func (s *shareSigner) sign(payload string) []byte {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+// mint returns a token for tunnelID valid until expires
+func (s *shareSigner) mint(tunnelID string, expires time.Time) string {
+	payload := fmt.Sprintf("%s.%d", tunnelID, expires.Unix())
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." +
+		base64.RawURLEncoding.EncodeToString(s.sign(payload))
+}
+
+// verify reports whether token is an unexpired token for tunnelID
+func (s *shareSigner) verify(token, tunnelID string) bool {
+	encPayload, encMAC, ok := strings.Cut(token, ".")
+	if !ok {
+		return false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encPayload)
+	if err != nil {
+		return false
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(encMAC)
+	if err != nil || !hmac.Equal(mac, s.sign(string(payload))) {
+		return false
+	}
+
+	id, exp, ok := strings.Cut(string(payload), ".")
+	if !ok || id != tunnelID {
+		return false
+	}
+	expires, err := strconv.ParseInt(exp, 10, 64)
+	return err == nil && time.Now().Unix() < expires
+}
+
+// sharedTunnelKey is the context key of the tunnel ID a request's share
+// token grants access to
+type sharedTunnelKey struct{}
+
+// sharedTunnel returns the tunnel ID granted by the request's share token
+func sharedTunnel(ctx context.Context) string {
+	id, _ := ctx.Value(sharedTunnelKey{}).(string)
+	return id
+}
+
+// shareReadable wraps a read-only tunnel route so that a share token for
+// the route's {id} stands in for an API key. Requests without a token go
+// through the usual authentication.
+func (s *Server) shareReadable(next http.HandlerFunc) http.Handler {
+	authed := s.auth.Middleware(next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := r.URL.Query().Get(shareTokenParam)
+		if token == "" {
+			authed.ServeHTTP(w, r)
+			return
+		}
+		id := mux.Vars(r)["id"]
+		if !s.shares.verify(token, id) {
+			respondError(w, http.StatusUnauthorized, CodeInvalidShareToken, "Invalid or expired share token")
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), sharedTunnelKey{}, id)))
+	})
+}
+
+// handleShareTunnel mints a share token for one of the caller's tunnels,
+// valid for ?ttl= (default 1h, at most 7 days)
+func (s *Server) handleShareTunnel(w http.ResponseWriter, r *http.Request) {
+	t := s.registry.GetTunnel(mux.Vars(r)["id"])
+	if t == nil || !s.canAccessTunnel(r, t) {
+		respondError(w, http.StatusNotFound, CodeTunnelNotFound, "Tunnel not found")
+		return
+	}
+
+	ttl := DefaultShareTTL
+	if v := r.URL.Query().Get("ttl"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			respondValidationError(w, ValidationError{{"ttl", "must be a positive duration such as 30m"}})
+			return
+		}
+		ttl = min(d, maxShareTTL)
+	}
+
+	expires := time.Now().Add(ttl).Truncate(time.Second)
+	writeJSON(w, http.StatusCreated, ShareResponse{
+		Token:     s.shares.mint(t.ID, expires),
+		TunnelID:  t.ID,
+		ExpiresAt: expires.UTC(),
+	})
+}
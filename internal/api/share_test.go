@@ -0,0 +1,89 @@
+package api
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShareSigner(t *testing.T) {
+	s := newShareSigner("secret")
+	token := s.mint("tun1", time.Now().Add(time.Minute))
+
+	if !s.verify(token, "tun1") {
+		t.Error("token rejected for its tunnel")
+	}
+	if s.verify(token, "tun2") {
+		t.Error("token accepted for another tunnel")
+	}
+	if newShareSigner("other").verify(token, "tun1") {
+		t.Error("token accepted under another secret")
+	}
+	if s.verify(s.mint("tun1", time.Now().Add(-time.Second)), "tun1") {
+		t.Error("expired token accepted")
+	}
+
+	// A payload swapped onto another token's signature is rejected
+	forged := s.mint("tun2", time.Now().Add(time.Minute))
+	payload, _, _ := strings.Cut(forged, ".")
+	_, mac, _ := strings.Cut(token, ".")
+	if s.verify(payload+"."+mac, "tun2") {
+		t.Error("token with a mismatched signature accepted")
+	}
+	for _, bad := range []string{"", "no-dot", "!!.!!", token + "x"} {
+		if s.verify(bad, "tun1") {
+			t.Errorf("malformed token %q accepted", bad)
+		}
+	}
+}
+
+func TestShareToken(t *testing.T) {
+	ts := newTestServer(t, Config{InspectRequests: 10}, testKeys{api: []string{"key-a", "key-b"}})
+	mine := ts.createTunnel(t, "3000", "key-a", "")
+	other := ts.createTunnel(t, "3001", "key-b", "")
+
+	w := ts.do(http.MethodPost, "", "/api/tunnel/"+mine.ID+"/share?ttl=30m", "key-a", "")
+	var share ShareResponse
+	decode(t, w, &share)
+	if w.Code != http.StatusCreated || share.TunnelID != mine.ID || share.Token == "" {
+		t.Fatalf("share = %d %+v", w.Code, share)
+	}
+	if d := time.Until(share.ExpiresAt); d <= 29*time.Minute || d > 30*time.Minute {
+		t.Errorf("token expires in %s, want 30m", d)
+	}
+	token := "share_token=" + url.QueryEscape(share.Token)
+
+	// Read-only routes of the shared tunnel work without a key
+	for _, path := range []string{"", "/requests", "/traffic"} {
+		if w := ts.do(http.MethodGet, "", "/api/tunnel/"+mine.ID+path+"?"+token, "", ""); w.Code != http.StatusOK {
+			t.Errorf("GET %s with token = %d %s, want 200", path, w.Code, w.Body)
+		}
+	}
+
+	// Other tunnels, and routes that change the tunnel, are off limits
+	w = ts.do(http.MethodGet, "", "/api/tunnel/"+other.ID+"?"+token, "", "")
+	var resp ErrorResponse
+	decode(t, w, &resp)
+	if w.Code != http.StatusUnauthorized || resp.Code != CodeInvalidShareToken {
+		t.Errorf("other tunnel with token = %d %s, want 401 %s", w.Code, resp.Code, CodeInvalidShareToken)
+	}
+	if w := ts.do(http.MethodDelete, "", "/api/tunnel/"+mine.ID+"?"+token, "", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("delete with token = %d, want 401", w.Code)
+	}
+	if w := ts.do(http.MethodPost, "", "/api/tunnel/"+mine.ID+"/share?"+token, "", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("resharing with token = %d, want 401", w.Code)
+	}
+	if ts.reg.GetTunnel(mine.ID) == nil {
+		t.Fatal("tunnel deleted through a share token")
+	}
+
+	// Tunnels can only be shared by their owner
+	if w := ts.do(http.MethodPost, "", "/api/tunnel/"+other.ID+"/share", "key-a", ""); w.Code != http.StatusNotFound {
+		t.Errorf("sharing another key's tunnel = %d, want 404", w.Code)
+	}
+	if w := ts.do(http.MethodPost, "", "/api/tunnel/"+mine.ID+"/share?ttl=soon", "key-a", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("share with a bad ttl = %d, want 400", w.Code)
+	}
+}
@@ -0,0 +1,166 @@
+package api
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Static tunnels serve files from backends that are often minimal: some
+// reject HEAD and many ignore Range. For them the proxy fills the gaps.
+// Backends that handle both are left alone.
+
+// headFallback answers HEAD requests the backend rejects by sending a GET
+// and dropping the body
+type headFallback struct {
+	http.RoundTripper
+}
+
+func (h headFallback) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := h.RoundTripper.RoundTrip(req)
+	if err != nil || req.Method != http.MethodHead {
+		return resp, err
+	}
+	if resp.StatusCode != http.StatusMethodNotAllowed && resp.StatusCode != http.StatusNotImplemented {
+		return resp, nil
+	}
+	resp.Body.Close()
+
+	get := req.Clone(req.Context())
+	get.Method = http.MethodGet
+	resp, err = h.RoundTripper.RoundTrip(get)
+	if err != nil {
+		return nil, err
+	}
+	// Closing unread drops the connection, which beats downloading the file
+	resp.Body.Close()
+	resp.Body = http.NoBody
+	resp.Request = req
+	return resp, nil
+}
+
+// serveStaticRange turns a full 200 response to a single-range GET into
+// the 206 the backend should have sent, skipping to the range as the body
+// streams. Full responses also advertise range support. Multi-range
+// requests, responses of unknown length and stale If-Range validators get
+// the full response, which RFC 9110 allows.
+func serveStaticRange(resp *http.Response) {
+	req := resp.Request
+	if req.Method != http.MethodGet || resp.StatusCode != http.StatusOK || resp.ContentLength < 0 {
+		return
+	}
+	if resp.Header.Get("Accept-Ranges") == "" {
+		resp.Header.Set("Accept-Ranges", "bytes")
+	}
+
+	spec := req.Header.Get("Range")
+	if spec == "" || !ifRangeMatches(req.Header.Get("If-Range"), resp.Header) {
+		return
+	}
+	size := resp.ContentLength
+	start, end, ok := parseByteRange(spec, size)
+	if !ok {
+		return
+	}
+	if start >= size {
+		resp.Body.Close()
+		resp.Body = http.NoBody
+		resp.StatusCode = http.StatusRequestedRangeNotSatisfiable
+		resp.Status = fmt.Sprintf("%d %s", resp.StatusCode, http.StatusText(resp.StatusCode))
+		resp.ContentLength = 0
+		resp.Header.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		resp.Header.Set("Content-Length", "0")
+		return
+	}
+
+	length := end - start + 1
+	resp.Body = &rangeBody{ReadCloser: resp.Body, skip: start, left: length}
+	resp.StatusCode = http.StatusPartialContent
+	resp.Status = fmt.Sprintf("%d %s", resp.StatusCode, http.StatusText(resp.StatusCode))
+	resp.ContentLength = length
+	resp.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, size))
+	resp.Header.Set("Content-Length", strconv.FormatInt(length, 10))
+}
+
+// ifRangeMatches reports whether an If-Range validator, if any, still
+// matches the response: a strong ETag or the exact Last-Modified date
+func ifRangeMatches(ifRange string, h http.Header) bool {
+	switch {
+	case ifRange == "":
+		return true
+	case strings.HasPrefix(ifRange, `"`):
+		return ifRange == h.Get("ETag")
+	case strings.HasPrefix(ifRange, "W/"):
+		return false
+	default:
+		return ifRange == h.Get("Last-Modified")
+	}
+}
+
+// parseByteRange parses a single-range "bytes=" spec against a body of
+// size bytes, clamping the end. A start at or past size is returned as is
+// for the caller to reject with 416; ok is false for specs to ignore.
+func parseByteRange(spec string, size int64) (start, end int64, ok bool) {
+	spec, found := strings.CutPrefix(spec, "bytes=")
+	if !found || strings.Contains(spec, ",") {
+		return 0, 0, false
+	}
+	first, last, found := strings.Cut(strings.TrimSpace(spec), "-")
+	if !found {
+		return 0, 0, false
+	}
+
+	if first == "" {
+		// Suffix range: the last n bytes
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n <= 0 {
+			return 0, 0, false
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, size - 1, size > 0
+	}
+
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return 0, 0, false
+	}
+	end = size - 1
+	if last != "" {
+		end, err = strconv.ParseInt(last, 10, 64)
+		if err != nil || end < start {
+			return 0, 0, false
+		}
+		end = min(end, size-1)
+	}
+	return start, end, true
+}
+
+// rangeBody discards skip bytes of a body, then yields the next left
+type rangeBody struct {
+	io.ReadCloser
+	skip int64
+	left int64
+}
+
+func (b *rangeBody) Read(p []byte) (int, error) {
+	if b.skip > 0 {
+		n, err := io.CopyN(io.Discard, b.ReadCloser, b.skip)
+		b.skip -= n
+		if err != nil {
+			return 0, err
+		}
+	}
+	if b.left <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > b.left {
+		p = p[:b.left]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.left -= int64(n)
+	return n, err
+}
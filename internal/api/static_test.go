@@ -0,0 +1,118 @@
+package api
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// fileBackend serves a fixed file the way minimal file servers do: it
+// ignores Range and rejects HEAD
+var fileBackend = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodHead {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("ETag", `"v1"`)
+	io.WriteString(w, "0123456789")
+})
+
+// proxyWithHeaders is proxy with request headers
+func (ts *testServer) proxyWithHeaders(tun TunnelResponse, method, target string, header http.Header) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, nil)
+	r.Host = tun.Subdomain + "." + ts.cfg.Domain
+	for k, v := range header {
+		r.Header[k] = v
+	}
+	w := httptest.NewRecorder()
+	ts.proxyHandler().ServeHTTP(w, r)
+	return w
+}
+
+func TestStaticRanges(t *testing.T) {
+	ts := newTestServer(t, Config{}, testKeys{})
+	tun := ts.backend(t, `{"static":true}`, fileBackend)
+
+	for _, tc := range []struct {
+		name         string
+		header       http.Header
+		code         int
+		body         string
+		contentRange string
+	}{
+		{"full", nil, http.StatusOK, "0123456789", ""},
+		{"range", http.Header{"Range": {"bytes=2-5"}}, http.StatusPartialContent, "2345", "bytes 2-5/10"},
+		{"open range", http.Header{"Range": {"bytes=7-"}}, http.StatusPartialContent, "789", "bytes 7-9/10"},
+		{"suffix", http.Header{"Range": {"bytes=-3"}}, http.StatusPartialContent, "789", "bytes 7-9/10"},
+		{"end past size", http.Header{"Range": {"bytes=8-100"}}, http.StatusPartialContent, "89", "bytes 8-9/10"},
+		{"unsatisfiable", http.Header{"Range": {"bytes=20-"}}, http.StatusRequestedRangeNotSatisfiable, "", "bytes */10"},
+		{"multiple ranges", http.Header{"Range": {"bytes=0-1,4-5"}}, http.StatusOK, "0123456789", ""},
+		{"matching If-Range", http.Header{"Range": {"bytes=0-1"}, "If-Range": {`"v1"`}}, http.StatusPartialContent, "01", "bytes 0-1/10"},
+		{"stale If-Range", http.Header{"Range": {"bytes=0-1"}, "If-Range": {`"v0"`}}, http.StatusOK, "0123456789", ""},
+	} {
+		w := ts.proxyWithHeaders(tun, http.MethodGet, "/file", tc.header)
+		if w.Code != tc.code || w.Body.String() != tc.body {
+			t.Errorf("%s: response = %d %q, want %d %q", tc.name, w.Code, w.Body, tc.code, tc.body)
+		}
+		if got := w.Header().Get("Content-Range"); got != tc.contentRange {
+			t.Errorf("%s: Content-Range = %q, want %q", tc.name, got, tc.contentRange)
+		}
+		if got := w.Header().Get("Accept-Ranges"); got != "bytes" {
+			t.Errorf("%s: Accept-Ranges = %q, want bytes", tc.name, got)
+		}
+	}
+}
+
+func TestStaticHeadFallback(t *testing.T) {
+	ts := newTestServer(t, Config{}, testKeys{})
+	tun := ts.backend(t, `{"static":true}`, fileBackend)
+
+	w := ts.proxyWithHeaders(tun, http.MethodHead, "/file", nil)
+	if w.Code != http.StatusOK || w.Body.Len() != 0 {
+		t.Fatalf("HEAD = %d %q, want an empty 200", w.Code, w.Body)
+	}
+	if got := w.Header().Get("Content-Length"); got != "10" {
+		t.Errorf("Content-Length = %q, want the GET's 10", got)
+	}
+	if got := w.Header().Get("ETag"); got != `"v1"` {
+		t.Errorf("ETag = %q, want the GET's", got)
+	}
+}
+
+func TestNonStaticTunnelPassesThrough(t *testing.T) {
+	ts := newTestServer(t, Config{}, testKeys{})
+	tun := ts.backend(t, "", fileBackend)
+
+	w := ts.proxyWithHeaders(tun, http.MethodGet, "/file", http.Header{"Range": {"bytes=2-5"}})
+	if w.Code != http.StatusOK || w.Body.String() != "0123456789" || w.Header().Get("Accept-Ranges") != "" {
+		t.Errorf("range = %d %q, want the backend's full response", w.Code, w.Body)
+	}
+	if w := ts.proxyWithHeaders(tun, http.MethodHead, "/file", nil); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("HEAD = %d, want the backend's 405", w.Code)
+	}
+}
+
+func TestParseByteRange(t *testing.T) {
+	for _, tc := range []struct {
+		spec       string
+		start, end int64
+		ok         bool
+	}{
+		{"bytes=0-0", 0, 0, true},
+		{"bytes=3-", 3, 9, true},
+		{"bytes=-20", 0, 9, true},
+		{"bytes= 1-2", 1, 2, true},
+		{"bytes=10-", 10, 9, true},
+		{"bytes=5-4", 0, 0, false},
+		{"bytes=-0", 0, 0, false},
+		{"bytes=a-b", 0, 0, false},
+		{"items=0-1", 0, 0, false},
+		{"bytes=0-1,3-4", 0, 0, false},
+	} {
+		start, end, ok := parseByteRange(tc.spec, 10)
+		if ok != tc.ok || ok && (start != tc.start || end != tc.end) {
+			t.Errorf("parseByteRange(%q) = %d-%d %v, want %d-%d %v", tc.spec, start, end, ok, tc.start, tc.end, tc.ok)
+		}
+	}
+}
@@ -0,0 +1,298 @@
+package api
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCA is a throwaway certificate authority
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	// pem is the CA certificate, PEM encoded
+	pem string
+}
+
+// newTestCA creates a CA valid for the next hour
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{
+		cert: cert,
+		key:  key,
+		pem:  string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+	}
+}
+
+// issue returns a leaf certificate signed by the CA for usage, valid for
+// hosts when it's a server certificate
+func (ca *testCA) issue(t *testing.T, usage x509.ExtKeyUsage, hosts ...string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "test leaf"},
+		DNSNames:     hosts,
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestRequireClientCertNeedsTLS(t *testing.T) {
+	ca := newTestCA(t)
+	body, _ := json.Marshal(map[string]any{"require_client_cert": true, "client_ca_pem": ca.pem})
+
+	ts := newTestServer(t, Config{}, testKeys{})
+	w := ts.do(http.MethodPost, "", "/api/tunnel/3000", "", string(body))
+	var resp ErrorResponse
+	decode(t, w, &resp)
+	if w.Code != http.StatusBadRequest || resp.Code != "TLS_NOT_ENABLED" {
+		t.Errorf("create without native TLS = %d %s, want 400 TLS_NOT_ENABLED", w.Code, resp.Code)
+	}
+
+	ts = newTestServer(t, Config{TLSCertFile: "server.crt", TLSKeyFile: "server.key"}, testKeys{})
+	w = ts.do(http.MethodPost, "", "/api/tunnel/3000", "", `{"require_client_cert":true}`)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("create without a CA bundle = %d, want 400", w.Code)
+	}
+	w = ts.do(http.MethodPost, "", "/api/tunnel/3000", "", string(body))
+	if w.Code != http.StatusCreated {
+		t.Errorf("create with native TLS = %d %s, want 201", w.Code, w.Body)
+	}
+}
+
+func TestClientCertRequired(t *testing.T) {
+	// Only the handler's view of TLS matters here, so the files aren't read
+	ts := newTestServer(t, Config{TLSCertFile: "server.crt", TLSKeyFile: "server.key"}, testKeys{})
+	ca := newTestCA(t)
+	body, _ := json.Marshal(map[string]any{"require_client_cert": true, "client_ca_pem": ca.pem})
+	created := ts.backend(t, string(body), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "backend")
+	}))
+
+	tests := []struct {
+		name  string
+		chain []tls.Certificate
+		want  int
+	}{
+		{"no certificate", nil, http.StatusForbidden},
+		{"signed by the tunnel's CA", []tls.Certificate{ca.issue(t, x509.ExtKeyUsageClientAuth)}, http.StatusOK},
+		{"signed by another CA", []tls.Certificate{newTestCA(t).issue(t, x509.ExtKeyUsageClientAuth)}, http.StatusForbidden},
+		{"not for client auth", []tls.Certificate{ca.issue(t, x509.ExtKeyUsageServerAuth)}, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Host = created.Subdomain + "." + ts.cfg.Domain
+		r.TLS = &tls.ConnectionState{}
+		for _, cert := range tt.chain {
+			r.TLS.PeerCertificates = append(r.TLS.PeerCertificates, cert.Leaf)
+		}
+		w := httptest.NewRecorder()
+		ts.proxyHandler().ServeHTTP(w, r)
+
+		if w.Code != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, w.Code, tt.want)
+			continue
+		}
+		if tt.want == http.StatusForbidden {
+			var resp ErrorResponse
+			decode(t, w, &resp)
+			if resp.Code != "CLIENT_CERT_REQUIRED" {
+				t.Errorf("%s: code %s, want CLIENT_CERT_REQUIRED", tt.name, resp.Code)
+			}
+		} else if w.Body.String() != "backend" {
+			t.Errorf("%s: body %q, want the backend's", tt.name, w.Body)
+		}
+	}
+}
+
+// writeServerCert issues a server certificate for localhost and writes it
+// and its key to PEM files, returning their paths
+func (ca *testCA) writeServerCert(t *testing.T) (certFile, keyFile string) {
+	t.Helper()
+	cert := ca.issue(t, x509.ExtKeyUsageServerAuth, "localhost")
+	keyDER, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	certFile, keyFile = filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestTLSListenerNegotiatesHTTP2(t *testing.T) {
+	ca := newTestCA(t)
+	certFile, keyFile := ca.writeServerCert(t)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	for _, tt := range []struct {
+		http2 bool
+		want  string
+	}{{true, "h2"}, {false, "http/1.1"}} {
+		addr := freeTCPAddr(t)
+		ts := newTestServer(t, Config{ListenAddr: addr, TLSCertFile: certFile, TLSKeyFile: keyFile, HTTP2: tt.http2}, testKeys{})
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error, 1)
+		go func() { done <- ts.Start(ctx) }()
+
+		var conn *tls.Conn
+		var err error
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			conn, err = tls.Dial("tcp", addr, &tls.Config{RootCAs: roots, ServerName: "localhost", NextProtos: []string{"h2", "http/1.1"}})
+			if err == nil {
+				break
+			}
+		}
+		if err != nil {
+			t.Fatalf("http2=%v: dialing the TLS listener: %v", tt.http2, err)
+		}
+		if got := conn.ConnectionState().NegotiatedProtocol; got != tt.want {
+			t.Errorf("http2=%v: negotiated %q, want %q", tt.http2, got, tt.want)
+		}
+		conn.Close()
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("Start: %v", err)
+		}
+	}
+}
+
+func TestConnectOverHTTP2(t *testing.T) {
+	ts := newTestServer(t, Config{}, testKeys{})
+	tun := ts.echoBackend(t)
+
+	srv := httptest.NewUnstartedServer(ts.proxyHandler())
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+
+	upstream, upstreamWriter := io.Pipe()
+	defer upstreamWriter.Close()
+	target, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    target,
+		Host:   tun.Subdomain + "." + ts.cfg.Domain + ":443",
+		Header: make(http.Header),
+		Body:   upstream,
+	}
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatalf("CONNECT: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.ProtoMajor != 2 || resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT = %s %d, want HTTP/2 200", resp.Proto, resp.StatusCode)
+	}
+
+	const msg = "bytes over an HTTP/2 stream"
+	go io.WriteString(upstreamWriter, msg)
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(resp.Body, got); err != nil {
+		t.Fatalf("reading echo: %v", err)
+	}
+	if string(got) != msg {
+		t.Errorf("echo = %q, want %q", got, msg)
+	}
+}
+
+// tlsBackend creates a tunnel with the create body and serves handler
+// over TLS, with a certificate from an unknown CA, from a connected peer
+func (ts *testServer) tlsBackend(t *testing.T, body string, handler http.Handler) TunnelResponse {
+	t.Helper()
+	created, ln := ts.listen(t, body)
+	cert := newTestCA(t).issue(t, x509.ExtKeyUsageServerAuth, "backend.internal")
+	srv := &http.Server{Handler: handler}
+	go srv.Serve(tls.NewListener(ln, &tls.Config{Certificates: []tls.Certificate{cert}}))
+	t.Cleanup(func() { srv.Close() })
+	return created
+}
+
+func TestProxyToHTTPSBackend(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		io.WriteString(w, "secure")
+	})
+	ts := newTestServer(t, Config{}, testKeys{})
+
+	skip := ts.tlsBackend(t, `{"backend_scheme":"https","backend_insecure_skip_verify":true}`, handler)
+	if w := ts.proxy(t, skip, http.MethodGet, "/", ""); w.Code != http.StatusOK || w.Body.String() != "secure" {
+		t.Errorf("request with verification skipped = %d %q, want the backend", w.Code, w.Body)
+	}
+	if got := ts.check(t, skip.ID); !got.Reachable || got.Status != http.StatusOK {
+		t.Errorf("check = %+v, want reachable over TLS", got)
+	}
+
+	// The self-signed certificate fails verification unless skipped
+	verify := ts.tlsBackend(t, `{"backend_scheme":"https"}`, handler)
+	if w := ts.proxy(t, verify, http.MethodGet, "/", ""); w.Code != http.StatusBadGateway {
+		t.Errorf("request to an untrusted backend = %d %q, want 502", w.Code, w.Body)
+	}
+	if got := ts.check(t, verify.ID); got.Reachable || !strings.Contains(got.Error, "certificate") {
+		t.Errorf("check = %+v, want a certificate error", got)
+	}
+}
@@ -0,0 +1,90 @@
+package api
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/mr-karan/arbok/internal/registry"
+)
+
+// TrafficResponse is a tunnel's recent traffic, one point per bucket,
+// oldest first
+type TrafficResponse struct {
+	TunnelID      string                  `json:"tunnel_id"`
+	BucketSeconds int                     `json:"bucket_seconds"`
+	Buckets       []registry.TrafficPoint `json:"buckets"`
+}
+
+// handleTunnelTraffic returns a tunnel's traffic per minute over the last
+// hour, e.g. for sparklines
+func (s *Server) handleTunnelTraffic(w http.ResponseWriter, r *http.Request) {
+	t := s.registry.GetTunnel(mux.Vars(r)["id"])
+	if t == nil || !s.canAccessTunnel(r, t) {
+		respondError(w, http.StatusNotFound, CodeTunnelNotFound, "Tunnel not found")
+		return
+	}
+
+	points, err := s.registry.Traffic(t.ID)
+	if err != nil {
+		respondError(w, http.StatusNotFound, CodeTunnelNotFound, "Tunnel not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, TrafficResponse{
+		TunnelID:      t.ID,
+		BucketSeconds: int(registry.TrafficBucketWidth / time.Second),
+		Buckets:       points,
+	})
+}
+
+// countingBody counts the bytes of a request body read by the proxy
+type countingBody struct {
+	io.ReadCloser
+	n atomic.Uint64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n.Add(uint64(n))
+	return n, err
+}
+
+// countingResponseWriter counts the bytes of a response body. Bytes
+// relayed after a hijack (WebSocket, CONNECT) are not counted.
+type countingResponseWriter struct {
+	http.ResponseWriter
+	n uint64
+}
+
+func (w *countingResponseWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.n += uint64(n)
+	return n, err
+}
+
+// Hijack lets WebSocket upgrades take over the connection through the
+// wrapper
+func (w *countingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("response writer does not support hijacking")
+	}
+	return hijacker.Hijack()
+}
+
+// Flush forwards flushes so streaming responses aren't buffered
+func (w *countingResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController
+func (w *countingResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
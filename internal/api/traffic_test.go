@@ -0,0 +1,40 @@
+package api
+
+import (
+	"io"
+	"net/http"
+	"testing"
+)
+
+func TestTrafficCountsProxiedBytes(t *testing.T) {
+	ts := newTestServer(t, Config{}, testKeys{})
+	tun := ts.backend(t, "", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		io.WriteString(w, "0123456789")
+	}))
+
+	for range 2 {
+		if w := ts.proxy(t, tun, http.MethodPost, "/", "hello"); w.Code != http.StatusOK {
+			t.Fatalf("request = %d %s", w.Code, w.Body)
+		}
+	}
+
+	w := ts.do(http.MethodGet, "", "/api/tunnel/"+tun.ID+"/traffic", "", "")
+	var resp TrafficResponse
+	decode(t, w, &resp)
+	if w.Code != http.StatusOK || resp.TunnelID != tun.ID || resp.BucketSeconds != 60 || len(resp.Buckets) != 60 {
+		t.Fatalf("traffic = %d %+v", w.Code, resp)
+	}
+	// The requests may straddle a minute, so sum every bucket
+	var requests, in, out uint64
+	for _, p := range resp.Buckets {
+		requests, in, out = requests+p.Requests, in+p.BytesIn, out+p.BytesOut
+	}
+	if requests != 2 || in != 10 || out != 20 {
+		t.Errorf("recorded %d requests, %d bytes in and %d out, want 2, 10 and 20", requests, in, out)
+	}
+
+	if w := ts.do(http.MethodGet, "", "/api/tunnel/missing/traffic", "", ""); w.Code != http.StatusNotFound {
+		t.Errorf("traffic of a missing tunnel = %d, want 404", w.Code)
+	}
+}
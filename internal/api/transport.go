@@ -0,0 +1,151 @@
+package api
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mr-karan/arbok/internal/tunnel"
+)
+
+// Defaults for per-tunnel connection pools
+const (
+	DefaultMaxIdleConnsPerTunnel = 16
+	DefaultIdleConnTimeout       = 90 * time.Second
+	DefaultDialTimeout           = 10 * time.Second
+	DefaultResponseHeaderTimeout = 60 * time.Second
+	DefaultExpectContinueTimeout = 1 * time.Second
+	DefaultMaxRequestTimeout     = 10 * time.Minute
+)
+
+// transportCache holds one http.Transport per tunnel so each tunnel has
+// its own idle connection pool and busy tunnels can't starve quiet ones
+type transportCache struct {
+	mu         sync.Mutex
+	transports map[string]*http.Transport
+
+	newTransport func(*tunnel.Info) *http.Transport
+}
+
+func newTransportCache(newTransport func(*tunnel.Info) *http.Transport) *transportCache {
+	return &transportCache{
+		transports:   make(map[string]*http.Transport),
+		newTransport: newTransport,
+	}
+}
+
+// get returns the transport for a tunnel, creating it on first use
+func (c *transportCache) get(t *tunnel.Info) *http.Transport {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	tr, ok := c.transports[t.ID]
+	if !ok {
+		tr = c.newTransport(t)
+		c.transports[t.ID] = tr
+	}
+	return tr
+}
+
+// evict drops a deleted tunnel's transport and closes its idle connections
+func (c *transportCache) evict(t *tunnel.Info) {
+	c.mu.Lock()
+	tr, ok := c.transports[t.ID]
+	delete(c.transports, t.ID)
+	c.mu.Unlock()
+
+	if ok {
+		tr.CloseIdleConnections()
+	}
+}
+
+// newTunnelTransport builds a transport for t dialing through the
+// tunnel's netstack (userspace WireGuard networking)
+func (s *Server) newTunnelTransport(t *tunnel.Info) *http.Transport {
+	maxIdle := s.cfg.MaxIdleConnsPerTunnel
+	if maxIdle <= 0 {
+		maxIdle = DefaultMaxIdleConnsPerTunnel
+	}
+	idleTimeout := s.cfg.IdleConnTimeout
+	if idleTimeout <= 0 {
+		idleTimeout = DefaultIdleConnTimeout
+	}
+	headerTimeout := s.cfg.ResponseHeaderTimeout
+	if headerTimeout <= 0 {
+		headerTimeout = DefaultResponseHeaderTimeout
+	}
+	// A tunnel's own request timeout bounds the whole request instead
+	if t.RequestTimeout > 0 {
+		headerTimeout = 0
+	}
+	expectTimeout := s.cfg.ExpectContinueTimeout
+	if expectTimeout <= 0 {
+		expectTimeout = DefaultExpectContinueTimeout
+	}
+	return &http.Transport{
+		DialContext:           s.dialTunnel, // Use netstack instead of kernel networking
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          maxIdle,
+		MaxIdleConnsPerHost:   maxIdle,
+		IdleConnTimeout:       idleTimeout,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: headerTimeout,
+		ExpectContinueTimeout: expectTimeout,
+		TLSClientConfig:       backendTLSConfig(t),
+	}
+}
+
+// backendTLSConfig returns the TLS settings for an HTTPS backend, nil for
+// plain HTTP ones. Certificates are checked against the backend hostname
+// when there is one.
+func backendTLSConfig(t *tunnel.Info) *tls.Config {
+	if !t.BackendTLS() {
+		return nil
+	}
+	conf := &tls.Config{InsecureSkipVerify: t.BackendInsecureSkipVerify}
+	if t.BackendIsHostname() {
+		conf.ServerName = t.BackendHost
+	}
+	return conf
+}
+
+// dialTunnel dials a backend through the netstack, giving up after the
+// dial timeout. Peers that went to sleep never answer the handshake, so
+// without a bound the dial hangs until the request is abandoned.
+// Connections may idle in a pool, so they don't hold a netstack
+// connection slot; the requests using them take one with acquireConn.
+func (s *Server) dialTunnel(ctx context.Context, network, addr string) (net.Conn, error) {
+	if s.warm != nil && network == "tcp" {
+		if c := s.warm.take(addr); c != nil {
+			return c, nil
+		}
+	}
+	ctx, cancel := context.WithTimeout(ctx, s.dialTimeout())
+	defer cancel()
+	return s.tun.DialPooled(ctx, network, addr)
+}
+
+// acquireConn takes a netstack connection slot for a proxied request or
+// stream, waiting no longer than a dial would
+func (s *Server) acquireConn(w http.ResponseWriter, r *http.Request, t *tunnel.Info) (func(), bool) {
+	ctx, cancel := context.WithTimeout(r.Context(), s.dialTimeout())
+	defer cancel()
+	release, err := s.tun.AcquireConn(ctx)
+	if err != nil {
+		s.logger.Warn("no free connection slot", "error", err, "tunnel_id", t.ID)
+		writeDialError(w, t, err)
+		return nil, false
+	}
+	return release, true
+}
+
+// dialTimeout returns the configured dial timeout or the default
+func (s *Server) dialTimeout() time.Duration {
+	if s.cfg.DialTimeout <= 0 {
+		return DefaultDialTimeout
+	}
+	return s.cfg.DialTimeout
+}
@@ -0,0 +1,243 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/mr-karan/arbok/internal/tunnel"
+)
+
+// countingBackend serves an empty 200 on the listener and counts the
+// connections it accepts
+func countingBackend(t *testing.T, ln net.Listener) *atomic.Int32 {
+	t.Helper()
+	var conns atomic.Int32
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+		ConnState: func(_ net.Conn, state http.ConnState) {
+			if state == http.StateNew {
+				conns.Add(1)
+			}
+		},
+	}
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Close() })
+	return &conns
+}
+
+func TestTunnelsHaveIndependentPools(t *testing.T) {
+	// One idle connection per tunnel: with a shared pool each tunnel's
+	// requests would push out the other's connection
+	ts := newTestServer(t, Config{MaxIdleConnsPerTunnel: 1}, testKeys{})
+	a, lnA := ts.listen(t, "")
+	b, lnB := ts.listen(t, "")
+	connsA, connsB := countingBackend(t, lnA), countingBackend(t, lnB)
+
+	for range 3 {
+		for _, tun := range []TunnelResponse{a, b} {
+			if w := ts.proxy(t, tun, http.MethodGet, "/", ""); w.Code != http.StatusOK {
+				t.Fatalf("request to %s = %d %s", tun.Subdomain, w.Code, w.Body)
+			}
+		}
+	}
+	if n := connsA.Load(); n != 1 {
+		t.Errorf("tunnel a opened %d backend connections, want 1 reused", n)
+	}
+	if n := connsB.Load(); n != 1 {
+		t.Errorf("tunnel b opened %d backend connections, want 1 reused", n)
+	}
+
+	infoA, infoB := ts.reg.GetTunnel(a.ID), ts.reg.GetTunnel(b.ID)
+	if ts.transports.get(infoA) == ts.transports.get(infoB) {
+		t.Error("tunnels share a transport")
+	}
+
+	// Deleting a tunnel drops its pool and leaves the other alone
+	trB := ts.transports.get(infoB)
+	if err := ts.reg.DeleteTunnel(a.ID); err != nil {
+		t.Fatal(err)
+	}
+	ts.transports.mu.Lock()
+	_, kept := ts.transports.transports[a.ID]
+	ts.transports.mu.Unlock()
+	if kept {
+		t.Error("deleted tunnel's transport still cached")
+	}
+	if ts.transports.get(infoB) != trB {
+		t.Error("deleting a tunnel replaced another tunnel's transport")
+	}
+}
+
+func TestSilentBackendTimesOut(t *testing.T) {
+	ts := newTestServer(t, Config{ResponseHeaderTimeout: 200 * time.Millisecond}, testKeys{})
+	created, ln := ts.listen(t, "")
+	// Accept connections but never answer
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+		}
+	}()
+
+	start := time.Now()
+	w := ts.proxy(t, created, http.MethodGet, "/", "")
+	wantTimeout(t, w, time.Since(start))
+}
+
+func TestUnreachablePeerTimesOut(t *testing.T) {
+	ts := newTestServer(t, Config{DialTimeout: 200 * time.Millisecond}, testKeys{})
+	// No peer ever connects, so the handshake never completes
+	created := ts.createTunnel(t, "3000", "", "")
+
+	start := time.Now()
+	w := ts.proxy(t, created, http.MethodGet, "/", "")
+	wantTimeout(t, w, time.Since(start))
+}
+
+// wantTimeout checks that a request took one short timeout and then got
+// a 504
+func wantTimeout(t *testing.T, w *httptest.ResponseRecorder, took time.Duration) {
+	t.Helper()
+	var resp ErrorResponse
+	decode(t, w, &resp)
+	if w.Code != http.StatusGatewayTimeout || resp.Code != CodeBackendTimeout {
+		t.Errorf("request = %d %s, want 504 %s", w.Code, resp.Code, CodeBackendTimeout)
+	}
+	if took > 3*time.Second {
+		t.Errorf("request took %v with a 200ms timeout", took)
+	}
+}
+
+func TestWriteDialError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"closed tunnel", fmt.Errorf("dial: %w", tunnel.ErrClosed), http.StatusServiceUnavailable},
+		{"deadline", fmt.Errorf("dial: %w", context.DeadlineExceeded), http.StatusGatewayTimeout},
+		{"net timeout", &net.OpError{Op: "read", Err: os.ErrDeadlineExceeded}, http.StatusGatewayTimeout},
+		{"refused", &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}, http.StatusBadGateway},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		writeDialError(w, &tunnel.Info{}, tt.err)
+		if w.Code != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, w.Code, tt.want)
+		}
+	}
+}
+
+func TestExpectContinue(t *testing.T) {
+	for _, strip := range []bool{false, true} {
+		t.Run(fmt.Sprintf("strip=%v", strip), func(t *testing.T) {
+			testExpectContinue(t, strip)
+		})
+	}
+}
+
+// testExpectContinue uploads a body with Expect: 100-continue through a
+// live proxy listener
+func testExpectContinue(t *testing.T, strip bool) {
+	ts := newTestServer(t, Config{ExpectContinueTimeout: 2 * time.Second, StripExpect: strip}, testKeys{})
+	var expect atomic.Value
+	created := ts.backend(t, "", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		expect.Store(r.Header.Get("Expect"))
+		n, _ := io.Copy(io.Discard, r.Body)
+		fmt.Fprint(w, n)
+	}))
+	if got := ts.transports.get(ts.reg.GetTunnel(created.ID)).ExpectContinueTimeout; got != 2*time.Second {
+		t.Errorf("ExpectContinueTimeout = %s, want the configured 2s", got)
+	}
+	srv := httptest.NewServer(ts.proxyHandler())
+	defer srv.Close()
+
+	// The client holds the body back until it gets its 100 Continue
+	client := &http.Client{Transport: &http.Transport{ExpectContinueTimeout: time.Minute}}
+	defer client.CloseIdleConnections()
+	body := strings.Repeat("x", 64<<10)
+	req, err := http.NewRequest(http.MethodPost, srv.URL+"/upload", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = created.Subdomain + "." + ts.cfg.Domain
+	req.Header.Set("Expect", "100-continue")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		t.Fatalf("upload: %v", err)
+	}
+	defer resp.Body.Close()
+	got, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(got) != fmt.Sprint(len(body)) {
+		t.Errorf("upload = %d, backend read %s bytes; want 200 and %d", resp.StatusCode, got, len(body))
+	}
+
+	want := "100-continue"
+	if strip {
+		want = ""
+	}
+	if got := expect.Load(); got != want {
+		t.Errorf("backend saw Expect %q, want %q", got, want)
+	}
+}
+
+func TestTunnelRequestTimeout(t *testing.T) {
+	ts := newTestServer(t, Config{ResponseHeaderTimeout: 200 * time.Millisecond, MaxRequestTimeout: time.Minute}, testKeys{})
+	// Answers after longer than the server's header timeout
+	slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(600 * time.Millisecond):
+		case <-r.Context().Done():
+		}
+	})
+
+	// A longer timeout of its own outlasts the server's
+	patient := ts.backend(t, `{"request_timeout":"5s"}`, slow)
+	if patient.RequestTimeout != "5s" {
+		t.Errorf("request_timeout = %q, want 5s", patient.RequestTimeout)
+	}
+	if w := ts.proxy(t, patient, http.MethodGet, "/", ""); w.Code != http.StatusOK {
+		t.Errorf("slow response with a 5s timeout = %d %s, want 200", w.Code, w.Body)
+	}
+
+	// A shorter one cuts it off before the backend answers
+	hasty := ts.backend(t, `{"request_timeout":"100ms"}`, slow)
+	start := time.Now()
+	w := ts.proxy(t, hasty, http.MethodGet, "/", "")
+	if took := time.Since(start); took >= 500*time.Millisecond {
+		t.Errorf("request took %v with a 100ms timeout", took)
+	}
+	var resp ErrorResponse
+	decode(t, w, &resp)
+	if w.Code != http.StatusGatewayTimeout || resp.Code != CodeBackendTimeout {
+		t.Errorf("request = %d %s, want 504 %s", w.Code, resp.Code, CodeBackendTimeout)
+	}
+
+	w = ts.do(http.MethodPost, "", "/api/tunnel/3000", "", `{"request_timeout":"2m"}`)
+	decode(t, w, &resp)
+	if w.Code != http.StatusBadRequest || resp.Code != CodeValidationFailed {
+		t.Errorf("request_timeout over the max = %d %s, want 400 %s", w.Code, resp.Code, CodeValidationFailed)
+	}
+	// A lowered max caps tunnels created under the old one
+	ts.cfg.MaxRequestTimeout = 100 * time.Millisecond
+	start = time.Now()
+	w = ts.proxy(t, patient, http.MethodGet, "/", "")
+	if took := time.Since(start); took >= 500*time.Millisecond || w.Code != http.StatusGatewayTimeout {
+		t.Errorf("request = %d after %v with the max lowered to 100ms, want a quick 504", w.Code, took)
+	}
+}
@@ -0,0 +1,125 @@
+package api
+
+import (
+	"embed"
+	"errors"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mr-karan/arbok/internal/auth"
+	"github.com/mr-karan/arbok/internal/registry"
+	"github.com/mr-karan/arbok/internal/tunnel"
+)
+
+//go:embed templates/*
+var templateFiles embed.FS
+
+// createdPage renders the result of a /ui/create form post
+var createdPage = template.Must(template.ParseFS(templateFiles, "templates/created.html"))
+
+// uiConfigFilename is the config name suggested to browsers. wg-quick
+// names the interface after it, as with curl provisioning.
+const uiConfigFilename = "burrow.conf"
+
+// createdPageData fills the created page; only Error is set on failure
+type createdPageData struct {
+	Error string
+
+	Port      uint16
+	URL       string
+	ExpiresAt string
+	ExpiresIn string
+	Config    string
+	Filename  string
+	Download  template.URL
+}
+
+// formAPIKey hands the api_key field of the website's form to the
+// authenticator as the X-API-Key header. Only this route reads forms, so
+// no other request body is parsed before authentication.
+func formAPIKey(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if key := r.PostFormValue("api_key"); key != "" && r.Header.Get(auth.HeaderAPIKey) == "" {
+			r.Header.Set(auth.HeaderAPIKey, key)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handleUICreate creates a tunnel from the website's form: port, and
+// optionally subdomain and ttl (e.g. "1h"), plus api_key when keys are
+// configured. It renders the config and instructions as HTML.
+func (s *Server) handleUICreate(w http.ResponseWriter, r *http.Request) {
+	port, err := strconv.ParseUint(r.PostFormValue("port"), 10, 16)
+	if err != nil || port == 0 {
+		s.renderCreated(w, http.StatusBadRequest, createdPageData{Error: "Enter a port between 1 and 65535."})
+		return
+	}
+
+	var ttl time.Duration
+	if v := strings.TrimSpace(r.PostFormValue("ttl")); v != "" {
+		ttl, err = time.ParseDuration(v)
+		if err != nil || ttl <= 0 {
+			s.renderCreated(w, http.StatusBadRequest, createdPageData{Error: "Enter the TTL as a duration such as 30m or 2h."})
+			return
+		}
+	}
+
+	if !s.allowCreate(w, r) {
+		s.renderCreated(w, http.StatusTooManyRequests, createdPageData{Error: "Too many tunnel creations, retry later."})
+		return
+	}
+	if !s.beginProvision(w) {
+		s.renderCreated(w, http.StatusServiceUnavailable, createdPageData{Error: "Too many tunnel creations in progress, retry later."})
+		return
+	}
+	defer s.endProvision()
+
+	t, err := s.registry.CreateTunnelWithPeer(uint16(port), registry.CreateOptions{
+		OwnerID:   ownerID(r),
+		Domain:    s.requestDomain(r),
+		Subdomain: strings.TrimSpace(r.PostFormValue("subdomain")),
+		TTL:       ttl,
+	}, s.peers())
+	if err != nil {
+		switch {
+		case errors.Is(err, registry.ErrInvalidSubdomain):
+			s.renderCreated(w, http.StatusBadRequest, createdPageData{Error: "Subdomains are lowercase letters, digits and dashes."})
+		case errors.Is(err, registry.ErrSubdomainReserved), errors.Is(err, registry.ErrSubdomainTaken):
+			s.renderCreated(w, http.StatusConflict, createdPageData{Error: "That subdomain is taken, pick another or leave it empty."})
+		case errors.Is(err, tunnel.ErrDeviceUnhealthy):
+			s.renderCreated(w, http.StatusServiceUnavailable, createdPageData{Error: "WireGuard is failing, retry later."})
+		default:
+			s.logger.Error("failed to create tunnel", "error", err, "port", port)
+			s.renderCreated(w, http.StatusInternalServerError, createdPageData{Error: "Failed to create tunnel."})
+		}
+		return
+	}
+
+	config := s.generateWireGuardConfig(t)
+	s.renderCreated(w, http.StatusCreated, createdPageData{
+		Port:      t.Port,
+		URL:       "https://" + t.Hostname(),
+		ExpiresAt: t.ExpiresAt.UTC().Format(time.RFC1123),
+		ExpiresIn: humanizeDuration(t.TTL()),
+		Config:    config,
+		Filename:  uiConfigFilename,
+		// The config was generated here, so it is safe to inline
+		Download: template.URL("data:text/plain;charset=utf-8," + url.PathEscape(config)),
+	})
+}
+
+// renderCreated writes the created page
+func (s *Server) renderCreated(w http.ResponseWriter, status int, data createdPageData) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	// The page carries the tunnel's private key
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if err := createdPage.Execute(w, data); err != nil {
+		s.logger.Error("failed to render created page", "error", err)
+	}
+}
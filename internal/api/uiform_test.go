@@ -0,0 +1,83 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// postForm posts form to /ui/create
+func (ts *testServer) postForm(form url.Values) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/ui/create", strings.NewReader(form.Encode()))
+	r.Host = ts.cfg.Domain
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	ts.router.ServeHTTP(w, r)
+	return w
+}
+
+func TestUICreate(t *testing.T) {
+	ts := newTestServer(t, Config{ServeUI: true}, testKeys{})
+
+	w := ts.postForm(url.Values{"port": {"3000"}, "subdomain": {"kiosk"}, "ttl": {"30m"}})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create = %d %s", w.Code, w.Body)
+	}
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+		t.Errorf("Content-Type = %q, want HTML", ct)
+	}
+	if cc := w.Header().Get("Cache-Control"); cc != "no-store" {
+		t.Errorf("Cache-Control = %q, want no-store", cc)
+	}
+	page := w.Body.String()
+	for _, want := range []string{"https://kiosk.example.com", "[Interface]", "PrivateKey", "data:text/plain", uiConfigFilename} {
+		if !strings.Contains(page, want) {
+			t.Errorf("page is missing %q", want)
+		}
+	}
+
+	tunnels := ts.reg.ListTunnels()
+	if len(tunnels) != 1 || tunnels[0].Subdomain != "kiosk" || tunnels[0].Port != 3000 {
+		t.Fatalf("tunnels = %v, want kiosk on port 3000", tunnels)
+	}
+	if ttl := tunnels[0].ExpiresAt.Sub(tunnels[0].CreatedAt); ttl.Minutes() != 30 {
+		t.Errorf("ttl = %s, want 30m", ttl)
+	}
+}
+
+func TestUICreateErrors(t *testing.T) {
+	ts := newTestServer(t, Config{ServeUI: true}, testKeys{})
+	ts.postForm(url.Values{"port": {"3000"}, "subdomain": {"taken"}})
+
+	for _, tc := range []struct {
+		name string
+		form url.Values
+		code int
+	}{
+		{"missing port", url.Values{}, http.StatusBadRequest},
+		{"port out of range", url.Values{"port": {"70000"}}, http.StatusBadRequest},
+		{"bad ttl", url.Values{"port": {"3000"}, "ttl": {"soon"}}, http.StatusBadRequest},
+		{"bad subdomain", url.Values{"port": {"3000"}, "subdomain": {"Not_Valid"}}, http.StatusBadRequest},
+		{"taken subdomain", url.Values{"port": {"3000"}, "subdomain": {"taken"}}, http.StatusConflict},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			w := ts.postForm(tc.form)
+			if w.Code != tc.code || !strings.Contains(w.Body.String(), "Tunnel not created") {
+				t.Errorf("create = %d, want %d and the error page", w.Code, tc.code)
+			}
+		})
+	}
+}
+
+func TestUICreateRequiresKey(t *testing.T) {
+	ts := newTestServer(t, Config{ServeUI: true}, testKeys{api: []string{"form-key"}})
+
+	if w := ts.postForm(url.Values{"port": {"3000"}}); w.Code != http.StatusUnauthorized {
+		t.Errorf("create without key = %d, want 401", w.Code)
+	}
+	if w := ts.postForm(url.Values{"port": {"3000"}, "api_key": {"form-key"}}); w.Code != http.StatusCreated {
+		t.Errorf("create with key field = %d %s, want 201", w.Code, w.Body)
+	}
+}
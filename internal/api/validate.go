@@ -0,0 +1,316 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/mr-karan/arbok/internal/tunnel"
+)
+
+// maxStripResponseHeaders bounds the per-tunnel header strip list
+const maxStripResponseHeaders = 32
+
+// maxAllowedClientCIDRs bounds the per-tunnel client network allowlist
+const maxAllowedClientCIDRs = 32
+
+// maxLabels bounds the number of labels on a tunnel
+const maxLabels = 16
+
+// maxErrorOverrideBody bounds the body of an error override
+const maxErrorOverrideBody = 4 << 10
+
+// maxRoutes bounds the path-prefix routes of a tunnel
+const maxRoutes = 16
+
+// maxDescriptionLength bounds a tunnel description, in characters
+const maxDescriptionLength = 256
+
+// labelPattern matches label keys and non-empty values: up to 63
+// alphanumerics, '-', '_' or '.', starting and ending alphanumeric
+var labelPattern = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9._-]{0,61}[A-Za-z0-9])?$`)
+
+// FieldError describes a request field that failed validation
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationError lists every field of a request that failed validation.
+// Error responses carry it as a JSON array in details.
+type ValidationError []FieldError
+
+func (e ValidationError) Error() string {
+	parts := make([]string, 0, len(e))
+	for _, fe := range e {
+		parts = append(parts, fe.Field+": "+fe.Message)
+	}
+	return strings.Join(parts, "; ")
+}
+
+// decodeStrictJSON decodes an optional JSON request body into v. An empty
+// body means no options; unknown fields and trailing data are rejected so
+// typos like "subdomian" don't pass silently.
+func decodeStrictJSON(r *http.Request, v interface{}) error {
+	if r.Body == nil {
+		return nil
+	}
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		return err
+	}
+	if dec.More() {
+		return errors.New("unexpected data after JSON object")
+	}
+	return nil
+}
+
+// Validate checks the request's field constraints, returning a
+// ValidationError naming every offending field. Valid fields are
+// normalized in place. maxRequestTimeout caps request_timeout; zero
+// means no cap.
+func (req *CreateTunnelRequest) Validate(maxRequestTimeout time.Duration) error {
+	var errs ValidationError
+
+	if req.BackendHost != "" && net.ParseIP(req.BackendHost) == nil && req.DNSResolver == "" {
+		errs = append(errs, FieldError{"backend_host", "must be an IP address, or a hostname with dns_resolver set"})
+	}
+	if req.DNSResolver != "" && req.DNSResolver != tunnel.PeerResolver {
+		if _, _, err := net.SplitHostPort(req.DNSResolver); err != nil {
+			errs = append(errs, FieldError{"dns_resolver", fmt.Sprintf("must be %q or a host:port", tunnel.PeerResolver)})
+		}
+	}
+
+	req.BackendScheme = strings.ToLower(req.BackendScheme)
+	if req.BackendScheme != "" && req.BackendScheme != "http" && req.BackendScheme != "https" {
+		errs = append(errs, FieldError{"backend_scheme", `must be "http" or "https"`})
+	}
+	if req.BackendInsecureSkipVerify && req.BackendScheme != "https" {
+		errs = append(errs, FieldError{"backend_insecure_skip_verify", `requires backend_scheme "https"`})
+	}
+
+	if req.RequireClientCert && strings.TrimSpace(req.ClientCAPEM) == "" {
+		errs = append(errs, FieldError{"client_ca_pem", "is required when require_client_cert is set"})
+	}
+	if req.ClientCAPEM != "" && !strings.Contains(req.ClientCAPEM, "-----BEGIN CERTIFICATE-----") {
+		errs = append(errs, FieldError{"client_ca_pem", "must contain PEM encoded certificates"})
+	}
+
+	if req.ClientPublicKey != "" {
+		if err := tunnel.ValidateKey(req.ClientPublicKey); err != nil {
+			errs = append(errs, FieldError{"client_public_key", "must be a base64 encoded 32 byte WireGuard key"})
+		}
+	}
+	if req.TTL != "" {
+		if ttl, err := time.ParseDuration(req.TTL); err != nil || ttl <= 0 {
+			errs = append(errs, FieldError{"ttl", "must be a positive duration such as 30m or 48h"})
+		}
+	}
+	if req.RequestTimeout != "" {
+		if timeout, err := time.ParseDuration(req.RequestTimeout); err != nil || timeout <= 0 {
+			errs = append(errs, FieldError{"request_timeout", "must be a positive duration such as 5s or 10m"})
+		} else if maxRequestTimeout > 0 && timeout > maxRequestTimeout {
+			errs = append(errs, FieldError{"request_timeout", fmt.Sprintf("must be at most %s", maxRequestTimeout)})
+		}
+	}
+	if req.Reclaim && req.ClientPublicKey == "" {
+		errs = append(errs, FieldError{"reclaim", "requires client_public_key"})
+	}
+
+	if len(req.StripResponseHeaders) > maxStripResponseHeaders {
+		errs = append(errs, FieldError{"strip_response_headers", fmt.Sprintf("must have at most %d entries", maxStripResponseHeaders)})
+	}
+	for i, h := range req.StripResponseHeaders {
+		if !validHeaderName(h) {
+			errs = append(errs, FieldError{fmt.Sprintf("strip_response_headers[%d]", i), "must be a valid header name"})
+		}
+	}
+
+	for i, m := range req.AllowedMethods {
+		if !validHeaderName(m) {
+			errs = append(errs, FieldError{fmt.Sprintf("allowed_methods[%d]", i), "must be an HTTP method"})
+			continue
+		}
+		// Methods are case-sensitive but clients mean the standard ones
+		req.AllowedMethods[i] = strings.ToUpper(m)
+	}
+
+	if len(req.AllowedClientCIDRs) > maxAllowedClientCIDRs {
+		errs = append(errs, FieldError{"allowed_client_cidrs", fmt.Sprintf("must have at most %d entries", maxAllowedClientCIDRs)})
+	}
+	for i, cidr := range req.AllowedClientCIDRs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			errs = append(errs, FieldError{fmt.Sprintf("allowed_client_cidrs[%d]", i), "must be a CIDR such as 203.0.113.0/24"})
+		}
+	}
+
+	if req.MaxRPS < 0 {
+		errs = append(errs, FieldError{"max_rps", "must be a non-negative number"})
+	}
+
+	conds := make([]string, 0, len(req.ErrorOverrides))
+	for cond := range req.ErrorOverrides {
+		conds = append(conds, cond)
+	}
+	sort.Strings(conds)
+	for _, cond := range conds {
+		field := "error_overrides." + cond
+		switch cond {
+		case tunnel.ErrorBackend, tunnel.ErrorBackendTimeout, tunnel.ErrorBackendUnavailable:
+		default:
+			errs = append(errs, FieldError{field, fmt.Sprintf("must be one of %q, %q or %q",
+				tunnel.ErrorBackend, tunnel.ErrorBackendTimeout, tunnel.ErrorBackendUnavailable)})
+			continue
+		}
+		o := req.ErrorOverrides[cond]
+		if o.Status < 200 || o.Status > 599 {
+			errs = append(errs, FieldError{field + ".status", "must be an HTTP status code between 200 and 599"})
+		}
+		if len(o.Body) > maxErrorOverrideBody {
+			errs = append(errs, FieldError{field + ".body", fmt.Sprintf("must be at most %d bytes", maxErrorOverrideBody)})
+		}
+		if o.ContentType != "" {
+			if _, _, err := mime.ParseMediaType(o.ContentType); err != nil {
+				errs = append(errs, FieldError{field + ".content_type", "must be a media type such as application/json"})
+			}
+		}
+	}
+
+	if err := validateDescription(req.Description); err != nil {
+		errs = append(errs, FieldError{"description", err.Error()})
+	}
+
+	if len(req.Routes) > maxRoutes {
+		errs = append(errs, FieldError{"routes", fmt.Sprintf("must have at most %d entries", maxRoutes)})
+	}
+	prefixes := make(map[string]bool, len(req.Routes))
+	for i, route := range req.Routes {
+		field := fmt.Sprintf("routes[%d]", i)
+		if !strings.HasPrefix(route.Prefix, "/") || strings.ContainsAny(route.Prefix, "?# ") {
+			errs = append(errs, FieldError{field + ".prefix", "must be a path starting with /"})
+		} else if prefix := strings.TrimSuffix(route.Prefix, "/"); prefixes[prefix] {
+			errs = append(errs, FieldError{field + ".prefix", "is routed more than once"})
+		} else {
+			prefixes[prefix] = true
+		}
+		if route.Port == 0 {
+			errs = append(errs, FieldError{field + ".port", "must be a port number"})
+		}
+	}
+
+	if len(req.Labels) > maxLabels {
+		errs = append(errs, FieldError{"labels", fmt.Sprintf("must have at most %d entries", maxLabels)})
+	}
+	// Sorted so errors come out in a stable order
+	keys := make([]string, 0, len(req.Labels))
+	for k := range req.Labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if err := validateLabel(k, req.Labels[k]); err != nil {
+			errs = append(errs, FieldError{"labels." + k, err.Error()})
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// Validate checks the request's field constraints like
+// CreateTunnelRequest.Validate
+func (req *UpdateTunnelRequest) Validate() error {
+	var errs ValidationError
+
+	if req.Description != nil {
+		if err := validateDescription(*req.Description); err != nil {
+			errs = append(errs, FieldError{"description", err.Error()})
+		}
+	}
+
+	if req.Port != nil && *req.Port == 0 {
+		errs = append(errs, FieldError{"port", "must be between 1 and 65535"})
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// validateDescription checks a tunnel description: printable UTF-8 text
+// of at most maxDescriptionLength characters
+func validateDescription(desc string) error {
+	if !utf8.ValidString(desc) {
+		return errors.New("must be valid UTF-8")
+	}
+	if utf8.RuneCountInString(desc) > maxDescriptionLength {
+		return fmt.Errorf("must be at most %d characters", maxDescriptionLength)
+	}
+	for _, c := range desc {
+		if unicode.IsControl(c) {
+			return errors.New("must not contain control characters")
+		}
+	}
+	return nil
+}
+
+// validateLabel checks a label key and value. Values may be empty.
+func validateLabel(key, value string) error {
+	if !labelPattern.MatchString(key) {
+		return errors.New("key must be 1-63 alphanumerics, '-', '_' or '.', starting and ending alphanumeric")
+	}
+	if value != "" && !labelPattern.MatchString(value) {
+		return errors.New("value must be up to 63 alphanumerics, '-', '_' or '.', starting and ending alphanumeric")
+	}
+	return nil
+}
+
+// parseLabelSelector parses key:value label selectors into the labels a
+// tunnel must carry
+func parseLabelSelector(selectors []string) (map[string]string, error) {
+	if len(selectors) == 0 {
+		return nil, nil
+	}
+	selector := make(map[string]string, len(selectors))
+	for _, sel := range selectors {
+		key, value, ok := strings.Cut(sel, ":")
+		if !ok {
+			return nil, fmt.Errorf("%q: must be key:value", sel)
+		}
+		if err := validateLabel(key, value); err != nil {
+			return nil, fmt.Errorf("%q: %w", sel, err)
+		}
+		selector[key] = value
+	}
+	return selector, nil
+}
+
+// validHeaderName reports whether name is a non-empty RFC 7230 token
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if c > 0x7e || c <= ' ' || strings.ContainsRune(`"(),/:;<=>?@[\]{}`, c) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,121 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/mr-karan/arbok/internal/tunnel"
+)
+
+func TestCreateRequestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		req    CreateTunnelRequest
+		fields []string
+	}{
+		{"empty", CreateTunnelRequest{}, nil},
+		{"bad ttl", CreateTunnelRequest{TTL: "soon"}, []string{"ttl"}},
+		{"negative ttl", CreateTunnelRequest{TTL: "-1h"}, []string{"ttl"}},
+		{"bad scheme", CreateTunnelRequest{BackendScheme: "ftp"}, []string{"backend_scheme"}},
+		{"skip verify without https", CreateTunnelRequest{BackendInsecureSkipVerify: true}, []string{"backend_insecure_skip_verify"}},
+		{"hostname backend without resolver", CreateTunnelRequest{BackendHost: "db.internal"}, []string{"backend_host"}},
+		{"client cert without CA", CreateTunnelRequest{RequireClientCert: true}, []string{"client_ca_pem"}},
+		{"bad public key", CreateTunnelRequest{ClientPublicKey: "nope"}, []string{"client_public_key"}},
+		{"bad header name", CreateTunnelRequest{StripResponseHeaders: []string{"X Bad"}}, []string{"strip_response_headers[0]"}},
+		{"bad client CIDR", CreateTunnelRequest{AllowedClientCIDRs: []string{"10.0.0.0/8", "10.0.0.1"}}, []string{"allowed_client_cidrs[1]"}},
+		{"negative max_rps", CreateTunnelRequest{MaxRPS: -1}, []string{"max_rps"}},
+		{"labels", CreateTunnelRequest{Labels: map[string]string{"env": "staging", "team.name": "", "a": "b"}}, nil},
+		{"bad label key", CreateTunnelRequest{Labels: map[string]string{"-env": "staging"}}, []string{"labels.-env"}},
+		{"bad label value", CreateTunnelRequest{Labels: map[string]string{"env": "stag ing"}}, []string{"labels.env"}},
+		{"error override", CreateTunnelRequest{ErrorOverrides: map[string]tunnel.ErrorOverride{"backend_error": {Status: 200, Body: "down"}}}, nil},
+		{"unknown error condition", CreateTunnelRequest{ErrorOverrides: map[string]tunnel.ErrorOverride{"teapot": {Status: 200}}}, []string{"error_overrides.teapot"}},
+		{
+			"informational error override",
+			CreateTunnelRequest{ErrorOverrides: map[string]tunnel.ErrorOverride{"backend_error": {Status: 101}}},
+			[]string{"error_overrides.backend_error.status"},
+		},
+		{
+			"bad error override",
+			CreateTunnelRequest{ErrorOverrides: map[string]tunnel.ErrorOverride{"backend_timeout": {Status: 42, Body: strings.Repeat("a", maxErrorOverrideBody+1), ContentType: "not a type"}}},
+			[]string{"error_overrides.backend_timeout.status", "error_overrides.backend_timeout.body", "error_overrides.backend_timeout.content_type"},
+		},
+		{"description", CreateTunnelRequest{Description: "PR #123 preview – café"}, nil},
+		{"long description", CreateTunnelRequest{Description: strings.Repeat("é", maxDescriptionLength+1)}, []string{"description"}},
+		{"description with control characters", CreateTunnelRequest{Description: "line\nbreak"}, []string{"description"}},
+		{"invalid UTF-8 description", CreateTunnelRequest{Description: "\xff"}, []string{"description"}},
+		{"routes", CreateTunnelRequest{Routes: []tunnel.Route{{Prefix: "/api", Port: 8081}, {Prefix: "/", Port: 3001}}}, nil},
+		{
+			"bad routes",
+			CreateTunnelRequest{Routes: []tunnel.Route{{Prefix: "api", Port: 8081}, {Prefix: "/ws", Port: 0}, {Prefix: "/x/", Port: 1}, {Prefix: "/x", Port: 2}}},
+			[]string{"routes[0].prefix", "routes[1].port", "routes[3].prefix"},
+		},
+		{"reclaim without public key", CreateTunnelRequest{Reclaim: true}, []string{"reclaim"}},
+		{"request timeout", CreateTunnelRequest{RequestTimeout: "5m"}, nil},
+		{"bad request timeout", CreateTunnelRequest{RequestTimeout: "0s"}, []string{"request_timeout"}},
+		{"request timeout over the max", CreateTunnelRequest{RequestTimeout: "11m"}, []string{"request_timeout"}},
+		{
+			"every failure listed",
+			CreateTunnelRequest{BackendHost: "db.internal", ClientPublicKey: "nope", RequireClientCert: true},
+			[]string{"backend_host", "client_ca_pem", "client_public_key"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.req.Validate(DefaultMaxRequestTimeout)
+			if tt.fields == nil {
+				if err != nil {
+					t.Fatalf("Validate: %v", err)
+				}
+				return
+			}
+			var verr ValidationError
+			if !errors.As(err, &verr) {
+				t.Fatalf("Validate = %v, want a ValidationError", err)
+			}
+			var got []string
+			for _, fe := range verr {
+				got = append(got, fe.Field)
+			}
+			if strings.Join(got, ",") != strings.Join(tt.fields, ",") {
+				t.Errorf("failed fields = %v, want %v", got, tt.fields)
+			}
+		})
+	}
+}
+
+func TestCreateRejectsUnknownFields(t *testing.T) {
+	ts := newTestServer(t, Config{}, testKeys{})
+	w := ts.do(http.MethodPost, "", "/api/tunnel/3000", "", `{"subdomian":"app"}`)
+
+	var resp ErrorResponse
+	decode(t, w, &resp)
+	if w.Code != http.StatusBadRequest || resp.Code != "INVALID_BODY" {
+		t.Fatalf("create with a typo = %d %s, want 400 INVALID_BODY", w.Code, resp.Code)
+	}
+	if details, _ := resp.Details.(string); !strings.Contains(details, "subdomian") {
+		t.Errorf("details %q don't name the unknown field", resp.Details)
+	}
+}
+
+func TestValidationDetailsAreFieldList(t *testing.T) {
+	ts := newTestServer(t, Config{}, testKeys{})
+	w := ts.do(http.MethodPost, "", "/api/tunnel/3000", "", `{"backend_host":"db.internal","client_public_key":"nope"}`)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("create = %d %s, want 400", w.Code, w.Body)
+	}
+
+	var resp struct {
+		Code    string       `json:"code"`
+		Details []FieldError `json:"details"`
+	}
+	decode(t, w, &resp)
+	if resp.Code != "VALIDATION_FAILED" {
+		t.Errorf("code = %s, want VALIDATION_FAILED", resp.Code)
+	}
+	if len(resp.Details) != 2 || resp.Details[0].Field != "backend_host" || resp.Details[1].Field != "client_public_key" ||
+		resp.Details[1].Message == "" {
+		t.Errorf("details = %+v, want backend_host and client_public_key with messages", resp.Details)
+	}
+}
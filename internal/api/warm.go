@@ -0,0 +1,211 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/mr-karan/arbok/internal/tunnel"
+)
+
+// Defaults for keep-warm
+const (
+	DefaultKeepWarmConns  = 2
+	DefaultKeepWarmWindow = 5 * time.Minute
+
+	// keepWarmInterval is how often warm pools are topped up
+	keepWarmInterval = 10 * time.Second
+	// keepWarmMaxAge retires warm connections before backends are likely
+	// to drop them as idle
+	keepWarmMaxAge = 30 * time.Second
+	// keepWarmDialTimeout bounds warming dials so one asleep peer can't
+	// hold up the others
+	keepWarmDialTimeout = 2 * time.Second
+)
+
+// Keep-warm holds a few pre-dialed connections to the backends of
+// recently used tunnels, so a request after a quiet spell doesn't pay for
+// a fresh handshake through WireGuard. Dials through the tunnel take a
+// warm connection when one is available. Connections are only held while
+// the tunnel keeps seeing traffic, and never longer than keepWarmMaxAge.
+
+// warmConn is a pre-dialed backend connection
+type warmConn struct {
+	net.Conn
+	dialedAt time.Time
+}
+
+// warmPool holds warm connections by backend address
+type warmPool struct {
+	mu    sync.Mutex
+	conns map[string][]warmConn
+}
+
+func newWarmPool() *warmPool {
+	return &warmPool{conns: make(map[string][]warmConn)}
+}
+
+// backendTarget returns the address the proxy dials for a tunnel
+func backendTarget(t *tunnel.Info) string {
+	return fmt.Sprintf("%s:%d", t.BackendAddr(), t.Port)
+}
+
+// take returns a live warm connection to addr, or nil
+func (p *warmPool) take(addr string) net.Conn {
+	for {
+		p.mu.Lock()
+		conns := p.conns[addr]
+		if len(conns) == 0 {
+			p.mu.Unlock()
+			return nil
+		}
+		wc := conns[len(conns)-1]
+		p.conns[addr] = conns[:len(conns)-1]
+		p.mu.Unlock()
+
+		if time.Since(wc.dialedAt) < keepWarmMaxAge && connAlive(wc.Conn) {
+			return wc.Conn
+		}
+		wc.Close()
+	}
+}
+
+// count returns how many warm connections are held for addr
+func (p *warmPool) count(addr string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return len(p.conns[addr])
+}
+
+// put adds a warm connection for addr
+func (p *warmPool) put(addr string, c net.Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.conns[addr] = append(p.conns[addr], warmConn{Conn: c, dialedAt: time.Now()})
+}
+
+// prune closes addr's connections that are too old to hand out, or all
+// of them
+func (p *warmPool) prune(addr string, all bool) {
+	p.mu.Lock()
+	var stale []warmConn
+	kept := p.conns[addr][:0]
+	for _, wc := range p.conns[addr] {
+		if all || time.Since(wc.dialedAt) >= keepWarmMaxAge {
+			stale = append(stale, wc)
+		} else {
+			kept = append(kept, wc)
+		}
+	}
+	if len(kept) == 0 {
+		delete(p.conns, addr)
+	} else {
+		p.conns[addr] = kept
+	}
+	p.mu.Unlock()
+
+	for _, wc := range stale {
+		wc.Close()
+	}
+}
+
+// addrs returns the addresses warm connections are held for
+func (p *warmPool) addrs() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	addrs := make([]string, 0, len(p.conns))
+	for addr := range p.conns {
+		addrs = append(addrs, addr)
+	}
+	return addrs
+}
+
+// evict closes a removed tunnel's warm connections
+func (p *warmPool) evict(t *tunnel.Info) {
+	p.prune(backendTarget(t), true)
+}
+
+// closeAll closes every warm connection
+func (p *warmPool) closeAll() {
+	for _, addr := range p.addrs() {
+		p.prune(addr, true)
+	}
+}
+
+// connAlive reports whether the backend still holds c open. A backend
+// that closed it, or unexpectedly sent data, makes it unusable. The
+// netstack reports deadlines with its own timeout error rather than
+// os.ErrDeadlineExceeded.
+func connAlive(c net.Conn) bool {
+	if err := c.SetReadDeadline(time.Now().Add(time.Millisecond)); err != nil {
+		return false
+	}
+	var b [1]byte
+	_, err := c.Read(b[:])
+	c.SetReadDeadline(time.Time{})
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// keepWarm tops up the warm pools of recently active tunnels until ctx is
+// done, and releases those of tunnels that went quiet
+func (s *Server) keepWarm(ctx context.Context) {
+	ticker := time.NewTicker(keepWarmInterval)
+	defer ticker.Stop()
+	defer s.warm.closeAll()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.warmTunnels(ctx)
+		}
+	}
+}
+
+// warmTunnels runs one keep-warm pass
+func (s *Server) warmTunnels(ctx context.Context) {
+	want := s.cfg.KeepWarmConns
+	if want <= 0 {
+		want = DefaultKeepWarmConns
+	}
+	window := s.cfg.KeepWarmWindow
+	if window <= 0 {
+		window = DefaultKeepWarmWindow
+	}
+
+	active := make(map[string]bool)
+	for _, t := range s.registry.ListTunnels() {
+		if t.Revoked || t.IsExpired() || t.BackendAddr() == "" || t.Port == 0 || time.Since(t.LastSeen()) > window {
+			continue
+		}
+		addr := backendTarget(t)
+		active[addr] = true
+
+		s.warm.prune(addr, false)
+		for n := s.warm.count(addr); n < want; n++ {
+			dialCtx, cancel := context.WithTimeout(ctx, keepWarmDialTimeout)
+			c, err := s.tun.DialPooled(dialCtx, "tcp", addr)
+			cancel()
+			if err != nil {
+				s.logger.Debug("keep-warm dial failed", "tunnel_id", t.ID, "target", addr, "error", err)
+				break
+			}
+			s.warm.put(addr, c)
+		}
+	}
+
+	// Quiet or gone tunnels don't keep connections
+	for _, addr := range s.warm.addrs() {
+		if !active[addr] {
+			s.warm.prune(addr, true)
+		}
+	}
+}
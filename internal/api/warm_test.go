@@ -0,0 +1,90 @@
+package api
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestWarmPoolTake(t *testing.T) {
+	p := newWarmPool()
+	if p.take("10.0.0.2:3000") != nil {
+		t.Fatal("empty pool handed out a connection")
+	}
+
+	live, liveRemote := net.Pipe()
+	defer liveRemote.Close()
+	closed, closedRemote := net.Pipe()
+	closedRemote.Close()
+	p.put("10.0.0.2:3000", live)
+	p.put("10.0.0.2:3000", closed)
+
+	// The connection the backend closed is skipped and dropped
+	if c := p.take("10.0.0.2:3000"); c != live {
+		t.Fatalf("take = %v, want the live connection", c)
+	}
+	if n := p.count("10.0.0.2:3000"); n != 0 {
+		t.Errorf("%d connections left after take, want 0", n)
+	}
+
+	// Connections past the max age are neither handed out nor kept
+	old, oldRemote := net.Pipe()
+	defer oldRemote.Close()
+	p.conns["10.0.0.2:3000"] = []warmConn{{Conn: old, dialedAt: time.Now().Add(-keepWarmMaxAge)}}
+	p.prune("10.0.0.2:3000", false)
+	if len(p.addrs()) != 0 {
+		t.Errorf("stale connection kept: %v", p.addrs())
+	}
+}
+
+func TestKeepWarm(t *testing.T) {
+	ts := newTestServer(t, Config{KeepWarm: true, KeepWarmConns: 2}, testKeys{})
+	created, ln := ts.listen(t, "")
+	conns := countingBackend(t, ln)
+	addr := backendTarget(ts.reg.GetTunnel(created.ID))
+
+	ts.warmTunnels(context.Background())
+	if n := ts.warm.count(addr); n != 2 {
+		t.Fatalf("%d warm connections, want 2", n)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for conns.Load() < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// A request takes a warm connection instead of dialing
+	if w := ts.proxy(t, created, http.MethodGet, "/", ""); w.Code != http.StatusOK {
+		t.Fatalf("request = %d %s", w.Code, w.Body)
+	}
+	if n := conns.Load(); n != 2 {
+		t.Errorf("backend accepted %d connections, want the 2 warm ones", n)
+	}
+	if n := ts.warm.count(addr); n != 1 {
+		t.Errorf("%d warm connections after a request, want 1", n)
+	}
+
+	// The next pass tops the pool back up
+	ts.warmTunnels(context.Background())
+	if n := ts.warm.count(addr); n != 2 {
+		t.Errorf("%d warm connections after top-up, want 2", n)
+	}
+
+	// Tunnels that went quiet release their connections
+	ts.cfg.KeepWarmWindow = time.Nanosecond
+	ts.warmTunnels(context.Background())
+	if n := ts.warm.count(addr); n != 0 {
+		t.Errorf("quiet tunnel kept %d warm connections", n)
+	}
+
+	// Deleting a tunnel closes its connections
+	ts.cfg.KeepWarmWindow = 0
+	ts.warmTunnels(context.Background())
+	if err := ts.reg.DeleteTunnel(created.ID); err != nil {
+		t.Fatal(err)
+	}
+	if n := ts.warm.count(addr); n != 0 {
+		t.Errorf("deleted tunnel kept %d warm connections", n)
+	}
+}
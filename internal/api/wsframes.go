@@ -0,0 +1,288 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// WebSocket relay modes. The raw relay copies bytes blindly; the frames
+// relay parses frames so it can enforce size limits and count messages.
+const (
+	WebSocketRelayRaw    = "raw"
+	WebSocketRelayFrames = "frames"
+)
+
+// Defaults for the frames relay
+const (
+	DefaultWebSocketMaxFrameBytes   = 1 << 20
+	DefaultWebSocketMaxMessageBytes = 4 << 20
+)
+
+// WebSocket opcodes and close codes (RFC 6455)
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+
+	wsCloseProtocolError = 1002
+	wsCloseMessageTooBig = 1009
+)
+
+// wsCloseWriteTimeout bounds how long a close frame waits for a frame
+// being relayed the other way to finish
+const wsCloseWriteTimeout = time.Second
+
+// wsViolation is a frame the relay refuses to forward
+type wsViolation struct {
+	code   uint16
+	reason string
+}
+
+func (v *wsViolation) Error() string {
+	return fmt.Sprintf("websocket %s (close %d)", v.reason, v.code)
+}
+
+// wsFrameHeader is a parsed frame header. raw holds the header bytes as
+// read, so the frame is forwarded untouched, mask included.
+type wsFrameHeader struct {
+	fin    bool
+	opcode byte
+	masked bool
+	length uint64
+	raw    []byte
+}
+
+// readWSFrameHeader reads the next frame header from r
+func readWSFrameHeader(r *bufio.Reader) (wsFrameHeader, error) {
+	var h wsFrameHeader
+	raw := make([]byte, 2, 14)
+	if _, err := io.ReadFull(r, raw); err != nil {
+		return h, err
+	}
+	h.fin = raw[0]&0x80 != 0
+	h.opcode = raw[0] & 0x0f
+	h.masked = raw[1]&0x80 != 0
+
+	n := raw[1] & 0x7f
+	ext := 0
+	switch n {
+	case 126:
+		ext = 2
+	case 127:
+		ext = 8
+	}
+	if h.masked {
+		raw = raw[:2+ext+4]
+	} else {
+		raw = raw[:2+ext]
+	}
+	if _, err := io.ReadFull(r, raw[2:]); err != nil {
+		return h, err
+	}
+
+	switch n {
+	case 126:
+		h.length = uint64(binary.BigEndian.Uint16(raw[2:4]))
+	case 127:
+		h.length = binary.BigEndian.Uint64(raw[2:10])
+	default:
+		h.length = uint64(n)
+	}
+	h.raw = raw
+	return h, nil
+}
+
+// wsEndpoint is one side of a relayed WebSocket. Writes hold its lock for
+// a whole frame so close frames never land inside another frame.
+type wsEndpoint struct {
+	conn net.Conn
+	// client is set for the client side, whose frames must be masked
+	client bool
+	wmu    chan struct{}
+}
+
+func newWSEndpoint(conn net.Conn, client bool) *wsEndpoint {
+	return &wsEndpoint{conn: conn, client: client, wmu: make(chan struct{}, 1)}
+}
+
+func (e *wsEndpoint) lock(timeout time.Duration) bool {
+	if timeout <= 0 {
+		e.wmu <- struct{}{}
+		return true
+	}
+	select {
+	case e.wmu <- struct{}{}:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func (e *wsEndpoint) unlock() {
+	<-e.wmu
+}
+
+// writeClose sends a close frame. Frames to the backend come from us as
+// its client and are masked.
+func (e *wsEndpoint) writeClose(code uint16, reason string) {
+	payload := binary.BigEndian.AppendUint16(nil, code)
+	payload = append(payload, reason...)
+	if len(payload) > 125 {
+		payload = payload[:125]
+	}
+
+	frame := []byte{0x80 | wsOpClose, byte(len(payload))}
+	if !e.client {
+		var key [4]byte
+		rand.Read(key[:])
+		frame[1] |= 0x80
+		frame = append(frame, key[:]...)
+		for i := range payload {
+			payload[i] ^= key[i%4]
+		}
+	}
+	frame = append(frame, payload...)
+
+	if !e.lock(wsCloseWriteTimeout) {
+		return
+	}
+	defer e.unlock()
+	e.conn.SetWriteDeadline(time.Now().Add(wsCloseWriteTimeout))
+	e.conn.Write(frame)
+}
+
+// wsMessageState tracks the fragmented message being relayed in one
+// direction
+type wsMessageState struct {
+	inMessage bool
+	size      uint64
+}
+
+// check validates a frame header from src against RFC 6455 and the size
+// limits
+func (m *wsMessageState) check(h wsFrameHeader, src *wsEndpoint, maxFrame, maxMessage uint64) *wsViolation {
+	if h.masked != src.client {
+		return &wsViolation{wsCloseProtocolError, "frame masking is invalid"}
+	}
+	if h.length > maxFrame {
+		return &wsViolation{wsCloseMessageTooBig, "frame too large"}
+	}
+
+	switch {
+	case h.opcode&0x8 != 0:
+		if h.opcode > 0xA {
+			return &wsViolation{wsCloseProtocolError, "reserved opcode"}
+		}
+		if !h.fin || h.length > 125 {
+			return &wsViolation{wsCloseProtocolError, "invalid control frame"}
+		}
+		return nil
+	case h.opcode == wsOpText || h.opcode == wsOpBinary:
+		if m.inMessage {
+			return &wsViolation{wsCloseProtocolError, "expected continuation frame"}
+		}
+		m.size = 0
+	case h.opcode == wsOpContinuation:
+		if !m.inMessage {
+			return &wsViolation{wsCloseProtocolError, "unexpected continuation frame"}
+		}
+	default:
+		return &wsViolation{wsCloseProtocolError, "reserved opcode"}
+	}
+
+	m.size += h.length
+	if m.size > maxMessage {
+		return &wsViolation{wsCloseMessageTooBig, "message too large"}
+	}
+	m.inMessage = !h.fin
+	return nil
+}
+
+// relayWebSocket relays an upgraded connection with the configured relay
+func (s *Server) relayWebSocket(ctx context.Context, clientConn, targetConn net.Conn) {
+	if s.cfg.WebSocketRelay != WebSocketRelayFrames {
+		s.relayConns(ctx, clientConn, targetConn)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	client := newWSEndpoint(clientConn, true)
+	backend := newWSEndpoint(targetConn, false)
+	errc := make(chan error, 2)
+	go func() {
+		defer cancel()
+		errc <- s.relayFrames(backend, client)
+	}()
+	go func() {
+		defer cancel()
+		errc <- s.relayFrames(client, backend)
+	}()
+
+	select {
+	case <-ctx.Done():
+	case <-errc:
+	}
+}
+
+// relayFrames forwards frames from src to dst until either side fails. A
+// frame over the limits, or breaking the protocol, closes both sides with
+// the matching close code instead of being forwarded.
+func (s *Server) relayFrames(dst, src *wsEndpoint) error {
+	maxFrame := uint64(s.cfg.WebSocketMaxFrameBytes)
+	maxMessage := uint64(s.cfg.WebSocketMaxMessageBytes)
+	direction := "backend"
+	if src.client {
+		direction = "client"
+	}
+
+	buf := s.buffers.Get()
+	defer s.buffers.Put(buf)
+	br := bufio.NewReader(s.bandwidth.reader(context.Background(), src.conn))
+
+	var msg wsMessageState
+	for {
+		h, err := readWSFrameHeader(br)
+		if err != nil {
+			return err
+		}
+
+		if v := msg.check(h, src, maxFrame, maxMessage); v != nil {
+			s.logger.Info("closing websocket", "from", direction, "reason", v.reason, "close_code", v.code)
+			s.metrics.WebSocketLimitCloses.Inc()
+			dst.writeClose(v.code, v.reason)
+			src.writeClose(v.code, v.reason)
+			return v
+		}
+
+		dst.lock(0)
+		_, err = dst.conn.Write(h.raw)
+		if err == nil {
+			var n int64
+			n, err = io.CopyBuffer(dst.conn, io.LimitReader(br, int64(h.length)), buf)
+			if err == nil && uint64(n) < h.length {
+				err = io.ErrUnexpectedEOF
+			}
+		}
+		dst.unlock()
+		if err != nil {
+			return err
+		}
+
+		if h.fin && h.opcode&0x8 == 0 {
+			s.metrics.WebSocketMessages(direction).Inc()
+		}
+		if h.opcode == wsOpClose {
+			return errors.New("websocket closed")
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// wsFrame builds a single frame, masked as a client would send it
+func wsFrame(opcode byte, fin, masked bool, payload []byte) []byte {
+	b := []byte{opcode, byte(len(payload))}
+	if fin {
+		b[0] |= 0x80
+	}
+	if !masked {
+		return append(b, payload...)
+	}
+	b[1] |= 0x80
+	key := []byte{1, 2, 3, 4}
+	b = append(b, key...)
+	for i, c := range payload {
+		b = append(b, c^key[i%4])
+	}
+	return b
+}
+
+// readWSFrame reads a frame from conn and returns its header and
+// unmasked payload
+func readWSFrame(conn net.Conn) (wsFrameHeader, []byte, error) {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	br := bufio.NewReader(conn)
+	h, err := readWSFrameHeader(br)
+	if err != nil {
+		return h, nil, err
+	}
+	payload := make([]byte, h.length)
+	if _, err := io.ReadFull(br, payload); err != nil {
+		return h, nil, err
+	}
+	if h.masked {
+		key := h.raw[len(h.raw)-4:]
+		for i := range payload {
+			payload[i] ^= key[i%4]
+		}
+	}
+	return h, payload, nil
+}
+
+// mustReadWSFrame is readWSFrame failing the test on errors
+func mustReadWSFrame(t *testing.T, conn net.Conn) (wsFrameHeader, []byte) {
+	t.Helper()
+	h, p, err := readWSFrame(conn)
+	if err != nil {
+		t.Fatalf("reading frame: %v", err)
+	}
+	return h, p
+}
+
+// relayFramePipes runs the frames relay between two pipes and returns the
+// test's ends: the client and the backend
+func relayFramePipes(t *testing.T, cfg Config) (net.Conn, net.Conn) {
+	t.Helper()
+	cfg.WebSocketRelay = WebSocketRelayFrames
+	ts := newTestServer(t, cfg, testKeys{})
+
+	client, clientSide := net.Pipe()
+	backend, backendSide := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ts.relayWebSocket(context.Background(), clientSide, backendSide)
+	}()
+	t.Cleanup(func() {
+		for _, c := range []net.Conn{client, clientSide, backend, backendSide} {
+			c.Close()
+		}
+		<-done
+	})
+	return client, backend
+}
+
+func TestWebSocketFramesPassThrough(t *testing.T) {
+	client, backend := relayFramePipes(t, Config{})
+
+	// Frames are forwarded untouched, fragmented messages included
+	go client.Write(wsFrame(wsOpText, false, true, []byte("hel")))
+	if h, p := mustReadWSFrame(t, backend); h.opcode != wsOpText || h.fin || !h.masked || string(p) != "hel" {
+		t.Fatalf("backend got opcode %d fin %v %q", h.opcode, h.fin, p)
+	}
+	go client.Write(wsFrame(wsOpContinuation, true, true, []byte("lo")))
+	if h, p := mustReadWSFrame(t, backend); h.opcode != wsOpContinuation || !h.fin || string(p) != "lo" {
+		t.Fatalf("backend got opcode %d fin %v %q", h.opcode, h.fin, p)
+	}
+
+	go backend.Write(wsFrame(wsOpBinary, true, false, []byte{0, 1, 2}))
+	if h, p := mustReadWSFrame(t, client); h.opcode != wsOpBinary || h.masked || !bytes.Equal(p, []byte{0, 1, 2}) {
+		t.Fatalf("client got opcode %d masked %v %v", h.opcode, h.masked, p)
+	}
+}
+
+// expectCloses checks that both ends are sent a close frame with code,
+// the backend's masked since the relay is its client
+func expectCloses(t *testing.T, client, backend net.Conn, code uint16) {
+	t.Helper()
+	type frame struct {
+		h   wsFrameHeader
+		p   []byte
+		err error
+	}
+	fromClient := make(chan frame, 1)
+	go func() {
+		h, p, err := readWSFrame(client)
+		fromClient <- frame{h, p, err}
+	}()
+	h, p, err := readWSFrame(backend)
+	got := map[string]frame{"backend": {h, p, err}, "client": <-fromClient}
+
+	for name, f := range got {
+		if f.err != nil {
+			t.Fatalf("%s: reading frame: %v", name, f.err)
+		}
+		if f.h.opcode != wsOpClose || len(f.p) < 2 {
+			t.Fatalf("%s got opcode %d %q, want a close frame", name, f.h.opcode, f.p)
+		}
+		if c := binary.BigEndian.Uint16(f.p); c != code {
+			t.Errorf("%s close code = %d, want %d", name, c, code)
+		}
+		if f.h.masked != (name == "backend") {
+			t.Errorf("%s close frame masked = %v", name, f.h.masked)
+		}
+	}
+}
+
+func TestWebSocketFramesCloseOnViolation(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		cfg   Config
+		frame []byte
+		code  uint16
+	}{
+		{"oversized frame", Config{WebSocketMaxFrameBytes: 4}, wsFrame(wsOpText, true, true, []byte("too long")), wsCloseMessageTooBig},
+		{"unmasked client frame", Config{}, wsFrame(wsOpText, true, false, []byte("hi")), wsCloseProtocolError},
+		{"stray continuation", Config{}, wsFrame(wsOpContinuation, true, true, []byte("hi")), wsCloseProtocolError},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			client, backend := relayFramePipes(t, tc.cfg)
+			go client.Write(tc.frame)
+			expectCloses(t, client, backend, tc.code)
+		})
+	}
+
+	t.Run("oversized message", func(t *testing.T) {
+		client, backend := relayFramePipes(t, Config{WebSocketMaxFrameBytes: 4, WebSocketMaxMessageBytes: 6})
+		go client.Write(wsFrame(wsOpText, false, true, []byte("abcd")))
+		mustReadWSFrame(t, backend)
+		go client.Write(wsFrame(wsOpContinuation, true, true, []byte("efg")))
+		expectCloses(t, client, backend, wsCloseMessageTooBig)
+	})
+}
@@ -0,0 +1,46 @@
+// Package apierror writes the API's JSON error responses. It is a leaf
+// package so that middleware outside the api package, such as the
+// authenticator, answers in the same shape as the handlers.
+package apierror
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Code identifies an API error. Codes are part of the API: clients match
+// on them, so they never change once released.
+type Code string
+
+// Codes returned by middleware outside the api package, which lists the
+// rest
+const (
+	CodeAPIKeyRequired Code = "API_KEY_REQUIRED"
+	CodeInvalidAPIKey  Code = "INVALID_API_KEY"
+	CodeInternal       Code = "INTERNAL_ERROR"
+)
+
+// Response represents an API error response. Details is a string, or a
+// list of the fields that failed validation.
+type Response struct {
+	Error   string `json:"error"`
+	Code    Code   `json:"code,omitempty"`
+	Details any    `json:"details,omitempty"`
+}
+
+// Write writes an error response
+func Write(w http.ResponseWriter, status int, code Code, message string) {
+	WriteDetails(w, status, code, message, nil)
+}
+
+// WriteDetails writes an error response with details, such as the
+// failed fields, for the client to act on
+func WriteDetails(w http.ResponseWriter, status int, code Code, message string, details any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(Response{
+		Error:   message,
+		Code:    code,
+		Details: details,
+	})
+}
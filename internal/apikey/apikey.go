@@ -0,0 +1,16 @@
+// Package apikey derives identifiers from API keys that are safe to log,
+// label metrics with and persist, so nothing but the authenticator needs
+// to hold the keys themselves
+package apikey
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// ID returns a short, non-reversible identifier for an API key. It is
+// the first 12 hex characters of the key's SHA-256 hash.
+func ID(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])[:12]
+}
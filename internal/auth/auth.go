@@ -5,8 +5,13 @@ import (
 	"crypto/subtle"
 	"log/slog"
 	"net/http"
+	"slices"
 	"strings"
-	
+	"sync"
+	"time"
+
+	"github.com/mr-karan/arbok/internal/apierror"
+	"github.com/mr-karan/arbok/internal/apikey"
 	"github.com/mr-karan/arbok/internal/metrics"
 )
 
@@ -24,25 +29,111 @@ const (
 	BearerPrefix = "Bearer "
 )
 
+// deprecationWarnInterval limits how often use of a deprecated or expired
+// key is logged, per key
+const deprecationWarnInterval = time.Hour
+
 // Authenticator handles API authentication
 type Authenticator struct {
-	keys   map[string]bool
-	logger *slog.Logger
+	// keys maps each valid key to the time it stops being accepted; the
+	// zero time means never
+	keys    map[string]time.Time
+	logger  *slog.Logger
+	metrics *metrics.Metrics
+
+	// adminKeys may use admin-scoped endpoints such as listing every
+	// tunnel. When empty, admin endpoints are refused unless no keys are
+	// configured at all.
+	adminKeys map[string]bool
+
+	// now is the clock used for key expiry
+	now func() time.Time
+
+	// warned records when a warning about a key's use was last logged,
+	// by kind of warning and key ID. Only configured keys are warned
+	// about, which bounds its size.
+	warnMu sync.Mutex
+	warned map[string]time.Time
+
+	// allowQueryKey accepts keys in the api_key query parameter, which
+	// ends up in access logs and browser history
+	allowQueryKey bool
 }
 
-// New creates a new authenticator
-func New(apiKeys []string, logger *slog.Logger) *Authenticator {
-	keys := make(map[string]bool, len(apiKeys))
-	for _, key := range apiKeys {
-		if key != "" {
-			keys[key] = true
+// ParseKey splits a configured key of the form key@RFC3339 into the key
+// and the time it expires. Keys without a valid timestamp suffix are
+// returned whole and never expire.
+func ParseKey(entry string) (string, time.Time) {
+	if i := strings.LastIndexByte(entry, '@'); i > 0 {
+		if expires, err := time.Parse(time.RFC3339, entry[i+1:]); err == nil {
+			return entry[:i], expires
 		}
 	}
-	
+	return entry, time.Time{}
+}
+
+// New creates a new authenticator. Admin keys are valid API keys too.
+// Keys written as key@RFC3339 are deprecated: they keep working, with a
+// warning, until that time so clients can move to a rotated key. Per-key
+// usage is recorded to m.
+func New(apiKeys, adminKeys []string, m *metrics.Metrics, logger *slog.Logger) *Authenticator {
+	keys := make(map[string]time.Time, len(apiKeys)+len(adminKeys))
+	admins := make(map[string]bool, len(adminKeys))
+	for _, entry := range adminKeys {
+		if key, _ := ParseKey(entry); key != "" {
+			admins[key] = true
+		}
+	}
+	for _, entry := range slices.Concat(apiKeys, adminKeys) {
+		key, expires := ParseKey(entry)
+		if key == "" {
+			continue
+		}
+		keys[key] = expires
+		if !expires.IsZero() {
+			logger.Info("API key is deprecated",
+				slog.String("key_id", apikey.ID(key)), slog.Time("expires", expires))
+		}
+
+		// Register per-key series up front so they're exported at zero
+		m.KeyRequests(apikey.ID(key))
+		m.KeyTunnelsCreated(apikey.ID(key))
+	}
+
+	if len(keys) > 0 && len(admins) == 0 {
+		logger.Warn("no admin keys configured, admin endpoints are disabled")
+	}
+
 	return &Authenticator{
-		keys:   keys,
-		logger: logger,
+		keys:      keys,
+		adminKeys: admins,
+		logger:    logger,
+		metrics:   m,
+		now:       time.Now,
+		warned:    make(map[string]time.Time),
+	}
+}
+
+// AllowQueryKey makes the authenticator accept keys passed as the api_key
+// query parameter, for legacy clients. Such use is logged as deprecated.
+func (a *Authenticator) AllowQueryKey(allow bool) {
+	a.allowQueryKey = allow
+}
+
+// IsAdmin reports whether the request context carries admin scope. In
+// open mode, with no keys at all, everyone is an admin; otherwise only
+// admin keys are, so without any admin endpoints are refused.
+func (a *Authenticator) IsAdmin(ctx context.Context) bool {
+	if len(a.keys) == 0 {
+		return true
 	}
+	key, _ := GetAPIKey(ctx)
+	for adminKey := range a.adminKeys {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(adminKey)) == 1 {
+			return true
+		}
+	}
+	return false
 }
 
 // Middleware returns HTTP middleware for authentication
@@ -59,60 +150,109 @@ func (a *Authenticator) Middleware(next http.Handler) http.Handler {
 			next.ServeHTTP(w, r)
 			return
 		}
-		
-		apiKey := a.extractAPIKey(r)
+
+		apiKey, fromQuery := a.extractAPIKey(r)
 		if apiKey == "" {
-			metrics.AuthFailures.Inc()
-			http.Error(w, "Missing API key", http.StatusUnauthorized)
+			a.metrics.AuthFailures.Inc()
+			apierror.Write(w, http.StatusUnauthorized, apierror.CodeAPIKeyRequired, "Missing API key")
 			return
 		}
 		
 		if !a.isValidKey(apiKey) {
-			metrics.AuthFailures.Inc()
+			a.metrics.AuthFailures.Inc()
 			a.logger.Warn("invalid API key attempt", slog.String("ip", r.RemoteAddr))
-			http.Error(w, "Invalid API key", http.StatusUnauthorized)
+			apierror.Write(w, http.StatusUnauthorized, apierror.CodeInvalidAPIKey, "Invalid API key")
 			return
 		}
-		
-		metrics.AuthSuccesses.Inc()
-		
+
+		if fromQuery && a.shouldWarn("query", apiKey) {
+			a.logger.Warn("API key passed as query parameter is deprecated, send the X-API-Key header",
+				slog.String("key_id", apikey.ID(apiKey)), slog.String("path", r.URL.Path))
+		}
+
+		a.metrics.AuthSuccesses.Inc()
+		a.metrics.KeyRequests(apikey.ID(apiKey)).Inc()
+
 		// Add API key to context
 		ctx := context.WithValue(r.Context(), ContextKeyAPIKey, apiKey)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
-// extractAPIKey extracts the API key from the request
-func (a *Authenticator) extractAPIKey(r *http.Request) string {
+// extractAPIKey extracts the API key from the request, reporting whether
+// it came from the query string
+func (a *Authenticator) extractAPIKey(r *http.Request) (string, bool) {
 	// Check header first
 	if key := r.Header.Get(HeaderAPIKey); key != "" {
-		return key
+		return key, false
 	}
 	
 	// Check Authorization header with Bearer token
 	if auth := r.Header.Get("Authorization"); auth != "" {
 		if strings.HasPrefix(auth, BearerPrefix) {
-			return strings.TrimPrefix(auth, BearerPrefix)
+			return strings.TrimPrefix(auth, BearerPrefix), false
 		}
 	}
-	
-	// Check query parameter as fallback
-	return r.URL.Query().Get("api_key")
+
+	// Check query parameter as fallback, when allowed
+	if !a.allowQueryKey {
+		return "", false
+	}
+	key := r.URL.Query().Get("api_key")
+	return key, key != ""
 }
 
-// isValidKey checks if the API key is valid using constant-time comparison
+// isValidKey checks if the API key is valid using constant-time
+// comparison. Deprecated keys are valid until they expire.
 func (a *Authenticator) isValidKey(key string) bool {
 	// Use constant-time comparison to prevent timing attacks
-	for validKey := range a.keys {
+	for validKey, expires := range a.keys {
 		if subtle.ConstantTimeCompare([]byte(key), []byte(validKey)) == 1 {
+			if expires.IsZero() {
+				return true
+			}
+			if !a.now().Before(expires) {
+				if a.shouldWarn("expired", key) {
+					a.logger.Warn("expired API key rejected",
+						slog.String("key_id", apikey.ID(key)), slog.Time("expired", expires))
+				}
+				return false
+			}
+			a.warnDeprecated(key, expires)
 			return true
 		}
 	}
 	return false
 }
 
+// warnDeprecated logs use of a deprecated key, at most once per
+// deprecationWarnInterval per key
+func (a *Authenticator) warnDeprecated(key string, expires time.Time) {
+	if !a.shouldWarn("deprecated", key) {
+		return
+	}
+	a.logger.Warn("deprecated API key used, switch to its replacement",
+		slog.String("key_id", apikey.ID(key)), slog.Time("expires", expires))
+}
+
+// shouldWarn reports whether a warning of kind about key is due, at most
+// once per deprecationWarnInterval, and records it as given
+func (a *Authenticator) shouldWarn(kind, key string) bool {
+	now := a.now()
+	name := kind + ":" + apikey.ID(key)
+
+	a.warnMu.Lock()
+	defer a.warnMu.Unlock()
+
+	if last, seen := a.warned[name]; seen && now.Sub(last) < deprecationWarnInterval {
+		return false
+	}
+	a.warned[name] = now
+	return true
+}
+
 // GetAPIKey retrieves the API key from the request context
 func GetAPIKey(ctx context.Context) (string, bool) {
 	key, ok := ctx.Value(ContextKeyAPIKey).(string)
 	return key, ok
-}
\ No newline at end of file
+}
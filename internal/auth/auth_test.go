@@ -0,0 +1,243 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mr-karan/arbok/internal/apierror"
+	"github.com/mr-karan/arbok/internal/apikey"
+	"github.com/mr-karan/arbok/internal/metrics"
+)
+
+// newTestAuthenticator creates an authenticator that logs nowhere
+func newTestAuthenticator(apiKeys, adminKeys []string) *Authenticator {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	return New(apiKeys, adminKeys, metrics.New(""), logger)
+}
+
+// withKey returns a context carrying key as the request's API key
+func withKey(key string) context.Context {
+	return context.WithValue(context.Background(), ContextKeyAPIKey, key)
+}
+
+func TestIsAdmin(t *testing.T) {
+	tests := []struct {
+		name      string
+		apiKeys   []string
+		adminKeys []string
+		key       string
+		want      bool
+	}{
+		{"open mode", nil, nil, "", true},
+		{"no admin keys configured", []string{"k1"}, nil, "k1", false},
+		{"admin key", []string{"k1"}, []string{"admin"}, "admin", true},
+		{"non-admin key", []string{"k1"}, []string{"admin"}, "k1", false},
+		{"admin keys only", nil, []string{"admin"}, "admin", true},
+		{"no key with keys configured", []string{"k1"}, []string{"admin"}, "", false},
+		{"deprecated admin key", nil, []string{"admin@2999-01-01T00:00:00Z"}, "admin", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newTestAuthenticator(tt.apiKeys, tt.adminKeys)
+			if got := a.IsAdmin(withKey(tt.key)); got != tt.want {
+				t.Errorf("IsAdmin(%q) = %v, want %v", tt.key, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMiddlewareErrorsAreJSON(t *testing.T) {
+	a := newTestAuthenticator([]string{"good"}, nil)
+	handler := a.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	tests := []struct {
+		name string
+		key  string
+		want int
+		code apierror.Code
+	}{
+		{"missing key", "", http.StatusUnauthorized, apierror.CodeAPIKeyRequired},
+		{"invalid key", "wrong", http.StatusUnauthorized, apierror.CodeInvalidAPIKey},
+		{"valid key", "good", http.StatusNoContent, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/api/tunnels", nil)
+			if tt.key != "" {
+				r.Header.Set(HeaderAPIKey, tt.key)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d", w.Code, tt.want)
+			}
+			if tt.code == "" {
+				return
+			}
+			var resp apierror.Response
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("body %q is not JSON: %v", w.Body, err)
+			}
+			if resp.Code != tt.code || w.Header().Get("Content-Type") != "application/json" {
+				t.Errorf("error code = %q (%s), want %q as JSON", resp.Code, w.Header().Get("Content-Type"), tt.code)
+			}
+		})
+	}
+}
+
+func TestKeyRequestsLabeledPerKey(t *testing.T) {
+	m := metrics.New("")
+	a := New([]string{"k1", "k2"}, nil, m, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	handler := a.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for _, key := range []string{"k1", "k2", "k2"} {
+		r := httptest.NewRequest(http.MethodGet, "/api/tunnels", nil)
+		r.Header.Set(HeaderAPIKey, key)
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+	}
+
+	w := httptest.NewRecorder()
+	m.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	out := w.Body.String()
+	for key, want := range map[string]int{"k1": 1, "k2": 2} {
+		series := fmt.Sprintf(`arbok_key_requests_total{key_id=%q} %d`, apikey.ID(key), want)
+		if !strings.Contains(out, series) {
+			t.Errorf("metrics lack %s", series)
+		}
+	}
+	if strings.Contains(out, `key_id="k1"`) || strings.Contains(out, `key_id="k2"`) {
+		t.Error("metrics expose raw API keys")
+	}
+}
+
+func TestQueryKeyOptIn(t *testing.T) {
+	var logs bytes.Buffer
+	a := New([]string{"k1"}, nil, metrics.New(""), slog.New(slog.NewTextHandler(&logs, nil)))
+	handler := a.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	query := func(key string) int {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/tunnels?api_key="+key, nil))
+		return w.Code
+	}
+
+	if code := query("k1"); code != http.StatusUnauthorized {
+		t.Errorf("query key by default = %d, want %d", code, http.StatusUnauthorized)
+	}
+
+	a.AllowQueryKey(true)
+	for range 2 {
+		if code := query("k1"); code != http.StatusNoContent {
+			t.Fatalf("query key when allowed = %d, want %d", code, http.StatusNoContent)
+		}
+	}
+	if n := strings.Count(logs.String(), "passed as query parameter is deprecated"); n != 1 {
+		t.Errorf("query key use logged %d times, want once", n)
+	}
+
+	// Unknown keys are rejected without a deprecation warning, and
+	// aren't remembered
+	for i := range 10 {
+		if code := query(fmt.Sprintf("junk%d", i)); code != http.StatusUnauthorized {
+			t.Fatalf("unknown query key = %d, want %d", code, http.StatusUnauthorized)
+		}
+	}
+	if n := strings.Count(logs.String(), "passed as query parameter is deprecated"); n != 1 {
+		t.Errorf("query key use logged %d times after unknown keys, want once", n)
+	}
+	if len(a.warned) != 1 {
+		t.Errorf("%d warnings remembered, want only the valid key's", len(a.warned))
+	}
+}
+
+func TestFormBodyNotReadForKey(t *testing.T) {
+	a := New([]string{"k1"}, nil, metrics.New(""), slog.New(slog.NewTextHandler(io.Discard, nil)))
+	handler := a.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if string(body) != "api_key=k1" {
+			t.Errorf("handler read body %q, want it untouched", body)
+		}
+	}))
+
+	r := httptest.NewRequest(http.MethodPost, "/api/tunnel/3000", strings.NewReader("api_key=k1"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("key in a form body = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+
+	r = httptest.NewRequest(http.MethodPost, "/api/tunnel/3000", strings.NewReader("api_key=k1"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set(HeaderAPIKey, "k1")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+}
+
+func TestDeprecatedKeyValidUntilExpiry(t *testing.T) {
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&logs, nil))
+	a := New([]string{"old@2024-12-31T00:00:00Z", "new"}, nil, metrics.New(""), logger)
+	expiry := time.Date(2024, 12, 31, 0, 0, 0, 0, time.UTC)
+
+	now := expiry.Add(-time.Hour)
+	a.now = func() time.Time { return now }
+	for range 3 {
+		if !a.isValidKey("old") {
+			t.Fatal("deprecated key rejected before its expiry")
+		}
+	}
+	if n := strings.Count(logs.String(), "deprecated API key used"); n != 1 {
+		t.Errorf("deprecation logged %d times, want once", n)
+	}
+
+	now = expiry
+	for range 3 {
+		if a.isValidKey("old") {
+			t.Fatal("deprecated key accepted after its expiry")
+		}
+	}
+	if n := strings.Count(logs.String(), "expired API key rejected"); n != 1 {
+		t.Errorf("expired key logged %d times, want once per %v", n, deprecationWarnInterval)
+	}
+	if !a.isValidKey("new") {
+		t.Error("replacement key rejected")
+	}
+
+	now = now.Add(deprecationWarnInterval)
+	a.isValidKey("old")
+	if n := strings.Count(logs.String(), "expired API key rejected"); n != 2 {
+		t.Errorf("expired key logged %d times an interval later, want 2", n)
+	}
+}
+
+func TestParseKey(t *testing.T) {
+	tests := []struct {
+		entry   string
+		key     string
+		expires time.Time
+	}{
+		{"plain", "plain", time.Time{}},
+		{"old@2024-12-31T00:00:00Z", "old", time.Date(2024, 12, 31, 0, 0, 0, 0, time.UTC)},
+		{"a@b@2024-12-31T00:00:00Z", "a@b", time.Date(2024, 12, 31, 0, 0, 0, 0, time.UTC)},
+		{"user@example.com", "user@example.com", time.Time{}},
+		{"@2024-12-31T00:00:00Z", "@2024-12-31T00:00:00Z", time.Time{}},
+	}
+	for _, tt := range tests {
+		key, expires := ParseKey(tt.entry)
+		if key != tt.key || !expires.Equal(tt.expires) {
+			t.Errorf("ParseKey(%q) = %q, %v; want %q, %v", tt.entry, key, expires, tt.key, tt.expires)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package auth
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// minLimiterIdleTTL is the least time an unused limiter is kept
+const minLimiterIdleTTL = 10 * time.Minute
+
+// RateLimiter is a per-key token bucket limiter
+type RateLimiter struct {
+	rps   rate.Limit
+	burst int
+	// idleTTL is how long an unused limiter is kept. It's at least the
+	// time to refill a full bucket, so dropping one changes nothing.
+	idleTTL time.Duration
+
+	mu        sync.Mutex
+	limiters  map[string]*keyLimiter
+	lastSweep time.Time
+}
+
+type keyLimiter struct {
+	limiter  *rate.Limiter
+	lastUsed time.Time
+}
+
+// NewRateLimiter creates a limiter allowing rps events per second per key,
+// with bursts of up to burst events
+func NewRateLimiter(rps float64, burst int) *RateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	idleTTL := minLimiterIdleTTL
+	if refill := time.Duration(float64(burst) / rps * float64(time.Second)); refill > idleTTL {
+		idleTTL = refill
+	}
+	return &RateLimiter{
+		rps:       rate.Limit(rps),
+		burst:     burst,
+		idleTTL:   idleTTL,
+		limiters:  make(map[string]*keyLimiter),
+		lastSweep: time.Now(),
+	}
+}
+
+// Allow reports whether an event for key may happen now. If not, it
+// returns how long until the next token is available.
+func (l *RateLimiter) Allow(key string) (bool, time.Duration) {
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sweepLocked(now)
+
+	kl, ok := l.limiters[key]
+	if !ok {
+		kl = &keyLimiter{limiter: rate.NewLimiter(l.rps, l.burst)}
+		l.limiters[key] = kl
+	}
+	kl.lastUsed = now
+
+	res := kl.limiter.ReserveN(now, 1)
+	if delay := res.DelayFrom(now); delay > 0 {
+		res.CancelAt(now)
+		return false, delay
+	}
+	return true, 0
+}
+
+// sweepLocked drops limiters idle for longer than idleTTL. It runs at
+// most once per TTL so the cost is amortized across calls.
+func (l *RateLimiter) sweepLocked(now time.Time) {
+	if now.Sub(l.lastSweep) < l.idleTTL {
+		return
+	}
+	l.lastSweep = now
+	for key, kl := range l.limiters {
+		if now.Sub(kl.lastUsed) > l.idleTTL {
+			delete(l.limiters, key)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiterPerKey(t *testing.T) {
+	l := NewRateLimiter(0.1, 2)
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.Allow("a"); !ok {
+			t.Fatalf("event %d within the burst was limited", i)
+		}
+	}
+	ok, wait := l.Allow("a")
+	if ok {
+		t.Fatal("event past the burst was allowed")
+	}
+	if wait <= 0 || wait > 10*time.Second {
+		t.Errorf("wait = %v, want up to the 10s refill of one token", wait)
+	}
+
+	if ok, _ := l.Allow("b"); !ok {
+		t.Error("another key was limited")
+	}
+}
+
+func TestRateLimiterEvictsIdle(t *testing.T) {
+	l := NewRateLimiter(1, 1)
+	l.Allow("idle")
+	l.Allow("busy")
+
+	// Both were last used long ago; only busy is used again
+	past := time.Now().Add(-2 * l.idleTTL)
+	for _, kl := range l.limiters {
+		kl.lastUsed = past
+	}
+	l.lastSweep = past
+	l.Allow("busy")
+
+	if _, ok := l.limiters["idle"]; ok {
+		t.Error("idle limiter kept")
+	}
+	if _, ok := l.limiters["busy"]; !ok {
+		t.Error("limiter in use evicted")
+	}
+}
+
+func TestRateLimiterIdleTTLCoversRefill(t *testing.T) {
+	// A full bucket of 100 at 0.01/s takes almost three hours to refill
+	l := NewRateLimiter(0.01, 100)
+	if want := 10000 * time.Second; l.idleTTL < want {
+		t.Errorf("idleTTL = %v, want at least the %v refill", l.idleTTL, want)
+	}
+}
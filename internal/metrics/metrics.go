@@ -3,50 +3,209 @@ package metrics
 import (
 	"fmt"
 	"net/http"
+	"regexp"
+	"sync"
 
 	"github.com/VictoriaMetrics/metrics"
 )
 
-var (
+// DefaultPrefix is the metric name prefix used when none is configured
+const DefaultPrefix = "arbok"
+
+// prefixPattern is what a prefix may look like, so that prefixed names
+// stay valid Prometheus metric names
+var prefixPattern = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+// ValidPrefix reports whether prefix can start Prometheus metric names
+func ValidPrefix(prefix string) bool {
+	return prefixPattern.MatchString(prefix)
+}
+
+// Metrics holds the server's metrics, every name starting with the
+// prefix it was created with, e.g. arbok_tunnels_active. Each instance
+// has its own registry, exported by its Handler.
+type Metrics struct {
+	prefix string
+	set    *metrics.Set
+
 	// Tunnel metrics
-	TunnelsActive   = metrics.NewGauge(`arbok_tunnels_active`, nil)
-	TunnelsCreated  = metrics.NewCounter(`arbok_tunnels_created_total`)
-	TunnelsDeleted  = metrics.NewCounter(`arbok_tunnels_deleted_total`)
-	TunnelsExpired  = metrics.NewCounter(`arbok_tunnels_expired_total`)
-	
+	TunnelsActive  *metrics.Gauge
+	TunnelsCreated *metrics.Counter
+	TunnelsDeleted *metrics.Counter
+	TunnelsExpired *metrics.Counter
+	TunnelsRevoked *metrics.Counter
+	TunnelsFlagged *metrics.Counter
+
+	// Cleanup loop metrics
+	CleanupLastRun  *metrics.Gauge
+	CleanupDuration *metrics.Histogram
+	CleanupPanics   *metrics.Counter
+
 	// HTTP metrics
-	HTTPRequestsTotal = metrics.NewCounter(`arbok_http_requests_total`)
-	HTTPRequestDuration = metrics.NewHistogram(`arbok_http_request_duration_seconds`)
-	HTTPBytesProxied = metrics.NewCounter(`arbok_http_bytes_proxied_total`)
-	
+	HTTPRequestsTotal    *metrics.Counter
+	HTTPRequestDuration  *metrics.Histogram
+	HTTPBytesProxied     *metrics.Counter
+	ProxyLoopsDetected   *metrics.Counter
+	WebSocketLimitCloses *metrics.Counter
+	FairQueueTimeouts    *metrics.Counter
+
 	// WireGuard metrics
-	WireGuardPeersActive = metrics.NewGauge(`arbok_wireguard_peers_active`, nil)
-	WireGuardErrors = metrics.NewCounter(`arbok_wireguard_errors_total`)
-	
+	WireGuardPeersActive *metrics.Gauge
+	WireGuardErrors      *metrics.Counter
+
 	// IP pool metrics
-	IPPoolAvailable = metrics.NewGauge(`arbok_ip_pool_available`, nil)
-	IPPoolExhausted = metrics.NewCounter(`arbok_ip_pool_exhausted_total`)
-	
+	IPPoolAvailable *metrics.Gauge
+	IPPoolExhausted *metrics.Counter
+
 	// Auth metrics
-	AuthFailures = metrics.NewCounter(`arbok_auth_failures_total`)
-	AuthSuccesses = metrics.NewCounter(`arbok_auth_successes_total`)
-)
+	AuthFailures      *metrics.Counter
+	AuthSuccesses     *metrics.Counter
+	CreateRateLimited *metrics.Counter
+	ProvisionsShed    *metrics.Counter
+
+	// requestDuration is the request latency histogram with trace
+	// exemplars exposed in OpenMetrics format
+	requestDuration *exemplarHistogram
 
-// Handler returns the metrics handler for Prometheus scraping
-func Handler() http.HandlerFunc {
+	// httpSeries are the labeled request counters created so far
+	httpSeriesMu sync.Mutex
+	httpSeries   map[string]struct{}
+}
+
+// maxHTTPSeries bounds the labeled request counters; requests for
+// further paths are counted under otherPath
+const maxHTTPSeries = 1000
+
+const otherPath = "other"
+
+// New creates the metrics with names starting with prefix and an
+// underscore; an empty prefix means DefaultPrefix. Callers validate
+// configured prefixes with ValidPrefix.
+func New(prefix string) *Metrics {
+	if prefix == "" {
+		prefix = DefaultPrefix
+	}
+	m := &Metrics{
+		prefix:          prefix,
+		set:             metrics.NewSet(),
+		requestDuration: newExemplarHistogram(),
+		httpSeries:      make(map[string]struct{}),
+	}
+
+	m.TunnelsActive = m.set.NewGauge(m.name("tunnels_active"), nil)
+	m.TunnelsCreated = m.set.NewCounter(m.name("tunnels_created_total"))
+	m.TunnelsDeleted = m.set.NewCounter(m.name("tunnels_deleted_total"))
+	m.TunnelsExpired = m.set.NewCounter(m.name("tunnels_expired_total"))
+	m.TunnelsRevoked = m.set.NewCounter(m.name("tunnels_revoked_total"))
+	m.TunnelsFlagged = m.set.NewCounter(m.name("tunnels_flagged_total"))
+
+	m.CleanupLastRun = m.set.NewGauge(m.name("cleanup_last_run_timestamp"), nil)
+	m.CleanupDuration = m.set.NewHistogram(m.name("cleanup_duration_seconds"))
+	m.CleanupPanics = m.set.NewCounter(m.name("cleanup_panics_total"))
+
+	m.HTTPRequestsTotal = m.set.NewCounter(m.name("http_requests_total"))
+	m.HTTPRequestDuration = m.set.NewHistogram(m.requestDurationName())
+	m.HTTPBytesProxied = m.set.NewCounter(m.name("http_bytes_proxied_total"))
+	m.ProxyLoopsDetected = m.set.NewCounter(m.name("proxy_loops_detected_total"))
+	m.WebSocketLimitCloses = m.set.NewCounter(m.name("websocket_limit_closes_total"))
+	m.FairQueueTimeouts = m.set.NewCounter(m.name("fair_queue_timeouts_total"))
+
+	m.WireGuardPeersActive = m.set.NewGauge(m.name("wireguard_peers_active"), nil)
+	m.WireGuardErrors = m.set.NewCounter(m.name("wireguard_errors_total"))
+
+	m.IPPoolAvailable = m.set.NewGauge(m.name("ip_pool_available"), nil)
+	m.IPPoolExhausted = m.set.NewCounter(m.name("ip_pool_exhausted_total"))
+
+	m.AuthFailures = m.set.NewCounter(m.name("auth_failures_total"))
+	m.AuthSuccesses = m.set.NewCounter(m.name("auth_successes_total"))
+	m.CreateRateLimited = m.set.NewCounter(m.name("create_rate_limited_total"))
+	m.ProvisionsShed = m.set.NewCounter(m.name("provisions_shed_total"))
+	return m
+}
+
+// name returns the full name of a metric, e.g. arbok_tunnels_active
+func (m *Metrics) name(name string) string {
+	return m.prefix + "_" + name
+}
+
+// Handler returns the metrics handler for Prometheus scraping, with Go
+// runtime and process metrics too. Scrapers asking for OpenMetrics get
+// request latency exemplars as well.
+func (m *Metrics) Handler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		metrics.WritePrometheus(w, true)
+		if acceptsOpenMetrics(r.Header.Get("Accept")) {
+			w.Header().Set("Content-Type", OpenMetricsContentType)
+			m.WriteOpenMetrics(w)
+			return
+		}
+		m.set.WritePrometheus(w)
+		metrics.WriteProcessMetrics(w)
+	}
+}
+
+// RecordHTTPRequest records HTTP request metrics. traceID, when known,
+// becomes an exemplar on the request duration histogram.
+func (m *Metrics) RecordHTTPRequest(method, path string, statusCode int, duration float64, traceID string) {
+	m.HTTPRequestsTotal.Inc()
+	m.HTTPRequestDuration.Update(duration)
+	m.requestDuration.observe(duration, traceID)
+
+	m.httpRequests(method, path, statusCode).Inc()
+}
+
+// httpRequests returns the labeled request counter. Paths come from
+// clients, so past maxHTTPSeries series new ones are counted under
+// path="other" instead of growing the registry without bound.
+func (m *Metrics) httpRequests(method, path string, statusCode int) *metrics.Counter {
+	name := m.httpRequestsName(method, path, statusCode)
+
+	m.httpSeriesMu.Lock()
+	defer m.httpSeriesMu.Unlock()
+
+	if _, ok := m.httpSeries[name]; !ok {
+		if len(m.httpSeries) >= maxHTTPSeries {
+			name = m.httpRequestsName(method, otherPath, statusCode)
+		} else {
+			m.httpSeries[name] = struct{}{}
+		}
 	}
+	return m.set.GetOrCreateCounter(name)
+}
+
+func (m *Metrics) httpRequestsName(method, path string, statusCode int) string {
+	return fmt.Sprintf(`%s{method=%q,path=%q,status="%d"}`, m.name("http_requests_total"), method, path, statusCode)
+}
+
+// KeyRequests returns the authenticated request counter for an API key id.
+// Callers must only pass ids of configured keys to keep cardinality bounded.
+func (m *Metrics) KeyRequests(keyID string) *metrics.Counter {
+	return m.set.GetOrCreateCounter(fmt.Sprintf(`%s{key_id=%q}`, m.name("key_requests_total"), keyID))
+}
+
+// TunnelThrottled returns the counter of requests to a tunnel rejected by
+// its request rate limit, by subdomain and domain since subdomains repeat
+// across domains
+func (m *Metrics) TunnelThrottled(subdomain, domain string) *metrics.Counter {
+	return m.set.GetOrCreateCounter(m.tunnelThrottledName(subdomain, domain))
+}
+
+// ForgetTunnelThrottled drops a removed tunnel's throttling counter so
+// per-tunnel series don't pile up
+func (m *Metrics) ForgetTunnelThrottled(subdomain, domain string) {
+	m.set.UnregisterMetric(m.tunnelThrottledName(subdomain, domain))
+}
+
+func (m *Metrics) tunnelThrottledName(subdomain, domain string) string {
+	return fmt.Sprintf(`%s{subdomain=%q,domain=%q}`, m.name("tunnel_throttled_total"), subdomain, domain)
 }
 
-// RecordHTTPRequest records HTTP request metrics
-func RecordHTTPRequest(method, path string, statusCode int, duration float64) {
-	HTTPRequestsTotal.Inc()
-	HTTPRequestDuration.Update(duration)
-	
-	// You can also use labeled metrics if needed
-	counter := metrics.GetOrCreateCounter(
-		fmt.Sprintf(`arbok_http_requests_total{method=%q,path=%q,status="%d"}`, 
-			method, path, statusCode))
-	counter.Inc()
-}
\ No newline at end of file
+// WebSocketMessages returns the counter of WebSocket messages relayed from
+// direction ("client" or "backend") by the frames relay
+func (m *Metrics) WebSocketMessages(direction string) *metrics.Counter {
+	return m.set.GetOrCreateCounter(fmt.Sprintf(`%s{from=%q}`, m.name("websocket_messages_total"), direction))
+}
+
+// KeyTunnelsCreated returns the tunnel creation counter for an API key id
+func (m *Metrics) KeyTunnelsCreated(keyID string) *metrics.Counter {
+	return m.set.GetOrCreateCounter(fmt.Sprintf(`%s{key_id=%q}`, m.name("key_tunnels_created_total"), keyID))
+}
@@ -0,0 +1,151 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// series returns the sample lines of the metrics' own registry
+func series(m *Metrics) []string {
+	var buf bytes.Buffer
+	m.set.WritePrometheus(&buf)
+	var lines []string
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if line != "" && !strings.HasPrefix(line, "#") {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+func TestMetricsUseConfiguredPrefix(t *testing.T) {
+	tests := []struct {
+		prefix string
+		want   string
+	}{
+		{"", "arbok_"},
+		{"edge_tunnels", "edge_tunnels_"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			m := New(tt.prefix)
+			m.TunnelsCreated.Inc()
+			m.RecordHTTPRequest("GET", "/", 200, 0.01, "trace")
+			m.KeyRequests("abc").Inc()
+			m.TunnelThrottled("app", "example.com").Inc()
+
+			lines := series(m)
+			if len(lines) == 0 {
+				t.Fatal("no metrics written")
+			}
+			for _, line := range lines {
+				if !strings.HasPrefix(line, tt.want) {
+					t.Errorf("metric %q lacks prefix %q", line, tt.want)
+				}
+			}
+
+			var open bytes.Buffer
+			m.WriteOpenMetrics(&open)
+			if !strings.Contains(open.String(), tt.want+"http_request_duration_seconds_bucket") {
+				t.Errorf("OpenMetrics output lacks the prefixed histogram:\n%s", open.String())
+			}
+		})
+	}
+}
+
+// Each Metrics has its own registry, so a fresh New gives tests what
+// a reset of shared globals used to: no panics on registering the same
+// names again and no series left over from earlier records.
+func TestNewStartsWithCleanRegistry(t *testing.T) {
+	m := New("")
+	for i := range 2 * maxHTTPSeries {
+		m.RecordHTTPRequest("GET", fmt.Sprintf("/path/%d", i), 200, 0.01, "")
+	}
+	requests := 0
+	for _, line := range series(m) {
+		if strings.HasPrefix(line, "arbok_http_requests_total{") {
+			requests++
+		}
+	}
+	// Past the cap, new paths share the "other" series
+	if requests != maxHTTPSeries+1 {
+		t.Errorf("%d labeled request series, want %d", requests, maxHTTPSeries+1)
+	}
+	other := fmt.Sprintf(`arbok_http_requests_total{method="GET",path=%q,status="200"} %d`, otherPath, maxHTTPSeries)
+	if !slices.Contains(series(m), other) {
+		t.Errorf("overflow requests not counted as %s", other)
+	}
+
+	fresh := New("")
+	for _, line := range series(fresh) {
+		if strings.HasPrefix(line, "arbok_http_requests_total{") {
+			t.Fatalf("fresh metrics hold an earlier series: %s", line)
+		}
+		if !strings.HasSuffix(line, " 0") {
+			t.Errorf("fresh metric is not zero: %s", line)
+		}
+	}
+}
+
+func TestOpenMetricsExemplars(t *testing.T) {
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	m := New("")
+	m.RecordHTTPRequest("GET", "/", 200, 0.003, traceID)
+	m.RecordHTTPRequest("GET", "/", 200, 0.7, "")
+
+	scrape := func(accept string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		if accept != "" {
+			r.Header.Set("Accept", accept)
+		}
+		w := httptest.NewRecorder()
+		m.Handler()(w, r)
+		return w
+	}
+
+	w := scrape("application/openmetrics-text; version=1.0.0,text/plain;q=0.5")
+	if ct := w.Header().Get("Content-Type"); ct != OpenMetricsContentType {
+		t.Errorf("Content-Type = %q, want %q", ct, OpenMetricsContentType)
+	}
+	out := w.Body.String()
+	traced := `arbok_http_request_duration_seconds_bucket{le="0.005"} 1 # {trace_id="` + traceID + `"} 0.003 `
+	if !strings.Contains(out, traced) {
+		t.Errorf("OpenMetrics output lacks the exemplar %q:\n%s", traced, out)
+	}
+	// The untraced observation has no exemplar
+	if !strings.Contains(out, "arbok_http_request_duration_seconds_bucket{le=\"1\"} 2\n") {
+		t.Errorf("bucket of the untraced observation is wrong or has an exemplar:\n%s", out)
+	}
+	if !strings.HasSuffix(out, "# EOF\n") {
+		t.Error("OpenMetrics output doesn't end with # EOF")
+	}
+
+	// Plain Prometheus scrapes get no exemplars
+	if out := scrape("").Body.String(); strings.Contains(out, "trace_id") {
+		t.Errorf("Prometheus output has exemplars:\n%s", out)
+	}
+}
+
+func TestTunnelThrottledBySubdomain(t *testing.T) {
+	m := New("")
+	m.TunnelThrottled("app", "team1.com").Inc()
+	m.TunnelThrottled("app", "team2.com").Add(2)
+
+	// Dropping one tunnel's series keeps the other's
+	m.ForgetTunnelThrottled("app", "team1.com")
+	lines := series(m)
+	want := `arbok_tunnel_throttled_total{subdomain="app",domain="team2.com"} 2`
+	if !slices.Contains(lines, want) {
+		t.Errorf("series = %q, want %q", lines, want)
+	}
+	for _, line := range lines {
+		if strings.Contains(line, "team1") {
+			t.Errorf("forgotten series %q still written", line)
+		}
+	}
+}
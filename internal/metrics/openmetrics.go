@@ -0,0 +1,126 @@
+package metrics
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+)
+
+// OpenMetricsContentType is the content type of WriteOpenMetrics output
+const OpenMetricsContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+
+// requestDurationBuckets are the upper bounds of the classic histogram
+// exposed in OpenMetrics format. VictoriaMetrics histograms use vmrange
+// buckets, which have no place for exemplars.
+var requestDurationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, math.Inf(1)}
+
+// exemplar links an observation to the trace it came from
+type exemplar struct {
+	traceID string
+	value   float64
+	ts      time.Time
+}
+
+// exemplarHistogram is a classic histogram remembering the most recent
+// traced observation per bucket
+type exemplarHistogram struct {
+	mu        sync.Mutex
+	counts    []uint64
+	exemplars []*exemplar
+	sum       float64
+	count     uint64
+}
+
+func newExemplarHistogram() *exemplarHistogram {
+	return &exemplarHistogram{
+		counts:    make([]uint64, len(requestDurationBuckets)),
+		exemplars: make([]*exemplar, len(requestDurationBuckets)),
+	}
+}
+
+// requestDurationName is the histogram that carries exemplars
+func (m *Metrics) requestDurationName() string {
+	return m.name("http_request_duration_seconds")
+}
+
+// observe records a value, keeping it as the bucket's exemplar when a
+// trace ID is known
+func (h *exemplarHistogram) observe(v float64, traceID string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, le := range requestDurationBuckets {
+		if v <= le {
+			h.counts[i]++
+			if traceID != "" {
+				h.exemplars[i] = &exemplar{traceID: traceID, value: v, ts: time.Now()}
+			}
+			break
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// write emits the histogram in OpenMetrics text format
+func (h *exemplarHistogram) write(w io.Writer, name string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintf(w, "# TYPE %s histogram\n", name)
+	var cumulative uint64
+	for i, le := range requestDurationBuckets {
+		cumulative += h.counts[i]
+		bound := "+Inf"
+		if !math.IsInf(le, 1) {
+			bound = strconv.FormatFloat(le, 'g', -1, 64)
+		}
+		fmt.Fprintf(w, "%s_bucket{le=%q} %d", name, bound, cumulative)
+		if e := h.exemplars[i]; e != nil {
+			fmt.Fprintf(w, " # {trace_id=%q} %s %s", e.traceID,
+				strconv.FormatFloat(e.value, 'g', -1, 64),
+				strconv.FormatFloat(float64(e.ts.UnixMilli())/1000, 'f', 3, 64))
+		}
+		fmt.Fprintln(w)
+	}
+	fmt.Fprintf(w, "%s_sum %s\n", name, strconv.FormatFloat(h.sum, 'g', -1, 64))
+	fmt.Fprintf(w, "%s_count %d\n", name, h.count)
+}
+
+// WriteOpenMetrics writes all metrics in OpenMetrics text format. The
+// request duration histogram is replaced by a classic one carrying trace
+// exemplars; everything else is passed through untyped.
+func (m *Metrics) WriteOpenMetrics(w io.Writer) {
+	var buf bytes.Buffer
+	m.set.WritePrometheus(&buf)
+	metrics.WriteProcessMetrics(&buf)
+
+	name := m.requestDurationName()
+	bw := bufio.NewWriter(w)
+	sc := bufio.NewScanner(&buf)
+	sc.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for sc.Scan() {
+		line := sc.Text()
+		if strings.HasPrefix(line, name+"_") {
+			continue
+		}
+		bw.WriteString(line)
+		bw.WriteByte('\n')
+	}
+	m.requestDuration.write(bw, name)
+	bw.WriteString("# EOF\n")
+	bw.Flush()
+}
+
+// acceptsOpenMetrics reports whether an Accept header asks for OpenMetrics
+func acceptsOpenMetrics(accept string) bool {
+	return strings.Contains(accept, "application/openmetrics-text")
+}
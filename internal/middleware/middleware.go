@@ -1,15 +1,60 @@
 package middleware
 
 import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"fmt"
 	"log/slog"
+	"net"
 	"net/http"
+	"strings"
+	"sync"
 	"time"
-	
+
+	"github.com/mr-karan/arbok/internal/apierror"
 	"github.com/mr-karan/arbok/internal/metrics"
 )
 
-// Logger logs HTTP requests
-func Logger(logger *slog.Logger) func(http.Handler) http.Handler {
+// logFieldsKey is the context key for per-request log fields
+type logFieldsKey struct{}
+
+// logFields collects attributes handlers want on the request log line
+type logFields struct {
+	mu    sync.Mutex
+	attrs []slog.Attr
+}
+
+// AddLogAttrs attaches attributes to the current request's log line.
+// It's a no-op outside of the Logger middleware.
+func AddLogAttrs(ctx context.Context, attrs ...slog.Attr) {
+	fields, ok := ctx.Value(logFieldsKey{}).(*logFields)
+	if !ok {
+		return
+	}
+	fields.mu.Lock()
+	fields.attrs = append(fields.attrs, attrs...)
+	fields.mu.Unlock()
+}
+
+// TraceID returns the trace ID from a W3C traceparent header
+// (version-traceid-parentid-flags), or "" when absent or malformed
+func TraceID(r *http.Request) string {
+	parts := strings.Split(r.Header.Get("Traceparent"), "-")
+	if len(parts) != 4 || len(parts[1]) != 32 {
+		return ""
+	}
+	if _, err := hex.DecodeString(parts[1]); err != nil || parts[1] == strings.Repeat("0", 32) {
+		return ""
+	}
+	return strings.ToLower(parts[1])
+}
+
+// Logger logs HTTP requests. With a positive slowThreshold only requests
+// slower than it or answered with a non-2xx status are logged at Info;
+// the rest are logged at Debug. Metrics are recorded to m for every
+// request.
+func Logger(logger *slog.Logger, m *metrics.Metrics, slowThreshold time.Duration) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			start := time.Now()
@@ -17,20 +62,37 @@ func Logger(logger *slog.Logger) func(http.Handler) http.Handler {
 			// Wrap ResponseWriter to capture status code
 			lrw := &loggingResponseWriter{ResponseWriter: w, statusCode: http.StatusOK}
 			
-			next.ServeHTTP(lrw, r)
+			// Let handlers add fields such as the resolved tunnel
+			fields := &logFields{}
+			ctx := context.WithValue(r.Context(), logFieldsKey{}, fields)
+
+			next.ServeHTTP(lrw, r.WithContext(ctx))
 			
 			duration := time.Since(start)
 			
-			logger.Info("http request",
+			attrs := []slog.Attr{
 				slog.String("method", r.Method),
 				slog.String("path", r.URL.Path),
 				slog.Int("status", lrw.statusCode),
 				slog.Duration("duration", duration),
 				slog.String("remote", r.RemoteAddr),
-			)
+			}
+			traceID := TraceID(r)
+			if traceID != "" {
+				attrs = append(attrs, slog.String("trace_id", traceID))
+			}
+			fields.mu.Lock()
+			attrs = append(attrs, fields.attrs...)
+			fields.mu.Unlock()
+
+			level := slog.LevelInfo
+			if slowThreshold > 0 && duration <= slowThreshold && lrw.statusCode >= 200 && lrw.statusCode < 300 {
+				level = slog.LevelDebug
+			}
+			logger.LogAttrs(ctx, level, "http request", attrs...)
 			
 			// Record metrics
-			metrics.RecordHTTPRequest(r.Method, r.URL.Path, lrw.statusCode, duration.Seconds())
+			m.RecordHTTPRequest(r.Method, r.URL.Path, lrw.statusCode, duration.Seconds(), traceID)
 		})
 	}
 }
@@ -46,7 +108,7 @@ func Recovery(logger *slog.Logger) func(http.Handler) http.Handler {
 						slog.String("method", r.Method),
 						slog.String("path", r.URL.Path),
 					)
-					http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+					apierror.Write(w, http.StatusInternalServerError, apierror.CodeInternal, "Internal server error")
 				}
 			}()
 			
@@ -97,4 +159,26 @@ type loggingResponseWriter struct {
 func (lrw *loggingResponseWriter) WriteHeader(code int) {
 	lrw.statusCode = code
 	lrw.ResponseWriter.WriteHeader(code)
-}
\ No newline at end of file
+}
+
+// Hijack lets connection-upgrading handlers (WebSocket, CONNECT) take over
+// the underlying connection through the wrapper
+func (lrw *loggingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := lrw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("response writer does not support hijacking")
+	}
+	return hijacker.Hijack()
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController
+func (lrw *loggingResponseWriter) Unwrap() http.ResponseWriter {
+	return lrw.ResponseWriter
+}
+
+// Flush forwards flushes so streaming responses aren't buffered
+func (lrw *loggingResponseWriter) Flush() {
+	if flusher, ok := lrw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,104 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mr-karan/arbok/internal/apierror"
+	"github.com/mr-karan/arbok/internal/metrics"
+)
+
+func TestTraceID(t *testing.T) {
+	tests := []struct {
+		traceparent string
+		want        string
+	}{
+		{"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01", "4bf92f3577b34da6a3ce929d0e0e4736"},
+		{"", ""},
+		{"00-4bf92f3577b34da6-00f067aa0ba902b7-01", ""},
+		{"00-zzf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", ""},
+		{"00-00000000000000000000000000000000-00f067aa0ba902b7-01", ""},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Traceparent", tt.traceparent)
+		if got := TraceID(r); got != tt.want {
+			t.Errorf("TraceID(%q) = %q, want %q", tt.traceparent, got, tt.want)
+		}
+	}
+}
+
+func TestLoggerRecordsTraceExemplar(t *testing.T) {
+	m := metrics.New("")
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	handler := Logger(logger, m, 0)(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+
+	var out bytes.Buffer
+	m.WriteOpenMetrics(&out)
+	if !strings.Contains(out.String(), `# {trace_id="4bf92f3577b34da6a3ce929d0e0e4736"}`) {
+		t.Errorf("request's trace ID not recorded as an exemplar:\n%s", out.String())
+	}
+}
+
+func TestLoggerLevelsBySlowThreshold(t *testing.T) {
+	tests := []struct {
+		name      string
+		threshold time.Duration
+		status    int
+		delay     time.Duration
+		want      string
+	}{
+		{"no threshold", 0, http.StatusOK, 0, "INFO"},
+		{"fast success", time.Second, http.StatusOK, 0, "DEBUG"},
+		{"fast error", time.Second, http.StatusBadGateway, 0, "INFO"},
+		{"fast redirect", time.Second, http.StatusFound, 0, "INFO"},
+		{"slow success", 10 * time.Millisecond, http.StatusOK, 20 * time.Millisecond, "INFO"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs bytes.Buffer
+			logger := slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+			handler := Logger(logger, metrics.New(""), tt.threshold)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				time.Sleep(tt.delay)
+				w.WriteHeader(tt.status)
+			}))
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+			if !strings.Contains(logs.String(), "level="+tt.want+" msg=\"http request\"") {
+				t.Errorf("logged %q, want the request at %s", logs.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestRecoveryWritesJSONError(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	handler := Recovery(logger)(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		panic("boom")
+	}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("status = %d, want 500", w.Code)
+	}
+	var resp apierror.Response
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("body %q is not JSON: %v", w.Body, err)
+	}
+	if resp.Code != apierror.CodeInternal {
+		t.Errorf("error code = %q, want %q", resp.Code, apierror.CodeInternal)
+	}
+}
@@ -0,0 +1,237 @@
+package registry
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mr-karan/arbok/internal/tunnel"
+)
+
+// Event types published on the registry's hub
+const (
+	EventTunnelCreated = "tunnel_created"
+	EventTunnelDeleted = "tunnel_deleted"
+	EventTunnelExpired = "tunnel_expired"
+	EventTunnelRevoked = "tunnel_revoked"
+	// EventTunnelFlagged marks a tunnel for admin review; Message says why
+	EventTunnelFlagged = "tunnel_flagged"
+	// EventServerShuttingDown warns subscribers that the server is going
+	// down and their tunnels may drop
+	EventServerShuttingDown = "server_shutting_down"
+
+	// Detail events are only delivered to subscribers of their tunnel
+	// (SubscribeTunnel), keeping server-wide streams to the lifecycle.
+	//
+	// EventTunnelTraffic carries the current TrafficPoint, at most once
+	// per TrafficEventInterval while traffic flows
+	EventTunnelTraffic = "tunnel_traffic"
+	// EventTunnelHealth reports the backend turning unreachable or
+	// reachable again, with a HealthChange
+	EventTunnelHealth = "tunnel_health"
+	// EventTunnelExpiring warns that the tunnel expires soon
+	EventTunnelExpiring = "tunnel_expiring"
+	// EventRequestCaptured announces a request recorded by the inspector
+	EventRequestCaptured = "request_captured"
+)
+
+// detailEvents are the event types only sent to per-tunnel subscribers
+var detailEvents = map[string]bool{
+	EventTunnelTraffic:   true,
+	EventTunnelHealth:    true,
+	EventTunnelExpiring:  true,
+	EventRequestCaptured: true,
+}
+
+// TrafficEventInterval is the least time between two EventTunnelTraffic
+// events of a tunnel
+const TrafficEventInterval = time.Second
+
+// HealthChange is the data of an EventTunnelHealth
+type HealthChange struct {
+	Healthy bool   `json:"healthy"`
+	Error   string `json:"error,omitempty"`
+}
+
+// eventBuffer is how many events a subscriber may fall behind by before
+// further events are dropped for it
+const eventBuffer = 64
+
+// EventLogBuffer is the buffer of the event log's subscription, which
+// writes to a pipe that may stall for a while
+const EventLogBuffer = 4096
+
+// Event is a tunnel lifecycle or server event. Server-wide events carry no
+// tunnel fields.
+type Event struct {
+	Type      string    `json:"event"`
+	Time      time.Time `json:"time"`
+	TunnelID  string    `json:"tunnel_id,omitempty"`
+	Subdomain string    `json:"subdomain,omitempty"`
+	Domain    string    `json:"domain,omitempty"`
+	Message   string    `json:"message,omitempty"`
+	// Data holds the details of detail events, e.g. a TrafficPoint
+	Data any `json:"data,omitempty"`
+	// OwnerID is the apikey.ID of the tunnel's owner, for scoping delivery
+	OwnerID string `json:"-"`
+}
+
+// TunnelEvent returns an event of type typ about t
+func TunnelEvent(typ string, t *tunnel.Info) Event {
+	return Event{
+		Type:      typ,
+		Time:      time.Now().UTC(),
+		TunnelID:  t.ID,
+		Subdomain: t.Subdomain,
+		Domain:    t.Domain,
+		OwnerID:   t.OwnerID,
+	}
+}
+
+// Hub fans events out to subscribers. Publishing never blocks: a
+// subscriber that falls behind misses events rather than stalling the
+// registry.
+type Hub struct {
+	mu     sync.Mutex
+	subs   map[*Subscription]struct{}
+	closed bool
+}
+
+// Subscription receives published events on C until it is closed or the
+// hub shuts down, which closes C
+type Subscription struct {
+	C <-chan Event
+
+	c   chan Event
+	hub *Hub
+	// tunnelID limits a per-tunnel subscription to that tunnel's events
+	// and server-wide ones
+	tunnelID string
+	// dropped counts the events missed while C was full
+	dropped atomic.Uint64
+}
+
+func newHub() *Hub {
+	return &Hub{subs: make(map[*Subscription]struct{})}
+}
+
+// Subscribe returns a new subscription to lifecycle and server events.
+// Callers must Close it.
+func (h *Hub) Subscribe() *Subscription {
+	return h.subscribe("", eventBuffer)
+}
+
+// SubscribeBuffered is Subscribe with room for size events, for consumers
+// that must not miss events to short stalls. Callers must Close it.
+func (h *Hub) SubscribeBuffered(size int) *Subscription {
+	return h.subscribe("", size)
+}
+
+// SubscribeTunnel returns a new subscription to every event of one
+// tunnel, detail events included, and to server-wide events. Callers must
+// Close it.
+func (h *Hub) SubscribeTunnel(id string) *Subscription {
+	return h.subscribe(id, eventBuffer)
+}
+
+func (h *Hub) subscribe(tunnelID string, size int) *Subscription {
+	c := make(chan Event, size)
+	sub := &Subscription{C: c, c: c, hub: h, tunnelID: tunnelID}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed {
+		close(c)
+		return sub
+	}
+	h.subs[sub] = struct{}{}
+	return sub
+}
+
+// Close stops the subscription. Closing twice is a no-op.
+func (s *Subscription) Close() {
+	s.hub.mu.Lock()
+	defer s.hub.mu.Unlock()
+
+	if _, ok := s.hub.subs[s]; ok {
+		delete(s.hub.subs, s)
+		close(s.c)
+	}
+}
+
+// Publish delivers e to every subscriber with room for it
+func (h *Hub) Publish(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for sub := range h.subs {
+		if !sub.wants(e) {
+			continue
+		}
+		select {
+		case sub.c <- e:
+		default:
+			sub.dropped.Add(1)
+		}
+	}
+}
+
+// Dropped returns how many events the subscription missed by falling
+// behind
+func (s *Subscription) Dropped() uint64 {
+	return s.dropped.Load()
+}
+
+// wants reports whether e is delivered to the subscription
+func (s *Subscription) wants(e Event) bool {
+	if s.tunnelID == "" {
+		return !detailEvents[e.Type]
+	}
+	return e.TunnelID == "" || e.TunnelID == s.tunnelID
+}
+
+// WriteEvents writes each event received on sub to w as a line of JSON
+// (NDJSON), e.g. for log pipelines, until sub is closed or the hub shuts
+// down. Events sub missed because w was slow are logged as warnings. It
+// closes sub when done.
+func WriteEvents(sub *Subscription, w io.Writer, logger *slog.Logger) error {
+	defer sub.Close()
+
+	var reported uint64
+	warnDropped := func() {
+		if dropped := sub.Dropped(); dropped > reported {
+			logger.Warn("event log fell behind, events dropped", slog.Uint64("dropped", dropped-reported))
+			reported = dropped
+		}
+	}
+	defer warnDropped()
+
+	enc := json.NewEncoder(w)
+	for e := range sub.C {
+		warnDropped()
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// close ends every subscription; later subscriptions start closed
+func (h *Hub) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.closed = true
+	for sub := range h.subs {
+		delete(h.subs, sub)
+		close(sub.c)
+	}
+}
@@ -0,0 +1,137 @@
+package registry
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestWriteEventsNDJSON(t *testing.T) {
+	r := newTestRegistry(t, Config{})
+	sub := r.Events().SubscribeBuffered(EventLogBuffer)
+
+	tun, err := r.CreateTunnel(3000, CreateOptions{Subdomain: "app"})
+	if err != nil {
+		t.Fatalf("CreateTunnel: %v", err)
+	}
+	r.Close()
+
+	var out bytes.Buffer
+	if err := WriteEvents(sub, &out, discardLogger()); err != nil {
+		t.Fatalf("WriteEvents: %v", err)
+	}
+
+	scanner := bufio.NewScanner(&out)
+	if !scanner.Scan() {
+		t.Fatal("no event written")
+	}
+	var got map[string]any
+	if err := json.Unmarshal(scanner.Bytes(), &got); err != nil {
+		t.Fatalf("event line %q isn't JSON: %v", scanner.Text(), err)
+	}
+	if got["event"] != EventTunnelCreated || got["tunnel_id"] != tun.ID || got["subdomain"] != "app" {
+		t.Errorf("first event = %s, want %s of %s", scanner.Text(), EventTunnelCreated, tun.ID)
+	}
+	if _, ok := got["OwnerID"]; ok {
+		t.Errorf("event line leaks the owner: %s", scanner.Text())
+	}
+}
+
+func TestWriteEventsLogsDrops(t *testing.T) {
+	h := newHub()
+	sub := h.SubscribeBuffered(1)
+	for range 3 {
+		h.Publish(Event{Type: EventTunnelCreated})
+	}
+	if sub.Dropped() != 2 {
+		t.Fatalf("Dropped = %d, want 2", sub.Dropped())
+	}
+	h.close()
+
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&logs, nil))
+	var out bytes.Buffer
+	if err := WriteEvents(sub, &out, logger); err != nil {
+		t.Fatalf("WriteEvents: %v", err)
+	}
+	if n := strings.Count(out.String(), "\n"); n != 1 {
+		t.Errorf("wrote %d events, want the 1 buffered", n)
+	}
+	if !strings.Contains(logs.String(), "dropped=2") {
+		t.Errorf("drops not logged: %q", logs.String())
+	}
+}
+
+// failingWriter fails every write
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) { return 0, errors.New("stdout closed") }
+
+func TestWriteEventsStopsOnWriteError(t *testing.T) {
+	h := newHub()
+	defer h.close()
+	sub := h.SubscribeBuffered(4)
+	h.Publish(Event{Type: EventTunnelCreated})
+
+	if err := WriteEvents(sub, failingWriter{}, discardLogger()); err == nil {
+		t.Fatal("WriteEvents ignored the write error")
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.subs) != 0 {
+		t.Error("subscription left open after WriteEvents returned")
+	}
+}
+
+// received drains the events already delivered to sub
+func received(sub *Subscription) []Event {
+	var events []Event
+	for {
+		select {
+		case e := <-sub.C:
+			events = append(events, e)
+		default:
+			return events
+		}
+	}
+}
+
+func TestSubscribeTunnelFilters(t *testing.T) {
+	h := newHub()
+	defer h.close()
+	all := h.Subscribe()
+	defer all.Close()
+	one := h.SubscribeTunnel("a")
+	defer one.Close()
+
+	for _, e := range []Event{
+		{Type: EventTunnelCreated, TunnelID: "a"},
+		{Type: EventTunnelCreated, TunnelID: "b"},
+		{Type: EventRequestCaptured, TunnelID: "a"},
+		{Type: EventTunnelHealth, TunnelID: "b"},
+		{Type: EventServerShuttingDown},
+	} {
+		h.Publish(e)
+	}
+
+	for _, tc := range []struct {
+		name string
+		sub  *Subscription
+		want []string
+	}{
+		{"server-wide", all, []string{"tunnel_created a", "tunnel_created b", "server_shutting_down "}},
+		{"tunnel a", one, []string{"tunnel_created a", "request_captured a", "server_shutting_down "}},
+	} {
+		var got []string
+		for _, e := range received(tc.sub) {
+			got = append(got, e.Type+" "+e.TunnelID)
+		}
+		if strings.Join(got, ", ") != strings.Join(tc.want, ", ") {
+			t.Errorf("%s subscriber got %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
@@ -2,8 +2,11 @@ package registry
 
 import (
 	"crypto/rand"
+	"encoding/base32"
 	"encoding/base64"
 	"fmt"
+	"io"
+	mrand "math/rand/v2"
 	"time"
 	
 	"golang.org/x/crypto/curve25519"
@@ -14,18 +17,58 @@ type KeyGenerator interface {
 	Generate() (privateKey, publicKey string, err error)
 }
 
-// NameGenerator generates human-friendly names
+// NameGenerator generates subdomain names
 type NameGenerator interface {
 	Generate() string
 }
 
+// Name schemes selectable for generated subdomains
+const (
+	// NameSchemeFriendly generates memorable names like swift-river-0042
+	NameSchemeFriendly = "friendly"
+	// NameSchemeRandom generates unguessable names, so active tunnels
+	// can't be found by enumerating names
+	NameSchemeRandom = "random"
+)
+
+// newNameGenerator returns the generator for a name scheme, friendly when
+// scheme is empty
+func newNameGenerator(scheme string, r io.Reader) (NameGenerator, error) {
+	switch scheme {
+	case "", NameSchemeFriendly:
+		return NewFriendlyNameGenerator(r), nil
+	case NameSchemeRandom:
+		return NewRandomNameGenerator(r), nil
+	default:
+		return nil, fmt.Errorf("unknown name scheme %q: must be %q or %q", scheme, NameSchemeFriendly, NameSchemeRandom)
+	}
+}
+
+// randReader returns r, or crypto/rand when r is nil
+func randReader(r io.Reader) io.Reader {
+	if r == nil {
+		return rand.Reader
+	}
+	return r
+}
+
 // WireGuardKeyGenerator generates WireGuard-compatible keys
-type WireGuardKeyGenerator struct{}
+type WireGuardKeyGenerator struct {
+	// Rand is the randomness source; nil means crypto/rand. Only inject
+	// a deterministic reader in tests.
+	Rand io.Reader
+}
+
+// NewWireGuardKeyGenerator creates a key generator reading from r (nil
+// for crypto/rand)
+func NewWireGuardKeyGenerator(r io.Reader) *WireGuardKeyGenerator {
+	return &WireGuardKeyGenerator{Rand: r}
+}
 
 func (g *WireGuardKeyGenerator) Generate() (privateKey, publicKey string, err error) {
 	// Generate private key
 	var priv [32]byte
-	if _, err := rand.Read(priv[:]); err != nil {
+	if _, err := io.ReadFull(randReader(g.Rand), priv[:]); err != nil {
 		return "", "", fmt.Errorf("failed to generate random bytes: %w", err)
 	}
 	
@@ -45,7 +88,16 @@ func (g *WireGuardKeyGenerator) Generate() (privateKey, publicKey string, err er
 }
 
 // FriendlyNameGenerator generates memorable subdomain names
-type FriendlyNameGenerator struct{}
+type FriendlyNameGenerator struct {
+	// Rand is the randomness source; nil means crypto/rand
+	Rand io.Reader
+}
+
+// NewFriendlyNameGenerator creates a name generator reading from r (nil
+// for crypto/rand)
+func NewFriendlyNameGenerator(r io.Reader) *FriendlyNameGenerator {
+	return &FriendlyNameGenerator{Rand: r}
+}
 
 func (g *FriendlyNameGenerator) Generate() string {
 	adjectives := []string{
@@ -62,8 +114,8 @@ func (g *FriendlyNameGenerator) Generate() string {
 	
 	// Generate random indices
 	var buf [3]byte
-	if _, err := rand.Read(buf[:]); err != nil {
-		// Fallback to time-based randomness if crypto/rand fails
+	if _, err := io.ReadFull(randReader(g.Rand), buf[:]); err != nil {
+		// Fallback to time-based randomness if the source fails
 		now := time.Now().UnixNano()
 		buf[0] = byte(now)
 		buf[1] = byte(now >> 8)
@@ -75,4 +127,36 @@ func (g *FriendlyNameGenerator) Generate() string {
 	num := (int(buf[2])<<8 | int(buf[0])) % 10000
 	
 	return fmt.Sprintf("%s-%s-%04d", adj, noun, num)
-}
\ No newline at end of file
+}
+
+// randomNameBytes is the entropy of a random name: 80 bits, encoded as 16
+// base32 characters
+const randomNameBytes = 10
+
+// randomNameEncoding is lowercase base32, which only uses characters valid
+// in DNS labels
+var randomNameEncoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+// RandomNameGenerator generates unguessable subdomain names
+type RandomNameGenerator struct {
+	// Rand is the randomness source; nil means crypto/rand
+	Rand io.Reader
+}
+
+// NewRandomNameGenerator creates a name generator reading from r (nil for
+// crypto/rand)
+func NewRandomNameGenerator(r io.Reader) *RandomNameGenerator {
+	return &RandomNameGenerator{Rand: r}
+}
+
+func (g *RandomNameGenerator) Generate() string {
+	var buf [randomNameBytes]byte
+	if _, err := io.ReadFull(randReader(g.Rand), buf[:]); err != nil {
+		// Fall back to the runtime-seeded generator, which unlike the
+		// clock can't be guessed
+		for i := range buf {
+			buf[i] = byte(mrand.Uint32())
+		}
+	}
+	return randomNameEncoding.EncodeToString(buf[:])
+}
@@ -0,0 +1,139 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	mrand "math/rand/v2"
+	"regexp"
+	"testing"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+// seeded returns a deterministic randomness source
+func seeded(seed byte) *mrand.ChaCha8 {
+	return mrand.NewChaCha8([32]byte{seed})
+}
+
+// zeros returns a source of n zero bytes
+func zeros(n int) *bytes.Reader {
+	return bytes.NewReader(make([]byte, n))
+}
+
+func TestKeyGeneratorFixedSource(t *testing.T) {
+	priv, pub, err := NewWireGuardKeyGenerator(zeros(32)).Generate()
+	if err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	// All zeros, clamped
+	if want := "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAEA="; priv != want {
+		t.Errorf("private key = %s, want %s", priv, want)
+	}
+	raw, _ := base64.StdEncoding.DecodeString(priv)
+	derived, err := curve25519.X25519(raw, curve25519.Basepoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := base64.StdEncoding.EncodeToString(derived); pub != want {
+		t.Errorf("public key = %s, want %s derived from the private key", pub, want)
+	}
+
+	// An exhausted source is an error, not a weak key
+	if _, _, err := NewWireGuardKeyGenerator(zeros(31)).Generate(); err == nil {
+		t.Error("Generate succeeded with 31 bytes of randomness")
+	}
+}
+
+func TestNameGeneratorsFixedSource(t *testing.T) {
+	if got := NewFriendlyNameGenerator(zeros(3)).Generate(); got != "happy-cloud-0000" {
+		t.Errorf("friendly name = %q, want happy-cloud-0000", got)
+	}
+	if got := NewRandomNameGenerator(zeros(randomNameBytes)).Generate(); got != "aaaaaaaaaaaaaaaa" {
+		t.Errorf("random name = %q, want aaaaaaaaaaaaaaaa", got)
+	}
+}
+
+func TestGeneratorsReproducibleFromSeed(t *testing.T) {
+	generate := func(seed byte) []string {
+		keys := NewWireGuardKeyGenerator(seeded(seed))
+		friendly := NewFriendlyNameGenerator(seeded(seed))
+		random := NewRandomNameGenerator(seeded(seed))
+		var out []string
+		for range 5 {
+			priv, pub, err := keys.Generate()
+			if err != nil {
+				t.Fatal(err)
+			}
+			out = append(out, priv, pub, friendly.Generate(), random.Generate())
+		}
+		return out
+	}
+
+	first, again, other := generate(1), generate(1), generate(2)
+	for i := range first {
+		if first[i] != again[i] {
+			t.Errorf("output %d = %q then %q from the same seed", i, first[i], again[i])
+		}
+	}
+	if first[0] == other[0] {
+		t.Error("different seeds produced the same key")
+	}
+}
+
+func TestRegistryReproducibleFromSeed(t *testing.T) {
+	create := func() (subdomain, privateKey string) {
+		r := newTestRegistry(t, Config{Rand: seeded(7)})
+		tun, err := r.CreateTunnel(3000, CreateOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tun.Subdomain, tun.PrivateKey
+	}
+	sub1, key1 := create()
+	sub2, key2 := create()
+	if sub1 != sub2 || key1 != key2 {
+		t.Errorf("seeded registries created %s/%s and %s/%s", sub1, key1, sub2, key2)
+	}
+}
+
+func TestRandomNames(t *testing.T) {
+	pattern := regexp.MustCompile(`^[a-z2-7]{16}$`)
+	gen := NewRandomNameGenerator(nil)
+	seen := make(map[string]bool)
+	for range 100 {
+		name := gen.Generate()
+		if !pattern.MatchString(name) {
+			t.Fatalf("random name %q isn't 16 lowercase base32 characters", name)
+		}
+		if seen[name] {
+			t.Fatalf("random name %q generated twice", name)
+		}
+		seen[name] = true
+	}
+}
+
+func TestNameSchemeSelectsGenerator(t *testing.T) {
+	tests := []struct {
+		scheme  string
+		pattern string
+	}{
+		{"", `^[a-z]+-[a-z]+-[0-9]{4}$`},
+		{NameSchemeFriendly, `^[a-z]+-[a-z]+-[0-9]{4}$`},
+		{NameSchemeRandom, `^[a-z2-7]{16}$`},
+	}
+	for _, tt := range tests {
+		r := newTestRegistry(t, Config{NameScheme: tt.scheme})
+		tun, err := r.CreateTunnel(3000, CreateOptions{})
+		if err != nil {
+			t.Fatalf("%q: CreateTunnel: %v", tt.scheme, err)
+		}
+		if !regexp.MustCompile(tt.pattern).MatchString(tun.Subdomain) {
+			t.Errorf("%q: subdomain %q doesn't match %s", tt.scheme, tun.Subdomain, tt.pattern)
+		}
+	}
+
+	if _, err := NewRegistry(context.Background(), Config{CIDR: "10.100.0.0/24", NameScheme: "hashed"}, discardLogger()); err == nil {
+		t.Error("NewRegistry accepted an unknown name scheme")
+	}
+}
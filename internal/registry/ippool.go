@@ -6,33 +6,105 @@ import (
 	"sync"
 )
 
+// DefaultPoolStartOffset is the first host offset handed to clients;
+// offset 1 is always the server's address
+const DefaultPoolStartOffset = 2
+
 // IPPool manages IP address allocation
 type IPPool struct {
 	mu        sync.Mutex
 	network   *net.IPNet
 	allocated map[string]bool
 	available int
+
+	// start and end are the first and last host offsets handed out
+	start int
+	end   int
 }
 
-// NewIPPool creates a new IP pool from a CIDR
-func NewIPPool(cidr string) (*IPPool, error) {
+// NewIPPool creates a new IP pool from a CIDR. Allocation begins at
+// startOffset within the network (DefaultPoolStartOffset when zero).
+// rangeStart and rangeEnd, when set, further confine the pool to that
+// inclusive address range within the CIDR, e.g. to hand out only
+// 10.100.0.50-10.100.0.200 of 10.100.0.0/24.
+func NewIPPool(cidr string, startOffset int, rangeStart, rangeEnd string) (*IPPool, error) {
 	_, network, err := net.ParseCIDR(cidr)
 	if err != nil {
 		return nil, fmt.Errorf("invalid CIDR: %w", err)
 	}
 	
-	// Calculate total available IPs (excluding network and broadcast)
+	if startOffset == 0 {
+		startOffset = DefaultPoolStartOffset
+	}
+	if startOffset < DefaultPoolStartOffset {
+		return nil, fmt.Errorf("pool start offset %d collides with the server address", startOffset)
+	}
+
+	// Calculate the last usable host offset (excluding network and broadcast)
 	ones, bits := network.Mask.Size()
+	if bits-ones > 30 {
+		return nil, fmt.Errorf("CIDR %s is too large", cidr)
+	}
 	total := 1 << (bits - ones)
-	if total > 2 {
-		total -= 2 // Remove network and broadcast addresses
+	end := total - 2
+	if startOffset > end {
+		return nil, fmt.Errorf("pool start offset %d is outside %s", startOffset, cidr)
 	}
-	
-	return &IPPool{
+
+	p := &IPPool{
 		network:   network,
 		allocated: make(map[string]bool),
-		available: total - 1, // -1 for server (.1)
-	}, nil
+	}
+	if rangeStart != "" {
+		n, err := p.rangeOffset(rangeStart, end)
+		if err != nil {
+			return nil, fmt.Errorf("pool range start: %w", err)
+		}
+		startOffset = max(startOffset, n)
+	}
+	if rangeEnd != "" {
+		n, err := p.rangeOffset(rangeEnd, end)
+		if err != nil {
+			return nil, fmt.Errorf("pool range end: %w", err)
+		}
+		end = n
+	}
+	if startOffset > end {
+		return nil, fmt.Errorf("pool range %s-%s is empty", p.ipAtOffset(startOffset), p.ipAtOffset(end))
+	}
+
+	p.start, p.end = startOffset, end
+	p.available = end - startOffset + 1
+	return p, nil
+}
+
+// rangeOffset returns the host offset of a pool range bound, which must
+// be a host address of the network other than the server's
+func (p *IPPool) rangeOffset(bound string, last int) (int, error) {
+	ip := net.ParseIP(bound)
+	if ip == nil {
+		return 0, fmt.Errorf("invalid IP: %s", bound)
+	}
+	n := p.offsetOf(ip)
+	if n < 0 || n > last {
+		return 0, fmt.Errorf("%s is not a host address of %s", bound, p.network)
+	}
+	if n < DefaultPoolStartOffset {
+		return 0, fmt.Errorf("%s collides with the server address", bound)
+	}
+	return n, nil
+}
+
+// ipAtOffset returns the address n hosts past the network address
+func (p *IPPool) ipAtOffset(n int) net.IP {
+	ip := make(net.IP, len(p.network.IP))
+	copy(ip, p.network.IP)
+	for i := len(ip) - 1; i >= 0 && n > 0; i-- {
+		sum := int(ip[i]) + n&0xff
+		ip[i] = byte(sum)
+		n = n>>8 + sum>>8
+	}
+	return ip
 }
 
 // Allocate assigns an available IP address
@@ -44,17 +116,9 @@ func (p *IPPool) Allocate() (net.IP, error) {
 		return nil, fmt.Errorf("IP pool exhausted")
 	}
 	
-	// Start from .2 (reserve .1 for server)
-	ip := make(net.IP, len(p.network.IP))
-	copy(ip, p.network.IP)
-	
-	// Find next available IP
-	for i := 2; i < 256; i++ { // Simple implementation for /24
-		ip[len(ip)-1] = byte(i)
-		
-		if !p.network.Contains(ip) {
-			break
-		}
+	// Find next available IP, starting at the configured offset
+	for i := p.start; i <= p.end; i++ {
+		ip := p.ipAtOffset(i)
 		
 		ipStr := ip.String()
 		if !p.allocated[ipStr] {
@@ -67,6 +131,43 @@ func (p *IPPool) Allocate() (net.IP, error) {
 	return nil, fmt.Errorf("no available IPs in pool")
 }
 
+// Claim marks a specific IP as allocated, e.g. when restoring tunnels
+func (p *IPPool) Claim(ipStr string) error {
+	ip := net.ParseIP(ipStr)
+	if ip == nil {
+		return fmt.Errorf("invalid IP: %s", ipStr)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if n := p.offsetOf(ip); n < p.start || n > p.end {
+		return fmt.Errorf("IP %s is outside the pool", ipStr)
+	}
+	if p.allocated[ip.String()] {
+		return fmt.Errorf("IP %s is already allocated", ipStr)
+	}
+	p.allocated[ip.String()] = true
+	p.available--
+	return nil
+}
+
+// offsetOf returns ip's host offset within the network, or -1 when the
+// address is outside it
+func (p *IPPool) offsetOf(ip net.IP) int {
+	if !p.network.Contains(ip) {
+		return -1
+	}
+	if v4 := ip.To4(); v4 != nil && len(p.network.IP) == net.IPv4len {
+		ip = v4
+	}
+	n := 0
+	for i := range ip {
+		n = n<<8 | int(ip[i]-p.network.IP[i])
+	}
+	return n
+}
+
 // Release returns an IP to the pool
 func (p *IPPool) Release(ip net.IP) error {
 	p.mu.Lock()
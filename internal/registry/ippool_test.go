@@ -0,0 +1,88 @@
+package registry
+
+import "testing"
+
+func TestIPPoolStartOffset(t *testing.T) {
+	tests := []struct {
+		offset    int
+		first     string
+		available int
+	}{
+		{0, "10.100.0.2", 253},
+		{2, "10.100.0.2", 253},
+		{10, "10.100.0.10", 245},
+		{254, "10.100.0.254", 1},
+	}
+	for _, tt := range tests {
+		pool, err := NewIPPool("10.100.0.0/24", tt.offset, "", "")
+		if err != nil {
+			t.Fatalf("NewIPPool with offset %d: %v", tt.offset, err)
+		}
+		if pool.Available() != tt.available {
+			t.Errorf("offset %d: Available = %d, want %d", tt.offset, pool.Available(), tt.available)
+		}
+		ip, err := pool.Allocate()
+		if err != nil {
+			t.Fatalf("offset %d: Allocate: %v", tt.offset, err)
+		}
+		if ip.String() != tt.first {
+			t.Errorf("offset %d: first IP = %s, want %s", tt.offset, ip, tt.first)
+		}
+		if pool.Available() != tt.available-1 {
+			t.Errorf("offset %d: Available after Allocate = %d, want %d", tt.offset, pool.Available(), tt.available-1)
+		}
+	}
+}
+
+func TestIPPoolStartOffsetOutsideNetwork(t *testing.T) {
+	for _, offset := range []int{1, 255, 1000} {
+		if _, err := NewIPPool("10.100.0.0/24", offset, "", ""); err == nil {
+			t.Errorf("NewIPPool accepted offset %d", offset)
+		}
+	}
+}
+
+func TestIPPoolRange(t *testing.T) {
+	pool, err := NewIPPool("10.100.0.0/24", 0, "10.100.0.50", "10.100.0.52")
+	if err != nil {
+		t.Fatalf("NewIPPool: %v", err)
+	}
+	if pool.Available() != 3 {
+		t.Errorf("Available = %d, want 3", pool.Available())
+	}
+	for _, want := range []string{"10.100.0.50", "10.100.0.51", "10.100.0.52"} {
+		ip, err := pool.Allocate()
+		if err != nil {
+			t.Fatalf("Allocate: %v", err)
+		}
+		if ip.String() != want {
+			t.Errorf("allocated %s, want %s", ip, want)
+		}
+	}
+	if ip, err := pool.Allocate(); err == nil {
+		t.Errorf("Allocate past the range end = %s, want the pool exhausted", ip)
+	}
+	if pool.Available() != 0 {
+		t.Errorf("Available when exhausted = %d, want 0", pool.Available())
+	}
+}
+
+func TestIPPoolRangeInvalid(t *testing.T) {
+	tests := []struct {
+		name       string
+		offset     int
+		start, end string
+	}{
+		{"start not an IP", 0, "pool", ""},
+		{"start outside network", 0, "10.101.0.5", ""},
+		{"end is broadcast", 0, "", "10.100.0.255"},
+		{"start is server", 0, "10.100.0.1", ""},
+		{"end before start", 0, "10.100.0.60", "10.100.0.50"},
+		{"end before offset", 100, "", "10.100.0.50"},
+	}
+	for _, tt := range tests {
+		if _, err := NewIPPool("10.100.0.0/24", tt.offset, tt.start, tt.end); err == nil {
+			t.Errorf("%s: NewIPPool accepted range %q-%q", tt.name, tt.start, tt.end)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package registry
+
+import (
+	"container/list"
+	"time"
+)
+
+// lru is a size-bounded map that evicts the least recently used entry
+// when full and treats entries older than ttl as absent. A zero ttl
+// disables expiry. Not safe for concurrent use; the registry guards it
+// with its own lock.
+type lru[K comparable, V any] struct {
+	max     int
+	ttl     time.Duration
+	ll      *list.List
+	items   map[K]*list.Element
+	onEvict func(K, V)
+}
+
+type lruEntry[K comparable, V any] struct {
+	key     K
+	value   V
+	touched time.Time
+}
+
+func newLRU[K comparable, V any](max int, ttl time.Duration) *lru[K, V] {
+	return &lru[K, V]{
+		max:   max,
+		ttl:   ttl,
+		ll:    list.New(),
+		items: make(map[K]*list.Element),
+	}
+}
+
+// Get returns the value for key and marks it as recently used
+func (c *lru[K, V]) Get(key K) (V, bool) {
+	var zero V
+	el, ok := c.items[key]
+	if !ok {
+		return zero, false
+	}
+	entry := el.Value.(*lruEntry[K, V])
+	if c.expired(entry) {
+		c.remove(el)
+		return zero, false
+	}
+	entry.touched = time.Now()
+	c.ll.MoveToFront(el)
+	return entry.value, true
+}
+
+// Peek returns the value for key without marking it as used
+func (c *lru[K, V]) Peek(key K) (V, bool) {
+	var zero V
+	el, ok := c.items[key]
+	if !ok {
+		return zero, false
+	}
+	entry := el.Value.(*lruEntry[K, V])
+	if c.expired(entry) {
+		return zero, false
+	}
+	return entry.value, true
+}
+
+// Put stores value under key, evicting the oldest entry if full
+func (c *lru[K, V]) Put(key K, value V) {
+	c.PutAt(key, value, time.Now())
+}
+
+// PutAt is Put for a value that came about at the given time, which its
+// ttl counts from rather than from now
+func (c *lru[K, V]) PutAt(key K, value V, at time.Time) {
+	if el, ok := c.items[key]; ok {
+		entry := el.Value.(*lruEntry[K, V])
+		entry.value = value
+		entry.touched = at
+		c.ll.MoveToFront(el)
+		return
+	}
+
+	c.items[key] = c.ll.PushFront(&lruEntry[K, V]{key: key, value: value, touched: at})
+	for c.max > 0 && c.ll.Len() > c.max {
+		c.remove(c.ll.Back())
+	}
+}
+
+// Delete removes key without calling onEvict
+func (c *lru[K, V]) Delete(key K) {
+	if el, ok := c.items[key]; ok {
+		c.ll.Remove(el)
+		delete(c.items, key)
+	}
+}
+
+// Len returns the number of stored entries, including expired ones not
+// yet pruned
+func (c *lru[K, V]) Len() int {
+	return c.ll.Len()
+}
+
+// Prune drops all expired entries
+func (c *lru[K, V]) Prune() {
+	for el := c.ll.Back(); el != nil; {
+		prev := el.Prev()
+		if c.expired(el.Value.(*lruEntry[K, V])) {
+			c.remove(el)
+		}
+		el = prev
+	}
+}
+
+func (c *lru[K, V]) expired(entry *lruEntry[K, V]) bool {
+	return c.ttl > 0 && time.Since(entry.touched) > c.ttl
+}
+
+func (c *lru[K, V]) remove(el *list.Element) {
+	entry := el.Value.(*lruEntry[K, V])
+	c.ll.Remove(el)
+	delete(c.items, entry.key)
+	if c.onEvict != nil {
+		c.onEvict(entry.key, entry.value)
+	}
+}
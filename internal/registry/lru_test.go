@@ -0,0 +1,41 @@
+package registry
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLRUEvictsLeastRecentlyUsed(t *testing.T) {
+	c := newLRU[string, int](2, 0)
+	c.Put("a", 1)
+	c.Put("b", 2)
+	c.Get("a")
+	c.Put("c", 3)
+
+	if _, ok := c.Peek("b"); ok {
+		t.Error("least recently used entry kept")
+	}
+	if _, ok := c.Peek("a"); !ok {
+		t.Error("recently used entry evicted")
+	}
+	if c.Len() != 2 {
+		t.Errorf("Len = %d, want 2", c.Len())
+	}
+}
+
+func TestLRUPutAtExpiresFromGivenTime(t *testing.T) {
+	c := newLRU[string, int](0, time.Minute)
+	c.PutAt("old", 1, time.Now().Add(-2*time.Minute))
+	c.PutAt("new", 2, time.Now().Add(-30*time.Second))
+
+	if _, ok := c.Peek("old"); ok {
+		t.Error("entry older than the ttl returned")
+	}
+	if v, ok := c.Peek("new"); !ok || v != 2 {
+		t.Errorf("Peek(new) = %d, %v; want 2, true", v, ok)
+	}
+	c.Prune()
+	if c.Len() != 1 {
+		t.Errorf("Len after Prune = %d, want 1", c.Len())
+	}
+}
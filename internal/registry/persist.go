@@ -0,0 +1,86 @@
+package registry
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// DefaultSaveDebounce is the quiet period before pending changes are saved
+const DefaultSaveDebounce = 2 * time.Second
+
+// restore loads persisted tunnels into the registry, skipping any that
+// expired while the server was down
+func (r *Registry) restore() error {
+	tunnels, err := r.cfg.Store.Load()
+	if err != nil {
+		return fmt.Errorf("failed to load state: %w", err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	restored := 0
+	for _, t := range tunnels {
+		if t.IsExpired() {
+			continue
+		}
+		// Tunnels saved before multi-domain support belong to the default
+		domain, err := r.resolveDomain(t.Domain)
+		if err != nil {
+			r.logger.Warn("skipping persisted tunnel",
+				slog.Any("error", err), slog.String("id", t.ID))
+			continue
+		}
+		t.Domain = domain
+		if err := r.ipPool.Claim(t.AllowedIP); err != nil {
+			r.logger.Warn("skipping persisted tunnel",
+				slog.Any("error", err), slog.String("id", t.ID))
+			continue
+		}
+		r.insertLocked(t)
+		r.metrics.TunnelsActive.Inc()
+		restored++
+	}
+
+	if restored > 0 {
+		r.logger.Info("restored tunnels from store", slog.Int("count", restored))
+	}
+	return nil
+}
+
+// scheduleSave coalesces bursts of mutations into a single write once
+// things have been quiet for SaveDebounce. A constant stream of changes
+// still gets flushed after ten quiet periods.
+func (r *Registry) scheduleSave() {
+	if r.cfg.Store == nil {
+		return
+	}
+
+	r.saveMu.Lock()
+	defer r.saveMu.Unlock()
+
+	now := time.Now()
+	if r.saveTimer == nil {
+		r.savePendingSince = now
+		r.saveTimer = time.AfterFunc(r.cfg.SaveDebounce, r.saveNow)
+		return
+	}
+	if now.Sub(r.savePendingSince) < 10*r.cfg.SaveDebounce {
+		r.saveTimer.Reset(r.cfg.SaveDebounce)
+	}
+}
+
+// saveNow writes the current tunnels to the store
+func (r *Registry) saveNow() {
+	r.saveMu.Lock()
+	if r.saveTimer != nil {
+		r.saveTimer.Stop()
+		r.saveTimer = nil
+	}
+	r.saveMu.Unlock()
+
+	if err := r.cfg.Store.Save(r.ListTunnels()); err != nil {
+		r.logger.Error("failed to persist registry", slog.Any("error", err))
+	}
+}
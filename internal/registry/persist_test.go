@@ -0,0 +1,140 @@
+package registry
+
+import (
+	"bytes"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mr-karan/arbok/internal/tunnel"
+)
+
+// freeUDPPort returns a UDP port that was free a moment ago
+func freeUDPPort(t *testing.T) int {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+func TestRestoreWithoutPrivateKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json.gz")
+
+	r := newTestRegistry(t, Config{Store: NewFileStore(path, false)})
+	created, err := r.CreateTunnel(3000, CreateOptions{})
+	if err != nil {
+		t.Fatalf("CreateTunnel: %v", err)
+	}
+	if created.PrivateKey == "" {
+		t.Fatal("server-generated tunnel has no private key")
+	}
+	if err := r.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	if data := readState(t, path); bytes.Contains(data, []byte(created.PrivateKey)) ||
+		bytes.Contains(data, []byte(`"private_key"`)) {
+		t.Fatalf("state file holds a private key: %s", data)
+	}
+
+	restored := newTestRegistry(t, Config{Store: NewFileStore(path, false)})
+	got := restored.GetTunnel(created.ID)
+	if got == nil {
+		t.Fatal("tunnel not restored")
+	}
+	if got.PrivateKey != "" {
+		t.Errorf("restored tunnel has a private key")
+	}
+	if got.PublicKey != created.PublicKey || got.AllowedIP != created.AllowedIP {
+		t.Errorf("restored peer identity = %s %s, want %s %s",
+			got.PublicKey, got.AllowedIP, created.PublicKey, created.AllowedIP)
+	}
+
+	// The server re-adds the peers of restored tunnels, which only needs
+	// their public key and IP
+	priv, _, err := NewWireGuardKeyGenerator(nil).Generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tun, err := tunnel.New(tunnel.PeerOpts{
+		PrivateKey: priv,
+		ListenPort: freeUDPPort(t),
+		Logger:     discardLogger(),
+	})
+	if err != nil {
+		t.Fatalf("tunnel.New: %v", err)
+	}
+	defer tun.Close()
+	for _, rt := range restored.ListTunnels() {
+		if err := tun.AddPeer(rt.PublicKey, rt.AllowedIP, rt.PeerAllowedIPs()...); err != nil {
+			t.Errorf("re-adding peer of %s: %v", rt.ID, err)
+		}
+	}
+}
+
+// countingStore is a Store recording how many times it was saved to
+type countingStore struct {
+	mu    sync.Mutex
+	saves int
+	last  int
+}
+
+func (s *countingStore) Load() ([]*tunnel.Info, error) { return nil, nil }
+
+func (s *countingStore) Save(tunnels []*tunnel.Info) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.saves++
+	s.last = len(tunnels)
+	return nil
+}
+
+func (s *countingStore) counts() (saves, last int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.saves, s.last
+}
+
+func TestSaveDebouncesBursts(t *testing.T) {
+	store := &countingStore{}
+	r := newTestRegistry(t, Config{Store: store, SaveDebounce: 50 * time.Millisecond})
+
+	for range 5 {
+		if _, err := r.CreateTunnel(3000, CreateOptions{}); err != nil {
+			t.Fatalf("CreateTunnel: %v", err)
+		}
+	}
+	if saves, _ := store.counts(); saves != 0 {
+		t.Fatalf("saved %d times during the burst, want none yet", saves)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	if saves, last := store.counts(); saves != 1 || last != 5 {
+		t.Errorf("after the burst: %d saves of %d tunnels, want 1 of 5", saves, last)
+	}
+}
+
+func TestSaveNotPostponedForever(t *testing.T) {
+	const debounce = 20 * time.Millisecond
+	store := &countingStore{}
+	r := newTestRegistry(t, Config{Store: store, SaveDebounce: debounce})
+
+	// Changes keep coming faster than the debounce for 20 debounces
+	deadline := time.Now().Add(20 * debounce)
+	for time.Now().Before(deadline) {
+		tun, err := r.CreateTunnel(3000, CreateOptions{})
+		if err != nil {
+			t.Fatalf("CreateTunnel: %v", err)
+		}
+		r.DeleteTunnel(tun.ID)
+		time.Sleep(debounce / 4)
+	}
+	if saves, _ := store.counts(); saves == 0 {
+		t.Error("a steady stream of changes was never saved")
+	}
+}
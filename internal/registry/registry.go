@@ -2,9 +2,17 @@ package registry
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
+	"math/rand/v2"
+	"net"
+	"regexp"
+	"slices"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
@@ -17,108 +25,981 @@ type Config struct {
 	CIDR           string
 	DefaultTTL     time.Duration
 	CleanupInterval time.Duration
+
+	// PoolStartOffset is the first host offset handed to clients (default 2)
+	PoolStartOffset int
+	// PoolRangeStart and PoolRangeEnd optionally confine the addresses
+	// handed to clients to that inclusive range within CIDR
+	PoolRangeStart string
+	PoolRangeEnd   string
+
+	// MinCleanupInterval is the floor applied to the jittered cleanup interval
+	MinCleanupInterval time.Duration
+
+	// Domains are the domains tunnels are served under. The first is the
+	// default for tunnels and reservations that don't name one.
+	Domains []string
+
+	// Reservations maps an owner ID (the apikey.ID of an API key) to the
+	// subdomain reserved for it, either a bare label or a label qualified
+	// with one of Domains
+	Reservations map[string]string
+
+	// Store persists tunnels across restarts (optional)
+	Store Store
+	// SaveDebounce is the quiet period before changes are written to Store
+	SaveDebounce time.Duration
+
+	// DNSResolvers are internal DNS servers (host:port) tunnels may pick
+	// to resolve hostname backends, reached from the server's network
+	DNSResolvers []string
+
+	// RevokedRetention is how long revoked tunnels are kept for
+	// inspection before cleanup reaps them
+	RevokedRetention time.Duration
+
+	// MaxTTL caps the TTL tunnels may ask for; zero means DefaultTTL.
+	// KeyMaxTTLs overrides it per owner ID, e.g. for premium keys.
+	MaxTTL     time.Duration
+	KeyMaxTTLs map[string]time.Duration
+
+	// NameScheme picks how subdomains are generated: NameSchemeFriendly
+	// (the default) or NameSchemeRandom
+	NameScheme string
+
+	// Rand is the randomness source for keys and generated names. nil
+	// means crypto/rand; tests can inject a seeded reader to get
+	// reproducible output.
+	Rand io.Reader
+
+	// Metrics records tunnel, IP pool and cleanup metrics. nil records
+	// to a private set nobody scrapes.
+	Metrics *metrics.Metrics
+}
+
+// DefaultRevokedRetention is how long revoked tunnels are kept by default
+const DefaultRevokedRetention = 24 * time.Hour
+
+var (
+	// ErrTunnelNotFound is returned for unknown tunnel IDs
+	ErrTunnelNotFound = errors.New("tunnel not found")
+
+	// ErrSubdomainReserved is returned when a subdomain is reserved by another key
+	ErrSubdomainReserved = errors.New("subdomain is reserved by another key")
+
+	// ErrInvalidSubdomain is returned when a subdomain is not a valid DNS label
+	ErrInvalidSubdomain = errors.New("invalid subdomain")
+
+	// ErrSubdomainTaken is returned when a requested subdomain is in use
+	ErrSubdomainTaken = errors.New("subdomain is in use")
+
+	// ErrUnknownDomain is returned for domains the server doesn't serve
+	ErrUnknownDomain = errors.New("unknown domain")
+
+	// ErrPeerAdd is returned when CreateTunnelWithPeer fails to add the peer
+	ErrPeerAdd = errors.New("failed to add peer")
+
+	// ErrInvalidPublicKey is returned for malformed or duplicate client public keys
+	ErrInvalidPublicKey = errors.New("invalid public key")
+
+	// ErrInvalidClientCA is returned when a client CA bundle can't be parsed
+	ErrInvalidClientCA = errors.New("invalid client CA bundle")
+
+	// ErrInvalidBackendHost is returned for backend hosts that can't be
+	// routed through a tunnel
+	ErrInvalidBackendHost = errors.New("invalid backend host")
+
+	// ErrNoSubdomainAvailable is returned when no free subdomain was
+	// generated within the attempt limit
+	ErrNoSubdomainAvailable = errors.New("no subdomain available")
+
+	// ErrInvalidClientCIDR is returned for unparseable client networks
+	ErrInvalidClientCIDR = errors.New("invalid client CIDR")
+
+	// ErrInvalidDNSResolver is returned for resolvers that are neither the
+	// peer nor one of the configured internal resolvers
+	ErrInvalidDNSResolver = errors.New("invalid DNS resolver")
+)
+
+// subdomainPattern matches a single lowercase DNS label
+var subdomainPattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// ValidSubdomain reports whether s can be used as a tunnel subdomain
+func ValidSubdomain(s string) bool {
+	return subdomainPattern.MatchString(s)
+}
+
+// tombstoneTTL is how long after its tunnel was removed a recently
+// expired subdomain is remembered
+const tombstoneTTL = 5 * time.Minute
+
+// Tombstone records a tunnel that expired recently
+type Tombstone struct {
+	ID        string
+	Subdomain string
+	Domain    string
+	ExpiredAt time.Time
+	// RemovedAt is when cleanup removed the tunnel, which may be well
+	// after ExpiredAt; the tombstone is kept for tombstoneTTL from then
+	RemovedAt time.Time
+}
+
+// CreateOptions holds optional parameters for tunnel creation
+type CreateOptions struct {
+	// OwnerID is the apikey.ID of the creator's API key, if any
+	OwnerID string
+
+	// Domain the tunnel is served under; empty means the default domain
+	Domain string
+
+	// Subdomain requests a name instead of a generated one. It must be
+	// free and not reserved by another key.
+	Subdomain string
+
+	// TTL is the tunnel's lifetime, capped at the owner's max TTL; zero
+	// means the default TTL
+	TTL time.Duration
+
+	// BackendHost is an IP on the client's network to forward to instead
+	// of the tunnel IP, or a hostname resolved with DNSResolver
+	BackendHost string
+
+	// DNSResolver resolves a hostname BackendHost: tunnel.PeerResolver or
+	// one of Config.DNSResolvers
+	DNSResolver string
+
+	// ClientPublicKey is a WireGuard public key generated by the client.
+	// When set no keypair is generated and no private key is stored.
+	ClientPublicKey string
+
+	// Reclaim gives the tunnel the IP and subdomain of the owner's tunnel
+	// with the same ClientPublicKey removed within ReclaimWindow, each
+	// only if it is still free
+	Reclaim bool
+
+	// StripResponseHeaders are extra response headers hidden from clients
+	StripResponseHeaders []string
+
+	// AllowedMethods restricts proxied HTTP methods; empty allows all
+	AllowedMethods []string
+
+	// Labels tag the tunnel for organization and filtering
+	Labels map[string]string
+
+	// MaxRPS caps requests per second to the tunnel; zero means the
+	// server-wide limit
+	MaxRPS float64
+
+	// AllowedClientCIDRs restricts the client networks that may reach the
+	// tunnel; empty allows all
+	AllowedClientCIDRs []string
+
+	// Static normalizes HEAD and Range handling for file serving
+	Static bool
+
+	// BackendScheme and BackendInsecureSkipVerify configure HTTPS backends
+	BackendScheme             string
+	BackendInsecureSkipVerify bool
+
+	// ErrorOverrides replaces proxy error responses by condition
+	ErrorOverrides map[string]tunnel.ErrorOverride
+
+	// Description is a human-readable note on the tunnel
+	Description string
+
+	// Routes send path prefixes to other backend ports
+	Routes []tunnel.Route
+
+	// RequestTimeout bounds each proxied request; zero keeps the server's
+	// timeouts
+	RequestTimeout time.Duration
+
+	// ClientCAPEM and RequireClientCert configure mutual TLS for the tunnel
+	ClientCAPEM       string
+	RequireClientCert bool
+}
+
+// UpdateOptions are the changes UpdateTunnel makes to a tunnel. Nil
+// fields are left as they are.
+type UpdateOptions struct {
+	Description *string
+	// Port sets the backend port
+	Port *uint16
 }
 
 // Registry manages active tunnels
 type Registry struct {
-	cfg    Config
-	logger *slog.Logger
-	
-	mu          sync.RWMutex
-	tunnels     map[string]*tunnel.Info
-	bySubdomain map[string]*tunnel.Info
-	
-	ipPool   *IPPool
-	keyGen   KeyGenerator
-	nameGen  NameGenerator
-	
-	ctx          context.Context
-	cancel       context.CancelFunc
+	cfg     Config
+	logger  *slog.Logger
+	metrics *metrics.Metrics
+
+	// peerMu is held shared by creations while they add their peer and
+	// exclusively by ReconcilePeers, so that reconciling never removes the
+	// peer of a tunnel that is about to be inserted. It is taken before mu.
+	peerMu sync.RWMutex
+
+	mu      sync.RWMutex
+	tunnels map[string]*tunnel.Info
+	// byHost maps a tunnel's hostname (subdomain.domain) to the tunnel.
+	// Names are namespaced per domain, so app.a.com and app.b.com are
+	// different tunnels. The maps below are keyed by hostname too.
+	byHost map[string]*tunnel.Info
+	// byOwner indexes tunnels by the key ID of their owner
+	byOwner map[string]map[string]*tunnel.Info
+	// pending maps the hostname of a tunnel whose peer is being added to
+	// the tunnel. Its name, public key and backend IP are taken, so that
+	// peers can be added without holding the lock.
+	pending map[string]*tunnel.Info
+	// version is bumped on every change to the tunnel set or a tunnel's
+	// settings, so listings can tell whether anything changed
+	version atomic.Uint64
+
+	// Auxiliary maps are bounded so churning creations can't grow them
+	// without limit.
+	//
+	// reservations maps a reserved hostname to the owner ID holding it.
+	// It mirrors pinnedReservations and reservedBy combined.
+	reservations map[string]string
+	// pinnedReservations maps an owner ID to a hostname reserved in config;
+	// these never expire
+	pinnedReservations map[string]string
+	// reservedBy maps an owner ID to a hostname reserved via the API
+	reservedBy *lru[string, string]
+
+	// tombstones maps recently expired hostnames to their tombstone
+	tombstones *lru[string, Tombstone]
+	// recentNames tracks recently freed hostnames
+	recentNames *lru[string, struct{}]
+	// released maps the public key of a recently removed tunnel to the
+	// IP and subdomain it may reclaim
+	released *lru[string, releasedTunnel]
+
+	ipPool  *IPPool
+	keyGen  KeyGenerator
+	nameGen NameGenerator
+
+	// onDelete hooks run for every removed tunnel
+	onDelete []func(*tunnel.Info)
+	// onExpire maps a tunnel ID to the callbacks to run once when that
+	// tunnel goes away
+	onExpire map[string][]func(*tunnel.Info, ExpireReason)
+	// events publishes tunnel lifecycle events
+	events *Hub
+
+	// trafficMu guards traffic counters, which are updated on every
+	// proxied request under the read lock. traffic holds each tunnel's
+	// recent history, bucketed by trafficNow.
+	trafficMu  sync.Mutex
+	traffic    map[string]*trafficHistory
+	trafficNow func() time.Time
+
+	// lastCleanup is the unix nano time of the last completed sweep
+	lastCleanup atomic.Int64
+	// cleanupReset wakes the cleanup loop to reschedule after the
+	// interval changed
+	cleanupReset chan struct{}
+
+	saveMu           sync.Mutex
+	saveTimer        *time.Timer
+	savePendingSince time.Time
+
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
 // New creates a new registry
 func NewRegistry(ctx context.Context, cfg Config, logger *slog.Logger) (*Registry, error) {
-	pool, err := NewIPPool(cfg.CIDR)
+	pool, err := NewIPPool(cfg.CIDR, cfg.PoolStartOffset, cfg.PoolRangeStart, cfg.PoolRangeEnd)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create IP pool: %w", err)
 	}
 	
+	if cfg.SaveDebounce == 0 {
+		cfg.SaveDebounce = DefaultSaveDebounce
+	}
+	if cfg.RevokedRetention == 0 {
+		cfg.RevokedRetention = DefaultRevokedRetention
+	}
+	if len(cfg.Domains) == 0 {
+		return nil, fmt.Errorf("at least one domain is required")
+	}
+	if cfg.Metrics == nil {
+		cfg.Metrics = metrics.New("")
+	}
+	nameGen, err := newNameGenerator(cfg.NameScheme, cfg.Rand)
+	if err != nil {
+		return nil, err
+	}
+
 	ctx, cancel := context.WithCancel(ctx)
 	
 	r := &Registry{
-		cfg:         cfg,
-		logger:      logger,
-		tunnels:     make(map[string]*tunnel.Info),
-		bySubdomain: make(map[string]*tunnel.Info),
-		ipPool:      pool,
-		keyGen:      &WireGuardKeyGenerator{},
-		nameGen:     &FriendlyNameGenerator{},
-		ctx:         ctx,
-		cancel:      cancel,
+		cfg:                cfg,
+		logger:             logger,
+		metrics:            cfg.Metrics,
+		tunnels:            make(map[string]*tunnel.Info),
+		byHost:             make(map[string]*tunnel.Info),
+		byOwner:            make(map[string]map[string]*tunnel.Info),
+		pending:            make(map[string]*tunnel.Info),
+		reservations:       make(map[string]string),
+		pinnedReservations: make(map[string]string),
+		reservedBy:         newLRU[string, string](maxReservations, reservationTTL),
+		tombstones:         newLRU[string, Tombstone](maxTombstones, tombstoneTTL),
+		recentNames:        newLRU[string, struct{}](maxRecentNames, nameCooldown),
+		released:           newLRU[string, releasedTunnel](maxReleased, ReclaimWindow),
+		ipPool:             pool,
+		keyGen:             NewWireGuardKeyGenerator(cfg.Rand),
+		nameGen:            nameGen,
+		cleanupReset:       make(chan struct{}, 1),
+		onExpire:           make(map[string][]func(*tunnel.Info, ExpireReason)),
+		events:             newHub(),
+		traffic:            make(map[string]*trafficHistory),
+		trafficNow:         time.Now,
+		ctx:                ctx,
+		cancel:             cancel,
 	}
 	
-	// Start cleanup routine
+	r.reservedBy.onEvict = func(owner, host string) {
+		if r.reservations[host] == owner {
+			delete(r.reservations, host)
+		}
+	}
+
+	for owner, name := range cfg.Reservations {
+		// A qualified name carries its domain after the first label
+		subdomain, domain, _ := strings.Cut(name, ".")
+		if err := r.reserve(owner, subdomain, domain, true); err != nil {
+			cancel()
+			return nil, fmt.Errorf("invalid reservation %q: %w", name, err)
+		}
+	}
+
+	if cfg.Store != nil {
+		if err := r.restore(); err != nil {
+			cancel()
+			return nil, err
+		}
+	}
+
+	// Start cleanup routine. Until the first sweep, startup counts as one.
+	r.lastCleanup.Store(time.Now().UnixNano())
 	go r.cleanupRoutine()
 	
 	// Update metrics
-	metrics.IPPoolAvailable.Set(float64(pool.Available()))
-	
+	r.metrics.IPPoolAvailable.Set(float64(pool.Available()))
+
 	return r, nil
 }
 
-// CreateTunnel creates a new tunnel
-func (r *Registry) CreateTunnel(port uint16) (*tunnel.Info, error) {
+// Reserve binds a subdomain of domain (the default domain when empty) to
+// an owner ID so tunnels created by that owner under the same domain reuse
+// it. An owner holds at most one reservation; reserving again replaces the
+// previous one. Reservations made this way lapse after reservationTTL
+// without use.
+func (r *Registry) Reserve(owner, subdomain, domain string) error {
+	return r.reserve(owner, subdomain, domain, false)
+}
+
+// reserve records a reservation; pinned ones come from config and are
+// never evicted
+func (r *Registry) reserve(owner, subdomain, domain string, pinned bool) error {
+	if owner == "" {
+		return fmt.Errorf("owner is required")
+	}
+	subdomain = strings.ToLower(subdomain)
+	if !ValidSubdomain(subdomain) {
+		return ErrInvalidSubdomain
+	}
+	domain, err := r.resolveDomain(domain)
+	if err != nil {
+		return err
+	}
+	host := hostname(subdomain, domain)
+
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	
-	// Allocate IP
-	ip, err := r.ipPool.Allocate()
+
+	if holder, ok := r.reservations[host]; ok && holder != owner {
+		return ErrSubdomainReserved
+	}
+	if t := r.byHost[host]; t != nil && t.OwnerID != owner {
+		return ErrSubdomainReserved
+	}
+	if t := r.pending[host]; t != nil && t.OwnerID != owner {
+		return ErrSubdomainReserved
+	}
+
+	if prev, ok := r.reservationForLocked(owner); ok {
+		delete(r.reservations, prev)
+	}
+	r.reservations[host] = owner
+	if pinned {
+		r.pinnedReservations[owner] = host
+		r.reservedBy.Delete(owner)
+	} else {
+		delete(r.pinnedReservations, owner)
+		r.reservedBy.Put(owner, host)
+	}
+
+	r.logger.Info("subdomain reserved", slog.String("subdomain", subdomain), slog.String("domain", domain))
+	return nil
+}
+
+// hostname joins a subdomain and domain into the key used by the
+// registry's maps. DNS names are case-insensitive, so keys are lowercase
+// and a Host of MyApp.Example.com finds the myapp tunnel.
+func hostname(subdomain, domain string) string {
+	return strings.ToLower(subdomain + "." + domain)
+}
+
+// resolveDomain returns domain, or the default domain when it's empty,
+// checking that it is one the server serves
+func (r *Registry) resolveDomain(domain string) (string, error) {
+	if domain == "" {
+		return r.cfg.Domains[0], nil
+	}
+	for _, d := range r.cfg.Domains {
+		if strings.EqualFold(d, domain) {
+			return d, nil
+		}
+	}
+	return "", fmt.Errorf("%w: %q", ErrUnknownDomain, domain)
+}
+
+// reservationForLocked returns the hostname reserved by key, refreshing
+// its last use (must be called with lock held)
+func (r *Registry) reservationForLocked(key string) (string, bool) {
+	if host, ok := r.pinnedReservations[key]; ok {
+		return host, true
+	}
+	return r.reservedBy.Get(key)
+}
+
+const (
+	// nameCooldown is how long a freed subdomain is avoided
+	nameCooldown = time.Hour
+	// maxRecentNames bounds how many freed subdomains are remembered
+	maxRecentNames = 1024
+	// maxNameAttempts bounds retries when avoiding recently freed names
+	maxNameAttempts = 16
+	// maxPickAttempts bounds generated names tried before giving up, so
+	// a crowded name space or a predictable generator can't spin forever
+	// under the lock
+	maxPickAttempts = 1000
+
+	// maxReservations bounds API-made reservations; the least recently
+	// used is evicted first
+	maxReservations = 10000
+	// reservationTTL is how long an unused API-made reservation is kept
+	reservationTTL = 30 * 24 * time.Hour
+	// maxTombstones bounds how many expired subdomains are remembered
+	maxTombstones = 4096
+
+	// ReclaimWindow is how long after a tunnel goes away its public key
+	// can reclaim its IP and subdomain
+	ReclaimWindow = 10 * time.Minute
+	// maxReleased bounds how many released tunnels are remembered
+	maxReleased = 4096
+)
+
+// releasedTunnel is what a recreated tunnel with the same public key
+// reclaims
+type releasedTunnel struct {
+	Subdomain string
+	Domain    string
+	AllowedIP string
+	OwnerID   string
+}
+
+// pickSubdomainLocked chooses a subdomain of domain for a new tunnel,
+// preferring the owner's reservation in that domain when it's free.
+// Generated names never collide with active or reserved ones and avoid
+// recently freed names while alternatives exist (must be called with lock
+// held). It gives up with ErrNoSubdomainAvailable after maxPickAttempts.
+func (r *Registry) pickSubdomainLocked(owner, domain string) (string, error) {
+	if reserved, ok := r.reservationForLocked(owner); ok && owner != "" {
+		subdomain, reservedDomain, _ := strings.Cut(reserved, ".")
+		if strings.EqualFold(reservedDomain, domain) && !r.hostTakenLocked(reserved) {
+			return subdomain, nil
+		}
+	}
+
+	for attempt := 0; attempt < maxPickAttempts; attempt++ {
+		name := r.nameGen.Generate()
+		host := hostname(name, domain)
+		if _, reserved := r.reservations[host]; reserved {
+			continue
+		}
+		if r.hostTakenLocked(host) {
+			continue
+		}
+		if _, recent := r.recentNames.Peek(host); recent && attempt < maxNameAttempts {
+			continue
+		}
+		return name, nil
+	}
+	return "", fmt.Errorf("%w under %s after %d attempts", ErrNoSubdomainAvailable, domain, maxPickAttempts)
+}
+
+// validateBackendHostLocked checks that host is a private or link-local
+// unicast IP outside the tunnel network that no tunnel other than self
+// routes to (must be called with lock held). WireGuard routes by
+// destination IP, so two peers can't share one, and a public address
+// would let a tenant capture everyone's traffic to it.
+func (r *Registry) validateBackendHostLocked(host string, self *tunnel.Info) error {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return fmt.Errorf("%w: %q is not an IP address", ErrInvalidBackendHost, host)
+	}
+	if ip.IsLoopback() || ip.IsUnspecified() || ip.IsMulticast() {
+		return fmt.Errorf("%w: %s is not routable", ErrInvalidBackendHost, host)
+	}
+	if !ip.IsPrivate() && !ip.IsLinkLocalUnicast() {
+		return fmt.Errorf("%w: %s is not a private or link-local address", ErrInvalidBackendHost, host)
+	}
+	if r.ipPool.network.Contains(ip) {
+		return fmt.Errorf("%w: %s is inside the tunnel network", ErrInvalidBackendHost, host)
+	}
+	// Routing a resolver's address to one peer would hand it every
+	// tunnel's lookups
+	for _, resolver := range r.cfg.DNSResolvers {
+		if h, _, err := net.SplitHostPort(resolver); err == nil && net.ParseIP(h).Equal(ip) {
+			return fmt.Errorf("%w: %s is a DNS resolver", ErrInvalidBackendHost, host)
+		}
+	}
+	for _, tunnels := range []map[string]*tunnel.Info{r.tunnels, r.pending} {
+		for _, t := range tunnels {
+			if t != self && t.BackendAddr() == ip.String() {
+				return fmt.Errorf("%w: %s is already used by another tunnel", ErrInvalidBackendHost, host)
+			}
+		}
+	}
+	return nil
+}
+
+// hostTakenLocked reports whether a live or pending tunnel has the
+// hostname host (must be called with lock held)
+func (r *Registry) hostTakenLocked(host string) bool {
+	return r.byHost[host] != nil || r.pending[host] != nil
+}
+
+// CreateTunnel creates a new tunnel
+func (r *Registry) CreateTunnel(port uint16, opts CreateOptions) (*tunnel.Info, error) {
+	return r.CreateTunnelWithPeer(port, opts, nil)
+}
+
+// Peers adds and removes the WireGuard peers of tunnels being created
+type Peers interface {
+	AddPeer(t *tunnel.Info) error
+	RemovePeer(t *tunnel.Info) error
+}
+
+// CreateTunnelWithPeer creates a new tunnel and adds its peer with peers,
+// which may be nil. The peer is added without holding the registry lock,
+// since WireGuard IPC can be slow; meanwhile the tunnel's name, public key
+// and backend IP are held for it. The tunnel only becomes visible, and
+// metrics only change, once the peer is added; on failure the IP is
+// released and the registry is left untouched.
+func (r *Registry) CreateTunnelWithPeer(port uint16, opts CreateOptions, peers Peers) (*tunnel.Info, error) {
+	domain, err := r.resolveDomain(opts.Domain)
 	if err != nil {
-		metrics.IPPoolExhausted.Inc()
-		return nil, fmt.Errorf("failed to allocate IP: %w", err)
+		return nil, err
 	}
-	
-	// Generate keys
-	privateKey, publicKey, err := r.keyGen.Generate()
+
+	p, err := r.prepareTunnel(opts)
 	if err != nil {
-		if releaseErr := r.ipPool.Release(ip); releaseErr != nil {
-			r.logger.Error("failed to release IP after key generation error", 
-				slog.Any("error", releaseErr), slog.String("ip", ip.String()))
+		return nil, err
+	}
+
+	t, _, err := r.createTunnel(port, domain, p, peers, nil)
+	return t, err
+}
+
+// ReuseOrCreateTunnel returns the owner's active tunnel for port under the
+// requested domain when there is one, and otherwise creates a tunnel like
+// CreateTunnelWithPeer. created reports which happened. Without an owner
+// key there is nothing to match, so a tunnel is always created.
+func (r *Registry) ReuseOrCreateTunnel(port uint16, opts CreateOptions, peers Peers) (t *tunnel.Info, created bool, err error) {
+	domain, err := r.resolveDomain(opts.Domain)
+	if err != nil {
+		return nil, false, err
+	}
+	findOwned := func() *tunnel.Info {
+		return r.findOwnedLocked(opts.OwnerID, domain, port)
+	}
+
+	r.mu.Lock()
+	t = findOwned()
+	r.mu.Unlock()
+	if t != nil {
+		t.UpdateLastSeen()
+		return t, false, nil
+	}
+
+	p, err := r.prepareTunnel(opts)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return r.createTunnel(port, domain, p, peers, findOwned)
+}
+
+// createTunnel creates the tunnel p under domain: it is staged under the
+// lock, its peer is added without the lock, and it is inserted under the
+// lock again. existing, when not nil, is called under the lock before
+// staging and before inserting; a tunnel it returns is used instead,
+// undoing the peer if it was already added.
+func (r *Registry) createTunnel(port uint16, domain string, p *pendingTunnel, peers Peers, existing func() *tunnel.Info) (*tunnel.Info, bool, error) {
+	r.peerMu.RLock()
+	defer r.peerMu.RUnlock()
+
+	r.mu.Lock()
+	if existing != nil {
+		if t := existing(); t != nil {
+			r.mu.Unlock()
+			r.releasePending(p)
+			t.UpdateLastSeen()
+			return t, false, nil
 		}
-		return nil, fmt.Errorf("failed to generate keys: %w", err)
 	}
-	
-	// Generate subdomain
-	subdomain := r.nameGen.Generate()
-	
+	t, err := r.stageTunnelLocked(port, domain, p)
+	r.mu.Unlock()
+	if err != nil {
+		r.releasePending(p)
+		return nil, false, err
+	}
+
+	var peerErr error
+	if peers != nil {
+		peerErr = peers.AddPeer(t)
+	}
+
+	r.mu.Lock()
+	delete(r.pending, hostname(t.Subdomain, t.Domain))
+	if peerErr != nil {
+		r.mu.Unlock()
+		r.releasePending(p)
+		return nil, false, fmt.Errorf("%w: %w", ErrPeerAdd, peerErr)
+	}
+	if existing != nil {
+		// Another request may have created one meanwhile
+		if other := existing(); other != nil {
+			r.mu.Unlock()
+			if peers != nil {
+				if err := peers.RemovePeer(t); err != nil {
+					r.logger.Error("failed to remove peer of uncreated tunnel",
+						slog.Any("error", err), slog.String("ip", t.AllowedIP))
+				}
+			}
+			r.releasePending(p)
+			other.UpdateLastSeen()
+			return other, false, nil
+		}
+	}
+	r.insertTunnelLocked(t)
+	r.mu.Unlock()
+	return t, true, nil
+}
+
+// ReconcilePeers calls apply with the peers of all tunnels, revoked ones
+// excluded, holding off creations until it returns so that the peer set
+// can't go stale while it is applied. It returns the number of peers.
+func (r *Registry) ReconcilePeers(apply func([]tunnel.PeerSpec) error) (int, error) {
+	r.peerMu.Lock()
+	defer r.peerMu.Unlock()
+
+	var peers []tunnel.PeerSpec
+	for _, t := range r.ListTunnels() {
+		if t.Revoked {
+			continue
+		}
+		peers = append(peers, tunnel.PeerSpec{
+			PublicKey:  t.PublicKey,
+			AllowedIPs: append([]string{t.AllowedIP}, t.PeerAllowedIPs()...),
+		})
+	}
+	return len(peers), apply(peers)
+}
+
+// findOwnedLocked returns the owner's live tunnel for port under domain,
+// the one expiring last if there are several (must be called with lock
+// held)
+func (r *Registry) findOwnedLocked(owner, domain string, port uint16) *tunnel.Info {
+	if owner == "" {
+		return nil
+	}
+	var found *tunnel.Info
+	for _, t := range r.byOwner[owner] {
+		if t.Port != port || t.Domain != domain || t.Revoked || t.IsExpired() {
+			continue
+		}
+		if found == nil || t.ExpiresAt.After(found.ExpiresAt) {
+			found = t
+		}
+	}
+	return found
+}
+
+// pendingTunnel holds what a tunnel needs before it is committed to the
+// registry: validated options, an IP and keys
+type pendingTunnel struct {
+	opts        CreateOptions
+	clientCIDRs []string
+	ip          net.IP
+	privateKey  string
+	publicKey   string
+	// reclaimed is the released tunnel being reclaimed, if any
+	reclaimed *releasedTunnel
+}
+
+// prepareTunnel validates the parts of opts that don't depend on other
+// tunnels, then allocates an IP and generates keys. It runs without the
+// registry lock so that the costly steps (CA parsing, key generation)
+// don't serialize creations; the IP pool has its own lock. The IP must be
+// released with releasePending unless the tunnel is committed.
+func (r *Registry) prepareTunnel(opts CreateOptions) (*pendingTunnel, error) {
+	switch {
+	case opts.BackendHost == "":
+	case net.ParseIP(opts.BackendHost) != nil:
+		opts.BackendHost = net.ParseIP(opts.BackendHost).String()
+	default:
+		// Hostnames are resolved on first use, with the tunnel's resolver
+		opts.BackendHost = strings.ToLower(strings.TrimSuffix(opts.BackendHost, "."))
+		if !validHostname(opts.BackendHost) {
+			return nil, fmt.Errorf("%w: %q is not an IP address or hostname", ErrInvalidBackendHost, opts.BackendHost)
+		}
+		if opts.DNSResolver == "" {
+			return nil, fmt.Errorf("%w: hostname backends need a DNS resolver", ErrInvalidBackendHost)
+		}
+	}
+
+	if opts.DNSResolver != "" && opts.DNSResolver != tunnel.PeerResolver && !slices.Contains(r.cfg.DNSResolvers, opts.DNSResolver) {
+		return nil, fmt.Errorf("%w: %q is not %q or a configured resolver", ErrInvalidDNSResolver, opts.DNSResolver, tunnel.PeerResolver)
+	}
+
+	// Store networks in canonical form, e.g. 10.1.2.3/8 as 10.0.0.0/8
+	p := &pendingTunnel{}
+	for _, cidr := range opts.AllowedClientCIDRs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidClientCIDR, cidr)
+		}
+		p.clientCIDRs = append(p.clientCIDRs, network.String())
+	}
+
+	if opts.RequireClientCert || opts.ClientCAPEM != "" {
+		if _, err := tunnel.ParseCAPool(opts.ClientCAPEM); err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidClientCA, err)
+		}
+	}
+
+	if opts.Subdomain != "" {
+		opts.Subdomain = strings.ToLower(opts.Subdomain)
+		if !ValidSubdomain(opts.Subdomain) {
+			return nil, ErrInvalidSubdomain
+		}
+	}
+
+	if opts.ClientPublicKey != "" {
+		if err := tunnel.ValidateKey(opts.ClientPublicKey); err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidPublicKey, err)
+		}
+	}
+	p.opts = opts
+
+	// Allocate IP, the released tunnel's when reclaiming and it's free
+	if opts.Reclaim && opts.ClientPublicKey != "" {
+		r.mu.Lock()
+		rel, ok := r.released.Peek(opts.ClientPublicKey)
+		r.mu.Unlock()
+		if ok && rel.OwnerID == opts.OwnerID {
+			p.reclaimed = &rel
+			if r.ipPool.Claim(rel.AllowedIP) == nil {
+				p.ip = net.ParseIP(rel.AllowedIP)
+			}
+		}
+	}
+	if p.ip == nil {
+		ip, err := r.ipPool.Allocate()
+		if err != nil {
+			r.metrics.IPPoolExhausted.Inc()
+			return nil, fmt.Errorf("failed to allocate IP: %w", err)
+		}
+		p.ip = ip
+	}
+
+	// Generate keys unless the client brought its own
+	p.publicKey = opts.ClientPublicKey
+	if p.publicKey == "" {
+		var err error
+		p.privateKey, p.publicKey, err = r.keyGen.Generate()
+		if err != nil {
+			r.releasePending(p)
+			return nil, fmt.Errorf("failed to generate keys: %w", err)
+		}
+	}
+	return p, nil
+}
+
+// releasePending returns the IP of a tunnel that won't be committed
+func (r *Registry) releasePending(p *pendingTunnel) {
+	if err := r.ipPool.Release(p.ip); err != nil {
+		r.logger.Error("failed to release IP of uncreated tunnel",
+			slog.Any("error", err), slog.String("ip", p.ip.String()))
+	}
+}
+
+// stageTunnelLocked runs the checks against other tunnels, picks the
+// subdomain and builds the tunnel under domain, holding its name, public
+// key and backend IP until it is inserted or dropped from r.pending (must
+// be called with lock held)
+func (r *Registry) stageTunnelLocked(port uint16, domain string, p *pendingTunnel) (*tunnel.Info, error) {
+	opts := p.opts
+	if err := r.checkConflictsLocked(domain, p); err != nil {
+		return nil, err
+	}
+
+	// Pick subdomain
+	subdomain := opts.Subdomain
+	if subdomain == "" && p.reclaimed != nil {
+		subdomain = r.reclaimSubdomainLocked(*p.reclaimed, opts.OwnerID, domain)
+	}
+	if subdomain == "" {
+		var err error
+		if subdomain, err = r.pickSubdomainLocked(opts.OwnerID, domain); err != nil {
+			return nil, err
+		}
+	}
+	ttl := r.tunnelTTLLocked(opts.OwnerID, opts.TTL)
+	now := time.Now()
+
 	// Create tunnel
 	t := &tunnel.Info{
-		ID:         uuid.New().String(),
-		Subdomain:  subdomain,
-		Port:       port,
-		PublicKey:  publicKey,
-		PrivateKey: privateKey,
-		AllowedIP:  ip.String(),
-		CreatedAt:  time.Now(),
-		ExpiresAt:  time.Now().Add(r.cfg.DefaultTTL),
-		LastSeen:   time.Now(),
+		ID:                        uuid.New().String(),
+		Subdomain:                 subdomain,
+		Domain:                    domain,
+		Port:                      port,
+		PublicKey:                 p.publicKey,
+		PrivateKey:                p.privateKey,
+		AllowedIP:                 p.ip.String(),
+		OwnerID:                   opts.OwnerID,
+		BackendHost:               opts.BackendHost,
+		DNSResolver:               opts.DNSResolver,
+		ClientCAPEM:               opts.ClientCAPEM,
+		RequireClientCert:         opts.RequireClientCert,
+		StripResponseHeaders:      opts.StripResponseHeaders,
+		AllowedMethods:            opts.AllowedMethods,
+		Labels:                    opts.Labels,
+		MaxRPS:                    opts.MaxRPS,
+		AllowedClientCIDRs:        p.clientCIDRs,
+		Static:                    opts.Static,
+		BackendScheme:             opts.BackendScheme,
+		BackendInsecureSkipVerify: opts.BackendInsecureSkipVerify,
+		ErrorOverrides:            opts.ErrorOverrides,
+		Description:               opts.Description,
+		Routes:                    opts.Routes,
+		RequestTimeout:            opts.RequestTimeout,
+		CreatedAt:                 now,
+		ExpiresAt:                 now.Add(ttl),
 	}
-	
-	r.tunnels[t.ID] = t
-	r.bySubdomain[t.Subdomain] = t
+	t.Track(now, 0, 0)
+	r.pending[hostname(t.Subdomain, t.Domain)] = t
+	return t, nil
+}
+
+// insertTunnelLocked makes a staged tunnel live (must be called with lock
+// held)
+func (r *Registry) insertTunnelLocked(t *tunnel.Info) {
+	r.insertLocked(t)
+	r.tombstones.Delete(hostname(t.Subdomain, t.Domain))
+	r.released.Delete(t.PublicKey)
+	r.scheduleSave()
 	
 	// Update metrics
-	metrics.TunnelsActive.Inc()
-	metrics.TunnelsCreated.Inc()
-	metrics.IPPoolAvailable.Set(float64(r.ipPool.Available()))
-	
-	r.logger.Info("tunnel created", 
-		slog.String("id", t.ID), 
+	r.metrics.TunnelsActive.Inc()
+	r.metrics.TunnelsCreated.Inc()
+	if t.OwnerID != "" {
+		r.metrics.KeyTunnelsCreated(t.OwnerID).Inc()
+	}
+	r.metrics.IPPoolAvailable.Set(float64(r.ipPool.Available()))
+	r.events.Publish(TunnelEvent(EventTunnelCreated, t))
+
+	r.logger.Info("tunnel created",
+		slog.String("id", t.ID),
 		slog.String("subdomain", t.Subdomain),
+		slog.String("domain", t.Domain),
 		slog.String("ip", t.AllowedIP),
-		slog.Duration("ttl", r.cfg.DefaultTTL))
-	
-	return t, nil
+		slog.Duration("ttl", t.ExpiresAt.Sub(t.CreatedAt)))
+}
+
+// tunnelTTLLocked returns the lifetime of a new tunnel owned by owner that
+// asked for requested (zero for the default), capped at the owner's max
+// TTL (must be called with lock held)
+func (r *Registry) tunnelTTLLocked(owner string, requested time.Duration) time.Duration {
+	ceiling := r.cfg.MaxTTL
+	if ceiling <= 0 {
+		ceiling = r.cfg.DefaultTTL
+	}
+	if keyMax, ok := r.cfg.KeyMaxTTLs[owner]; ok && owner != "" {
+		ceiling = keyMax
+	}
+
+	ttl := r.cfg.DefaultTTL
+	if requested > 0 {
+		ttl = requested
+	}
+	return min(ttl, ceiling)
+}
+
+// reclaimSubdomainLocked returns the subdomain of a released tunnel when
+// it was under domain and is still free for owner, or "" (must be called
+// with lock held)
+func (r *Registry) reclaimSubdomainLocked(rel releasedTunnel, owner, domain string) string {
+	if !strings.EqualFold(rel.Domain, domain) {
+		return ""
+	}
+	host := hostname(rel.Subdomain, domain)
+	if reservedBy, ok := r.reservations[host]; ok && reservedBy != owner {
+		return ""
+	}
+	if r.hostTakenLocked(host) {
+		return ""
+	}
+	return rel.Subdomain
+}
+
+// checkConflictsLocked checks a pending tunnel against the existing ones:
+// its backend IP, public key and requested subdomain must all be free
+// (must be called with lock held)
+func (r *Registry) checkConflictsLocked(domain string, p *pendingTunnel) error {
+	opts := p.opts
+	if opts.BackendHost != "" && net.ParseIP(opts.BackendHost) != nil {
+		if err := r.validateBackendHostLocked(opts.BackendHost, nil); err != nil {
+			return err
+		}
+	}
+
+	if opts.Subdomain != "" {
+		host := hostname(opts.Subdomain, domain)
+		if owner, ok := r.reservations[host]; ok && owner != opts.OwnerID {
+			return ErrSubdomainReserved
+		}
+		if r.hostTakenLocked(host) {
+			return ErrSubdomainTaken
+		}
+	}
+
+	if opts.ClientPublicKey != "" {
+		// WireGuard identifies peers by public key, so it can't be shared
+		for _, tunnels := range []map[string]*tunnel.Info{r.tunnels, r.pending} {
+			for _, t := range tunnels {
+				if t.PublicKey == opts.ClientPublicKey {
+					return fmt.Errorf("%w: already in use by another tunnel", ErrInvalidPublicKey)
+				}
+			}
+		}
+	}
+	return nil
 }
 
 // GetTunnel retrieves a tunnel by ID
@@ -133,18 +1014,81 @@ func (r *Registry) GetTunnel(id string) *tunnel.Info {
 	return t
 }
 
-// GetTunnelBySubdomain retrieves a tunnel by subdomain
-func (r *Registry) GetTunnelBySubdomain(subdomain string) *tunnel.Info {
+// GetTunnelBySubdomain retrieves a tunnel by subdomain within domain (the
+// default domain when empty)
+func (r *Registry) GetTunnelBySubdomain(subdomain, domain string) *tunnel.Info {
+	if domain == "" {
+		domain = r.cfg.Domains[0]
+	}
+
 	r.mu.RLock()
 	defer r.mu.RUnlock()
 	
-	t := r.bySubdomain[subdomain]
+	t := r.byHost[hostname(subdomain, domain)]
 	if t != nil {
 		t.UpdateLastSeen()
 	}
 	return t
 }
 
+// RecentlyExpired returns the tombstone for a subdomain of domain whose
+// tunnel expired within the last few minutes
+func (r *Registry) RecentlyExpired(subdomain, domain string) (Tombstone, bool) {
+	if domain == "" {
+		domain = r.cfg.Domains[0]
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.tombstones.Peek(hostname(subdomain, domain))
+}
+
+// OnDelete registers fn to run whenever a tunnel is removed, whether
+// deleted, expired or cleaned up on close. It runs with the registry lock
+// held, so it must be quick and must not call back into the registry.
+func (r *Registry) OnDelete(fn func(*tunnel.Info)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.onDelete = append(r.onDelete, fn)
+}
+
+// ExpireReason says why a tunnel passed to an OnExpire callback went away
+type ExpireReason string
+
+const (
+	// ExpireReasonExpired means its TTL ran out
+	ExpireReasonExpired ExpireReason = "expired"
+	// ExpireReasonDeleted means it was deleted before expiring
+	ExpireReasonDeleted ExpireReason = "deleted"
+	// ExpireReasonRevoked means it was revoked and then reaped
+	ExpireReasonRevoked ExpireReason = "revoked"
+	// ExpireReasonShutdown means the registry closed without a store
+	ExpireReasonShutdown ExpireReason = "shutdown"
+)
+
+// OnExpire registers fn to run exactly once when the tunnel id goes away,
+// e.g. to revoke its DNS records, with the reason it went away. Like
+// OnDelete hooks it runs with the registry lock held, so it must be quick
+// and must not call back into the registry.
+func (r *Registry) OnExpire(id string, fn func(*tunnel.Info, ExpireReason)) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, exists := r.tunnels[id]; !exists {
+		return fmt.Errorf("%w: %s", ErrTunnelNotFound, id)
+	}
+	r.onExpire[id] = append(r.onExpire[id], fn)
+	return nil
+}
+
+// Events returns the hub tunnel lifecycle events are published on. Others
+// may publish server-wide events there too.
+func (r *Registry) Events() *Hub {
+	return r.events
+}
+
 // DeleteTunnel removes a tunnel
 func (r *Registry) DeleteTunnel(id string) error {
 	r.mu.Lock()
@@ -152,34 +1096,259 @@ func (r *Registry) DeleteTunnel(id string) error {
 	
 	t, exists := r.tunnels[id]
 	if !exists {
-		return fmt.Errorf("tunnel not found: %s", id)
+		return fmt.Errorf("%w: %s", ErrTunnelNotFound, id)
 	}
-	
-	return r.deleteTunnelLocked(t)
+
+	reason := ExpireReasonDeleted
+	if t.IsExpired() {
+		reason = ExpireReasonExpired
+	}
+	return r.deleteTunnelLocked(t, reason)
+}
+
+// UpdateTunnel applies opts to a copy of a live tunnel, swaps the copy in
+// and returns it
+func (r *Registry) UpdateTunnel(id string, opts UpdateOptions) (*tunnel.Info, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	t, exists := r.tunnels[id]
+	if !exists {
+		return nil, fmt.Errorf("%w: %s", ErrTunnelNotFound, id)
+	}
+
+	t = t.Clone()
+	if opts.Description != nil {
+		t.Description = *opts.Description
+	}
+	if opts.Port != nil {
+		t.Port = *opts.Port
+	}
+	r.replaceLocked(t)
+	r.scheduleSave()
+	return t, nil
+}
+
+// SetResolvedBackend records the address a tunnel's hostname backend
+// resolved to, after checking it like a backend IP given at creation, and
+// returns the tunnel as registered afterwards. It reports whether the
+// address changed, in which case the caller must update the peer's routes.
+func (r *Registry) SetResolvedBackend(id, ip string) (*tunnel.Info, bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	t, exists := r.tunnels[id]
+	if !exists {
+		return nil, false, fmt.Errorf("%w: %s", ErrTunnelNotFound, id)
+	}
+	if !t.BackendIsHostname() {
+		return nil, false, fmt.Errorf("%w: tunnel %s has no hostname backend", ErrInvalidBackendHost, id)
+	}
+	if err := r.validateBackendHostLocked(ip, t); err != nil {
+		return nil, false, err
+	}
+	ip = net.ParseIP(ip).String()
+	if t.ResolvedBackendIP == ip {
+		return t, false, nil
+	}
+
+	t = t.Clone()
+	t.ResolvedBackendIP = ip
+	r.replaceLocked(t)
+	r.scheduleSave()
+	return t, true, nil
+}
+
+// validHostname reports whether host is a DNS name made of valid labels
+func validHostname(host string) bool {
+	if host == "" || len(host) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(host, ".") {
+		if !subdomainPattern.MatchString(label) {
+			return false
+		}
+	}
+	return true
 }
 
-// deleteTunnelLocked removes a tunnel (must be called with lock held)
-func (r *Registry) deleteTunnelLocked(t *tunnel.Info) error {
+// RevokeTunnel marks a tunnel revoked. It stays listed so operators can
+// inspect it, but the proxy refuses its traffic and cleanup reaps it once
+// RevokedRetention has passed. Revoking twice is a no-op; the returned
+// bool reports whether this call revoked it, so callers remove its peer
+// only once.
+func (r *Registry) RevokeTunnel(id string) (*tunnel.Info, bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	t, exists := r.tunnels[id]
+	if !exists {
+		return nil, false, fmt.Errorf("%w: %s", ErrTunnelNotFound, id)
+	}
+	if t.Revoked {
+		return t, false, nil
+	}
+
+	t = t.Clone()
+	t.Revoked = true
+	t.RevokedAt = time.Now()
+	t.ExpiresAt = t.RevokedAt.Add(r.cfg.RevokedRetention)
+	r.replaceLocked(t)
+	r.scheduleSave()
+
+	r.metrics.TunnelsRevoked.Inc()
+	r.events.Publish(TunnelEvent(EventTunnelRevoked, t))
+	r.logger.Info("tunnel revoked",
+		slog.String("id", t.ID), slog.String("subdomain", t.Subdomain))
+
+	return t, true, nil
+}
+
+// FlagTunnel marks a tunnel for admin review, e.g. after it served blocked
+// content. Its traffic is not affected. Only the first flag is recorded;
+// the returned bool reports whether this call flagged it.
+func (r *Registry) FlagTunnel(id, reason string) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	t, exists := r.tunnels[id]
+	if !exists {
+		return false, fmt.Errorf("%w: %s", ErrTunnelNotFound, id)
+	}
+	if t.Flagged {
+		return false, nil
+	}
+
+	t = t.Clone()
+	t.Flagged = true
+	t.FlaggedAt = time.Now()
+	t.FlagReason = reason
+	r.replaceLocked(t)
+	r.scheduleSave()
+
+	r.metrics.TunnelsFlagged.Inc()
+	event := TunnelEvent(EventTunnelFlagged, t)
+	event.Message = reason
+	r.events.Publish(event)
+	r.logger.Warn("tunnel flagged for review",
+		slog.String("id", t.ID), slog.String("subdomain", t.Subdomain),
+		slog.String("reason", reason))
+
+	return true, nil
+}
+
+// deleteTunnelLocked removes a tunnel (must be called with lock held).
+// reason is passed to the tunnel's OnExpire callbacks.
+func (r *Registry) deleteTunnelLocked(t *tunnel.Info, reason ExpireReason) error {
 	// Release IP
 	if err := r.ipPool.ReleaseString(t.AllowedIP); err != nil {
-		r.logger.Error("failed to release IP", 
+		r.logger.Error("failed to release IP",
 			slog.Any("error", err), slog.String("ip", t.AllowedIP))
 	}
 	
-	delete(r.tunnels, t.ID)
-	delete(r.bySubdomain, t.Subdomain)
+	r.removeLocked(t)
+	r.recentNames.Put(hostname(t.Subdomain, t.Domain), struct{}{})
+	// Revoked tunnels must not come back
+	if !t.Revoked {
+		r.released.Put(t.PublicKey, releasedTunnel{
+			Subdomain: t.Subdomain,
+			Domain:    t.Domain,
+			AllowedIP: t.AllowedIP,
+			OwnerID:   t.OwnerID,
+		})
+	}
+	r.scheduleSave()
 	
+	for _, fn := range r.onDelete {
+		fn(t)
+	}
+	callbacks := r.onExpire[t.ID]
+	delete(r.onExpire, t.ID)
+	for _, fn := range callbacks {
+		fn(t, reason)
+	}
+	event := EventTunnelDeleted
+	if t.IsExpired() {
+		event = EventTunnelExpired
+	}
+	r.events.Publish(TunnelEvent(event, t))
+
 	// Update metrics
-	metrics.TunnelsActive.Dec()
-	metrics.TunnelsDeleted.Inc()
-	metrics.IPPoolAvailable.Set(float64(r.ipPool.Available()))
-	
-	r.logger.Info("tunnel deleted", 
+	r.metrics.TunnelsActive.Dec()
+	r.metrics.TunnelsDeleted.Inc()
+	r.metrics.IPPoolAvailable.Set(float64(r.ipPool.Available()))
+
+	r.logger.Info("tunnel deleted",
 		slog.String("id", t.ID), slog.String("subdomain", t.Subdomain))
 	
 	return nil
 }
 
+// insertLocked adds a tunnel to the registry's maps and indexes (must be
+// called with lock held)
+func (r *Registry) insertLocked(t *tunnel.Info) {
+	r.version.Add(1)
+	r.tunnels[t.ID] = t
+	r.byHost[hostname(t.Subdomain, t.Domain)] = t
+	if t.OwnerID != "" {
+		if r.byOwner[t.OwnerID] == nil {
+			r.byOwner[t.OwnerID] = make(map[string]*tunnel.Info)
+		}
+		r.byOwner[t.OwnerID][t.ID] = t
+	}
+}
+
+// replaceLocked swaps in t, a changed clone of a registered tunnel, in
+// the registry's maps and indexes (must be called with lock held). Infos
+// are copy-on-write: the proxy reads them without the lock, so they are
+// never changed once registered.
+func (r *Registry) replaceLocked(t *tunnel.Info) {
+	r.version.Add(1)
+	r.tunnels[t.ID] = t
+	r.byHost[hostname(t.Subdomain, t.Domain)] = t
+	if t.OwnerID != "" {
+		r.byOwner[t.OwnerID][t.ID] = t
+	}
+}
+
+// removeLocked drops a tunnel from the registry's maps and indexes (must
+// be called with lock held)
+func (r *Registry) removeLocked(t *tunnel.Info) {
+	r.version.Add(1)
+	delete(r.tunnels, t.ID)
+	r.trafficMu.Lock()
+	delete(r.traffic, t.ID)
+	r.trafficMu.Unlock()
+	delete(r.byHost, hostname(t.Subdomain, t.Domain))
+	if t.OwnerID != "" {
+		delete(r.byOwner[t.OwnerID], t.ID)
+		if len(r.byOwner[t.OwnerID]) == 0 {
+			delete(r.byOwner, t.OwnerID)
+		}
+	}
+}
+
+// Version returns a counter that increases whenever a tunnel is added,
+// removed or changed. Read it before listing: a listing is at least as new
+// as the version read before it.
+func (r *Registry) Version() uint64 {
+	return r.version.Load()
+}
+
+// ListTunnelsByOwner returns the active tunnels created with the API key
+// identified by keyID (see apikey.ID)
+func (r *Registry) ListTunnelsByOwner(keyID string) []*tunnel.Info {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	owned := r.byOwner[keyID]
+	tunnels := make([]*tunnel.Info, 0, len(owned))
+	for _, t := range owned {
+		tunnels = append(tunnels, t)
+	}
+	return tunnels
+}
+
 // ListTunnels returns all active tunnels
 func (r *Registry) ListTunnels() []*tunnel.Info {
 	r.mu.RLock()
@@ -192,59 +1361,231 @@ func (r *Registry) ListTunnels() []*tunnel.Info {
 	return tunnels
 }
 
+// cleanupBatchSize is how many expired tunnels are deleted per write lock
+const cleanupBatchSize = 100
+
+// UpdateConfig applies the reloadable settings of cfg: DefaultTTL,
+// CleanupInterval and MinCleanupInterval. Zero values keep the current
+// setting. Only tunnels created afterwards get the new TTL; existing ones
+// keep their expiry. A changed cleanup interval reschedules the next sweep.
+func (r *Registry) UpdateConfig(cfg Config) {
+	r.mu.Lock()
+	old := r.cfg
+	if cfg.DefaultTTL > 0 {
+		r.cfg.DefaultTTL = cfg.DefaultTTL
+	}
+	if cfg.CleanupInterval > 0 {
+		r.cfg.CleanupInterval = cfg.CleanupInterval
+	}
+	if cfg.MinCleanupInterval > 0 {
+		r.cfg.MinCleanupInterval = cfg.MinCleanupInterval
+	}
+	updated := r.cfg
+	r.mu.Unlock()
+
+	if updated.CleanupInterval != old.CleanupInterval || updated.MinCleanupInterval != old.MinCleanupInterval {
+		select {
+		case r.cleanupReset <- struct{}{}:
+		default:
+		}
+	}
+
+	r.logger.Info("registry config updated",
+		slog.Duration("default_ttl", updated.DefaultTTL),
+		slog.Duration("cleanup_interval", updated.CleanupInterval),
+		slog.Duration("min_cleanup_interval", updated.MinCleanupInterval))
+}
+
+// cleanupIntervals returns the configured cleanup interval and its floor
+func (r *Registry) cleanupIntervals() (interval, floor time.Duration) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.cfg.CleanupInterval, r.cfg.MinCleanupInterval
+}
+
+// nextCleanupDelay returns the cleanup interval with ±10% jitter applied,
+// never going below the configured floor
+func (r *Registry) nextCleanupDelay() time.Duration {
+	interval, floor := r.cleanupIntervals()
+	if interval < floor {
+		interval = floor
+	}
+
+	jitter := time.Duration(rand.Int64N(int64(interval)/5+1)) - interval/10
+	delay := interval + jitter
+	if delay < floor {
+		delay = floor
+	}
+	if delay <= 0 {
+		delay = time.Second
+	}
+	return delay
+}
+
 // cleanupRoutine periodically removes expired tunnels
 func (r *Registry) cleanupRoutine() {
-	ticker := time.NewTicker(r.cfg.CleanupInterval)
-	defer ticker.Stop()
+	timer := time.NewTimer(r.nextCleanupDelay())
+	defer timer.Stop()
 	
 	for {
 		select {
 		case <-r.ctx.Done():
 			return
-		case <-ticker.C:
-			r.cleanupExpired()
+		case <-timer.C:
+			r.runCleanup()
+			timer.Reset(r.nextCleanupDelay())
+		case <-r.cleanupReset:
+			timer.Reset(r.nextCleanupDelay())
 		}
 	}
 }
 
-// cleanupExpired removes expired tunnels
-func (r *Registry) cleanupExpired() {
-	r.mu.Lock()
-	defer r.mu.Unlock()
-	
-	var expired []*tunnel.Info
-	
-	for _, t := range r.tunnels {
+// Cleanup runs a sweep now rather than at the next interval, e.g. when
+// debugging expiry, and returns how many tunnels it removed
+func (r *Registry) Cleanup() int {
+	return r.runCleanup()
+}
+
+// runCleanup runs one sweep, recording its duration and completion time,
+// and returns how many tunnels it removed. A panic is logged and
+// recovered so one bad tunnel can't kill the loop; the completion time
+// then isn't updated, which /ready picks up if it keeps happening.
+func (r *Registry) runCleanup() (removed int) {
+	defer func() {
+		if err := recover(); err != nil {
+			r.metrics.CleanupPanics.Inc()
+			r.logger.Error("cleanup panic recovered", slog.Any("error", err))
+		}
+	}()
+
+	start := time.Now()
+	removed = r.cleanupExpired()
+
+	now := time.Now()
+	r.lastCleanup.Store(now.UnixNano())
+	r.metrics.CleanupDuration.UpdateDuration(start)
+	r.metrics.CleanupLastRun.Set(float64(now.Unix()))
+	return removed
+}
+
+// LastCleanup returns when the cleanup loop last completed a sweep and
+// whether that is overdue, i.e. older than twice the cleanup interval
+func (r *Registry) LastCleanup() (time.Time, bool) {
+	last := time.Unix(0, r.lastCleanup.Load())
+	interval, floor := r.cleanupIntervals()
+	interval = max(interval, floor)
+	// Without an interval the loop sweeps every second
+	if interval <= 0 {
+		interval = time.Second
+	}
+	return last, time.Since(last) > 2*interval
+}
+
+// expiredIDs returns the IDs of tunnels past their expiry
+func (r *Registry) expiredIDs() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var expired []string
+	for id, t := range r.tunnels {
 		if t.IsExpired() {
-			expired = append(expired, t)
+			expired = append(expired, id)
 		}
 	}
+	return expired
+}
+
+// cleanupExpired removes expired tunnels and returns how many. Expired
+// IDs are collected under the read lock and then deleted in small batches
+// so the write lock is never held for the whole sweep.
+func (r *Registry) cleanupExpired() int {
+	expired := r.expiredIDs()
 	
-	for _, t := range expired {
-		if err := r.deleteTunnelLocked(t); err != nil {
-			r.logger.Error("failed to delete expired tunnel", 
+	r.pruneAuxiliary()
+
+	removed := 0
+	for start := 0; start < len(expired); start += cleanupBatchSize {
+		end := min(start+cleanupBatchSize, len(expired))
+		removed += r.deleteExpiredBatch(expired[start:end])
+	}
+
+	if removed > 0 {
+		r.logger.Info("cleaned up expired tunnels", slog.Int("count", removed))
+	}
+	return removed
+}
+
+// deleteExpiredBatch deletes the given tunnels under a single write lock,
+// skipping any that were removed or renewed since they were collected
+func (r *Registry) deleteExpiredBatch(ids []string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	removed := 0
+	for _, id := range ids {
+		t, exists := r.tunnels[id]
+		if !exists || !t.IsExpired() {
+			continue
+		}
+		reason := ExpireReasonExpired
+		if t.Revoked {
+			reason = ExpireReasonRevoked
+		}
+		if err := r.deleteTunnelLocked(t, reason); err != nil {
+			r.logger.Error("failed to delete expired tunnel",
 				slog.Any("error", err), slog.String("id", t.ID))
-		} else {
-			metrics.TunnelsExpired.Inc()
+			continue
 		}
+		r.metrics.TunnelsExpired.Inc()
+		removed++
+		// Revoked tunnels didn't expire, don't tell visitors they did
+		if t.Revoked {
+			continue
+		}
+		removedAt := time.Now()
+		r.tombstones.PutAt(hostname(t.Subdomain, t.Domain), Tombstone{
+			ID:        t.ID,
+			Subdomain: t.Subdomain,
+			Domain:    t.Domain,
+			ExpiredAt: t.ExpiresAt,
+			RemovedAt: removedAt,
+		}, removedAt)
 	}
-	
-	if len(expired) > 0 {
-		r.logger.Info("cleaned up expired tunnels", slog.Int("count", len(expired)))
-	}
+	return removed
+}
+
+// pruneAuxiliary drops expired tombstones, lapsed reservations and
+// recently freed names past their cooldown
+func (r *Registry) pruneAuxiliary() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.tombstones.Prune()
+	r.reservedBy.Prune()
+	r.recentNames.Prune()
+	r.released.Prune()
 }
 
-// Close gracefully shuts down the registry
+// Close gracefully shuts down the registry. With a store configured the
+// tunnels are flushed to disk so they survive the restart; otherwise they
+// are all cleaned up.
 func (r *Registry) Close() error {
 	r.cancel()
-	
+	defer r.events.close()
+
+	if r.cfg.Store != nil {
+		r.saveNow()
+		return nil
+	}
+
 	r.mu.Lock()
 	defer r.mu.Unlock()
 	
 	// Clean up all tunnels
 	for _, t := range r.tunnels {
-		if err := r.deleteTunnelLocked(t); err != nil {
-			r.logger.Error("failed to cleanup tunnel", 
+		if err := r.deleteTunnelLocked(t, ExpireReasonShutdown); err != nil {
+			r.logger.Error("failed to cleanup tunnel",
 				slog.Any("error", err), slog.String("id", t.ID))
 		}
 	}
@@ -252,14 +1593,54 @@ func (r *Registry) Close() error {
 	return nil
 }
 
-// UpdateTraffic updates traffic statistics for a tunnel
+// UpdateTraffic records one proxied request of a tunnel and its bytes, in
+// the tunnel's totals and its traffic history
 func (r *Registry) UpdateTraffic(id string, bytesIn, bytesOut uint64) {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
-	
-	if t, exists := r.tunnels[id]; exists {
-		t.BytesIn += bytesIn
-		t.BytesOut += bytesOut
-		metrics.HTTPBytesProxied.Add(int(bytesIn + bytesOut))
+
+	t, exists := r.tunnels[id]
+	if !exists {
+		return
 	}
-}
\ No newline at end of file
+
+	r.trafficMu.Lock()
+	defer r.trafficMu.Unlock()
+
+	t.AddBytes(bytesIn, bytesOut)
+	h := r.traffic[id]
+	if h == nil {
+		h = &trafficHistory{}
+		r.traffic[id] = h
+	}
+	now := r.trafficNow()
+	h.add(now, bytesIn, bytesOut)
+	r.metrics.HTTPBytesProxied.Add(int(bytesIn + bytesOut))
+
+	if now.Sub(h.published) >= TrafficEventInterval {
+		h.published = now
+		event := TunnelEvent(EventTunnelTraffic, t)
+		event.Data = h.point(trafficSlot(now))
+		r.events.Publish(event)
+	}
+}
+
+// Traffic returns a tunnel's traffic per minute over the last hour,
+// oldest first
+func (r *Registry) Traffic(id string) ([]TrafficPoint, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if _, exists := r.tunnels[id]; !exists {
+		return nil, fmt.Errorf("%w: %s", ErrTunnelNotFound, id)
+	}
+
+	r.trafficMu.Lock()
+	defer r.trafficMu.Unlock()
+
+	h := r.traffic[id]
+	if h == nil {
+		h = &trafficHistory{}
+	}
+	return h.points(r.trafficNow()), nil
+}
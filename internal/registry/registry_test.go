@@ -0,0 +1,1283 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mr-karan/arbok/internal/metrics"
+	"github.com/mr-karan/arbok/internal/tunnel"
+)
+
+// discardLogger returns a logger that drops everything
+func discardLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+// newTestRegistry creates a registry for tests, filling in the CIDR,
+// domain and TTL when cfg leaves them empty, and closes it when the test
+// ends
+func newTestRegistry(t testing.TB, cfg Config) *Registry {
+	t.Helper()
+	if cfg.CIDR == "" {
+		cfg.CIDR = "10.100.0.0/24"
+	}
+	if cfg.DefaultTTL == 0 {
+		cfg.DefaultTTL = time.Hour
+	}
+	if cfg.CleanupInterval == 0 {
+		cfg.CleanupInterval = time.Minute
+	}
+	if len(cfg.Domains) == 0 {
+		cfg.Domains = []string{"example.com"}
+	}
+	r, err := NewRegistry(context.Background(), cfg, discardLogger())
+	if err != nil {
+		t.Fatalf("NewRegistry: %v", err)
+	}
+	t.Cleanup(func() { r.Close() })
+	return r
+}
+
+func TestTunnelTTLClamping(t *testing.T) {
+	const premium = "premium-owner"
+	r := newTestRegistry(t, Config{
+		DefaultTTL: 2 * time.Hour,
+		MaxTTL:     24 * time.Hour,
+		KeyMaxTTLs: map[string]time.Duration{premium: 168 * time.Hour},
+	})
+
+	tests := []struct {
+		name      string
+		owner     string
+		requested time.Duration
+		want      time.Duration
+	}{
+		{"default", "", 0, 2 * time.Hour},
+		{"within max", "", 12 * time.Hour, 12 * time.Hour},
+		{"clamped to max", "", 48 * time.Hour, 24 * time.Hour},
+		{"other owner clamped to max", "someone", 48 * time.Hour, 24 * time.Hour},
+		{"owner max applies", premium, 48 * time.Hour, 48 * time.Hour},
+		{"clamped to owner max", premium, 500 * time.Hour, 168 * time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tun, err := r.CreateTunnel(3000, CreateOptions{OwnerID: tt.owner, TTL: tt.requested})
+			if err != nil {
+				t.Fatalf("CreateTunnel: %v", err)
+			}
+			if got := tun.ExpiresAt.Sub(tun.CreatedAt).Round(time.Second); got != tt.want {
+				t.Errorf("TTL = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReservedSubdomain(t *testing.T) {
+	r := newTestRegistry(t, Config{Reservations: map[string]string{"carol": "pinned"}})
+	if err := r.Reserve("alice", "app", ""); err != nil {
+		t.Fatalf("Reserve: %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		owner string
+		want  string
+	}{
+		{"holder gets its reservation", "alice", "app"},
+		{"configured reservation", "carol", "pinned"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tun, err := r.CreateTunnel(3000, CreateOptions{OwnerID: tt.owner})
+			if err != nil {
+				t.Fatalf("CreateTunnel: %v", err)
+			}
+			if tun.Subdomain != tt.want {
+				t.Errorf("subdomain = %q, want %q", tun.Subdomain, tt.want)
+			}
+			r.DeleteTunnel(tun.ID)
+		})
+	}
+
+	for _, name := range []string{"app", "pinned"} {
+		if err := r.Reserve("bob", name, ""); !errors.Is(err, ErrSubdomainReserved) {
+			t.Errorf("Reserve of another key's %s = %v, want %v", name, err, ErrSubdomainReserved)
+		}
+	}
+}
+
+func TestRequestedSubdomainHonorsReservations(t *testing.T) {
+	r := newTestRegistry(t, Config{Reservations: map[string]string{"carol": "pinned"}})
+	if err := r.Reserve("alice", "app", ""); err != nil {
+		t.Fatalf("Reserve: %v", err)
+	}
+
+	tests := []struct {
+		owner     string
+		subdomain string
+		err       error
+	}{
+		{"bob", "app", ErrSubdomainReserved},
+		{"", "app", ErrSubdomainReserved},
+		{"bob", "pinned", ErrSubdomainReserved},
+		{"alice", "app", nil},
+		{"carol", "pinned", nil},
+	}
+	for _, tt := range tests {
+		tun, err := r.CreateTunnel(3000, CreateOptions{OwnerID: tt.owner, Subdomain: tt.subdomain})
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%q asking for %s: %v, want %v", tt.owner, tt.subdomain, err, tt.err)
+		}
+		if err == nil && tun.Subdomain != tt.subdomain {
+			t.Errorf("%q got subdomain %q, want %q", tt.owner, tun.Subdomain, tt.subdomain)
+		}
+	}
+}
+
+// messageHook is a slog handler that calls fn for every record logged
+// with msg
+type messageHook struct {
+	msg string
+	fn  func()
+}
+
+func (h messageHook) Enabled(context.Context, slog.Level) bool { return true }
+func (h messageHook) WithAttrs([]slog.Attr) slog.Handler       { return h }
+func (h messageHook) WithGroup(string) slog.Handler            { return h }
+
+func (h messageHook) Handle(_ context.Context, rec slog.Record) error {
+	if rec.Message == h.msg {
+		h.fn()
+	}
+	return nil
+}
+
+func TestCleanupReleasesLockBetweenBatches(t *testing.T) {
+	const n = 2 * cleanupBatchSize
+	r := newTestRegistry(t, Config{DefaultTTL: time.Nanosecond, CleanupInterval: time.Hour})
+	for i := range n {
+		if _, err := r.CreateTunnel(3000, CreateOptions{}); err != nil {
+			t.Fatalf("CreateTunnel %d: %v", i, err)
+		}
+	}
+
+	// At the end of the first batch a reader queues for the lock; it gets
+	// in before the next batch unless the sweep holds the lock throughout
+	seen := make(chan int, 1)
+	deleted := 0
+	r.logger = slog.New(messageHook{msg: "tunnel deleted", fn: func() {
+		if deleted++; deleted == cleanupBatchSize {
+			go func() { seen <- len(r.ListTunnels()) }()
+			time.Sleep(10 * time.Millisecond)
+		}
+	}})
+
+	r.cleanupExpired()
+	if left := len(r.ListTunnels()); left != 0 {
+		t.Fatalf("%d tunnels left after cleanup, want none", left)
+	}
+	if left := <-seen; left == 0 || left == n {
+		t.Errorf("reader saw %d of %d tunnels, want it between batches", left, n)
+	}
+}
+
+func TestCleanupDelayJitter(t *testing.T) {
+	r := newTestRegistry(t, Config{CleanupInterval: time.Minute, MinCleanupInterval: 55 * time.Second})
+
+	seen := make(map[time.Duration]bool)
+	for range 100 {
+		d := r.nextCleanupDelay()
+		if d < 55*time.Second || d > 66*time.Second {
+			t.Fatalf("delay %v outside the floor and +10%% of the interval", d)
+		}
+		seen[d] = true
+	}
+	if len(seen) < 2 {
+		t.Error("delays aren't jittered")
+	}
+
+	r.UpdateConfig(Config{MinCleanupInterval: 2 * time.Minute})
+	for range 100 {
+		if d := r.nextCleanupDelay(); d < 2*time.Minute {
+			t.Fatalf("delay %v below the raised floor", d)
+		}
+	}
+}
+
+func TestUpdateConfig(t *testing.T) {
+	r := newTestRegistry(t, Config{CleanupInterval: time.Hour})
+	before, err := r.CreateTunnel(3000, CreateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r.UpdateConfig(Config{DefaultTTL: 2 * time.Hour})
+	after, err := r.CreateTunnel(3000, CreateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ttl := after.ExpiresAt.Sub(after.CreatedAt); ttl < 2*time.Hour-time.Second {
+		t.Errorf("new tunnel TTL = %v, want the reloaded 2h", ttl)
+	}
+	if ttl := r.GetTunnel(before.ID).ExpiresAt.Sub(before.CreatedAt); ttl > time.Hour+time.Second {
+		t.Errorf("existing tunnel TTL = %v, want its original 1h", ttl)
+	}
+
+	// Zero values keep the current settings
+	r.UpdateConfig(Config{})
+	if interval, _ := r.cleanupIntervals(); interval != time.Hour || r.cfg.DefaultTTL != 2*time.Hour {
+		t.Errorf("empty update changed the config: interval %v, TTL %v", interval, r.cfg.DefaultTTL)
+	}
+
+	// A shorter interval takes effect without waiting out the old one
+	r.UpdateConfig(Config{DefaultTTL: time.Nanosecond})
+	if _, err := r.CreateTunnel(3000, CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	r.UpdateConfig(Config{CleanupInterval: 20 * time.Millisecond, MinCleanupInterval: 10 * time.Millisecond})
+	deadline := time.Now().Add(5 * time.Second)
+	for len(r.ListTunnels()) != 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("expired tunnel not reaped on the reloaded interval")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCleanupRemembersExpiredSubdomains(t *testing.T) {
+	r := newTestRegistry(t, Config{DefaultTTL: time.Nanosecond})
+	tun, err := r.CreateTunnel(3000, CreateOptions{})
+	if err != nil {
+		t.Fatalf("CreateTunnel: %v", err)
+	}
+
+	r.cleanupExpired()
+	if r.GetTunnel(tun.ID) != nil {
+		t.Fatal("expired tunnel not reaped")
+	}
+	ts, ok := r.RecentlyExpired(tun.Subdomain, "")
+	if !ok || !ts.ExpiredAt.Equal(tun.ExpiresAt) {
+		t.Errorf("RecentlyExpired(%s) = %v %v, want the tunnel's expiry", tun.Subdomain, ts, ok)
+	}
+	if _, ok := r.RecentlyExpired("never", ""); ok {
+		t.Error("RecentlyExpired of an unknown subdomain = true")
+	}
+}
+
+// scriptedNames is a NameGenerator returning names in order, then the
+// last one forever
+type scriptedNames []string
+
+func (s *scriptedNames) Generate() string {
+	name := (*s)[0]
+	if len(*s) > 1 {
+		*s = (*s)[1:]
+	}
+	return name
+}
+
+func TestFreedNameNotRegenerated(t *testing.T) {
+	r := newTestRegistry(t, Config{})
+	r.nameGen = &scriptedNames{"calm-otter", "calm-otter", "brave-heron"}
+
+	first, err := r.CreateTunnel(3000, CreateOptions{})
+	if err != nil {
+		t.Fatalf("CreateTunnel: %v", err)
+	}
+	if err := r.DeleteTunnel(first.ID); err != nil {
+		t.Fatalf("DeleteTunnel: %v", err)
+	}
+
+	second, err := r.CreateTunnel(3000, CreateOptions{})
+	if err != nil {
+		t.Fatalf("CreateTunnel: %v", err)
+	}
+	if second.Subdomain != "brave-heron" {
+		t.Errorf("subdomain = %q, want the alternative to the name freed moments ago", second.Subdomain)
+	}
+
+	// With no alternative in sight the freed name is reused eventually
+	r.nameGen = &scriptedNames{"brave-heron-2", "calm-otter"}
+	r.DeleteTunnel(second.ID)
+	third, err := r.CreateTunnel(3000, CreateOptions{})
+	if err != nil {
+		t.Fatalf("CreateTunnel: %v", err)
+	}
+	if third.Subdomain != "brave-heron-2" {
+		t.Errorf("subdomain = %q, want brave-heron-2", third.Subdomain)
+	}
+	fourth, err := r.CreateTunnel(3000, CreateOptions{})
+	if err != nil {
+		t.Fatalf("CreateTunnel: %v", err)
+	}
+	if fourth.Subdomain != "calm-otter" {
+		t.Errorf("subdomain = %q, want the freed name once nothing else comes up", fourth.Subdomain)
+	}
+}
+
+func TestConstantNameGeneratorGivesUp(t *testing.T) {
+	r := newTestRegistry(t, Config{})
+	r.nameGen = &scriptedNames{"calm-otter"}
+	available := r.ipPool.Available()
+
+	if _, err := r.CreateTunnel(3000, CreateOptions{}); err != nil {
+		t.Fatalf("CreateTunnel: %v", err)
+	}
+	// Every generated name is taken from now on
+	_, err := r.CreateTunnel(3001, CreateOptions{})
+	if !errors.Is(err, ErrNoSubdomainAvailable) {
+		t.Fatalf("CreateTunnel = %v, want %v", err, ErrNoSubdomainAvailable)
+	}
+	if got := r.ipPool.Available(); got != available-1 {
+		t.Errorf("available IPs = %d, want %d with the failed tunnel's returned", got, available-1)
+	}
+
+	// The registry is still usable
+	r.nameGen = &scriptedNames{"brave-heron"}
+	if _, err := r.CreateTunnel(3001, CreateOptions{}); err != nil {
+		t.Errorf("CreateTunnel with a fresh name: %v", err)
+	}
+}
+
+func TestTombstoneKeptFromRemoval(t *testing.T) {
+	r := newTestRegistry(t, Config{DefaultTTL: time.Nanosecond})
+	tun, err := r.CreateTunnel(3000, CreateOptions{})
+	if err != nil {
+		t.Fatalf("CreateTunnel: %v", err)
+	}
+
+	// Cleanup ran long after the tunnel expired
+	r.mu.Lock()
+	tun.ExpiresAt = time.Now().Add(-time.Hour)
+	r.mu.Unlock()
+
+	before := time.Now()
+	r.cleanupExpired()
+	ts, ok := r.RecentlyExpired(tun.Subdomain, "")
+	if !ok {
+		t.Fatal("no tombstone for a tunnel expired an hour before removal")
+	}
+	if ts.ID != tun.ID || !ts.ExpiredAt.Equal(tun.ExpiresAt) || ts.RemovedAt.Before(before) {
+		t.Errorf("tombstone = %+v, want %s removed after %v", ts, tun.ID, before)
+	}
+}
+
+func TestChurnKeepsAuxiliaryMapsBounded(t *testing.T) {
+	r := newTestRegistry(t, Config{DefaultTTL: time.Nanosecond})
+
+	for i := range maxTombstones + 100 {
+		if _, err := r.CreateTunnel(3000, CreateOptions{}); err != nil {
+			t.Fatalf("CreateTunnel %d: %v", i, err)
+		}
+		r.cleanupExpired()
+	}
+	for i := range maxReservations + 100 {
+		if err := r.Reserve(fmt.Sprintf("owner%d", i), fmt.Sprintf("name%d", i), ""); err != nil {
+			t.Fatalf("Reserve %d: %v", i, err)
+		}
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if n := r.tombstones.Len(); n > maxTombstones {
+		t.Errorf("%d tombstones, want at most %d", n, maxTombstones)
+	}
+	if n := r.recentNames.Len(); n > maxRecentNames {
+		t.Errorf("%d recent names, want at most %d", n, maxRecentNames)
+	}
+	if n := r.reservedBy.Len(); n > maxReservations {
+		t.Errorf("%d reservations, want at most %d", n, maxReservations)
+	}
+	if n := len(r.reservations); n > maxReservations {
+		t.Errorf("%d reserved subdomains, want at most %d", n, maxReservations)
+	}
+}
+
+// failingPeers is a WireGuard device that refuses every peer
+type failingPeers struct{}
+
+func (failingPeers) AddPeer(*tunnel.Info) error    { return errors.New("device busy") }
+func (failingPeers) RemovePeer(*tunnel.Info) error { return nil }
+
+func TestFailedPeerAddLeavesRegistryUnchanged(t *testing.T) {
+	m := metrics.New("")
+	r := newTestRegistry(t, Config{Metrics: m})
+	r.nameGen = &scriptedNames{"app"}
+	available := r.ipPool.Available()
+	version := r.Version()
+
+	_, err := r.CreateTunnelWithPeer(3000, CreateOptions{}, failingPeers{})
+	if !errors.Is(err, ErrPeerAdd) {
+		t.Fatalf("CreateTunnelWithPeer = %v, want %v", err, ErrPeerAdd)
+	}
+	if n := len(r.ListTunnels()); n != 0 {
+		t.Errorf("%d tunnels after a failed create, want 0", n)
+	}
+	if r.ipPool.Available() != available {
+		t.Errorf("IP pool has %d addresses, want %d", r.ipPool.Available(), available)
+	}
+	if r.Version() != version {
+		t.Error("registry version changed by a failed create")
+	}
+	if got := m.TunnelsActive.Get(); got != 0 {
+		t.Errorf("active tunnels gauge = %v, want 0", got)
+	}
+
+	// The subdomain and address are free for the next try
+	tun, err := r.CreateTunnelWithPeer(3000, CreateOptions{}, &stubPeers{})
+	if err != nil {
+		t.Fatalf("retry: %v", err)
+	}
+	if tun.Subdomain != "app" {
+		t.Errorf("retry got subdomain %q, want app back", tun.Subdomain)
+	}
+	if pool, _ := NewIPPool("10.100.0.0/24", 0, "", ""); tun.AllowedIP != mustAllocate(t, pool) {
+		t.Errorf("retry got %s, want the first address back", tun.AllowedIP)
+	}
+}
+
+// mustAllocate allocates an address from pool or fails the test
+func mustAllocate(t *testing.T, pool *IPPool) string {
+	t.Helper()
+	ip, err := pool.Allocate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ip.String()
+}
+
+func TestSubdomainsArePerDomain(t *testing.T) {
+	r := newTestRegistry(t, Config{Domains: []string{"team1.com", "team2.com"}})
+
+	// Each owner reserves app under its own domain and gets it on create
+	for owner, domain := range map[string]string{"one": "team1.com", "two": "team2.com"} {
+		if err := r.Reserve(owner, "app", domain); err != nil {
+			t.Fatalf("reserve app under %s: %v", domain, err)
+		}
+	}
+	one, err := r.CreateTunnel(3000, CreateOptions{OwnerID: "one", Domain: "team1.com"})
+	if err != nil {
+		t.Fatalf("app under team1.com: %v", err)
+	}
+	two, err := r.CreateTunnel(3000, CreateOptions{OwnerID: "two", Domain: "team2.com"})
+	if err != nil {
+		t.Fatalf("app under team2.com: %v", err)
+	}
+	if got := r.GetTunnelBySubdomain("app", "team1.com"); got != one {
+		t.Errorf("app.team1.com resolved to %v, want %s", got, one.ID)
+	}
+	if got := r.GetTunnelBySubdomain("app", "team2.com"); got != two {
+		t.Errorf("app.team2.com resolved to %v, want %s", got, two.ID)
+	}
+	if got := r.GetTunnelBySubdomain("app", ""); got != one {
+		t.Errorf("app in the default domain resolved to %v, want %s", got, one.ID)
+	}
+
+	if err := r.Reserve("three", "app", "team2.com"); !errors.Is(err, ErrSubdomainReserved) {
+		t.Errorf("second app under team2.com: %v, want %v", err, ErrSubdomainReserved)
+	}
+	if _, err := r.CreateTunnel(3000, CreateOptions{Domain: "team3.com"}); !errors.Is(err, ErrUnknownDomain) {
+		t.Errorf("tunnel under an unserved domain: %v, want %v", err, ErrUnknownDomain)
+	}
+
+	// Removing one leaves the other in place
+	if err := r.DeleteTunnel(one.ID); err != nil {
+		t.Fatal(err)
+	}
+	if r.GetTunnelBySubdomain("app", "team2.com") != two {
+		t.Error("deleting app.team1.com removed app.team2.com")
+	}
+}
+
+func TestCleanupRecordsLiveness(t *testing.T) {
+	r := newTestRegistry(t, Config{CleanupInterval: time.Hour})
+
+	// The last sweep was long ago
+	r.lastCleanup.Store(time.Now().Add(-3 * time.Hour).UnixNano())
+	if _, stale := r.LastCleanup(); !stale {
+		t.Fatal("cleanup three intervals ago isn't stale")
+	}
+
+	start := time.Now()
+	r.runCleanup()
+	last, stale := r.LastCleanup()
+	if stale || last.Before(start) {
+		t.Errorf("LastCleanup after a sweep = %v, stale %v; want it advanced past %v", last, stale, start)
+	}
+	if ts := r.metrics.CleanupLastRun.Get(); ts < float64(start.Unix()) {
+		t.Errorf("cleanup_last_run_timestamp = %v, want at least %d", ts, start.Unix())
+	}
+}
+
+func TestCleanupLoopSurvivesPanic(t *testing.T) {
+	r := newTestRegistry(t, Config{
+		DefaultTTL:         time.Nanosecond,
+		CleanupInterval:    10 * time.Millisecond,
+		MinCleanupInterval: 10 * time.Millisecond,
+	})
+	var panicked atomic.Bool
+	r.OnDelete(func(*tunnel.Info) {
+		if panicked.CompareAndSwap(false, true) {
+			panic("bad tunnel")
+		}
+	})
+
+	waitFor := func(what string, done func() bool) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for !done() {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %s", what)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	if _, err := r.CreateTunnel(3000, CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor("the panicking sweep", func() bool { return r.metrics.CleanupPanics.Get() == 1 })
+
+	// Later sweeps still run
+	next, err := r.CreateTunnel(3000, CreateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor("the next sweep", func() bool {
+		r.mu.RLock()
+		defer r.mu.RUnlock()
+		return r.tunnels[next.ID] == nil
+	})
+	if _, stale := r.LastCleanup(); stale {
+		t.Error("cleanup stale after sweeps resumed")
+	}
+}
+
+func TestClonesShareTraffic(t *testing.T) {
+	r := newTestRegistry(t, Config{})
+	tun, err := r.CreateTunnel(3000, CreateOptions{})
+	if err != nil {
+		t.Fatalf("CreateTunnel: %v", err)
+	}
+
+	// A clone taken before traffic still sees it, so swapping in a
+	// changed copy never loses counts
+	clone := tun.Clone()
+	r.UpdateTraffic(tun.ID, 10, 20)
+	if in, out := clone.Bytes(); in != 10 || out != 20 {
+		t.Errorf("clone counts %d in, %d out; want 10 and 20", in, out)
+	}
+	if clone.LastSeen() != tun.LastSeen() {
+		t.Error("clone and original disagree on last seen")
+	}
+}
+
+func TestOwnerIndex(t *testing.T) {
+	r := newTestRegistry(t, Config{})
+	a1, _ := r.CreateTunnel(3000, CreateOptions{OwnerID: "a"})
+	a2, _ := r.CreateTunnel(3000, CreateOptions{OwnerID: "a"})
+	b1, _ := r.CreateTunnel(3000, CreateOptions{OwnerID: "b"})
+	r.CreateTunnel(3000, CreateOptions{})
+
+	ids := func(tunnels []*tunnel.Info) map[string]bool {
+		m := make(map[string]bool)
+		for _, t := range tunnels {
+			m[t.ID] = true
+		}
+		return m
+	}
+	if got := ids(r.ListTunnelsByOwner("a")); len(got) != 2 || !got[a1.ID] || !got[a2.ID] {
+		t.Errorf("owner a lists %v, want %s and %s", got, a1.ID, a2.ID)
+	}
+	if got := ids(r.ListTunnelsByOwner("b")); len(got) != 1 || !got[b1.ID] {
+		t.Errorf("owner b lists %v, want %s", got, b1.ID)
+	}
+	if got := r.ListTunnelsByOwner(""); len(got) != 0 {
+		t.Errorf("unowned tunnels listed under the empty owner: %d", len(got))
+	}
+
+	// Removing an owner's last tunnel drops its index entry
+	if err := r.DeleteTunnel(b1.ID); err != nil {
+		t.Fatal(err)
+	}
+	r.mu.RLock()
+	_, indexed := r.byOwner["b"]
+	r.mu.RUnlock()
+	if indexed {
+		t.Error("owner index keeps an owner with no tunnels")
+	}
+}
+
+func TestRevokeTunnelCopyOnWrite(t *testing.T) {
+	r := newTestRegistry(t, Config{RevokedRetention: time.Hour})
+	before, err := r.CreateTunnel(3000, CreateOptions{})
+	if err != nil {
+		t.Fatalf("CreateTunnel: %v", err)
+	}
+
+	// Readers use tunnels without the registry lock, like the proxy
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if tun := r.GetTunnelBySubdomain(before.Subdomain, ""); tun != nil {
+					_ = tun.Revoked && tun.IsExpired()
+					_ = tun.BackendAddr()
+					_ = tun.TTL()
+				}
+				r.UpdateTraffic(before.ID, 10, 20)
+			}
+		}()
+	}
+
+	after, revoked, err := r.RevokeTunnel(before.ID)
+	close(stop)
+	wg.Wait()
+	if err != nil || !revoked {
+		t.Fatalf("RevokeTunnel = %v, %v", revoked, err)
+	}
+
+	if before.Revoked {
+		t.Error("revoking changed the Info readers already held")
+	}
+	if !after.Revoked || after.RevokedAt.IsZero() {
+		t.Errorf("returned Info not revoked: %+v", after)
+	}
+	if got := r.GetTunnel(before.ID); got != after {
+		t.Error("registry does not serve the revoked Info")
+	}
+	// Traffic recorded on either copy counts for the tunnel
+	beforeIn, _ := before.Bytes()
+	afterIn, _ := after.Bytes()
+	if beforeIn != afterIn {
+		t.Errorf("copies disagree on traffic: %d and %d bytes in", beforeIn, afterIn)
+	}
+
+	if _, again, err := r.RevokeTunnel(before.ID); err != nil || again {
+		t.Errorf("second RevokeTunnel = %v, %v; want a no-op", again, err)
+	}
+}
+
+func TestUpdateTunnelCopyOnWrite(t *testing.T) {
+	r := newTestRegistry(t, Config{})
+	before, err := r.CreateTunnel(3000, CreateOptions{Description: "old"})
+	if err != nil {
+		t.Fatalf("CreateTunnel: %v", err)
+	}
+
+	desc := "new"
+	after, err := r.UpdateTunnel(before.ID, UpdateOptions{Description: &desc})
+	if err != nil {
+		t.Fatalf("UpdateTunnel: %v", err)
+	}
+	if before.Description != "old" {
+		t.Error("updating changed the Info readers already held")
+	}
+	if after.Description != "new" || r.GetTunnel(before.ID) != after {
+		t.Errorf("registry serves %+v, want the updated Info", r.GetTunnel(before.ID))
+	}
+}
+
+func TestRevokedTunnelReapedAfterRetention(t *testing.T) {
+	r := newTestRegistry(t, Config{RevokedRetention: 20 * time.Millisecond})
+	tun, err := r.CreateTunnel(3000, CreateOptions{})
+	if err != nil {
+		t.Fatalf("CreateTunnel: %v", err)
+	}
+	if _, _, err := r.RevokeTunnel(tun.ID); err != nil {
+		t.Fatalf("RevokeTunnel: %v", err)
+	}
+
+	r.cleanupExpired()
+	if r.GetTunnel(tun.ID) == nil {
+		t.Fatal("revoked tunnel reaped before its retention ran out")
+	}
+	time.Sleep(30 * time.Millisecond)
+	r.cleanupExpired()
+	if r.GetTunnel(tun.ID) != nil {
+		t.Fatal("revoked tunnel kept past its retention")
+	}
+	// Visitors aren't told a revoked tunnel merely expired
+	if _, ok := r.RecentlyExpired(tun.Subdomain, ""); ok {
+		t.Error("reaped revoked tunnel left an expiry tombstone")
+	}
+}
+
+func TestSetResolvedBackendCopyOnWrite(t *testing.T) {
+	const resolver = "10.0.0.53:53"
+	r := newTestRegistry(t, Config{DNSResolvers: []string{resolver}})
+	before, err := r.CreateTunnel(3000, CreateOptions{BackendHost: "db.internal", DNSResolver: resolver})
+	if err != nil {
+		t.Fatalf("CreateTunnel: %v", err)
+	}
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if tun := r.GetTunnel(before.ID); tun != nil {
+				_ = tun.BackendAddr()
+				_ = tun.PeerAllowedIPs()
+			}
+		}
+	}()
+
+	after, changed, err := r.SetResolvedBackend(before.ID, "192.168.1.10")
+	close(stop)
+	wg.Wait()
+	if err != nil || !changed {
+		t.Fatalf("SetResolvedBackend = %v, %v", changed, err)
+	}
+	if before.ResolvedBackendIP != "" {
+		t.Error("resolving changed the Info readers already held")
+	}
+	if after.BackendAddr() != "192.168.1.10" {
+		t.Errorf("BackendAddr = %q, want the resolved address", after.BackendAddr())
+	}
+	if got := r.GetTunnel(before.ID); got != after {
+		t.Error("registry does not serve the resolved Info")
+	}
+
+	same, changed, err := r.SetResolvedBackend(before.ID, "192.168.1.10")
+	if err != nil || changed || same != after {
+		t.Errorf("unchanged SetResolvedBackend = %p, %v, %v; want the current Info, false", same, changed, err)
+	}
+}
+
+func TestBackendHostMustBePrivate(t *testing.T) {
+	r := newTestRegistry(t, Config{})
+	for _, host := range []string{"192.168.1.10", "172.16.0.9", "10.1.2.3", "169.254.10.20", "fd00::10"} {
+		if _, err := r.CreateTunnel(3000, CreateOptions{BackendHost: host}); err != nil {
+			t.Errorf("backend %s: %v", host, err)
+		}
+	}
+	for _, host := range []string{"8.8.8.8", "1.1.1.1", "2001:4860:4860::8888", "127.0.0.1", "0.0.0.0", "224.0.0.1"} {
+		if _, err := r.CreateTunnel(3000, CreateOptions{BackendHost: host}); !errors.Is(err, ErrInvalidBackendHost) {
+			t.Errorf("backend %s: %v, want ErrInvalidBackendHost", host, err)
+		}
+	}
+}
+
+func TestHostnameBackends(t *testing.T) {
+	const resolver = "10.0.0.53:53"
+	r := newTestRegistry(t, Config{DNSResolvers: []string{resolver}})
+
+	tests := []struct {
+		name     string
+		opts     CreateOptions
+		wantErr  error
+		wantHost string
+	}{
+		{"peer resolver", CreateOptions{BackendHost: "DB.Internal.", DNSResolver: tunnel.PeerResolver}, nil, "db.internal"},
+		{"configured resolver", CreateOptions{BackendHost: "cache.internal", DNSResolver: resolver}, nil, "cache.internal"},
+		{"no resolver", CreateOptions{BackendHost: "db.internal"}, ErrInvalidBackendHost, ""},
+		{"bad hostname", CreateOptions{BackendHost: "db_1.internal", DNSResolver: tunnel.PeerResolver}, ErrInvalidBackendHost, ""},
+		{"unknown resolver", CreateOptions{BackendHost: "db.internal", DNSResolver: "8.8.8.8:53"}, ErrInvalidDNSResolver, ""},
+	}
+	for _, tt := range tests {
+		info, err := r.CreateTunnel(3000, tt.opts)
+		if !errors.Is(err, tt.wantErr) {
+			t.Errorf("%s: CreateTunnel error = %v, want %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if err == nil && (info.BackendHost != tt.wantHost || info.BackendAddr() != "" || len(info.PeerAllowedIPs()) != 0) {
+			t.Errorf("%s: backend %q dialing %q, want %q unresolved", tt.name, info.BackendHost, info.BackendAddr(), tt.wantHost)
+		}
+	}
+}
+
+func TestSetResolvedBackendValidates(t *testing.T) {
+	r := newTestRegistry(t, Config{DNSResolvers: []string{"10.0.0.53:53"}})
+	byIP, err := r.CreateTunnel(3000, CreateOptions{BackendHost: "192.168.1.10"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	byName, err := r.CreateTunnel(3000, CreateOptions{BackendHost: "db.internal", DNSResolver: tunnel.PeerResolver})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, ip := range []string{"192.168.1.10", "10.100.0.7", "8.8.8.8", "10.0.0.53", "not-an-ip"} {
+		if _, _, err := r.SetResolvedBackend(byName.ID, ip); !errors.Is(err, ErrInvalidBackendHost) {
+			t.Errorf("resolving to %s: %v, want ErrInvalidBackendHost", ip, err)
+		}
+	}
+	if _, _, err := r.SetResolvedBackend(byIP.ID, "192.168.1.11"); !errors.Is(err, ErrInvalidBackendHost) {
+		t.Errorf("resolving an IP backend: %v, want ErrInvalidBackendHost", err)
+	}
+	if _, _, err := r.SetResolvedBackend("missing", "192.168.1.11"); !errors.Is(err, ErrTunnelNotFound) {
+		t.Errorf("resolving a missing tunnel: %v, want ErrTunnelNotFound", err)
+	}
+
+	if _, err := r.CreateTunnel(3000, CreateOptions{BackendHost: "10.0.0.53"}); !errors.Is(err, ErrInvalidBackendHost) {
+		t.Errorf("creating over a resolver: %v, want ErrInvalidBackendHost", err)
+	}
+
+	// Once resolved, the address is taken like a configured backend IP
+	resolved, _, err := r.SetResolvedBackend(byName.ID, "192.168.1.11")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ips := resolved.PeerAllowedIPs(); len(ips) != 1 || ips[0] != "192.168.1.11" {
+		t.Errorf("PeerAllowedIPs = %v, want the resolved address", ips)
+	}
+	if _, err := r.CreateTunnel(3000, CreateOptions{BackendHost: "192.168.1.11"}); !errors.Is(err, ErrInvalidBackendHost) {
+		t.Errorf("creating over a resolved backend: %v, want ErrInvalidBackendHost", err)
+	}
+}
+
+func TestUpdateAndFlagCopyOnWrite(t *testing.T) {
+	r := newTestRegistry(t, Config{})
+	before, err := r.CreateTunnel(0, CreateOptions{OwnerID: "owner", Description: "old"})
+	if err != nil {
+		t.Fatalf("CreateTunnel: %v", err)
+	}
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if tun := r.GetTunnel(before.ID); tun != nil {
+				_ = tun.PortFor("/")
+				_ = tun.Description
+				_ = tun.Flagged && tun.FlagReason != ""
+			}
+		}
+	}()
+
+	port, desc := uint16(8080), "new"
+	updated, err := r.UpdateTunnel(before.ID, UpdateOptions{Port: &port, Description: &desc})
+	if err != nil {
+		t.Fatalf("UpdateTunnel: %v", err)
+	}
+	flagged, err := r.FlagTunnel(before.ID, "blocked content")
+	close(stop)
+	wg.Wait()
+	if err != nil || !flagged {
+		t.Fatalf("FlagTunnel = %v, %v", flagged, err)
+	}
+
+	if before.Port != 0 || before.Description != "old" || before.Flagged {
+		t.Errorf("updates changed the Info readers already held: %+v", before)
+	}
+	if updated.Port != port || updated.Description != desc {
+		t.Errorf("UpdateTunnel returned %d %q", updated.Port, updated.Description)
+	}
+	got := r.GetTunnel(before.ID)
+	if got.Port != port || got.Description != desc || !got.Flagged || got.FlagReason != "blocked content" {
+		t.Errorf("registry serves %+v", got)
+	}
+	if owned := r.ListTunnelsByOwner("owner"); len(owned) != 1 || owned[0] != got {
+		t.Error("owner listing does not serve the current Info")
+	}
+}
+
+// stubPeers is a WireGuard device that records the peers it has. hook,
+// if set, runs in AddPeer before the peer is added.
+type stubPeers struct {
+	hook func(*tunnel.Info)
+
+	mu      sync.Mutex
+	peers   map[string]bool
+	removed int
+}
+
+func (s *stubPeers) AddPeer(t *tunnel.Info) error {
+	if s.hook != nil {
+		s.hook(t)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.peers == nil {
+		s.peers = make(map[string]bool)
+	}
+	s.peers[t.PublicKey] = true
+	return nil
+}
+
+func (s *stubPeers) RemovePeer(t *tunnel.Info) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.peers, t.PublicKey)
+	s.removed++
+	return nil
+}
+
+// SyncPeers replaces the device's peers, like tunnel.SyncPeers
+func (s *stubPeers) SyncPeers(peers []tunnel.PeerSpec) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.peers = make(map[string]bool)
+	for _, p := range peers {
+		s.peers[p.PublicKey] = true
+	}
+	return nil
+}
+
+func (s *stubPeers) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.peers)
+}
+
+func TestCreateAddsPeerWithoutLock(t *testing.T) {
+	r := newTestRegistry(t, Config{})
+	peers := &stubPeers{hook: func(*tunnel.Info) {
+		if !r.mu.TryLock() {
+			t.Error("registry lock held while adding the peer")
+			return
+		}
+		r.mu.Unlock()
+	}}
+
+	if _, err := r.CreateTunnelWithPeer(3000, CreateOptions{}, peers); err != nil {
+		t.Fatalf("CreateTunnelWithPeer: %v", err)
+	}
+	if peers.count() != 1 {
+		t.Errorf("device has %d peers, want 1", peers.count())
+	}
+}
+
+func TestParallelCreateSameSubdomain(t *testing.T) {
+	r := newTestRegistry(t, Config{})
+	available := r.ipPool.Available()
+	peers := &stubPeers{hook: func(*tunnel.Info) { time.Sleep(5 * time.Millisecond) }}
+
+	const n = 20
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, errs[i] = r.CreateTunnelWithPeer(3000, CreateOptions{Subdomain: "app"}, peers)
+		}()
+	}
+	wg.Wait()
+
+	created := 0
+	for _, err := range errs {
+		switch {
+		case err == nil:
+			created++
+		case !errors.Is(err, ErrSubdomainTaken):
+			t.Errorf("create: %v, want %v", err, ErrSubdomainTaken)
+		}
+	}
+	if created != 1 {
+		t.Errorf("%d creations succeeded, want 1", created)
+	}
+	if peers.count() != 1 || len(r.ListTunnels()) != 1 {
+		t.Errorf("device has %d peers and registry %d tunnels, want 1 each", peers.count(), len(r.ListTunnels()))
+	}
+	if got := r.ipPool.Available(); got != available-1 {
+		t.Errorf("%d IPs available, want %d", got, available-1)
+	}
+}
+
+func TestStagedTunnelHiddenWhilePeerAdded(t *testing.T) {
+	r := newTestRegistry(t, Config{})
+
+	// The hook runs while the peer is added, which is outside the lock:
+	// reads don't block, and don't see the tunnel yet
+	var during []*tunnel.Info
+	peers := &stubPeers{hook: func(staged *tunnel.Info) {
+		during = append(during, r.GetTunnel(staged.ID), r.GetTunnelBySubdomain(staged.Subdomain, staged.Domain))
+		if _, err := r.CreateTunnel(3000, CreateOptions{Subdomain: staged.Subdomain}); !errors.Is(err, ErrSubdomainTaken) {
+			t.Errorf("create of the staged subdomain = %v, want %v", err, ErrSubdomainTaken)
+		}
+	}}
+
+	tun, err := r.CreateTunnelWithPeer(3000, CreateOptions{Subdomain: "app"}, peers)
+	if err != nil {
+		t.Fatalf("CreateTunnelWithPeer: %v", err)
+	}
+	for _, got := range during {
+		if got != nil {
+			t.Error("tunnel visible before its peer was added")
+		}
+	}
+	if r.GetTunnel(tun.ID) == nil || r.GetTunnelBySubdomain("app", tun.Domain) == nil {
+		t.Error("tunnel not visible once created")
+	}
+}
+
+func TestReuseOrCreateUndoesPeerOnCollision(t *testing.T) {
+	r := newTestRegistry(t, Config{})
+
+	// Both requests add their peer before either inserts its tunnel
+	var barrier sync.WaitGroup
+	barrier.Add(2)
+	peers := &stubPeers{hook: func(*tunnel.Info) {
+		barrier.Done()
+		barrier.Wait()
+	}}
+
+	type result struct {
+		t       *tunnel.Info
+		created bool
+	}
+	results := make([]result, 2)
+	var wg sync.WaitGroup
+	for i := range results {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tun, created, err := r.ReuseOrCreateTunnel(3000, CreateOptions{OwnerID: "owner"}, peers)
+			if err != nil {
+				t.Errorf("ReuseOrCreateTunnel: %v", err)
+				return
+			}
+			results[i] = result{tun, created}
+		}()
+	}
+	wg.Wait()
+
+	if results[0].t == nil || results[1].t == nil || results[0].t.ID != results[1].t.ID {
+		t.Fatalf("requests got different tunnels: %+v", results)
+	}
+	if results[0].created == results[1].created {
+		t.Errorf("created = %v and %v, want exactly one creation", results[0].created, results[1].created)
+	}
+	if peers.count() != 1 || peers.removed != 1 {
+		t.Errorf("device has %d peers after %d removals, want 1 after 1", peers.count(), peers.removed)
+	}
+	if n := len(r.ListTunnels()); n != 1 {
+		t.Errorf("registry has %d tunnels, want 1", n)
+	}
+}
+
+func TestReconcileDuringCreates(t *testing.T) {
+	r := newTestRegistry(t, Config{})
+	peers := &stubPeers{hook: func(*tunnel.Info) { time.Sleep(time.Millisecond) }}
+
+	done := make(chan struct{})
+	reconciled := make(chan struct{})
+	go func() {
+		defer close(reconciled)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if _, err := r.ReconcilePeers(peers.SyncPeers); err != nil {
+				t.Errorf("ReconcilePeers: %v", err)
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := r.CreateTunnelWithPeer(3000, CreateOptions{}, peers); err != nil {
+				t.Errorf("CreateTunnelWithPeer: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	close(done)
+	<-reconciled
+
+	// Every tunnel kept its peer, and the device has no others
+	tunnels := r.ListTunnels()
+	if peers.count() != len(tunnels) {
+		t.Fatalf("device has %d peers for %d tunnels", peers.count(), len(tunnels))
+	}
+	for _, tun := range tunnels {
+		if !peers.peers[tun.PublicKey] {
+			t.Errorf("tunnel %s lost its peer to a reconcile", tun.Subdomain)
+		}
+	}
+}
+
+// BenchmarkCreateTunnel creates and deletes tunnels in parallel against
+// a device whose IPC takes a millisecond, as a slow or retrying one does.
+// Creations only serialize on the registry lock, not on the device.
+func BenchmarkCreateTunnel(b *testing.B) {
+	r := newTestRegistry(b, Config{CIDR: "10.100.0.0/16"})
+	peers := &stubPeers{hook: func(*tunnel.Info) { time.Sleep(time.Millisecond) }}
+
+	b.SetParallelism(16)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			t, err := r.CreateTunnelWithPeer(3000, CreateOptions{}, peers)
+			if err != nil {
+				b.Error(err)
+				return
+			}
+			if err := r.DeleteTunnel(t.ID); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+func TestHostnamesCaseInsensitive(t *testing.T) {
+	r := newTestRegistry(t, Config{})
+	tun, err := r.CreateTunnel(3000, CreateOptions{Subdomain: "MyApp"})
+	if err != nil {
+		t.Fatalf("CreateTunnel: %v", err)
+	}
+	if tun.Subdomain != "myapp" {
+		t.Errorf("subdomain = %q, want it lowercased", tun.Subdomain)
+	}
+	for _, sub := range []string{"myapp", "MYAPP", "MyApp"} {
+		if got := r.GetTunnelBySubdomain(sub, strings.ToUpper(tun.Domain)); got == nil || got.ID != tun.ID {
+			t.Errorf("lookup of %q = %v, want the tunnel", sub, got)
+		}
+	}
+	if _, err := r.CreateTunnel(3000, CreateOptions{Subdomain: "MYAPP"}); !errors.Is(err, ErrSubdomainTaken) {
+		t.Errorf("create of MYAPP = %v, want %v", err, ErrSubdomainTaken)
+	}
+}
+
+func TestOnExpire(t *testing.T) {
+	r := newTestRegistry(t, Config{})
+	expiring, err := r.CreateTunnel(3000, CreateOptions{TTL: time.Nanosecond})
+	if err != nil {
+		t.Fatalf("CreateTunnel: %v", err)
+	}
+	deleted, err := r.CreateTunnel(3001, CreateOptions{})
+	if err != nil {
+		t.Fatalf("CreateTunnel: %v", err)
+	}
+
+	reasons := map[string][]ExpireReason{}
+	for _, id := range []string{expiring.ID, deleted.ID} {
+		if err := r.OnExpire(id, func(info *tunnel.Info, reason ExpireReason) {
+			reasons[info.ID] = append(reasons[info.ID], reason)
+		}); err != nil {
+			t.Fatalf("OnExpire(%s): %v", id, err)
+		}
+	}
+	if err := r.OnExpire("missing", func(*tunnel.Info, ExpireReason) {}); !errors.Is(err, ErrTunnelNotFound) {
+		t.Errorf("OnExpire for an unknown tunnel = %v, want %v", err, ErrTunnelNotFound)
+	}
+
+	if err := r.DeleteTunnel(deleted.ID); err != nil {
+		t.Fatalf("DeleteTunnel: %v", err)
+	}
+	time.Sleep(time.Millisecond)
+	r.cleanupExpired()
+	r.cleanupExpired()
+
+	for id, want := range map[string]ExpireReason{expiring.ID: ExpireReasonExpired, deleted.ID: ExpireReasonDeleted} {
+		if got := reasons[id]; len(got) != 1 || got[0] != want {
+			t.Errorf("callbacks for %s ran with %v, want once with %s", id, got, want)
+		}
+	}
+}
+
+func TestReclaimReleasedTunnel(t *testing.T) {
+	r := newTestRegistry(t, Config{})
+	_, pub, err := NewWireGuardKeyGenerator(nil).Generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reclaim := CreateOptions{OwnerID: "owner", ClientPublicKey: pub, Reclaim: true}
+
+	expiring := reclaim
+	expiring.TTL = time.Nanosecond
+	first, err := r.CreateTunnel(3000, expiring)
+	if err != nil {
+		t.Fatalf("CreateTunnel: %v", err)
+	}
+	time.Sleep(time.Millisecond)
+	if r.Cleanup() != 1 {
+		t.Fatal("tunnel didn't expire")
+	}
+
+	again, err := r.CreateTunnel(3000, reclaim)
+	if err != nil {
+		t.Fatalf("CreateTunnel: %v", err)
+	}
+	if again.AllowedIP != first.AllowedIP || again.Subdomain != first.Subdomain {
+		t.Errorf("recreated as %s %s, want the released %s %s", again.Subdomain, again.AllowedIP, first.Subdomain, first.AllowedIP)
+	}
+
+	// Only what's still free is reclaimed: here the IP was taken meanwhile
+	if err := r.DeleteTunnel(again.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.CreateTunnel(3000, CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	third, err := r.CreateTunnel(3000, reclaim)
+	if err != nil {
+		t.Fatalf("CreateTunnel: %v", err)
+	}
+	if third.AllowedIP == first.AllowedIP || third.Subdomain != first.Subdomain {
+		t.Errorf("recreated as %s %s, want %s with a new IP", third.Subdomain, third.AllowedIP, first.Subdomain)
+	}
+
+	// Another owner using the same key gets nothing back
+	if err := r.DeleteTunnel(third.ID); err != nil {
+		t.Fatal(err)
+	}
+	stranger := reclaim
+	stranger.OwnerID = "stranger"
+	other, err := r.CreateTunnel(3000, stranger)
+	if err != nil {
+		t.Fatalf("CreateTunnel: %v", err)
+	}
+	if other.Subdomain == first.Subdomain {
+		t.Errorf("another owner reclaimed %s", first.Subdomain)
+	}
+	if err := r.DeleteTunnel(other.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	// Revoked tunnels can't come back
+	revoked, err := r.CreateTunnel(3000, reclaim)
+	if err != nil {
+		t.Fatalf("CreateTunnel: %v", err)
+	}
+	if _, _, err := r.RevokeTunnel(revoked.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.DeleteTunnel(revoked.ID); err != nil {
+		t.Fatal(err)
+	}
+	after, err := r.CreateTunnel(3000, reclaim)
+	if err != nil {
+		t.Fatalf("CreateTunnel: %v", err)
+	}
+	if after.Subdomain == revoked.Subdomain {
+		t.Errorf("revoked tunnel's subdomain %s reclaimed", revoked.Subdomain)
+	}
+}
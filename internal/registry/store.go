@@ -0,0 +1,245 @@
+package registry
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/mr-karan/arbok/internal/apikey"
+	"github.com/mr-karan/arbok/internal/tunnel"
+)
+
+// Store persists registry state across restarts
+type Store interface {
+	Save(tunnels []*tunnel.Info) error
+	Load() ([]*tunnel.Info, error)
+}
+
+// storedTunnel is the on-disk representation of a tunnel. Unlike
+// tunnel.Info's JSON form it includes the fields hidden from the API.
+type storedTunnel struct {
+	ID         string `json:"id"`
+	Subdomain  string `json:"subdomain"`
+	Domain     string `json:"domain,omitempty"`
+	Port       uint16 `json:"port"`
+	PublicKey  string `json:"public_key"`
+	PrivateKey string `json:"private_key,omitempty"`
+	AllowedIP  string `json:"allowed_ip"`
+	OwnerID    string `json:"owner_id,omitempty"`
+	// LegacyOwnerKey is the owner's API key as older versions stored it.
+	// It is only read, to migrate to OwnerID, and never written back.
+	LegacyOwnerKey            string                          `json:"owner_key,omitempty"`
+	BackendHost               string                          `json:"backend_host,omitempty"`
+	DNSResolver               string                          `json:"dns_resolver,omitempty"`
+	ResolvedBackendIP         string                          `json:"resolved_backend_ip,omitempty"`
+	ClientCAPEM               string                          `json:"client_ca_pem,omitempty"`
+	RequireClientCert         bool                            `json:"require_client_cert,omitempty"`
+	StripResponseHeaders      []string                        `json:"strip_response_headers,omitempty"`
+	AllowedMethods            []string                        `json:"allowed_methods,omitempty"`
+	Labels                    map[string]string               `json:"labels,omitempty"`
+	MaxRPS                    float64                         `json:"max_rps,omitempty"`
+	AllowedClientCIDRs        []string                        `json:"allowed_client_cidrs,omitempty"`
+	Static                    bool                            `json:"static,omitempty"`
+	BackendScheme             string                          `json:"backend_scheme,omitempty"`
+	BackendInsecureSkipVerify bool                            `json:"backend_insecure_skip_verify,omitempty"`
+	ErrorOverrides            map[string]tunnel.ErrorOverride `json:"error_overrides,omitempty"`
+	Description               string                          `json:"description,omitempty"`
+	Routes                    []tunnel.Route                  `json:"routes,omitempty"`
+	RequestTimeout            time.Duration                   `json:"request_timeout,omitempty"`
+	Revoked                   bool                            `json:"revoked,omitempty"`
+	RevokedAt                 time.Time                       `json:"revoked_at,omitempty"`
+	Flagged                   bool                            `json:"flagged,omitempty"`
+	FlaggedAt                 time.Time                       `json:"flagged_at,omitempty"`
+	FlagReason                string                          `json:"flag_reason,omitempty"`
+	CreatedAt                 time.Time                       `json:"created_at"`
+	ExpiresAt                 time.Time                       `json:"expires_at"`
+	BytesIn                   uint64                          `json:"bytes_in"`
+	BytesOut                  uint64                          `json:"bytes_out"`
+}
+
+// storedState is the top-level document written by FileStore
+type storedState struct {
+	Version int            `json:"version"`
+	Tunnels []storedTunnel `json:"tunnels"`
+}
+
+// FileStore persists tunnels to a gzip-compressed JSON file. Writes go to
+// a temporary file that is renamed into place, so a crash mid-write never
+// leaves a truncated state file behind.
+type FileStore struct {
+	path string
+	// persistPrivateKeys writes server-generated tunnel private keys to
+	// the file. Without them restored tunnels still work, since the peer
+	// only needs the public key, but their client config can't be
+	// produced again.
+	persistPrivateKeys bool
+}
+
+// NewFileStore creates a file store at path. Private keys are only
+// written when persistPrivateKeys is set.
+func NewFileStore(path string, persistPrivateKeys bool) *FileStore {
+	return &FileStore{path: path, persistPrivateKeys: persistPrivateKeys}
+}
+
+// Save writes the given tunnels to disk atomically
+func (f *FileStore) Save(tunnels []*tunnel.Info) error {
+	state := storedState{
+		Version: 1,
+		Tunnels: make([]storedTunnel, 0, len(tunnels)),
+	}
+	for _, t := range tunnels {
+		bytesIn, bytesOut := t.Bytes()
+		privateKey := t.PrivateKey
+		if !f.persistPrivateKeys {
+			privateKey = ""
+		}
+		state.Tunnels = append(state.Tunnels, storedTunnel{
+			ID:                        t.ID,
+			Subdomain:                 t.Subdomain,
+			Domain:                    t.Domain,
+			Port:                      t.Port,
+			PublicKey:                 t.PublicKey,
+			PrivateKey:                privateKey,
+			AllowedIP:                 t.AllowedIP,
+			OwnerID:                   t.OwnerID,
+			BackendHost:               t.BackendHost,
+			DNSResolver:               t.DNSResolver,
+			ResolvedBackendIP:         t.ResolvedBackendIP,
+			ClientCAPEM:               t.ClientCAPEM,
+			RequireClientCert:         t.RequireClientCert,
+			StripResponseHeaders:      t.StripResponseHeaders,
+			AllowedMethods:            t.AllowedMethods,
+			Labels:                    t.Labels,
+			MaxRPS:                    t.MaxRPS,
+			AllowedClientCIDRs:        t.AllowedClientCIDRs,
+			Static:                    t.Static,
+			BackendScheme:             t.BackendScheme,
+			BackendInsecureSkipVerify: t.BackendInsecureSkipVerify,
+			ErrorOverrides:            t.ErrorOverrides,
+			Description:               t.Description,
+			Routes:                    t.Routes,
+			RequestTimeout:            t.RequestTimeout,
+			Revoked:                   t.Revoked,
+			RevokedAt:                 t.RevokedAt,
+			Flagged:                   t.Flagged,
+			FlaggedAt:                 t.FlaggedAt,
+			FlagReason:                t.FlagReason,
+			CreatedAt:                 t.CreatedAt,
+			ExpiresAt:                 t.ExpiresAt,
+			BytesIn:                   bytesIn,
+			BytesOut:                  bytesOut,
+		})
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), filepath.Base(f.path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temp state file: %w", err)
+	}
+	// Clean up the temp file on any failure before the rename
+	defer os.Remove(tmp.Name())
+
+	gz := gzip.NewWriter(tmp)
+	if err := json.NewEncoder(gz).Encode(state); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to encode state: %w", err)
+	}
+	if err := gz.Close(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to compress state: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to sync state file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close state file: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), f.path); err != nil {
+		return fmt.Errorf("failed to replace state file: %w", err)
+	}
+	return nil
+}
+
+// Load reads tunnels from disk. A missing file yields no tunnels.
+// Uncompressed JSON is accepted too so the file can be hand-edited.
+func (f *FileStore) Load() ([]*tunnel.Info, error) {
+	file, err := os.Open(f.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to open state file: %w", err)
+	}
+	defer file.Close()
+
+	br := bufio.NewReader(file)
+	var r io.Reader = br
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress state file: %w", err)
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	var state storedState
+	if err := json.NewDecoder(r).Decode(&state); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to decode state file: %w", err)
+	}
+
+	tunnels := make([]*tunnel.Info, 0, len(state.Tunnels))
+	for _, st := range state.Tunnels {
+		ownerID := st.OwnerID
+		if ownerID == "" && st.LegacyOwnerKey != "" {
+			ownerID = apikey.ID(st.LegacyOwnerKey)
+		}
+		t := &tunnel.Info{
+			ID:                        st.ID,
+			Subdomain:                 st.Subdomain,
+			Domain:                    st.Domain,
+			Port:                      st.Port,
+			PublicKey:                 st.PublicKey,
+			PrivateKey:                st.PrivateKey,
+			AllowedIP:                 st.AllowedIP,
+			OwnerID:                   ownerID,
+			BackendHost:               st.BackendHost,
+			DNSResolver:               st.DNSResolver,
+			ResolvedBackendIP:         st.ResolvedBackendIP,
+			ClientCAPEM:               st.ClientCAPEM,
+			RequireClientCert:         st.RequireClientCert,
+			StripResponseHeaders:      st.StripResponseHeaders,
+			AllowedMethods:            st.AllowedMethods,
+			Labels:                    st.Labels,
+			MaxRPS:                    st.MaxRPS,
+			AllowedClientCIDRs:        st.AllowedClientCIDRs,
+			Static:                    st.Static,
+			BackendScheme:             st.BackendScheme,
+			BackendInsecureSkipVerify: st.BackendInsecureSkipVerify,
+			ErrorOverrides:            st.ErrorOverrides,
+			Description:               st.Description,
+			Routes:                    st.Routes,
+			RequestTimeout:            st.RequestTimeout,
+			Revoked:                   st.Revoked,
+			RevokedAt:                 st.RevokedAt,
+			Flagged:                   st.Flagged,
+			FlaggedAt:                 st.FlaggedAt,
+			FlagReason:                st.FlagReason,
+			CreatedAt:                 st.CreatedAt,
+			ExpiresAt:                 st.ExpiresAt,
+		}
+		t.Track(time.Now(), st.BytesIn, st.BytesOut)
+		tunnels = append(tunnels, t)
+	}
+	return tunnels, nil
+}
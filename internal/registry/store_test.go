@@ -0,0 +1,144 @@
+package registry
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mr-karan/arbok/internal/apikey"
+	"github.com/mr-karan/arbok/internal/tunnel"
+)
+
+// readState returns the decompressed contents of a state file
+func readState(t *testing.T, path string) []byte {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestFileStoreRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json.gz")
+	store := NewFileStore(path, true)
+
+	now := time.Now().UTC().Truncate(time.Second)
+	in := &tunnel.Info{
+		ID:         "t1",
+		Subdomain:  "app",
+		Domain:     "example.com",
+		Port:       3000,
+		PublicKey:  "pub",
+		PrivateKey: "priv",
+		AllowedIP:  "10.100.0.2",
+		OwnerID:    apikey.ID("secret-key"),
+		Labels:     map[string]string{"env": "dev"},
+		CreatedAt:  now,
+		ExpiresAt:  now.Add(time.Hour),
+	}
+	if err := store.Save([]*tunnel.Info{in}); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	out, err := store.Load()
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if len(out) != 1 {
+		t.Fatalf("loaded %d tunnels, want 1", len(out))
+	}
+	got := out[0]
+	if got.ID != in.ID || got.Subdomain != in.Subdomain || got.Domain != in.Domain ||
+		got.Port != in.Port || got.PrivateKey != in.PrivateKey || got.OwnerID != in.OwnerID ||
+		got.Labels["env"] != "dev" || !got.ExpiresAt.Equal(in.ExpiresAt) {
+		t.Errorf("round trip mismatch:\n got %+v\nwant %+v", got, in)
+	}
+}
+
+func TestFileStoreLoadMissing(t *testing.T) {
+	store := NewFileStore(filepath.Join(t.TempDir(), "missing.json.gz"), false)
+	tunnels, err := store.Load()
+	if err != nil || tunnels != nil {
+		t.Fatalf("Load of missing file = %v, %v; want nil, nil", tunnels, err)
+	}
+}
+
+func TestFileStoreNeverWritesAPIKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json.gz")
+	store := NewFileStore(path, true)
+
+	const key = "secret-key"
+	err := store.Save([]*tunnel.Info{{ID: "t1", Subdomain: "app", OwnerID: apikey.ID(key)}})
+	if err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	data := readState(t, path)
+	if bytes.Contains(data, []byte(key)) {
+		t.Errorf("state file contains the owner's API key: %s", data)
+	}
+	if !bytes.Contains(data, []byte(apikey.ID(key))) {
+		t.Errorf("state file lacks the owner ID: %s", data)
+	}
+}
+
+func TestFileStoreDropsPrivateKeysByDefault(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json.gz")
+	store := NewFileStore(path, false)
+
+	const key = "server-generated-private-key"
+	err := store.Save([]*tunnel.Info{{ID: "t1", Subdomain: "app", PublicKey: "pub", PrivateKey: key}})
+	if err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if data := readState(t, path); bytes.Contains(data, []byte(key)) {
+		t.Errorf("state file contains the private key: %s", data)
+	}
+
+	out, err := store.Load()
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if len(out) != 1 || out[0].PublicKey != "pub" || out[0].PrivateKey != "" {
+		t.Errorf("loaded %+v, want the tunnel with its public key only", out)
+	}
+}
+
+func TestFileStoreMigratesLegacyOwnerKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	legacy := `{"version":1,"tunnels":[{"id":"t1","subdomain":"app","owner_key":"secret-key"}]}`
+	if err := os.WriteFile(path, []byte(legacy), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	store := NewFileStore(path, false)
+	tunnels, err := store.Load()
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if len(tunnels) != 1 || tunnels[0].OwnerID != apikey.ID("secret-key") {
+		t.Fatalf("legacy owner_key not migrated to its ID: %+v", tunnels)
+	}
+
+	// Saving again drops the key for good
+	if err := store.Save(tunnels); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if data := readState(t, path); bytes.Contains(data, []byte("secret-key")) {
+		t.Errorf("state file still contains the legacy key: %s", data)
+	}
+}
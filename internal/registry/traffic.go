@@ -0,0 +1,72 @@
+package registry
+
+import (
+	"time"
+)
+
+// Traffic history is kept per tunnel as one-minute buckets covering the
+// last hour, enough for sparklines without growing with tunnel age
+const (
+	TrafficBucketWidth = time.Minute
+	trafficBuckets     = 60
+)
+
+// TrafficPoint is the traffic of one bucket
+type TrafficPoint struct {
+	Time     time.Time `json:"time"`
+	BytesIn  uint64    `json:"bytes_in"`
+	BytesOut uint64    `json:"bytes_out"`
+	Requests uint64    `json:"requests"`
+}
+
+type trafficBucket struct {
+	// slot is the bucket's start in whole TrafficBucketWidths since the
+	// epoch; a stale slot means the bucket is from an earlier lap
+	slot     int64
+	bytesIn  uint64
+	bytesOut uint64
+	requests uint64
+}
+
+// trafficHistory is a ring of buckets indexed by slot
+type trafficHistory struct {
+	buckets [trafficBuckets]trafficBucket
+	// published is when the last EventTunnelTraffic went out
+	published time.Time
+}
+
+func trafficSlot(t time.Time) int64 {
+	return t.Unix() / int64(TrafficBucketWidth/time.Second)
+}
+
+// add records a request and its bytes in the bucket for now
+func (h *trafficHistory) add(now time.Time, bytesIn, bytesOut uint64) {
+	slot := trafficSlot(now)
+	b := &h.buckets[slot%trafficBuckets]
+	if b.slot != slot {
+		*b = trafficBucket{slot: slot}
+	}
+	b.bytesIn += bytesIn
+	b.bytesOut += bytesOut
+	b.requests++
+}
+
+// point returns the traffic of a slot, zero when it has none
+func (h *trafficHistory) point(slot int64) TrafficPoint {
+	p := TrafficPoint{Time: time.Unix(slot*int64(TrafficBucketWidth/time.Second), 0).UTC()}
+	if b := h.buckets[slot%trafficBuckets]; b.slot == slot {
+		p.BytesIn, p.BytesOut, p.Requests = b.bytesIn, b.bytesOut, b.requests
+	}
+	return p
+}
+
+// points returns the buckets of the last hour up to now, oldest first,
+// with quiet minutes as zeros
+func (h *trafficHistory) points(now time.Time) []TrafficPoint {
+	last := trafficSlot(now)
+	points := make([]TrafficPoint, 0, trafficBuckets)
+	for slot := last - trafficBuckets + 1; slot <= last; slot++ {
+		points = append(points, h.point(slot))
+	}
+	return points
+}
@@ -0,0 +1,81 @@
+package registry
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTrafficHistoryBuckets(t *testing.T) {
+	var h trafficHistory
+	start := time.Date(2026, 1, 1, 12, 0, 30, 0, time.UTC)
+
+	h.add(start, 10, 100)
+	h.add(start.Add(20*time.Second), 5, 50)
+	h.add(start.Add(2*time.Minute), 1, 2)
+
+	points := h.points(start.Add(2 * time.Minute))
+	if len(points) != trafficBuckets {
+		t.Fatalf("%d points, want %d", len(points), trafficBuckets)
+	}
+	last := len(points) - 1
+	for i, want := range map[int]TrafficPoint{
+		last - 2: {Time: start.Truncate(time.Minute), BytesIn: 15, BytesOut: 150, Requests: 2},
+		last - 1: {Time: start.Truncate(time.Minute).Add(time.Minute)},
+		last:     {Time: start.Truncate(time.Minute).Add(2 * time.Minute), BytesIn: 1, BytesOut: 2, Requests: 1},
+	} {
+		if points[i] != want {
+			t.Errorf("point %d = %+v, want %+v", i, points[i], want)
+		}
+	}
+	if points[0].Requests != 0 || !points[0].Time.Equal(start.Truncate(time.Minute).Add(-57*time.Minute)) {
+		t.Errorf("oldest point = %+v, want an empty bucket 57 minutes before the first", points[0])
+	}
+
+	// An hour on, the ring reuses the first bucket and drops its old counts
+	later := start.Add(time.Hour)
+	h.add(later, 7, 7)
+	points = h.points(later)
+	if p := points[len(points)-1]; p.Requests != 1 || p.BytesIn != 7 {
+		t.Errorf("bucket an hour later = %+v, want only the new request", p)
+	}
+	for _, p := range points[:len(points)-1] {
+		if p.Time.Before(later.Add(-time.Hour)) {
+			t.Errorf("point %+v is older than an hour", p)
+		}
+	}
+}
+
+func TestTrafficRecordedPerTunnel(t *testing.T) {
+	r := newTestRegistry(t, Config{})
+	// A fixed clock keeps both updates in one bucket
+	now := time.Date(2026, 1, 1, 12, 0, 59, 0, time.UTC)
+	r.trafficNow = func() time.Time { return now }
+	a, err := r.CreateTunnel(3000, CreateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := r.CreateTunnel(3000, CreateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r.UpdateTraffic(a.ID, 10, 20)
+	r.UpdateTraffic(a.ID, 1, 2)
+	points, err := r.Traffic(a.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := points[len(points)-1]; p.Requests != 2 || p.BytesIn != 11 || p.BytesOut != 22 {
+		t.Errorf("current bucket = %+v, want 2 requests, 11 bytes in and 22 out", p)
+	}
+	if points, _ := r.Traffic(b.ID); points[len(points)-1].Requests != 0 {
+		t.Errorf("untouched tunnel has traffic %+v", points[len(points)-1])
+	}
+
+	if err := r.DeleteTunnel(a.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Traffic(a.ID); err == nil {
+		t.Error("traffic of a deleted tunnel returned")
+	}
+}
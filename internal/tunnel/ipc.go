@@ -0,0 +1,146 @@
+package tunnel
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/mr-karan/arbok/internal/metrics"
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/ipc"
+)
+
+// ErrDeviceUnhealthy is returned without touching the device while the
+// IPC circuit breaker is open
+var ErrDeviceUnhealthy = errors.New("wireguard device is unhealthy")
+
+// IPC retry and circuit breaker settings
+const (
+	// ipcAttempts is how often a configuration change is tried, backing
+	// off from ipcBackoff and doubling
+	ipcAttempts = 3
+	ipcBackoff  = 50 * time.Millisecond
+	// ipcBreakerThreshold consecutive failed changes open the breaker for
+	// ipcBreakerCooldown; after that one change is let through to probe
+	ipcBreakerThreshold = 5
+	ipcBreakerCooldown  = 30 * time.Second
+)
+
+// ipcBreaker retries transient device errors and, once changes keep
+// failing, fails new ones fast instead of queueing them on a broken
+// device
+type ipcBreaker struct {
+	// metrics counts failed attempts
+	metrics *metrics.Metrics
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	// probing is set while the one change let through after the cooldown
+	// runs
+	probing bool
+}
+
+// do runs op, retrying transient errors, unless the breaker is open or
+// another change is probing the device
+func (b *ipcBreaker) do(op func() error) error {
+	if !b.allow() {
+		return ErrDeviceUnhealthy
+	}
+
+	var err error
+	for attempt := 0; attempt < ipcAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(ipcBackoff << (attempt - 1))
+		}
+		err = op()
+		if err == nil {
+			b.record(true)
+			return nil
+		}
+		if errors.Is(err, ErrClosed) {
+			b.endProbe()
+			return err
+		}
+		b.metrics.WireGuardErrors.Inc()
+		if !transientIPCError(err) {
+			b.record(false)
+			return err
+		}
+	}
+	b.record(false)
+	return fmt.Errorf("%w (after %d attempts)", err, ipcAttempts)
+}
+
+// allow reports whether a change may go to the device. Once the cooldown
+// is over, only the first change is let through, as the probe.
+func (b *ipcBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.failures < ipcBreakerThreshold {
+		return true
+	}
+	if b.probing || time.Now().Before(b.openUntil) {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+// endProbe lets another change probe the device after a probe that
+// didn't reach it
+func (b *ipcBreaker) endProbe() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+}
+
+// record counts a change that reached the device, opening the breaker
+// after ipcBreakerThreshold failures in a row
+func (b *ipcBreaker) record(ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+
+	if ok {
+		b.failures = 0
+		b.openUntil = time.Time{}
+		return
+	}
+	b.failures++
+	if b.failures >= ipcBreakerThreshold {
+		b.openUntil = time.Now().Add(ipcBreakerCooldown)
+	}
+}
+
+// healthy reports whether recent configuration changes succeeded
+func (b *ipcBreaker) healthy() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.failures < ipcBreakerThreshold
+}
+
+// transientIPCError reports whether a failed change may succeed when
+// retried. Configurations the device rejects as malformed never will.
+func transientIPCError(err error) bool {
+	var ipcErr *device.IPCError
+	if errors.As(err, &ipcErr) {
+		switch ipcErr.ErrorCode() {
+		case ipc.IpcErrorInvalid, ipc.IpcErrorProtocol:
+			return false
+		}
+	}
+	return true
+}
+
+// Healthy reports whether the WireGuard device is accepting peer changes.
+// It turns false after repeated failures and back after a change
+// succeeds.
+func (tun *Tunnel) Healthy() bool {
+	return tun.ipc.healthy()
+}
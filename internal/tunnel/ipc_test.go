@@ -0,0 +1,195 @@
+package tunnel
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mr-karan/arbok/internal/metrics"
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/tun/netstack"
+)
+
+// testPublicKey is a well-formed WireGuard public key
+const testPublicKey = "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="
+
+// stubDevice is a WireGuard device whose IpcSet runs set
+type stubDevice struct {
+	set func(config string) error
+
+	mu    sync.Mutex
+	calls int
+}
+
+func (d *stubDevice) IpcSet(config string) error {
+	d.mu.Lock()
+	d.calls++
+	d.mu.Unlock()
+	return d.set(config)
+}
+
+func (d *stubDevice) IpcGet() (string, error) { return "", nil }
+
+func (d *stubDevice) Close() {}
+
+func (d *stubDevice) callCount() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.calls
+}
+
+// newStubTunnel returns a tunnel configuring dev
+func newStubTunnel(dev ipcDevice) *Tunnel {
+	return &Tunnel{
+		logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+		device: dev,
+		ipc:    ipcBreaker{metrics: metrics.New("")},
+	}
+}
+
+// invalidConfigError returns the error a real device gives for a
+// malformed configuration, which retrying can't fix
+func invalidConfigError(t *testing.T) error {
+	t.Helper()
+	tunDev, _, err := netstack.CreateNetTUN([]netip.Addr{netip.MustParseAddr("10.0.0.1")}, nil, 1420)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dev := device.NewDevice(tunDev, conn.NewDefaultBind(), device.NewLogger(device.LogLevelSilent, ""))
+	defer dev.Close()
+
+	err = dev.IpcSet("bogus=1\n")
+	if err == nil || transientIPCError(err) {
+		t.Fatalf("IpcSet of a malformed config = %v, want a permanent error", err)
+	}
+	return err
+}
+
+func TestAddPeerRetriesFlakyDevice(t *testing.T) {
+	dev := &stubDevice{}
+	dev.set = func(string) error {
+		if dev.callCount() < ipcAttempts {
+			return errors.New("device busy")
+		}
+		return nil
+	}
+	tun := newStubTunnel(dev)
+
+	if err := tun.AddPeer(testPublicKey, "10.100.0.2"); err != nil {
+		t.Fatalf("AddPeer: %v", err)
+	}
+	if dev.callCount() != ipcAttempts {
+		t.Errorf("device called %d times, want %d", dev.callCount(), ipcAttempts)
+	}
+	if got := tun.ipc.metrics.WireGuardErrors.Get(); got != ipcAttempts-1 {
+		t.Errorf("wireguard_errors_total = %d, want the %d failed attempts", got, ipcAttempts-1)
+	}
+	if !tun.Healthy() {
+		t.Error("device unhealthy after a successful change")
+	}
+}
+
+func TestAddPeerGivesUpOnFlakyDevice(t *testing.T) {
+	dev := &stubDevice{set: func(string) error { return errors.New("device busy") }}
+	tun := newStubTunnel(dev)
+
+	if err := tun.AddPeer(testPublicKey, "10.100.0.2"); err == nil {
+		t.Fatal("AddPeer succeeded on a failing device")
+	}
+	if dev.callCount() != ipcAttempts {
+		t.Errorf("device called %d times, want %d", dev.callCount(), ipcAttempts)
+	}
+}
+
+func TestBreakerOpensOnPermanentErrors(t *testing.T) {
+	invalid := invalidConfigError(t)
+	dev := &stubDevice{set: func(string) error { return invalid }}
+	tun := newStubTunnel(dev)
+
+	for i := 0; i < ipcBreakerThreshold; i++ {
+		err := tun.AddPeer(testPublicKey, "10.100.0.2")
+		if err == nil || errors.Is(err, ErrDeviceUnhealthy) {
+			t.Fatalf("change %d: %v, want the device's error", i, err)
+		}
+	}
+	if dev.callCount() != ipcBreakerThreshold {
+		t.Errorf("device called %d times, want %d: permanent errors aren't retried",
+			dev.callCount(), ipcBreakerThreshold)
+	}
+	if tun.Healthy() {
+		t.Error("device healthy after repeated failures")
+	}
+
+	if err := tun.AddPeer(testPublicKey, "10.100.0.2"); !errors.Is(err, ErrDeviceUnhealthy) {
+		t.Errorf("change with the breaker open: %v, want %v", err, ErrDeviceUnhealthy)
+	}
+	if dev.callCount() != ipcBreakerThreshold {
+		t.Error("open breaker let a change through to the device")
+	}
+}
+
+func TestBreakerLetsOneProbeThrough(t *testing.T) {
+	release := make(chan struct{})
+	dev := &stubDevice{set: func(string) error {
+		<-release
+		return nil
+	}}
+	tun := newStubTunnel(dev)
+
+	// The breaker opened and its cooldown is over
+	tun.ipc.failures = ipcBreakerThreshold
+	tun.ipc.openUntil = time.Now().Add(-time.Second)
+
+	const n = 5
+	errs := make(chan error, n)
+	for range n {
+		go func() { errs <- tun.AddPeer(testPublicKey, "10.100.0.2") }()
+	}
+
+	// Everything but the probe fails fast
+	for range n - 1 {
+		select {
+		case err := <-errs:
+			if !errors.Is(err, ErrDeviceUnhealthy) {
+				t.Errorf("change while probing: %v, want %v", err, ErrDeviceUnhealthy)
+			}
+		case <-time.After(5 * time.Second):
+			close(release)
+			t.Fatal("changes waited for the device while it was probed")
+		}
+	}
+	close(release)
+	if err := <-errs; err != nil {
+		t.Errorf("probe: %v", err)
+	}
+	if dev.callCount() != 1 {
+		t.Errorf("device called %d times, want 1 probe", dev.callCount())
+	}
+	if !tun.Healthy() {
+		t.Error("device unhealthy after a successful probe")
+	}
+}
+
+func TestBreakerReopensAfterFailedProbe(t *testing.T) {
+	invalid := invalidConfigError(t)
+	dev := &stubDevice{set: func(string) error { return invalid }}
+	tun := newStubTunnel(dev)
+
+	tun.ipc.failures = ipcBreakerThreshold
+	tun.ipc.openUntil = time.Now().Add(-time.Second)
+
+	if err := tun.AddPeer(testPublicKey, "10.100.0.2"); err == nil || errors.Is(err, ErrDeviceUnhealthy) {
+		t.Fatalf("probe: %v, want the device's error", err)
+	}
+	if err := tun.AddPeer(testPublicKey, "10.100.0.2"); !errors.Is(err, ErrDeviceUnhealthy) {
+		t.Errorf("change after a failed probe: %v, want %v", err, ErrDeviceUnhealthy)
+	}
+	if dev.callCount() != 1 {
+		t.Errorf("device called %d times, want 1", dev.callCount())
+	}
+}
@@ -0,0 +1,42 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"golang.zx2c4.com/wireguard/device"
+)
+
+// deviceLogLevel picks the WireGuard device's log level: verbose only
+// when asked for and debug logs are kept, errors while error logs are
+// kept, and silent otherwise
+func deviceLogLevel(verbose bool, logger *slog.Logger) int {
+	ctx := context.Background()
+	switch {
+	case verbose && logger.Enabled(ctx, slog.LevelDebug):
+		return device.LogLevelVerbose
+	case logger.Enabled(ctx, slog.LevelError):
+		return device.LogLevelError
+	default:
+		return device.LogLevelSilent
+	}
+}
+
+// newDeviceLogger routes the WireGuard device's logs at level to logger,
+// verbose lines at debug, tagged with component=wireguard
+func newDeviceLogger(level int, logger *slog.Logger) *device.Logger {
+	logger = logger.With(slog.String("component", "wireguard"))
+	l := &device.Logger{Verbosef: device.DiscardLogf, Errorf: device.DiscardLogf}
+	if level >= device.LogLevelVerbose {
+		l.Verbosef = func(format string, args ...any) {
+			logger.Debug(fmt.Sprintf(format, args...))
+		}
+	}
+	if level >= device.LogLevelError {
+		l.Errorf = func(format string, args ...any) {
+			logger.Error(fmt.Sprintf(format, args...))
+		}
+	}
+	return l
+}
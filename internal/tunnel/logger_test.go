@@ -0,0 +1,52 @@
+package tunnel
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"golang.zx2c4.com/wireguard/device"
+)
+
+func TestDeviceLogLevel(t *testing.T) {
+	tests := []struct {
+		name    string
+		verbose bool
+		level   slog.Level
+		want    int
+	}{
+		{"verbose with debug logs", true, slog.LevelDebug, device.LogLevelVerbose},
+		{"verbose without debug logs", true, slog.LevelInfo, device.LogLevelError},
+		{"not verbose", false, slog.LevelDebug, device.LogLevelError},
+		{"errors not logged", false, slog.LevelError + 1, device.LogLevelSilent},
+	}
+	for _, tt := range tests {
+		logger := slog.New(slog.NewTextHandler(&bytes.Buffer{}, &slog.HandlerOptions{Level: tt.level}))
+		if got := deviceLogLevel(tt.verbose, logger); got != tt.want {
+			t.Errorf("%s: level = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDeviceLoggerRoutesToSlog(t *testing.T) {
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	l := newDeviceLogger(device.LogLevelError, logger)
+	l.Verbosef("handshake %d", 1)
+	l.Errorf("bind %s", "failed")
+	out := logs.String()
+	if strings.Contains(out, "handshake") {
+		t.Errorf("verbose line logged at error level: %s", out)
+	}
+	if !strings.Contains(out, "level=ERROR") || !strings.Contains(out, `msg="bind failed"`) || !strings.Contains(out, "component=wireguard") {
+		t.Errorf("error line = %s, want it at ERROR tagged component=wireguard", out)
+	}
+
+	logs.Reset()
+	newDeviceLogger(device.LogLevelVerbose, logger).Verbosef("handshake %d", 1)
+	if out := logs.String(); !strings.Contains(out, "level=DEBUG") || !strings.Contains(out, `msg="handshake 1"`) {
+		t.Errorf("verbose line = %s, want it at DEBUG", out)
+	}
+}
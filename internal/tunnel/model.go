@@ -1,6 +1,13 @@
 package tunnel
 
 import (
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -8,15 +15,297 @@ import (
 type Info struct {
 	ID         string    `json:"id"`
 	Subdomain  string    `json:"subdomain"`
+	Domain     string    `json:"domain"`
 	Port       uint16    `json:"port"`
 	PublicKey  string    `json:"public_key"`
 	PrivateKey string    `json:"-"` // Never expose in JSON
 	AllowedIP  string    `json:"allowed_ip"`
+	OwnerID    string    `json:"-"` // apikey.ID of the creator's API key, never exposed
 	CreatedAt  time.Time `json:"created_at"`
 	ExpiresAt  time.Time `json:"expires_at"`
-	LastSeen   time.Time `json:"last_seen"`
-	BytesIn    uint64    `json:"bytes_in"`
-	BytesOut   uint64    `json:"bytes_out"`
+
+	// BackendHost is an address in the client's network to forward to
+	// instead of AllowedIP. Routed through the peer like AllowedIP.
+	BackendHost string `json:"backend_host,omitempty"`
+
+	// DNSResolver resolves a hostname BackendHost: PeerResolver queries
+	// the client's own resolver through the tunnel, anything else is one
+	// of the server's configured internal resolvers (host:port).
+	// ResolvedBackendIP is the address it last resolved to.
+	DNSResolver       string `json:"dns_resolver,omitempty"`
+	ResolvedBackendIP string `json:"resolved_backend_ip,omitempty"`
+
+	// ClientCAPEM is a PEM bundle of CAs trusted to sign client
+	// certificates. With RequireClientCert set, the proxy only serves
+	// clients presenting a certificate signed by one of them.
+	ClientCAPEM       string `json:"client_ca_pem,omitempty"`
+	RequireClientCert bool   `json:"require_client_cert,omitempty"`
+
+	// StripResponseHeaders are removed from proxied responses in addition
+	// to the server-wide list
+	StripResponseHeaders []string `json:"strip_response_headers,omitempty"`
+
+	// AllowedMethods restricts the HTTP methods proxied to the backend.
+	// Empty allows all; GET implies HEAD.
+	AllowedMethods []string `json:"allowed_methods,omitempty"`
+
+	// Labels are free-form tags such as env=staging, for organizing and
+	// filtering tunnels
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// MaxRPS caps the requests per second proxied to this tunnel, across
+	// all clients. Zero falls back to the server-wide limit.
+	MaxRPS float64 `json:"max_rps,omitempty"`
+
+	// AllowedClientCIDRs limits which client networks may reach the
+	// tunnel, e.g. an office VPN. Empty allows everyone.
+	AllowedClientCIDRs []string `json:"allowed_client_cidrs,omitempty"`
+
+	// Static marks a tunnel serving files: the proxy answers HEAD from GET
+	// when the backend can't, and serves byte ranges from full responses
+	// when the backend ignores Range
+	Static bool `json:"static,omitempty"`
+
+	// BackendScheme is "https" for backends serving TLS, e.g. with a
+	// self-signed dev certificate; empty means plain HTTP.
+	// BackendInsecureSkipVerify accepts any certificate they present.
+	BackendScheme             string `json:"backend_scheme,omitempty"`
+	BackendInsecureSkipVerify bool   `json:"backend_insecure_skip_verify,omitempty"`
+
+	// ErrorOverrides replaces the proxy's error responses, keyed by
+	// condition (see the Error* constants), for monitors that misread
+	// 502s and 503s
+	ErrorOverrides map[string]ErrorOverride `json:"error_overrides,omitempty"`
+
+	// Description is a human-readable note such as "PR #123 preview",
+	// set at creation or updated later
+	Description string `json:"description,omitempty"`
+
+	// Routes send requests under a path prefix to another backend port,
+	// e.g. /api to an API server while the rest goes to Port
+	Routes []Route `json:"routes,omitempty"`
+
+	// RequestTimeout bounds each proxied request, replacing the server's
+	// response header timeout: long for long-polling backends, short to
+	// fail fast. Zero keeps the server's timeouts.
+	RequestTimeout time.Duration `json:"request_timeout,omitempty"`
+
+	// Revoked tunnels have had their peer removed by an operator. They
+	// are kept, with traffic refused, until cleanup reaps them.
+	Revoked   bool      `json:"revoked,omitempty"`
+	RevokedAt time.Time `json:"revoked_at,omitempty"`
+
+	// Flagged tunnels served blocked content and await admin review.
+	// FlagReason says what was blocked.
+	Flagged    bool      `json:"flagged,omitempty"`
+	FlaggedAt  time.Time `json:"flagged_at,omitempty"`
+	FlagReason string    `json:"flag_reason,omitempty"`
+
+	// shared is the state every copy of the Info shares, see Track
+	shared *shared
+}
+
+// shared holds what changes with a tunnel's traffic, updated atomically
+// so the proxy never needs the registry lock, and the parsed CA bundle
+type shared struct {
+	lastSeen atomic.Int64
+	bytesIn  atomic.Uint64
+	bytesOut atomic.Uint64
+
+	caOnce sync.Once
+	caPool *x509.CertPool
+	caErr  error
+}
+
+// Track starts tracking the tunnel's activity from lastSeen and the given
+// byte totals. Call it once, before the Info is shared; copies made with
+// Clone keep tracking the same activity. Untracked Infos report none.
+func (t *Info) Track(lastSeen time.Time, bytesIn, bytesOut uint64) {
+	t.shared = &shared{}
+	t.shared.lastSeen.Store(lastSeen.UnixNano())
+	t.shared.bytesIn.Store(bytesIn)
+	t.shared.bytesOut.Store(bytesOut)
+}
+
+// Clone returns a copy of t to change. Infos handed out by the registry
+// are never modified: updates change a clone and swap it in, so readers
+// holding the old one keep a consistent snapshot. Slices and maps are
+// shared with t and must be replaced rather than modified.
+func (t *Info) Clone() *Info {
+	c := *t
+	return &c
+}
+
+// ParseCAPool parses a PEM bundle into a certificate pool
+func ParseCAPool(pemData string) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM([]byte(pemData)) {
+		return nil, errors.New("no valid certificates in CA bundle")
+	}
+	return pool, nil
+}
+
+// ClientCAPool returns the parsed ClientCAPEM, parsing it only once for
+// tracked Infos
+func (t *Info) ClientCAPool() (*x509.CertPool, error) {
+	if t.shared == nil {
+		return ParseCAPool(t.ClientCAPEM)
+	}
+	t.shared.caOnce.Do(func() {
+		t.shared.caPool, t.shared.caErr = ParseCAPool(t.ClientCAPEM)
+	})
+	return t.shared.caPool, t.shared.caErr
+}
+
+// VerifyClientCert checks a client's certificate chain against the
+// tunnel's CA bundle. The first certificate is the leaf.
+func (t *Info) VerifyClientCert(chain []*x509.Certificate) error {
+	if len(chain) == 0 {
+		return errors.New("no client certificate presented")
+	}
+	pool, err := t.ClientCAPool()
+	if err != nil {
+		return err
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range chain[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err = chain[0].Verify(x509.VerifyOptions{
+		Roots:         pool,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	return err
+}
+
+// Hostname returns the public hostname the tunnel is served at
+func (t *Info) Hostname() string {
+	return t.Subdomain + "." + t.Domain
+}
+
+// PeerResolver is the DNSResolver value that resolves backends with the
+// DNS server on port 53 of the client's tunnel IP
+const PeerResolver = "peer"
+
+// BackendIsHostname reports whether BackendHost is a name that has to be
+// resolved before it can be dialed
+func (t *Info) BackendIsHostname() bool {
+	return t.BackendHost != "" && net.ParseIP(t.BackendHost) == nil
+}
+
+// BackendAddr returns the host the proxy dials for this tunnel. For
+// hostname backends that is the last resolved address, empty until the
+// name has been resolved.
+func (t *Info) BackendAddr() string {
+	if t.BackendIsHostname() {
+		return t.ResolvedBackendIP
+	}
+	if t.BackendHost != "" {
+		return t.BackendHost
+	}
+	return t.AllowedIP
+}
+
+// Route sends requests whose path is Prefix, or below it, to Port
+type Route struct {
+	Prefix string `json:"prefix"`
+	Port   uint16 `json:"port"`
+}
+
+// matches reports whether path is the route's prefix or below it. Prefixes
+// match whole segments: /api matches /api and /api/users, not /apis.
+func (r Route) matches(path string) bool {
+	prefix := strings.TrimSuffix(r.Prefix, "/")
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	return len(path) == len(prefix) || path[len(prefix)] == '/'
+}
+
+// PortFor returns the backend port for a request path: that of the
+// longest matching route, or Port when none matches
+func (t *Info) PortFor(path string) uint16 {
+	port, longest := t.Port, -1
+	for _, r := range t.Routes {
+		if len(r.Prefix) > longest && r.matches(path) {
+			port, longest = r.Port, len(r.Prefix)
+		}
+	}
+	return port
+}
+
+// Proxy error conditions that ErrorOverrides can replace
+const (
+	// ErrorBackend is a backend that can't be reached or reset the
+	// connection (502)
+	ErrorBackend = "backend_error"
+	// ErrorBackendTimeout is a backend that didn't answer in time (504)
+	ErrorBackendTimeout = "backend_timeout"
+	// ErrorBackendUnavailable is a request cut off by shutdown (503)
+	ErrorBackendUnavailable = "backend_unavailable"
+)
+
+// ErrorOverride is the response sent instead of a proxy error. An empty
+// ContentType is application/json for JSON bodies and text/plain
+// otherwise.
+type ErrorOverride struct {
+	Status      int    `json:"status"`
+	Body        string `json:"body,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+}
+
+// BackendTLS reports whether the backend is reached over HTTPS
+func (t *Info) BackendTLS() bool {
+	return t.BackendScheme == "https"
+}
+
+// PeerAllowedIPs returns the addresses WireGuard should route to this
+// tunnel's peer
+func (t *Info) PeerAllowedIPs() []string {
+	if backend := t.BackendAddr(); backend != "" && backend != t.AllowedIP {
+		return []string{backend}
+	}
+	return nil
+}
+
+// MethodAllowed reports whether requests with method may reach the backend
+func (t *Info) MethodAllowed(method string) bool {
+	if len(t.AllowedMethods) == 0 {
+		return true
+	}
+	for _, m := range t.AllowedMethods {
+		if m == method || (m == http.MethodGet && method == http.MethodHead) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientAllowed reports whether a client at ip may reach the tunnel
+func (t *Info) ClientAllowed(ip net.IP) bool {
+	if len(t.AllowedClientCIDRs) == 0 {
+		return true
+	}
+	if ip == nil {
+		return false
+	}
+	for _, cidr := range t.AllowedClientCIDRs {
+		if _, network, err := net.ParseCIDR(cidr); err == nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchesLabels reports whether the tunnel carries every label in selector
+func (t *Info) MatchesLabels(selector map[string]string) bool {
+	for k, v := range selector {
+		if got, ok := t.Labels[k]; !ok || got != v {
+			return false
+		}
+	}
+	return true
 }
 
 // IsExpired checks if the tunnel has expired
@@ -26,7 +315,33 @@ func (t *Info) IsExpired() bool {
 
 // UpdateLastSeen updates the last seen timestamp
 func (t *Info) UpdateLastSeen() {
-	t.LastSeen = time.Now()
+	if t.shared != nil {
+		t.shared.lastSeen.Store(time.Now().UnixNano())
+	}
+}
+
+// LastSeen returns when the tunnel was last looked up
+func (t *Info) LastSeen() time.Time {
+	if t.shared == nil {
+		return time.Time{}
+	}
+	return time.Unix(0, t.shared.lastSeen.Load())
+}
+
+// AddBytes adds to the tunnel's proxied byte totals
+func (t *Info) AddBytes(bytesIn, bytesOut uint64) {
+	if t.shared != nil {
+		t.shared.bytesIn.Add(bytesIn)
+		t.shared.bytesOut.Add(bytesOut)
+	}
+}
+
+// Bytes returns the tunnel's proxied byte totals
+func (t *Info) Bytes() (bytesIn, bytesOut uint64) {
+	if t.shared == nil {
+		return 0, 0
+	}
+	return t.shared.bytesIn.Load(), t.shared.bytesOut.Load()
 }
 
 // TTL returns the time until expiration
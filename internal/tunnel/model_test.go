@@ -0,0 +1,23 @@
+package tunnel
+
+import "testing"
+
+func TestPortFor(t *testing.T) {
+	info := &Info{Port: 3000, Routes: []Route{
+		{Prefix: "/api", Port: 8081},
+		{Prefix: "/api/admin/", Port: 8082},
+	}}
+	for path, want := range map[string]uint16{
+		"/":                3000,
+		"/apis":            3000,
+		"/api":             8081,
+		"/api/users":       8081,
+		"/api/admin":       8082,
+		"/api/admin/users": 8082,
+		"/api/administer":  8081,
+	} {
+		if got := info.PortFor(path); got != want {
+			t.Errorf("PortFor(%q) = %d, want %d", path, got, want)
+		}
+	}
+}
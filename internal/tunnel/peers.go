@@ -0,0 +1,141 @@
+package tunnel
+
+import (
+	"bufio"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net"
+	"slices"
+	"strings"
+)
+
+// PeerSpec is the desired WireGuard configuration of one peer: its
+// base64-encoded public key and the IPs routed to it
+type PeerSpec struct {
+	PublicKey  string
+	AllowedIPs []string
+}
+
+// SyncPeers makes the device's peers exactly peers, e.g. to recover from
+// drift between the registry and WireGuard. It reads the current peers and
+// applies the difference in a single configuration change: missing peers
+// are added, peers with different routes updated and unknown peers
+// removed. Peers already as desired are left alone, keeping their
+// sessions.
+func (tun *Tunnel) SyncPeers(peers []PeerSpec) error {
+	desired := make(map[string][]string, len(peers))
+	for _, p := range peers {
+		keyHex, err := encodeBase64ToHex(p.PublicKey)
+		if err != nil {
+			return fmt.Errorf("invalid public key %s: %w", truncateKey(p.PublicKey), err)
+		}
+		ips := make([]string, 0, len(p.AllowedIPs))
+		for _, ip := range p.AllowedIPs {
+			if net.ParseIP(ip) == nil {
+				return fmt.Errorf("invalid IP address: %s", ip)
+			}
+			ips = append(ips, ip+"/32")
+		}
+		desired[keyHex] = ips
+	}
+
+	current, err := tun.ipcGet()
+	if err != nil {
+		return fmt.Errorf("error reading WireGuard peers: %w", err)
+	}
+
+	config, added, updated, removed := peerSyncConfig(parsePeers(current), desired)
+	if config == "" {
+		return nil
+	}
+	if err := tun.ipcSet(config); err != nil {
+		return fmt.Errorf("error syncing WireGuard peers: %w", err)
+	}
+
+	tun.logger.Info("synced peers",
+		slog.Int("added", added),
+		slog.Int("updated", updated),
+		slog.Int("removed", removed))
+	return nil
+}
+
+// ipcGet reads the device's UAPI configuration, failing with ErrClosed
+// once the tunnel has been shut down
+func (tun *Tunnel) ipcGet() (string, error) {
+	tun.closeMutex.RLock()
+	defer tun.closeMutex.RUnlock()
+
+	if tun.device == nil {
+		return "", ErrClosed
+	}
+	return tun.device.IpcGet()
+}
+
+// parsePeers extracts each peer's hex public key and allowed IPs from a
+// UAPI get response
+func parsePeers(config string) map[string][]string {
+	peers := make(map[string][]string)
+	var key string
+	scanner := bufio.NewScanner(strings.NewReader(config))
+	for scanner.Scan() {
+		k, v, ok := strings.Cut(scanner.Text(), "=")
+		if !ok {
+			continue
+		}
+		switch k {
+		case "public_key":
+			key = v
+			peers[key] = nil
+		case "allowed_ip":
+			if key != "" {
+				peers[key] = append(peers[key], v)
+			}
+		}
+	}
+	return peers
+}
+
+// peerSyncConfig returns the UAPI configuration turning the current peers
+// into the desired ones, both keyed by hex public key, and how many peers
+// it adds, updates and removes. It is empty when they already match.
+func peerSyncConfig(current, desired map[string][]string) (config string, added, updated, removed int) {
+	var b strings.Builder
+	for _, key := range slices.Sorted(maps.Keys(current)) {
+		if _, ok := desired[key]; !ok {
+			fmt.Fprintf(&b, "public_key=%s\nremove=true\n", key)
+			removed++
+		}
+	}
+	for _, key := range slices.Sorted(maps.Keys(desired)) {
+		ips := desired[key]
+		have, exists := current[key]
+		if exists && sameIPs(have, ips) {
+			continue
+		}
+		if exists {
+			updated++
+		} else {
+			added++
+		}
+		fmt.Fprintf(&b, "public_key=%s\nreplace_allowed_ips=true\n", key)
+		for _, ip := range ips {
+			fmt.Fprintf(&b, "allowed_ip=%s\n", ip)
+		}
+		if !exists {
+			b.WriteString("persistent_keepalive_interval=25\n")
+		}
+	}
+	return b.String(), added, updated, removed
+}
+
+// sameIPs reports whether a and b hold the same prefixes in any order
+func sameIPs(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	a, b = slices.Clone(a), slices.Clone(b)
+	slices.Sort(a)
+	slices.Sort(b)
+	return slices.Equal(a, b)
+}
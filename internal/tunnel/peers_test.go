@@ -0,0 +1,172 @@
+package tunnel
+
+import (
+	"encoding/base64"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// uapiDevice is an in-memory WireGuard device that applies UAPI peer
+// changes and reports its peers the way a real device does
+type uapiDevice struct {
+	mu    sync.Mutex
+	peers map[string][]string
+	sets  int
+}
+
+func (d *uapiDevice) IpcSet(config string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.sets++
+	var key string
+	for _, line := range strings.Split(strings.TrimSpace(config), "\n") {
+		k, v, _ := strings.Cut(line, "=")
+		switch k {
+		case "public_key":
+			key = v
+			if _, ok := d.peers[key]; !ok {
+				d.peers[key] = nil
+			}
+		case "remove":
+			delete(d.peers, key)
+		case "replace_allowed_ips":
+			d.peers[key] = nil
+		case "allowed_ip":
+			d.peers[key] = append(d.peers[key], v)
+		}
+	}
+	return nil
+}
+
+func (d *uapiDevice) IpcGet() (string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var b strings.Builder
+	for _, key := range slices.Sorted(maps.Keys(d.peers)) {
+		fmt.Fprintf(&b, "public_key=%s\npersistent_keepalive_interval=25\n", key)
+		for _, ip := range d.peers[key] {
+			fmt.Fprintf(&b, "allowed_ip=%s\n", ip)
+		}
+	}
+	return b.String(), nil
+}
+
+func (d *uapiDevice) Close() {}
+
+// testKey returns a public key made of b repeated, base64 and hex encoded
+func testKey(t *testing.T, b byte) (key, keyHex string) {
+	t.Helper()
+	key = base64.StdEncoding.EncodeToString([]byte(strings.Repeat(string(b), 32)))
+	keyHex, err := encodeBase64ToHex(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, keyHex
+}
+
+func TestPeerSyncConfigConverges(t *testing.T) {
+	_, keepHex := testKey(t, 1)
+	_, staleHex := testKey(t, 2)
+	_, movedHex := testKey(t, 3)
+	_, addedHex := testKey(t, 4)
+
+	dev := &uapiDevice{peers: map[string][]string{
+		keepHex:  {"10.100.0.2/32"},
+		staleHex: {"10.100.0.3/32"},
+		movedHex: {"10.100.0.4/32"},
+	}}
+	desired := map[string][]string{
+		keepHex:  {"10.100.0.2/32"},
+		movedHex: {"10.100.0.4/32", "192.168.1.10/32"},
+		addedHex: {"10.100.0.5/32"},
+	}
+	reconcile := func() (added, updated, removed int) {
+		t.Helper()
+		current, err := dev.IpcGet()
+		if err != nil {
+			t.Fatal(err)
+		}
+		config, added, updated, removed := peerSyncConfig(parsePeers(current), desired)
+		if config != "" {
+			if err := dev.IpcSet(config); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return added, updated, removed
+	}
+
+	if added, updated, removed := reconcile(); added != 1 || updated != 1 || removed != 1 {
+		t.Errorf("added, updated, removed = %d, %d, %d, want 1 each", added, updated, removed)
+	}
+	if len(dev.peers) != len(desired) {
+		t.Fatalf("device peers = %v, want %v", dev.peers, desired)
+	}
+	for key, ips := range desired {
+		if !sameIPs(dev.peers[key], ips) {
+			t.Errorf("peer %s routes %v, want %v", key[:8], dev.peers[key], ips)
+		}
+	}
+	if dev.sets != 1 {
+		t.Errorf("device changed %d times, want 1", dev.sets)
+	}
+
+	// In sync, nothing is applied
+	reconcile()
+	if dev.sets != 1 {
+		t.Errorf("device changed again although in sync")
+	}
+}
+
+func TestSyncPeersConverges(t *testing.T) {
+	keep, keepHex := testKey(t, 1)
+	_, staleHex := testKey(t, 2)
+	moved, movedHex := testKey(t, 3)
+	added, addedHex := testKey(t, 4)
+
+	dev := &uapiDevice{peers: map[string][]string{
+		keepHex:  {"10.100.0.2/32"},
+		staleHex: {"10.100.0.3/32"},
+		movedHex: {"10.100.0.4/32"},
+	}}
+	tun := newStubTunnel(dev)
+
+	desired := []PeerSpec{
+		{PublicKey: keep, AllowedIPs: []string{"10.100.0.2"}},
+		{PublicKey: moved, AllowedIPs: []string{"10.100.0.4", "192.168.1.10"}},
+		{PublicKey: added, AllowedIPs: []string{"10.100.0.5"}},
+	}
+	if err := tun.SyncPeers(desired); err != nil {
+		t.Fatalf("SyncPeers: %v", err)
+	}
+
+	want := map[string][]string{
+		keepHex:  {"10.100.0.2/32"},
+		movedHex: {"10.100.0.4/32", "192.168.1.10/32"},
+		addedHex: {"10.100.0.5/32"},
+	}
+	if len(dev.peers) != len(want) {
+		t.Fatalf("device peers = %v, want %v", dev.peers, want)
+	}
+	for key, ips := range want {
+		if !sameIPs(dev.peers[key], ips) {
+			t.Errorf("peer %s routes %v, want %v", key[:8], dev.peers[key], ips)
+		}
+	}
+	if dev.sets != 1 {
+		t.Errorf("device changed %d times, want 1", dev.sets)
+	}
+
+	// In sync, nothing is applied
+	if err := tun.SyncPeers(desired); err != nil {
+		t.Fatalf("SyncPeers: %v", err)
+	}
+	if dev.sets != 1 {
+		t.Errorf("device changed again although in sync")
+	}
+}
@@ -0,0 +1,121 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"sync"
+	"unsafe"
+
+	"golang.zx2c4.com/wireguard/tun/netstack"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+)
+
+// MinTCPBufferSize is the smallest TCP buffer size netstack accepts
+const MinTCPBufferSize = tcp.MinBufferSize
+
+// StackOptions tunes the userspace network stack that proxied connections
+// run on
+type StackOptions struct {
+	// MaxConns caps the connections in use through the stack at once:
+	// those dialed with DialContext, and uses taken with AcquireConn.
+	// Further ones wait for a slot, or for their context to end. Zero
+	// means no limit.
+	MaxConns int
+	// TCPSendBufferSize and TCPReceiveBufferSize are the initial TCP
+	// buffer sizes in bytes, at least MinTCPBufferSize. Buffers may still grow up to
+	// 4 MiB, or the configured size if larger. Zero keeps netstack's 1 MiB.
+	TCPSendBufferSize    int
+	TCPReceiveBufferSize int
+}
+
+// netStack returns the gVisor stack behind tnet. netstack doesn't export
+// it, so it's read through reflection, failing cleanly should the field
+// ever change.
+func netStack(tnet *netstack.Net) (*stack.Stack, error) {
+	field := reflect.ValueOf(tnet).Elem().FieldByName("stack")
+	if !field.IsValid() || field.Type() != reflect.TypeOf((*stack.Stack)(nil)) {
+		return nil, fmt.Errorf("netstack doesn't expose its network stack")
+	}
+	return (*stack.Stack)(unsafe.Pointer(field.Pointer())), nil
+}
+
+// applyStackOptions sets opts' TCP buffer sizes on tnet's stack
+func applyStackOptions(tnet *netstack.Net, opts StackOptions) error {
+	if opts.TCPSendBufferSize == 0 && opts.TCPReceiveBufferSize == 0 {
+		return nil
+	}
+	s, err := netStack(tnet)
+	if err != nil {
+		return err
+	}
+	if size := opts.TCPSendBufferSize; size != 0 {
+		opt := tcpip.TCPSendBufferSizeRangeOption{Min: tcp.MinBufferSize, Default: size, Max: max(size, tcp.MaxBufferSize)}
+		if err := s.SetTransportProtocolOption(tcp.ProtocolNumber, &opt); err != nil {
+			return fmt.Errorf("invalid TCP send buffer size %d: %s", size, err)
+		}
+	}
+	if size := opts.TCPReceiveBufferSize; size != 0 {
+		opt := tcpip.TCPReceiveBufferSizeRangeOption{Min: tcp.MinBufferSize, Default: size, Max: max(size, tcp.MaxBufferSize)}
+		if err := s.SetTransportProtocolOption(tcp.ProtocolNumber, &opt); err != nil {
+			return fmt.Errorf("invalid TCP receive buffer size %d: %s", size, err)
+		}
+	}
+	return nil
+}
+
+// limitedConn releases its slot in the connection limit once closed
+type limitedConn struct {
+	net.Conn
+	release func()
+}
+
+func (c *limitedConn) Close() error {
+	err := c.Conn.Close()
+	c.release()
+	return err
+}
+
+// limitedPacketConn is a limitedConn over a UDP connection. It keeps the
+// net.PacketConn methods visible, which the DNS resolver checks for to
+// send queries as datagrams rather than length-prefixed streams.
+type limitedPacketConn struct {
+	*limitedConn
+	packet net.PacketConn
+}
+
+func (c *limitedPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	return c.packet.ReadFrom(p)
+}
+
+func (c *limitedPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	return c.packet.WriteTo(p, addr)
+}
+
+// newLimitedConn wraps conn to release its connection slot on close
+func newLimitedConn(conn net.Conn, release func()) net.Conn {
+	limited := &limitedConn{Conn: conn, release: release}
+	if packet, ok := conn.(net.PacketConn); ok {
+		return &limitedPacketConn{limitedConn: limited, packet: packet}
+	}
+	return limited
+}
+
+// AcquireConn takes a connection slot, waiting while MaxConns are taken.
+// It returns the function releasing the slot. DialContext takes one per
+// connection; users of DialPooled take one for each use of a connection.
+func (tun *Tunnel) AcquireConn(ctx context.Context) (func(), error) {
+	if tun.conns == nil {
+		return func() {}, nil
+	}
+	select {
+	case tun.conns <- struct{}{}:
+		var once sync.Once
+		return func() { once.Do(func() { <-tun.conns }) }, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("waiting for a free connection slot: %w", ctx.Err())
+	}
+}
@@ -0,0 +1,150 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/tun/netstack"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+)
+
+func TestAcquireConnLimitsOpenConnections(t *testing.T) {
+	tun := &Tunnel{conns: make(chan struct{}, 1)}
+
+	release, err := tun.AcquireConn(context.Background())
+	if err != nil {
+		t.Fatalf("first connection: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := tun.AcquireConn(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("connection over the limit: %v, want to wait until the deadline", err)
+	}
+
+	// Releasing twice frees one slot only
+	release()
+	release()
+	if _, err := tun.AcquireConn(context.Background()); err != nil {
+		t.Fatalf("connection after a release: %v", err)
+	}
+	if len(tun.conns) != 1 {
+		t.Errorf("%d slots taken, want 1", len(tun.conns))
+	}
+}
+
+func TestAcquireConnWithoutLimit(t *testing.T) {
+	tun := &Tunnel{}
+	for range 100 {
+		if _, err := tun.AcquireConn(context.Background()); err != nil {
+			t.Fatalf("AcquireConn without a limit: %v", err)
+		}
+	}
+}
+
+func TestLimitedConnKeepsPacketConn(t *testing.T) {
+	udp, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	released := 0
+	conn := newLimitedConn(udp, func() { released++ })
+	if _, ok := conn.(net.PacketConn); !ok {
+		t.Error("UDP connection lost its PacketConn methods")
+	}
+	conn.Close()
+	if released != 1 {
+		t.Errorf("slot released %d times on close, want 1", released)
+	}
+
+	a, b := net.Pipe()
+	defer b.Close()
+	if _, ok := newLimitedConn(a, func() {}).(net.PacketConn); ok {
+		t.Error("stream connection claims to be a PacketConn")
+	}
+}
+
+func TestStackBufferSizesApplied(t *testing.T) {
+	dev, tnet, err := netstack.CreateNetTUN([]netip.Addr{netip.MustParseAddr("10.99.0.1")}, nil, DefaultMTU)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dev.Close()
+
+	opts := StackOptions{TCPSendBufferSize: 256 << 10, TCPReceiveBufferSize: 8 << 20}
+	if err := applyStackOptions(tnet, opts); err != nil {
+		t.Fatalf("applyStackOptions: %v", err)
+	}
+	s, err := netStack(tnet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var send tcpip.TCPSendBufferSizeRangeOption
+	if err := s.TransportProtocolOption(tcp.ProtocolNumber, &send); err != nil {
+		t.Fatal(err)
+	}
+	if send.Default != 256<<10 || send.Max != tcp.MaxBufferSize {
+		t.Errorf("send buffer = %+v, want a 256 KiB default growing to netstack's max", send)
+	}
+	var recv tcpip.TCPReceiveBufferSizeRangeOption
+	if err := s.TransportProtocolOption(tcp.ProtocolNumber, &recv); err != nil {
+		t.Fatal(err)
+	}
+	if recv.Default != 8<<20 || recv.Max != 8<<20 {
+		t.Errorf("receive buffer = %+v, want 8 MiB", recv)
+	}
+
+	if err := applyStackOptions(tnet, StackOptions{TCPSendBufferSize: 100}); err == nil {
+		t.Error("send buffer below the minimum accepted")
+	}
+}
+
+func TestPooledConnsHoldNoSlot(t *testing.T) {
+	tun := newTestTunnel(t)
+	tun.conns = make(chan struct{}, 1)
+	ln, err := tun.GetNetstack().ListenTCP(&net.TCPAddr{IP: tun.serverIP.AsSlice(), Port: 8080})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	addr := ln.Addr().String()
+	for range 3 {
+		conn, err := tun.DialPooled(ctx, "tcp", addr)
+		if err != nil {
+			t.Fatalf("DialPooled: %v", err)
+		}
+		defer conn.Close()
+	}
+	if len(tun.conns) != 0 {
+		t.Fatalf("%d slots taken by pooled connections, want none", len(tun.conns))
+	}
+
+	conn, err := tun.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		t.Fatalf("DialContext with pooled connections open: %v", err)
+	}
+	if len(tun.conns) != 1 {
+		t.Errorf("%d slots taken, want 1 for the dialed connection", len(tun.conns))
+	}
+	conn.Close()
+	if len(tun.conns) != 0 {
+		t.Errorf("%d slots taken after close, want none", len(tun.conns))
+	}
+}
@@ -32,18 +32,23 @@ package tunnel
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net"
 	"net/netip"
 	"sync"
 
+	"github.com/mr-karan/arbok/internal/metrics"
 	"golang.zx2c4.com/wireguard/conn"
 	"golang.zx2c4.com/wireguard/device"
 	"golang.zx2c4.com/wireguard/tun"
 	"golang.zx2c4.com/wireguard/tun/netstack"
 )
 
+// ErrClosed is returned by operations on a tunnel that has been closed
+var ErrClosed = errors.New("tunnel is closed")
+
 const (
 	DefaultListenPort = 54321           // Default UDP port for WireGuard
 	DefaultCIDR       = "10.100.0.0/24" // Default CIDR for server interface
@@ -52,12 +57,14 @@ const (
 
 // PeerOpts represents configuration options for WireGuard peer initialization.
 type PeerOpts struct {
-	CIDR       string       // Network CIDR for the tunnel
-	ListenPort int          // UDP port for WireGuard to listen on
-	PrivateKey string       // Base64-encoded private key
-	DNSServers []string     // DNS servers for netstack (optional)
-	Verbose    bool         // Enable verbose logging
-	Logger     *slog.Logger // Logger instance
+	CIDR       string           // Network CIDR for the tunnel
+	ListenPort int              // UDP port for WireGuard to listen on
+	PrivateKey string           // Base64-encoded private key
+	DNSServers []string         // DNS servers for netstack (optional)
+	Verbose    bool             // Enable verbose WireGuard logging, at debug level
+	Logger     *slog.Logger     // Logger instance
+	Stack      StackOptions     // Netstack tuning (optional)
+	Metrics    *metrics.Metrics // Metrics to record to (optional)
 }
 
 // Tunnel represents a WireGuard userspace tunnel interface.
@@ -71,13 +78,26 @@ type Tunnel struct {
 	cidr       string
 	
 	// WireGuard components
-	device *device.Device
+	device ipcDevice
 	tun    tun.Device
 	tnet   *netstack.Net
-	
+	// conns holds a slot per open netstack connection when
+	// StackOptions.MaxConns is set
+	conns chan struct{}
+
 	// Synchronization
-	closeMutex sync.Mutex
+	closeMutex sync.RWMutex
 	closed     bool
+
+	// ipc retries and circuit-breaks peer configuration changes
+	ipc ipcBreaker
+}
+
+// ipcDevice is the configuration interface of a WireGuard device
+type ipcDevice interface {
+	IpcSet(config string) error
+	IpcGet() (string, error)
+	Close()
 }
 
 // validateCIDR validates that the provided CIDR is valid.
@@ -191,9 +211,14 @@ func New(opts PeerOpts) (*Tunnel, error) {
 	if err != nil {
 		return nil, fmt.Errorf("error creating netstack TUN: %w", err)
 	}
+	if err := applyStackOptions(tnet, opts.Stack); err != nil {
+		tun.Close() // Cleanup TUN interface on failure
+		return nil, fmt.Errorf("error tuning netstack: %w", err)
+	}
 
 	// Create WireGuard device
-	dev := device.NewDevice(tun, conn.NewDefaultBind(), device.NewLogger(device.LogLevelVerbose, ""))
+	logger := newDeviceLogger(deviceLogLevel(opts.Verbose, opts.Logger), opts.Logger)
+	dev := device.NewDevice(tun, conn.NewDefaultBind(), logger)
 
 	// Convert base64 private key to hex for WireGuard IPC
 	privateKeyHex, err := encodeBase64ToHex(opts.PrivateKey)
@@ -215,6 +240,15 @@ func New(opts PeerOpts) (*Tunnel, error) {
 		return nil, fmt.Errorf("error bringing WireGuard device up: %w", err)
 	}
 
+	m := opts.Metrics
+	if m == nil {
+		m = metrics.New("")
+	}
+	var conns chan struct{}
+	if opts.Stack.MaxConns > 0 {
+		conns = make(chan struct{}, opts.Stack.MaxConns)
+	}
+
 	return &Tunnel{
 		logger:     opts.Logger,
 		privateKey: opts.PrivateKey,
@@ -225,6 +259,8 @@ func New(opts PeerOpts) (*Tunnel, error) {
 		device:     dev,
 		tun:        tun,
 		tnet:       tnet,
+		conns:      conns,
+		ipc:        ipcBreaker{metrics: m},
 	}, nil
 }
 
@@ -256,6 +292,7 @@ func (tun *Tunnel) Close() error {
 	// Don't explicitly close tun as device.Close() handles it
 	// Setting to nil to prevent double-close attempts
 	tun.tun = nil
+	tun.tnet = nil
 	
 	tun.closed = true
 	return nil
@@ -266,6 +303,11 @@ func (tun *Tunnel) GetPublicKey() string {
 	return tun.publicKey
 }
 
+// CIDR returns the tunnel network clients get their addresses from
+func (tun *Tunnel) CIDR() string {
+	return tun.cidr
+}
+
 // GetServerIP returns the server's IP address by calculating it from the CIDR
 func GetServerIP(cidr string) (string, error) {
 	_, cidrNet, err := net.ParseCIDR(cidr)
@@ -281,15 +323,57 @@ func GetServerIP(cidr string) (string, error) {
 	return serverIP.String(), nil
 }
 
-// GetNetstack returns the netstack network interface for dialing
+// GetNetstack returns the netstack network interface for dialing, or nil
+// once the tunnel is closed. Prefer DialContext, which handles that case.
 func (tun *Tunnel) GetNetstack() *netstack.Net {
+	tun.closeMutex.RLock()
+	defer tun.closeMutex.RUnlock()
 	return tun.tnet
 }
 
+// DialContext dials an address through the tunnel's netstack. It returns
+// ErrClosed instead of panicking when the tunnel has been shut down, and
+// waits for a free slot while StackOptions.MaxConns connections are open.
+func (tun *Tunnel) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	release, err := tun.AcquireConn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := tun.DialPooled(ctx, network, address)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	return newLimitedConn(conn, release), nil
+}
+
+// DialPooled is DialContext for connections kept open in a pool between
+// uses. They don't hold a connection slot, which would be taken while
+// they sit idle; callers take one with AcquireConn while using them.
+func (tun *Tunnel) DialPooled(ctx context.Context, network, address string) (net.Conn, error) {
+	tnet := tun.GetNetstack()
+	if tnet == nil {
+		return nil, ErrClosed
+	}
+	return tnet.DialContext(ctx, network, address)
+}
+
+// Resolver returns a resolver that queries the DNS server at addr
+// (host:port) through the tunnel, i.e. from the peer's network
+func (tun *Tunnel) Resolver(addr string) *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return tun.DialContext(ctx, network, addr)
+		},
+	}
+}
+
 // AddPeer adds a new peer to the userspace WireGuard interface.
 // It validates the input parameters and configures the peer with the specified
-// public key and allowed IP address.
-func (tun *Tunnel) AddPeer(publicKey, allowedIP string) error {
+// public key and allowed IP address. Extra IPs are also routed to the peer,
+// which lets the proxy reach hosts on the client's network.
+func (tun *Tunnel) AddPeer(publicKey, allowedIP string, extraAllowedIPs ...string) error {
 	// Validate input parameters
 	if publicKey == "" {
 		return fmt.Errorf("public key cannot be empty")
@@ -304,11 +388,21 @@ func (tun *Tunnel) AddPeer(publicKey, allowedIP string) error {
 		return fmt.Errorf("error converting public key to hex: %w", err)
 	}
 
-	// Configure peer using IPC
-	config := fmt.Sprintf("public_key=%s\nallowed_ip=%s/32\npersistent_keepalive_interval=25\n",
+	for _, ip := range extraAllowedIPs {
+		if net.ParseIP(ip) == nil {
+			return fmt.Errorf("invalid IP address: %s", ip)
+		}
+	}
+
+	// Configure peer using IPC. Allowed IPs are replaced, so calling this
+	// again for an existing peer updates its routes.
+	config := fmt.Sprintf("public_key=%s\nreplace_allowed_ips=true\nallowed_ip=%s/32\npersistent_keepalive_interval=25\n",
 		publicKeyHex, allowedIP)
+	for _, ip := range extraAllowedIPs {
+		config += fmt.Sprintf("allowed_ip=%s/32\n", ip)
+	}
 
-	if err := tun.device.IpcSet(config); err != nil {
+	if err := tun.ipcSet(config); err != nil {
 		return fmt.Errorf("error adding peer to WireGuard: %w", err)
 	}
 
@@ -335,7 +429,7 @@ func (tun *Tunnel) RemovePeer(publicKey, allowedIP string) error {
 	// Remove peer using IPC
 	config := fmt.Sprintf("public_key=%s\nremove=true\n", publicKeyHex)
 
-	if err := tun.device.IpcSet(config); err != nil {
+	if err := tun.ipcSet(config); err != nil {
 		return fmt.Errorf("error removing peer from WireGuard: %w", err)
 	}
 
@@ -343,4 +437,20 @@ func (tun *Tunnel) RemovePeer(publicKey, allowedIP string) error {
 		slog.String("public_key", truncateKey(publicKey)), 
 		slog.String("allowed_ip", allowedIP))
 	return nil
-}
\ No newline at end of file
+}
+
+// ipcSet applies a UAPI configuration to the device, failing with
+// ErrClosed once the tunnel has been shut down. Transient errors are
+// retried; after repeated failures ErrDeviceUnhealthy is returned
+// straight away for a while.
+func (tun *Tunnel) ipcSet(config string) error {
+	return tun.ipc.do(func() error {
+		tun.closeMutex.RLock()
+		defer tun.closeMutex.RUnlock()
+
+		if tun.device == nil {
+			return ErrClosed
+		}
+		return tun.device.IpcSet(config)
+	})
+}
@@ -0,0 +1,58 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"testing"
+
+	"github.com/mr-karan/arbok/internal/metrics"
+)
+
+// testPrivateKey is a well-formed WireGuard private key
+const testPrivateKey = "yBQWnFQEq9q9al4ratmo6ylyZ52ngNsk4U11u4JtH0U="
+
+// newTestTunnel brings up a tunnel on a free UDP port
+func newTestTunnel(t *testing.T) *Tunnel {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+	conn.Close()
+
+	tun, err := New(PeerOpts{
+		PrivateKey: testPrivateKey,
+		ListenPort: port,
+		Logger:     slog.New(slog.NewTextHandler(io.Discard, nil)),
+		Metrics:    metrics.New(""),
+	})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	t.Cleanup(func() { tun.Close() })
+	return tun
+}
+
+func TestClosedTunnelFailsCleanly(t *testing.T) {
+	tun := newTestTunnel(t)
+	if err := tun.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if err := tun.Close(); err != nil {
+		t.Errorf("second Close: %v", err)
+	}
+
+	if tun.GetNetstack() != nil {
+		t.Error("closed tunnel still has a netstack")
+	}
+	if _, err := tun.DialContext(context.Background(), "tcp", "10.100.0.2:80"); !errors.Is(err, ErrClosed) {
+		t.Errorf("DialContext after Close: %v, want %v", err, ErrClosed)
+	}
+	if err := tun.AddPeer(testPublicKey, "10.100.0.2"); !errors.Is(err, ErrClosed) {
+		t.Errorf("AddPeer after Close: %v, want %v", err, ErrClosed)
+	}
+}
@@ -19,6 +19,12 @@ func encodeBase64ToHex(key string) (string, error) {
 	return hex.EncodeToString(decoded), nil
 }
 
+// ValidateKey checks that key is a base64-encoded 32-byte WireGuard key
+func ValidateKey(key string) error {
+	_, err := encodeBase64ToHex(key)
+	return err
+}
+
 func privateKeyToPublicKey(privateKeyBase64 string) (string, error) {
 	// Decode private key
 	privBytes, err := base64.StdEncoding.DecodeString(privateKeyBase64)
@@ -0,0 +1,26 @@
+package tunnel
+
+import (
+	"encoding/base64"
+	"testing"
+)
+
+func TestValidateKey(t *testing.T) {
+	tests := []struct {
+		name  string
+		key   string
+		valid bool
+	}{
+		{"32 bytes", base64.StdEncoding.EncodeToString(make([]byte, 32)), true},
+		{"31 bytes", base64.StdEncoding.EncodeToString(make([]byte, 31)), false},
+		{"33 bytes", base64.StdEncoding.EncodeToString(make([]byte, 33)), false},
+		{"empty", "", false},
+		{"not base64", "not a key!", false},
+		{"hex", "0000000000000000000000000000000000000000000000000000000000000000", false},
+	}
+	for _, tt := range tests {
+		if err := ValidateKey(tt.key); (err == nil) != tt.valid {
+			t.Errorf("%s: ValidateKey(%q) = %v, want valid=%v", tt.name, tt.key, err, tt.valid)
+		}
+	}
+}